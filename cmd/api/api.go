@@ -7,14 +7,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -35,9 +38,17 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if Conf.Archive.Type != "" {
+		Conf.API.Archive, err = storage.NewBackend(Conf.Archive)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	Conf.ReloadOnSIGHUP(nil)
 
 	sigc := make(chan os.Signal, 5)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-sigc
 		shutdown()
@@ -65,6 +76,7 @@ func setup(config *config.Config) *http.Server {
 	r := mux.NewRouter().SkipClean(true)
 
 	r.HandleFunc("/ready", readinessResponse).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
 	cfg := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
@@ -120,19 +132,58 @@ func readinessResponse(w http.ResponseWriter, r *http.Request) {
 
 	if DBRes := checkDB(Conf.API.DB, 5*time.Millisecond); DBRes != nil {
 		log.Debugf("DB connection error :%v", DBRes)
-		Conf.API.DB.Reconnect()
+		reconnectDB(Conf.API.DB)
 		statusCocde = http.StatusServiceUnavailable
 	}
 
+	if Conf.API.Archive != nil {
+		if err := checkStorage(Conf.API.Archive, storageCheckTimeout); err != nil {
+			log.Debugf("Archive storage error: %v", err)
+			statusCocde = http.StatusServiceUnavailable
+		}
+	}
+
 	w.WriteHeader(statusCocde)
 }
 
+// dbReconnecting is set while reconnectDB runs, so that readiness probes
+// arriving meanwhile don't start reconnects of their own
+var dbReconnecting int32
+
+// reconnectDB reconnects to the database in the background, as Reconnect
+// backs off between attempts for longer than a readiness probe waits
+func reconnectDB(db *database.SQLdb) {
+	if !atomic.CompareAndSwapInt32(&dbReconnecting, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&dbReconnecting, 0)
+
+		if err := db.Reconnect(); err != nil {
+			log.Errorf("failed to reconnect to the database, reason: %v", err)
+		}
+	}()
+}
+
+// storageCheckTimeout bounds the archive check of the readiness endpoint
+const storageCheckTimeout = 2 * time.Second
+
+func checkStorage(backend storage.Backend, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return backend.HealthCheck(ctx)
+}
+
+// requiredTables must exist for the api to be ready
+var requiredTables = []string{"local_ega.files"}
+
 func checkDB(database *database.SQLdb, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	if database.DB == nil {
-		return fmt.Errorf("database is nil")
-	}
 
-	return database.DB.PingContext(ctx)
+	_, err := database.HealthCheck(ctx, requiredTables...)
+
+	return err
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"os"
 	"testing"
 	"time"
 
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/spf13/viper"
@@ -50,7 +52,30 @@ func TestDatabasePingCheck(t *testing.T) {
 	database := database.SQLdb{}
 	assert.Error(t, checkDB(&database, 1*time.Second), "nil DB should fail")
 
-	database.DB, _, err = sqlmock.New()
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
-	assert.NoError(t, checkDB(&database, 1*time.Second), "ping should succeed")
+	database.DB = db
+	mock.ExpectQuery("SELECT 1;").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectQuery("SELECT to_regclass").
+		WithArgs("local_ega.files").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	assert.NoError(t, checkDB(&database, 1*time.Second), "health check should succeed")
+
+	// connected to a database without the schema
+	mock.ExpectQuery("SELECT 1;").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectQuery("SELECT to_regclass").
+		WithArgs("local_ega.files").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	assert.EqualError(t, checkDB(&database, 1*time.Second), "missing tables: local_ega.files")
+}
+
+func TestStorageCheck(t *testing.T) {
+	conf := storage.Conf{Type: "posix"}
+	conf.Posix.Location = t.TempDir()
+	archive, err := storage.NewBackend(conf)
+	assert.NoError(t, err)
+	assert.NoError(t, checkStorage(archive, time.Second), "health check should succeed")
+
+	assert.NoError(t, os.Remove(conf.Posix.Location))
+	assert.Error(t, checkStorage(archive, time.Second), "a missing archive should fail")
 }
@@ -43,6 +43,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.ReloadOnSIGHUP(func(r config.ReloadableConf) {
+		if err := mq.SetPrefetch(r.PrefetchCount); err != nil {
+			log.Errorf("Failed to change prefetch count: %v", err)
+		}
+	})
 	db, err := database.NewDB(conf.Database)
 	if err != nil {
 		log.Fatal(err)
@@ -56,7 +61,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	key, err := config.GetC4GHKey()
+	keyring, err := config.NewC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -331,6 +336,7 @@ func main() {
 
 				// Decrypt header
 				log.Debug("Decrypt header")
+				key := keyring.Key()
 				DecrHeader, err := FormatHexHeader(header, *key)
 				if err != nil {
 					log.Errorf("Failed to decrypt the header %s "+
@@ -451,7 +457,38 @@ func main() {
 			}
 
 			file.Close()
-			dest.Close()
+			if err := dest.Close(); err != nil {
+				log.Errorf("Failed to finish backup file %s "+
+					"(corr-id: %s, "+
+					"filepath: %s, "+
+					"user: %s, "+
+					"accessionid: %s, "+
+					"decryptedChecksums: %v, error: %v)",
+					filePath,
+					delivered.CorrelationId,
+					message.Filepath,
+					message.User,
+					message.AccessionID,
+					message.DecryptedChecksums,
+					err)
+
+				if e := delivered.Nack(false, true); e != nil {
+					log.Errorf("Failed to NAck because of Close failed "+
+						"(corr-id: %s, "+
+						"filepath: %s, "+
+						"user: %s, "+
+						"accessionid: %s, "+
+						"decryptedChecksums: %v, error: %v)",
+						delivered.CorrelationId,
+						message.Filepath,
+						message.User,
+						message.AccessionID,
+						message.DecryptedChecksums,
+						e)
+				}
+
+				continue
+			}
 
 			log.Infof("Backuped file %s (%d bytes) from archive to backup "+
 				"(corr-id: %s, "+
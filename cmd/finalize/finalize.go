@@ -45,6 +45,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.ReloadOnSIGHUP(func(r config.ReloadableConf) {
+		if err := mq.SetPrefetch(r.PrefetchCount); err != nil {
+			log.Errorf("Failed to change prefetch count: %v", err)
+		}
+	})
 	db, err := database.NewDB(conf.Database)
 	if err != nil {
 		log.Fatal(err)
@@ -55,15 +55,22 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.ReloadOnSIGHUP(func(r config.ReloadableConf) {
+		if err := mq.SetPrefetch(r.PrefetchCount); err != nil {
+			log.Errorf("Failed to change prefetch count: %v", err)
+		}
+	})
 	db, err := database.NewDB(conf.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
-	key, err := config.GetC4GHKey()
+	keyring, err := config.NewC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
-	archive, err := storage.NewBackend(conf.Archive)
+	// Archived files are written to the output storage, which is the
+	// archive storage unless configured otherwise
+	archive, err := storage.NewBackend(conf.Output)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -235,6 +242,17 @@ func main() {
 					err)
 			}
 
+			// Kept so that messages about the file sent later, outside of
+			// this flow, can carry the same correlation id
+			if err := db.StoreCorrelationID(fileID, delivered.CorrelationId); err != nil {
+				log.Errorf("StoreCorrelationID failed "+
+					"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					err)
+			}
+
 			// 4MiB readbuffer, this must be large enough that we get the entire header and the first 64KiB datablock
 			// Should be made configurable once we have S3 support
 			var bufSize int
@@ -272,7 +290,7 @@ func main() {
 
 				//nolint:nestif
 				if bytesRead <= int64(len(readBuffer)) {
-					header, err := tryDecrypt(key, readBuffer)
+					header, err := tryDecrypt(keyring.Key(), readBuffer)
 					if err != nil {
 						log.Errorf("Trying to decrypt start of file failed "+
 							"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
@@ -377,12 +395,49 @@ func main() {
 			}
 
 			file.Close()
-			dest.Close()
+			if err := dest.Close(); err != nil {
+				log.Errorf("Failed to finish archive file "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+					delivered.CorrelationId,
+					message.User,
+					message.Filepath,
+					archivedFile,
+					err)
+				// Nack message so the server gets notified that something is wrong and requeue the message.
+				// The upload failing to complete is a backend problem so this is reasonable to requeue.
+				if e := delivered.Nack(false, true); e != nil {
+					log.Errorf("Failed to Nack message (archive file close error) "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				// Send the message to an error queue so it can be analyzed.
+				fileError := broker.InfoError{
+					Error:           "Failed to finish archive file",
+					Reason:          err.Error(),
+					OriginalMessage: message,
+				}
+				body, _ := json.Marshal(fileError)
+				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
+					log.Errorf("Failed to publish message (archive file close error), to error queue "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.Filepath,
+						archivedFile,
+						e)
+				}
+				// Restart on new message
+				continue
+			}
 
 			fileInfo := database.FileInfo{}
 			fileInfo.Path = archivedFile
 
-			fileInfo.Size, err = archive.GetFileSize(archivedFile)
+			fileInfo.Size, err = storage.GetFileSizeNoCache(archive, archivedFile)
 
 			if err != nil {
 				log.Errorf("Couldn't get file size from archive for verification "+
@@ -30,6 +30,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	conf.ReloadOnSIGHUP(func(r config.ReloadableConf) {
+		if err := mq.SetPrefetch(r.PrefetchCount); err != nil {
+			log.Errorf("Failed to change prefetch count: %v", err)
+		}
+	})
 
 	defer mq.Channel.Close()
 	defer mq.Connection.Close()
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcomes of verifying a file of a batch
+const (
+	batchPassed  = "PASSED"
+	batchFailed  = "FAILED"
+	batchSkipped = "SKIPPED"
+)
+
+// batchResult is the outcome of verifying one file of a batch
+type batchResult struct {
+	fileID  int
+	outcome string
+	reason  string
+}
+
+// readFileIDs reads the file ids to verify, one per line, skipping blank
+// lines and comments starting with #
+func readFileIDs(r io.Reader) ([]int, error) {
+	var ids []int
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, err := strconv.Atoi(text)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("line %d: %q is not a file id", line, text)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, scanner.Err()
+}
+
+// writeBatchReport writes a line for each file of a batch and a summary,
+// returning how many files failed
+func writeBatchReport(w io.Writer, results []batchResult, total int) int {
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.outcome]++
+		if r.reason != "" {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", r.fileID, r.outcome, r.reason)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\n", r.fileID, r.outcome)
+		}
+	}
+
+	fmt.Fprintf(w, "%d files: %d passed, %d failed, %d skipped",
+		total, counts[batchPassed], counts[batchFailed], counts[batchSkipped])
+	if notVerified := total - len(results); notVerified > 0 {
+		fmt.Fprintf(w, ", %d not verified", notVerified)
+	}
+	fmt.Fprintln(w)
+
+	return counts[batchFailed]
+}
+
+// runBatch verifies the files with the ids listed in input, or on stdin
+// for "-", writing a report to stdout. It returns the exit status: zero
+// when no file failed.
+func runBatch(conf *config.Config, input string) int {
+	in := os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			log.Fatalf("Failed to open the file id list: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	fileIDs, err := readFileIDs(in)
+	if err != nil {
+		log.Fatalf("Failed to read the file id list: %v", err)
+	}
+
+	db, err := database.NewDB(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	archive, err := storage.NewBackend(conf.Archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring, err := loadC4GHKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// On SIGINT or SIGTERM the file being verified is cancelled, and the
+	// files verified so far reported
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Infof("Verifying a batch of %d files", len(fileIDs))
+
+	verifier := newFileVerifier(conf, db, archive, keyring, nil)
+	results := make([]batchResult, 0, len(fileIDs))
+	for _, fileID := range fileIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, verifyBatchFile(ctx, verifier, fileID))
+	}
+
+	if writeBatchReport(os.Stdout, results, len(fileIDs)) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// verifyBatchFile re-verifies the file with fileID the way a message with
+// re_verify set would, without sending any message
+func verifyBatchFile(ctx context.Context, v *fileVerifier, fileID int) batchResult {
+	logger := log.WithField("fileid", fileID)
+
+	// Files are logged with the correlation id they were ingested with,
+	// if it was recorded
+	corrID, err := v.db.GetCorrelationID(fileID)
+	if err == nil {
+		logger = logger.WithField("corr-id", corrID)
+	}
+
+	status, skip := skipFile(ctx, v.db, fileID, true)
+	if skip {
+		return batchResult{fileID: fileID, outcome: batchSkipped, reason: "file is " + status}
+	}
+
+	file, err := v.db.GetFile(fileID)
+	if err != nil {
+		return batchResult{fileID: fileID, outcome: batchFailed, reason: err.Error()}
+	}
+
+	fileCtx, cancel := fileContext(ctx, v.conf.Verify.FileTimeout)
+	defer cancel()
+
+	metrics := newFileMetrics()
+	result, err := v.verify(fileCtx, logger, corrID, message{
+		FileID:      fileID,
+		User:        file.User,
+		FilePath:    file.InboxPath,
+		ArchivePath: file.Path,
+		ReVerify:    true,
+	}, metrics)
+	if err != nil {
+		metrics.done(outcomeFailed)
+
+		reason := err.Error()
+		var failure *verifyError
+		if errors.As(err, &failure) {
+			reason = categorized(failure.category, reason)
+		}
+
+		return batchResult{fileID: fileID, outcome: batchFailed, reason: reason}
+	}
+
+	archiveChecksum := fmt.Sprintf("%x", result.file.Checksum.Sum(nil))
+	storedChecksum, err := v.db.GetArchiveChecksumContext(fileCtx, fileID)
+	if err != nil {
+		metrics.done(outcomeFailed)
+
+		return batchResult{fileID: fileID, outcome: batchFailed, reason: err.Error()}
+	}
+	if archiveDrifted(storedChecksum, archiveChecksum) {
+		r := handleBatchDrift(fileCtx, logger, v.db, v.conf.Verify.ArchiveDrift, fileID, storedChecksum, archiveChecksum)
+		if r.outcome == batchFailed {
+			metrics.done(outcomeFailed)
+		} else {
+			metrics.done(outcomeReVerified)
+		}
+
+		return r
+	}
+
+	logger.Infof("File re-verified (fileid: %d, archivepath: %s, archivechecksum: %s)", fileID, file.Path, archiveChecksum)
+	metrics.done(outcomeReVerified)
+
+	return batchResult{fileID: fileID, outcome: batchPassed}
+}
+
+// driftStore is the part of the database handling a changed archive
+// checksum needs
+type driftStore interface {
+	errorMarker
+	UpdateArchiveChecksumContext(ctx context.Context, checksum string, fileID int) error
+}
+
+// handleBatchDrift handles the archive checksum of a file of a batch no
+// longer matching the one stored at ingestion according to
+// verify.archiveDrift, as re-verifying it from a message would
+func handleBatchDrift(ctx context.Context, logger *log.Entry, db driftStore, action string, fileID int, storedChecksum, archiveChecksum string) batchResult {
+	mismatch := fmt.Sprintf("stored archive checksum %s does not match computed checksum %s", storedChecksum, archiveChecksum)
+	logger.Warnf("Archive mutated since ingestion (fileid: %d, storedchecksum: %s, archivechecksum: %s, action: %s)",
+		fileID, storedChecksum, archiveChecksum, action)
+
+	switch action {
+	case config.ArchiveDriftWarn:
+		return batchResult{fileID: fileID, outcome: batchPassed, reason: mismatch}
+	case config.ArchiveDriftUpdate:
+		if err := db.UpdateArchiveChecksumContext(ctx, archiveChecksum, fileID); err != nil {
+			return batchResult{fileID: fileID, outcome: batchFailed, reason: categorized(categoryStorage, "UpdateArchiveChecksum failed: "+err.Error())}
+		}
+
+		return batchResult{fileID: fileID, outcome: batchPassed, reason: mismatch + ", stored checksum updated"}
+	default:
+		markFailed(ctx, db, fileID, categoryChecksum, mismatch)
+
+		return batchResult{fileID: fileID, outcome: batchFailed, reason: categorized(categoryChecksum, mismatch)}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"sda-pipeline/internal/config"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFileIDs(t *testing.T) {
+	ids, err := readFileIDs(strings.NewReader("42\n\n# audit of dataset 7\n  43 \n44"))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{42, 43, 44}, ids)
+
+	ids, err = readFileIDs(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	_, err = readFileIDs(strings.NewReader("42\nEGAF00000000001\n"))
+	assert.EqualError(t, err, `line 2: "EGAF00000000001" is not a file id`)
+
+	_, err = readFileIDs(strings.NewReader("0"))
+	assert.EqualError(t, err, `line 1: "0" is not a file id`)
+}
+
+func TestWriteBatchReport(t *testing.T) {
+	var out bytes.Buffer
+	failed := writeBatchReport(&out, []batchResult{
+		{fileID: 42, outcome: batchPassed},
+		{fileID: 43, outcome: batchFailed, reason: "archive file is missing"},
+		{fileID: 44, outcome: batchSkipped, reason: "file is REMOVED"},
+	}, 3)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, "42\tPASSED\n"+
+		"43\tFAILED\tarchive file is missing\n"+
+		"44\tSKIPPED\tfile is REMOVED\n"+
+		"3 files: 1 passed, 1 failed, 1 skipped\n", out.String())
+
+	// files left when the batch is interrupted are counted
+	out.Reset()
+	failed = writeBatchReport(&out, []batchResult{{fileID: 42, outcome: batchPassed}}, 3)
+	assert.Zero(t, failed)
+	assert.Equal(t, "42\tPASSED\n3 files: 1 passed, 0 failed, 0 skipped, 2 not verified\n", out.String())
+}
+
+// fakeDriftStore records the archive checksums updated and the files marked
+// as failed
+type fakeDriftStore struct {
+	fakeErrorMarker
+	updated   map[int]string
+	updateErr error
+}
+
+func (f *fakeDriftStore) UpdateArchiveChecksumContext(_ context.Context, checksum string, fileID int) error {
+	if f.updateErr != nil {
+		return f.updateErr
+	}
+	f.updated[fileID] = checksum
+
+	return nil
+}
+
+func TestHandleBatchDrift(t *testing.T) {
+	logger := log.WithField("test", t.Name())
+	mismatch := "stored archive checksum aa does not match computed checksum bb"
+
+	db := &fakeDriftStore{updated: map[int]string{}}
+	r := handleBatchDrift(context.Background(), logger, db, config.ArchiveDriftError, 42, "aa", "bb")
+	assert.Equal(t, batchResult{fileID: 42, outcome: batchFailed, reason: "CHECKSUM_MISMATCH: " + mismatch}, r)
+	assert.Equal(t, []int{42}, db.failed)
+	assert.Empty(t, db.updated)
+
+	db = &fakeDriftStore{updated: map[int]string{}}
+	r = handleBatchDrift(context.Background(), logger, db, config.ArchiveDriftWarn, 42, "aa", "bb")
+	assert.Equal(t, batchResult{fileID: 42, outcome: batchPassed, reason: mismatch}, r)
+	assert.Empty(t, db.failed)
+	assert.Empty(t, db.updated)
+
+	db = &fakeDriftStore{updated: map[int]string{}}
+	r = handleBatchDrift(context.Background(), logger, db, config.ArchiveDriftUpdate, 42, "aa", "bb")
+	assert.Equal(t, batchResult{fileID: 42, outcome: batchPassed, reason: mismatch + ", stored checksum updated"}, r)
+	assert.Empty(t, db.failed)
+	assert.Equal(t, map[int]string{42: "bb"}, db.updated)
+
+	db = &fakeDriftStore{updated: map[int]string{}, updateErr: errors.New("connection refused")}
+	r = handleBatchDrift(context.Background(), logger, db, config.ArchiveDriftUpdate, 42, "aa", "bb")
+	assert.Equal(t, batchFailed, r.outcome)
+	assert.Contains(t, r.reason, "UpdateArchiveChecksum failed: connection refused")
+	assert.Empty(t, db.failed)
+}
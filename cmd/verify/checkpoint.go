@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/neicnordic/crypt4gh/model/headers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// encryptedSegmentSize is the size of a segment of the archive file: 64 KiB
+// of data with its nonce and MAC. Segments are decrypted one at a time, so
+// verifying a file can resume at any multiple of it.
+const encryptedSegmentSize = int64(chacha20poly1305.NonceSize + headers.UnencryptedDataSegmentSize + chacha20poly1305.Overhead)
+
+// fileHashes are the hashes of a file being verified
+type fileHashes struct {
+	// archive hashes the archive file, and ingested the encrypted file as
+	// it was ingested, the header followed by the archive file
+	archive  hash.Hash
+	ingested ingestedHashes
+	// decrypted hashes the decrypted file with each algorithm, sha256
+	// always included, decryptedSize bytes of it so far
+	decrypted     map[string]hash.Hash
+	decryptedSize int64
+}
+
+// newFileHashes returns the hashes of a file verified from the start
+func newFileHashes(header []byte, algorithms []string) *fileHashes {
+	h := &fileHashes{
+		archive:   sha256.New(),
+		ingested:  newIngestedHashes(header),
+		decrypted: map[string]hash.Hash{config.ChecksumSHA256: sha256.New()},
+	}
+	for _, algorithm := range algorithms {
+		if _, ok := h.decrypted[algorithm]; !ok {
+			h.decrypted[algorithm] = newChecksumHash(algorithm)
+		}
+	}
+
+	return h
+}
+
+// hashState is the state of the hashes of a file, as saved in a checkpoint
+type hashState struct {
+	// Algorithms are the decrypted checksums computed, a checkpoint can only
+	// be resumed computing the same
+	Algorithms []string          `json:"algorithms"`
+	Archive    []byte            `json:"archive"`
+	Ingested   map[string][]byte `json:"ingested"`
+	Decrypted  map[string][]byte `json:"decrypted"`
+}
+
+// state returns the state of the hashes
+func (h *fileHashes) state(algorithms []string) (hashState, error) {
+	s := hashState{Algorithms: algorithms, Ingested: map[string][]byte{}, Decrypted: map[string][]byte{}}
+
+	var err error
+	if s.Archive, err = marshalHash(h.archive); err != nil {
+		return s, err
+	}
+	for name, hash := range h.ingested {
+		if s.Ingested[name], err = marshalHash(hash); err != nil {
+			return s, err
+		}
+	}
+	for name, hash := range h.decrypted {
+		if s.Decrypted[name], err = marshalHash(hash); err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// restoreFileHashes returns the hashes of a file resumed from a checkpoint
+// of decryptedSize bytes
+func restoreFileHashes(s hashState, decryptedSize int64) (*fileHashes, error) {
+	h := newFileHashes(nil, s.Algorithms)
+	h.decryptedSize = decryptedSize
+
+	if err := unmarshalHash(h.archive, s.Archive); err != nil {
+		return nil, err
+	}
+	for name, hash := range h.ingested {
+		if err := unmarshalHash(hash, s.Ingested[name]); err != nil {
+			return nil, fmt.Errorf("ingested %s: %w", name, err)
+		}
+	}
+	for name, hash := range h.decrypted {
+		if err := unmarshalHash(hash, s.Decrypted[name]); err != nil {
+			return nil, fmt.Errorf("decrypted %s: %w", name, err)
+		}
+	}
+
+	return h, nil
+}
+
+func marshalHash(h hash.Hash) ([]byte, error) {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("the state of a %T can't be saved", h)
+	}
+
+	return m.MarshalBinary()
+}
+
+func unmarshalHash(h hash.Hash, state []byte) error {
+	u, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("the state of a %T can't be restored", h)
+	}
+
+	return u.UnmarshalBinary(state)
+}
+
+// checkpointStore saves, looks up and removes checkpoints
+type checkpointStore interface {
+	SaveCheckpoint(c database.Checkpoint) error
+	GetCheckpoint(fileID int) (*database.Checkpoint, error)
+	ClearCheckpoint(fileID int) error
+}
+
+// resumable tells whether verifying a file with header can resume part way:
+// the header decrypts with one of the keys, has the standard segment size
+// and no data edit list, which would make the decrypted data depend on what
+// came before
+func resumable(header []byte, keys []*[32]byte) bool {
+	for _, key := range keys {
+		h, err := headers.NewHeader(bytes.NewReader(header), *key)
+		if err != nil {
+			continue
+		}
+		if h.GetDataEditListHeaderPacket() != nil {
+			return false
+		}
+		packets, err := h.GetDataEncryptionParameterHeaderPackets()
+		if err != nil {
+			return false
+		}
+		for _, p := range *packets {
+			if int64(p.EncryptedSegmentSize) != encryptedSegmentSize {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// loadCheckpoint returns the offset in the archive file to resume verifying
+// the file from, with the hashes of what came before, or zero and nil to
+// verify it from the start: when there is no checkpoint, or it doesn't fit
+// the archive file of archiveSize bytes or the algorithms. A checkpoint that
+// doesn't fit is removed.
+func loadCheckpoint(logger *log.Entry, store checkpointStore, fileID int, archiveSize int64, algorithms []string) (int64, *fileHashes) {
+	c, err := store.GetCheckpoint(fileID)
+	if err != nil {
+		logger.Warnf("Failed to get the checkpoint, verifying from the start (fileid: %d, reason: %v)", fileID, err)
+
+		return 0, nil
+	}
+	if c == nil {
+		return 0, nil
+	}
+
+	hashes, err := checkpointHashes(c, archiveSize, algorithms)
+	if err != nil {
+		logger.Infof("Checkpoint can't be resumed, verifying from the start (fileid: %d, reason: %v)", fileID, err)
+		clearCheckpoint(logger, store, fileID)
+
+		return 0, nil
+	}
+
+	return c.ArchiveOffset, hashes
+}
+
+// checkpointHashes returns the hashes saved in c, if it can be resumed
+func checkpointHashes(c *database.Checkpoint, archiveSize int64, algorithms []string) (*fileHashes, error) {
+	switch {
+	case c.ArchiveSize != archiveSize:
+		return nil, fmt.Errorf("the archive file size changed from %d to %d", c.ArchiveSize, archiveSize)
+	case c.ArchiveOffset <= 0 || c.ArchiveOffset >= archiveSize || c.ArchiveOffset%encryptedSegmentSize != 0:
+		return nil, fmt.Errorf("offset %d is not a segment of the archive file", c.ArchiveOffset)
+	case c.DecryptedSize != c.ArchiveOffset/encryptedSegmentSize*int64(headers.UnencryptedDataSegmentSize):
+		return nil, fmt.Errorf("decrypted size %d does not match offset %d", c.DecryptedSize, c.ArchiveOffset)
+	}
+
+	var s hashState
+	if err := json.Unmarshal(c.State, &s); err != nil {
+		return nil, fmt.Errorf("failed to read the hash state: %w", err)
+	}
+	if fmt.Sprint(s.Algorithms) != fmt.Sprint(algorithms) {
+		return nil, fmt.Errorf("the checksums changed from %v to %v", s.Algorithms, algorithms)
+	}
+
+	return restoreFileHashes(s, c.DecryptedSize)
+}
+
+func clearCheckpoint(logger *log.Entry, store checkpointStore, fileID int) {
+	if err := store.ClearCheckpoint(fileID); err != nil {
+		logger.Warnf("Failed to remove the checkpoint (fileid: %d, reason: %v)", fileID, err)
+	}
+}
+
+// checkpointer saves how far verifying a file got, at most every interval
+type checkpointer struct {
+	logger      *log.Entry
+	store       checkpointStore
+	fileID      int
+	archiveSize int64
+	algorithms  []string
+	interval    time.Duration
+	// progress counts the bytes read from the archive file, from its start
+	progress *progressReader
+	saved    time.Time
+}
+
+// check saves a checkpoint when the interval has passed, and the hashes are
+// at the end of a segment: everything read from the archive file has been
+// decrypted and hashed. A failure to save is only logged.
+func (c *checkpointer) check(hashes *fileHashes) {
+	if c == nil || time.Since(c.saved) < c.interval {
+		return
+	}
+	offset := atomic.LoadInt64(&c.progress.done)
+	if offset == 0 || offset%encryptedSegmentSize != 0 ||
+		hashes.decryptedSize != offset/encryptedSegmentSize*int64(headers.UnencryptedDataSegmentSize) {
+		return
+	}
+	c.saved = time.Now()
+
+	s, err := hashes.state(c.algorithms)
+	if err == nil {
+		var state []byte
+		state, err = json.Marshal(&s)
+		if err == nil {
+			err = c.store.SaveCheckpoint(database.Checkpoint{
+				FileID:        c.fileID,
+				ArchiveOffset: offset,
+				ArchiveSize:   c.archiveSize,
+				DecryptedSize: hashes.decryptedSize,
+				State:         state,
+			})
+		}
+	}
+	if err != nil {
+		c.logger.Warnf("Failed to save a checkpoint (fileid: %d, offset: %d, reason: %v)", c.fileID, offset, err)
+	}
+}
+
+// copyHashed hashes decrypted through buf, calling check after each block
+func copyHashed(hashes *fileHashes, decrypted io.Reader, buf []byte, check func(*fileHashes)) error {
+	writers := make([]io.Writer, 0, len(hashes.decrypted))
+	for _, h := range hashes.decrypted {
+		writers = append(writers, h)
+	}
+	w := io.MultiWriter(writers...)
+
+	for {
+		n, err := decrypted.Read(buf)
+		if n > 0 {
+			_, _ = w.Write(buf[:n])
+			hashes.decryptedSize += int64(n)
+			check(hashes)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
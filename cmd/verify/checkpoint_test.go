@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCheckpoints keeps the checkpoints saved in memory
+type fakeCheckpoints struct {
+	saved   []database.Checkpoint
+	current *database.Checkpoint
+	cleared int
+}
+
+func (f *fakeCheckpoints) SaveCheckpoint(c database.Checkpoint) error {
+	f.saved = append(f.saved, c)
+	f.current = &c
+
+	return nil
+}
+
+func (f *fakeCheckpoints) GetCheckpoint(fileID int) (*database.Checkpoint, error) {
+	return f.current, nil
+}
+
+func (f *fakeCheckpoints) ClearCheckpoint(fileID int) error {
+	f.current = nil
+	f.cleared++
+
+	return nil
+}
+
+// dummyFile returns the header and body of the dev dummy file, and the key
+// that decrypts it
+func dummyFile(t *testing.T) ([]byte, []byte, *[32]byte) {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	key, err := config.GetC4GHKey()
+	require.NoError(t, err)
+
+	data, err := os.ReadFile("../../dev_utils/dummy_data.c4gh")
+	require.NoError(t, err)
+	r := bytes.NewReader(data)
+	header, err := headers.ReadHeader(r)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(r)
+
+	return header, body, key
+}
+
+// verifyFrom verifies body from offset with hashes and cp, as verify does
+func verifyFrom(t *testing.T, header, body []byte, key *[32]byte, offset int64, hashes *fileHashes, algorithms []string, cp *checkpointer) []checksums {
+	progress := &progressReader{reader: bytes.NewReader(body[offset:]), done: offset}
+	if cp != nil {
+		cp.progress = progress
+	}
+	c4ghr, _, err := newCrypt4GHReader(header, io.TeeReader(progress, io.MultiWriter(hashes.archive, hashes.ingested)), []*[32]byte{key})
+	require.NoError(t, err)
+
+	var file database.FileInfo
+	sums, err := computeChecksums(&file, c4ghr, hashes, make([]byte, 4096), algorithms, cp)
+	require.NoError(t, err)
+
+	return sums
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	header, body, key := dummyFile(t)
+	algorithms := []string{"sha256", "md5"}
+	assert.True(t, resumable(header, []*[32]byte{key}))
+
+	whole := newFileHashes(header, algorithms)
+	want := verifyFrom(t, header, body, key, 0, whole, algorithms, nil)
+
+	store := &fakeCheckpoints{}
+	cp := &checkpointer{logger: log.NewEntry(log.StandardLogger()), store: store, fileID: 42, archiveSize: int64(len(body)), algorithms: algorithms}
+	assert.Equal(t, want, verifyFrom(t, header, body, key, 0, newFileHashes(header, algorithms), algorithms, cp))
+	require.NotEmpty(t, store.saved)
+	for _, c := range store.saved {
+		assert.Zero(t, c.ArchiveOffset%encryptedSegmentSize)
+		assert.Equal(t, c.ArchiveOffset/encryptedSegmentSize*int64(headers.UnencryptedDataSegmentSize), c.DecryptedSize)
+	}
+
+	// verifying resumed from any checkpoint gives the same checksums as
+	// verifying the whole file
+	for _, c := range []database.Checkpoint{store.saved[0], store.saved[len(store.saved)/2]} {
+		store.current = &c
+		offset, hashes := loadCheckpoint(cp.logger, store, 42, int64(len(body)), algorithms)
+		require.NotNil(t, hashes)
+		assert.Equal(t, c.ArchiveOffset, offset)
+		assert.Equal(t, want, verifyFrom(t, header, body, key, offset, hashes, algorithms, nil))
+		assert.Equal(t, whole.ingested["sha256"].Sum(nil), hashes.ingested["sha256"].Sum(nil))
+	}
+}
+
+func TestCheckpointHashes(t *testing.T) {
+	algorithms := []string{"sha256", "md5"}
+	h := newFileHashes([]byte("header"), algorithms)
+	s, err := h.state(algorithms)
+	require.NoError(t, err)
+	state, _ := json.Marshal(&s)
+
+	valid := database.Checkpoint{FileID: 42, ArchiveOffset: 2 * encryptedSegmentSize, ArchiveSize: 3 * encryptedSegmentSize, DecryptedSize: 2 * int64(headers.UnencryptedDataSegmentSize), State: state}
+	_, err = checkpointHashes(&valid, valid.ArchiveSize, algorithms)
+	assert.NoError(t, err)
+
+	_, err = checkpointHashes(&valid, valid.ArchiveSize+1, algorithms)
+	assert.ErrorContains(t, err, "archive file size changed")
+
+	_, err = checkpointHashes(&valid, valid.ArchiveSize, []string{"sha256", "sha512"})
+	assert.ErrorContains(t, err, "checksums changed")
+
+	c := valid
+	c.ArchiveOffset++
+	_, err = checkpointHashes(&c, c.ArchiveSize, algorithms)
+	assert.ErrorContains(t, err, "is not a segment")
+
+	c = valid
+	c.DecryptedSize--
+	_, err = checkpointHashes(&c, c.ArchiveSize, algorithms)
+	assert.ErrorContains(t, err, "does not match offset")
+
+	c = valid
+	c.State = []byte("{")
+	_, err = checkpointHashes(&c, c.ArchiveSize, algorithms)
+	assert.ErrorContains(t, err, "failed to read the hash state")
+
+	// a checkpoint that can't be resumed is removed
+	store := &fakeCheckpoints{current: &c}
+	offset, hashes := loadCheckpoint(log.NewEntry(log.StandardLogger()), store, 42, c.ArchiveSize, algorithms)
+	assert.Zero(t, offset)
+	assert.Nil(t, hashes)
+	assert.Nil(t, store.current)
+	assert.Equal(t, 1, store.cleared)
+}
+
+func TestResumable(t *testing.T) {
+	header, _, key := dummyFile(t)
+	_, other, err := keys.GenerateKeyPair()
+	require.NoError(t, err)
+
+	assert.True(t, resumable(header, []*[32]byte{&other, key}))
+	assert.False(t, resumable(header, []*[32]byte{&other}))
+	assert.False(t, resumable(header, nil))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of verifying a file, the outcome label of the file metrics
+const (
+	outcomeVerified   = "verified"
+	outcomeReVerified = "reverified"
+	outcomeSkipped    = "skipped"
+	outcomeFailed     = "failed"
+	outcomeRetried    = "retried"
+	// outcomeQuarantined is a message that failed its last attempt
+	outcomeQuarantined = "quarantined"
+)
+
+// File metrics, registered on the default prometheus registry and served on
+// /metrics next to the readiness endpoint
+var (
+	filesVerified = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "verify_files_total",
+		Help: "Number of files verified, by outcome.",
+	}, []string{"outcome"})
+
+	fileBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "verify_file_bytes",
+		Help: "Bytes read from the archive file of a verified file.",
+		// 1 MB to 256 GB
+		Buckets: prometheus.ExponentialBuckets(1<<20, 4, 10),
+	}, []string{"outcome"})
+
+	fileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "verify_file_duration_seconds",
+		Help:    "Time spent verifying a file.",
+		Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600, 7200},
+	}, []string{"outcome"})
+
+	filesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "verify_files_in_flight",
+		Help: "Number of files let through verify.maxConcurrentFiles and verify.maxInFlightBytes.",
+	})
+
+	bytesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "verify_bytes_in_flight",
+		Help: "Total size of the archive files of the files in flight.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(filesVerified, fileBytes, fileDuration, filesInFlight, bytesInFlight)
+}
+
+// fileMetrics measures the verification of one file
+type fileMetrics struct {
+	start time.Time
+	// progress counts the bytes read from the archive file, once opened,
+	// from resumed when resuming from a checkpoint
+	progress *progressReader
+	resumed  int64
+}
+
+func newFileMetrics() *fileMetrics {
+	return &fileMetrics{start: time.Now()}
+}
+
+// done records the outcome of the verification
+func (m *fileMetrics) done(outcome string) {
+	var read int64
+	if m.progress != nil {
+		read = atomic.LoadInt64(&m.progress.done) - m.resumed
+	}
+
+	filesVerified.WithLabelValues(outcome).Inc()
+	fileBytes.WithLabelValues(outcome).Observe(float64(read))
+	fileDuration.WithLabelValues(outcome).Observe(time.Since(m.start).Seconds())
+}
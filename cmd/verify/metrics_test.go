@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMetrics(t *testing.T) {
+	verified := testutil.ToFloat64(filesVerified.WithLabelValues(outcomeVerified))
+	failed := testutil.ToFloat64(filesVerified.WithLabelValues(outcomeFailed))
+
+	m := newFileMetrics()
+	m.progress = &progressReader{reader: bytes.NewReader(make([]byte, 3000))}
+	_, err := m.progress.Read(make([]byte, 2048))
+	assert.NoError(t, err)
+	m.done(outcomeVerified)
+
+	// a file that failed before its archive file was opened read nothing
+	newFileMetrics().done(outcomeFailed)
+
+	assert.Equal(t, verified+1, testutil.ToFloat64(filesVerified.WithLabelValues(outcomeVerified)))
+	assert.Equal(t, failed+1, testutil.ToFloat64(filesVerified.WithLabelValues(outcomeFailed)))
+
+	var metric dto.Metric
+	assert.NoError(t, fileBytes.WithLabelValues(outcomeVerified).(prometheus.Histogram).Write(&metric))
+	assert.GreaterOrEqual(t, metric.GetHistogram().GetSampleSum(), float64(2048))
+	assert.NoError(t, fileDuration.WithLabelValues(outcomeFailed).(prometheus.Histogram).Write(&metric))
+	assert.GreaterOrEqual(t, metric.GetHistogram().GetSampleCount(), uint64(1))
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	newFileMetrics().done(outcomeSkipped)
+
+	w := httptest.NewRecorder()
+	setupHTTP("localhost", 8080, nil).Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `verify_files_total{outcome="skipped"}`)
+}
@@ -3,20 +3,38 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5" // #nosec
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"sda-pipeline/internal/broker"
 	"sda-pipeline/internal/config"
 	"sda-pipeline/internal/database"
 	"sda-pipeline/internal/storage"
 
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
 	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/crypto/blake2b"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -29,6 +47,8 @@ type message struct {
 	ArchivePath        string      `json:"archive_path"`
 	EncryptedChecksums []checksums `json:"encrypted_checksums"`
 	ReVerify           bool        `json:"re_verify"`
+	// DecryptedSize is the expected size of the decrypted file, if known
+	DecryptedSize int64 `json:"decrypted_size,omitempty"`
 }
 
 // Verified is struct holding the full message data
@@ -36,6 +56,24 @@ type verified struct {
 	User               string      `json:"user"`
 	FilePath           string      `json:"filepath"`
 	DecryptedChecksums []checksums `json:"decrypted_checksums"`
+	// AuthoritativeChecksum is the type of the decrypted checksum accession
+	// is assigned by
+	AuthoritativeChecksum string `json:"authoritative_checksum,omitempty"`
+	Region                string `json:"region,omitempty"`
+	Zone                  string `json:"zone,omitempty"`
+}
+
+// checkAuthoritative makes sure the authoritative checksum is among the
+// decrypted checksums of a verified message, rather than sending only the
+// others
+func checkAuthoritative(v verified) error {
+	for _, c := range v.DecryptedChecksums {
+		if c.Type == v.AuthoritativeChecksum {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("authoritative checksum %s was not computed", v.AuthoritativeChecksum)
 }
 
 // Checksums is struct for the checksum type and value
@@ -49,10 +87,24 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// In batch mode the listed files are verified instead of consuming
+	// messages
+	if conf.Verify.Batch != "" {
+		os.Exit(runBatch(conf, conf.Verify.Batch))
+	}
 	mq, err := broker.NewMQ(conf.Broker)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := mq.LoadSchemas("ingestion-verification", "ingestion-accession-request"); err != nil {
+		log.Fatal(err)
+	}
+	// Without a prefetch limit every worker would be handed the whole queue
+	if prefetch := prefetchFor(conf.Broker.PrefetchCount, conf.Verify.Workers); prefetch != conf.Broker.PrefetchCount {
+		if err := mq.SetPrefetch(prefetch); err != nil {
+			log.Fatalf("Failed to set prefetch count: %v", err)
+		}
+	}
 	db, err := database.NewDB(conf.Database)
 	if err != nil {
 		log.Fatal(err)
@@ -65,7 +117,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	key, err := config.GetC4GHKey()
+	keyring, err := loadC4GHKeyring()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -76,43 +128,116 @@ func main() {
 
 	go func() {
 		connError := mq.ConnectionWatcher()
+		// The connection is closed without an error on shutdown
+		if connError == nil {
+			return
+		}
 		log.Error(connError)
 		os.Exit(1)
 	}()
 
-	forever := make(chan bool)
+	guard := newMemoryGuard(conf.Verify.MemoryHighWater, conf.Verify.MemoryLowWater)
+	if guard != nil {
+		go guard.monitor(memoryCheckInterval)
+	}
+
+	if conf.Verify.Port != 0 {
+		go func() {
+			srv := setupHTTP(conf.Verify.Host, conf.Verify.Port, guard)
+			if err := srv.ListenAndServe(); err != nil {
+				log.Fatalf("Failed to start readiness endpoint (error: %v)", err)
+			}
+		}()
+	}
+
+	// Workers wait for capacity before reading an archive file, holding on
+	// to their message without taking another
+	limiter := newFileLimiter(conf.Verify.MaxConcurrentFiles, conf.Verify.MaxInFlightBytes)
 
-	log.Info("starting verify service")
+	// On SIGINT or SIGTERM stopping is closed, after which the workers
+	// requeue the messages they are handed, and work is cancelled once the
+	// files being verified have had the grace period to finish
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	stopping := make(chan struct{})
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
+	log.Infof("starting verify service (workers: %d)", conf.Verify.Workers)
+
+	messages, err := mq.GetMessages(conf.Broker.Queue)
+	if err != nil {
+		log.Fatalf("Failed to get messages (error: %v) ",
+			err)
+	}
+
+	deliveries := make(chan amqp.Delivery)
 	go func() {
-		messages, err := mq.GetMessages(conf.Broker.Queue)
-		if err != nil {
-			log.Fatalf("Failed to get messages (error: %v) ",
-				err)
+		if err := consume(mq, conf.Broker.Queue, messages, guard, stopping, deliveries); err != nil {
+			log.Fatal(err)
 		}
-		for delivered := range messages {
+	}()
+
+	// Each worker verifies one message at a time, acking or nacking it
+	// itself, while the database pool and the broker are shared. A worker
+	// stops when quit is closed, after the message it is verifying.
+	worker := func(quit <-chan struct{}) {
+		verifier := newFileVerifier(conf, db, archive, keyring, limiter)
+
+		// verifyMessage verifies the file of a message and settles the
+		// message
+		verifyMessage := func(delivered amqp.Delivery) {
+			// Every log line about the message carries its correlation
+			// id, and its file id once known
+			logger := log.WithField("corr-id", delivered.CorrelationId)
+
+			// Hold on to a delivery that arrived before the consumer was
+			// paused until memory use has come down, handing it back on
+			// shutdown
+			if err := guard.wait(work); err != nil {
+				requeueAfter(work, delivered, 0)
+
+				return
+			}
+			metrics := newFileMetrics()
+
+			// Database calls and archive reads for a message are tied to
+			// its context, ended after verify.fileTimeout, with each
+			// statement bounded by db.statementTimeout, so that a slow file
+			// or a hung database can't block the consumer
+			ctx, cancel := fileContext(work, conf.Verify.FileTimeout)
+			defer cancel()
+			defer func() {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					logger.Warnf("Verification timed out after %v (corr-id: %s)",
+						conf.Verify.FileTimeout,
+						delivered.CorrelationId)
+				}
+			}()
+
 			var message message
-			log.Debugf("Received a message (corr-id: %s, message: %s)",
+			logger.Debugf("Received a message (corr-id: %s, message: %s)",
 				delivered.CorrelationId,
 				delivered.Body)
 
 			err := mq.ValidateJSON(&delivered, "ingestion-verification", delivered.Body, &message)
 
 			if err != nil {
-				log.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
+				logger.Errorf("Validation (ingestion-verifiation) of incoming message failed "+
 					"(corr-id: %s, error: %v, message: %s)",
 					delivered.CorrelationId,
 					err,
 					delivered.Body)
 
 				// Restart on new message
-				continue
+				return
 			}
 
 			// we unmarshal the message in the validation step so this is safe to do
 			_ = json.Unmarshal(delivered.Body, &message)
+			logger = logger.WithField("fileid", message.FileID)
 
-			log.Infof("Received work "+
+			logger.Infof("Received work "+
 				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t)",
 				delivered.CorrelationId,
 				message.User,
@@ -122,213 +247,153 @@ func main() {
 				message.EncryptedChecksums,
 				message.ReVerify)
 
-			header, err := db.GetHeader(message.FileID)
-			if err != nil {
-				log.Errorf("GetHeader failed "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			// A redelivered message for a file that was already verified,
+			// or a message for a withdrawn file, only needs to be
+			// acknowledged
+			status, skip := skipFile(ctx, db, message.FileID, message.ReVerify)
+			if skip && status == "COMPLETED" {
+				skip = conf.Verify.SkipCompleted && alreadyVerified(logger, db, message.FileID, message.DecryptedSize)
+			}
+			if skip {
+				logger.Infof("File is %s, skipping "+
+					"(corr-id: %s, user: %s, filepath: %s, fileid: %d)",
+					status,
 					delivered.CorrelationId,
 					message.User,
 					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
+					message.FileID)
 
-				// Nack message so the server gets notified that something is wrong but don't requeue the message
-				if e := delivered.Nack(false, false); e != nil {
-					log.Errorf("Failed to nack following getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				if err := delivered.Ack(false); err != nil {
+					logger.Errorf("Failed acking skipped work "+
+						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
 						delivered.CorrelationId,
 						message.User,
 						message.FilePath,
 						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
 						err)
-
-				}
-				// store full message info in case we want to fix the db entry and retry
-				infoErrorMessage := broker.InfoError{
-					Error:           "Getheader failed",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-
-				// Send the message to an error queue so it can be analyzed.
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-					log.Errorf("Failed to publish getheader error message "+
-						"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.FileID,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
 				}
-				continue
-			}
-
-			var file database.FileInfo
-
-			file.Size, err = archive.GetFileSize(message.ArchivePath)
-
-			if err != nil {
-				log.Errorf("Failed to get archived file size "+
-					"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.FileID,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
+				metrics.done(outcomeSkipped)
 
-				continue
+				return
 			}
 
-			log.Infof("Got archived file size "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
-				delivered.CorrelationId,
-				message.User,
-				message.FilePath,
-				message.ArchivePath,
-				message.EncryptedChecksums,
-				message.ReVerify,
-				file.Size)
-
-			archiveFileHash := sha256.New()
-
-			f, err := archive.NewFileReader(message.ArchivePath)
-			if err != nil {
-				log.Errorf("Failed to open archived file "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			result, err := verifier.verify(ctx, logger, delivered.CorrelationId, message, metrics)
+			if errors.Is(err, storage.ErrRestoreInProgress) {
+				logger.Infof("Archived file is being restored, retrying in %v "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+					conf.Verify.RestoreRetryDelay,
 					delivered.CorrelationId,
 					message.User,
 					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				// Send the message to an error queue so it can be analyzed.
-				infoErrorMessage := broker.InfoError{
-					Error:           "Failed to open archived file",
-					Reason:          err.Error(),
-					OriginalMessage: message,
-				}
-
-				body, _ := json.Marshal(infoErrorMessage)
-				if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-
-					log.Errorf("Failed to publish file open error message "+
-						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-						delivered.CorrelationId,
-						message.User,
-						message.FilePath,
-						message.ArchivePath,
-						message.EncryptedChecksums,
-						message.ReVerify,
-						e)
-
-				}
-				// Restart on new message
-				continue
-			}
+					message.ArchivePath)
 
-			hr := bytes.NewReader(header)
-			// Feed everything read from the archive file to archiveFileHash
-			mr := io.MultiReader(hr, io.TeeReader(f, archiveFileHash))
-
-			c4ghr, err := streaming.NewCrypt4GHReader(mr, *key, nil)
-			if err != nil {
-				log.Errorf("Failed to open c4gh decryptor stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
+				requeueAfter(work, delivered, conf.Verify.RestoreRetryDelay)
 
-				continue
+				return
 			}
+			var failure *verifyError
+			if errors.As(err, &failure) {
+				var mismatch *checksumMismatch
+				if errors.As(err, &mismatch) {
+					publishMismatch(mq, conf, mismatchEvent{
+						FileID:         message.FileID,
+						FilePath:       message.FilePath,
+						ArchivePath:    message.ArchivePath,
+						User:           message.User,
+						Kind:           mismatchEncrypted,
+						Algorithm:      mismatch.algorithm,
+						Expected:       mismatch.expected,
+						Actual:         mismatch.actual,
+						CorrelationID:  delivered.CorrelationId,
+						KeyFingerprint: result.keyFingerprint,
+					})
+				}
+				metrics.done(settleFailure(work, logger, mq, &delivered, conf, failure.category, failure.msg, failure.err, message))
 
-			md5hash := md5.New() // #nosec
-			sha256hash := sha256.New()
-
-			stream := io.TeeReader(c4ghr, md5hash)
-
-			if file.DecryptedSize, err = io.Copy(sha256hash, stream); err != nil {
-				log.Errorf("Failed to copy decrypted data to hash stream "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
-					delivered.CorrelationId,
-					message.User,
-					message.FilePath,
-					message.ArchivePath,
-					message.EncryptedChecksums,
-					message.ReVerify,
-					err)
-
-				continue
+				return
 			}
-
-			file.Checksum = archiveFileHash
-			file.DecryptedChecksum = sha256hash
-
-			log.Infof("Calculated decrypted hash "+
-				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
-				"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
-				"decryptedchecksum: %x)",
-				delivered.CorrelationId,
-				message.User,
-				message.FilePath,
-				message.ArchivePath,
-				message.EncryptedChecksums,
-				message.ReVerify,
-				file.DecryptedSize,
-				file.DecryptedChecksum.Sum(nil))
+			file, decryptedChecksums, fingerprint := result.file, result.decryptedChecksums, result.keyFingerprint
 
 			//nolint:nestif
 			if !message.ReVerify {
 
 				c := verified{
-					User:     message.User,
-					FilePath: message.FilePath,
-					DecryptedChecksums: []checksums{
-						{"sha256", fmt.Sprintf("%x", sha256hash.Sum(nil))},
-						{"md5", fmt.Sprintf("%x", md5hash.Sum(nil))},
-					},
+					User:                  message.User,
+					FilePath:              message.FilePath,
+					DecryptedChecksums:    decryptedChecksums,
+					AuthoritativeChecksum: conf.Verify.AuthoritativeChecksum,
+					Region:                conf.Deployment.Region,
+					Zone:                  conf.Deployment.Zone,
 				}
 
 				verifiedMessage, _ := json.Marshal(&c)
 
+				if err := checkAuthoritative(c); err != nil {
+					logger.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
+						"(corr-id: %s, error: %v, message: %s)",
+						delivered.CorrelationId,
+						err,
+						verifiedMessage)
+
+					metrics.done(settleFailure(work, logger, mq, &delivered, conf, categorySchema, "Authoritative checksum missing", permanentError(err), message))
+
+					return
+				}
+
 				err = mq.ValidateJSON(&delivered,
 					"ingestion-accession-request",
 					verifiedMessage,
 					new(verified))
 
 				if err != nil {
-					log.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
+					logger.Errorf("Validation (ingestion-accession-request) of outgoing message failed "+
 						"(corr-id: %s, error: %v, message: %s)",
 						delivered.CorrelationId,
 						err,
 						verifiedMessage)
 
 					// Logging is in ValidateJSON so just restart on new message
-					continue
+					metrics.done(outcomeFailed)
+
+					return
+				}
+
+				// Mark file as "COMPLETED", a redelivered message may find it
+				// already completed which is as good
+				e := db.MarkCompletedContext(ctx, file, message.FileID)
+				if errors.Is(e, database.ErrAlreadyCompleted) {
+					logger.Infof("File already marked completed "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath)
+					e = nil
 				}
+				// A file withdrawn while it was verified stays withdrawn
+				if errors.Is(e, database.ErrFileRemoved) {
+					logger.Infof("File was removed during verification, skipping "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath)
+
+					if err := delivered.Ack(false); err != nil {
+						logger.Errorf("Failed acking skipped work "+
+							"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+							delivered.CorrelationId,
+							message.User,
+							message.FilePath,
+							message.FileID,
+							err)
+					}
+					metrics.done(outcomeSkipped)
 
-				// Mark file as "COMPLETED"
-				if e := db.MarkCompleted(file, message.FileID); e != nil {
-					log.Errorf("MarkCompleted failed "+
+					return
+				}
+				if e != nil {
+					logger.Errorf("MarkCompleted failed "+
 						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 						delivered.CorrelationId,
 						message.User,
@@ -338,19 +403,22 @@ func main() {
 						message.ReVerify,
 						e)
 
-					continue
-					// this should really be hadled by the DB retry mechanism
+					metrics.done(settleFailure(work, logger, mq, &delivered, conf, categoryStorage, "MarkCompleted failed", e, message))
+
+					return
 				}
 
-				log.Infof("File marked completed "+
-					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x)",
+				logger.Infof("File marked completed "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, decryptedchecksum: %x, region: %s, zone: %s)",
 					delivered.CorrelationId,
 					message.User,
 					message.FilePath,
 					message.ArchivePath,
 					message.EncryptedChecksums,
 					message.ReVerify,
-					file.DecryptedChecksum.Sum(nil))
+					file.DecryptedChecksum.Sum(nil),
+					conf.Deployment.Region,
+					conf.Deployment.Zone)
 
 				// Send message to verified queue
 
@@ -361,7 +429,7 @@ func main() {
 					verifiedMessage); err != nil {
 					// TODO fix resend mechanism
 
-					log.Errorf("Sending of message failed "+
+					logger.Errorf("Sending of message failed "+
 						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 						delivered.CorrelationId,
 						message.User,
@@ -370,11 +438,24 @@ func main() {
 						message.EncryptedChecksums,
 						message.ReVerify,
 						err)
-					continue
+
+					metrics.done(settleFailure(work, logger, mq, &delivered, conf, "", "Sending of message failed", err, message))
+
+					return
+				}
+
+				// A redelivered message only skips the file once its
+				// accession request is known to have been sent
+				if err := db.MarkAccessionRequested(message.FileID); err != nil {
+					logger.Warnf("Failed to record the accession request "+
+						"(corr-id: %s, fileid: %d, reason: %v)",
+						delivered.CorrelationId,
+						message.FileID,
+						err)
 				}
 
 				if err := delivered.Ack(false); err != nil {
-					log.Errorf("Failed acking completed work"+
+					logger.Errorf("Failed acking completed work"+
 						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
 						delivered.CorrelationId,
 						message.User,
@@ -384,13 +465,14 @@ func main() {
 						message.ReVerify,
 						err)
 				}
+				metrics.done(outcomeVerified)
 
 				// At the end we try to remove file from inbox
 				// In case of error we send a message to error queue to track it
 				// we don't need to force removing the file
 				err = inbox.RemoveFile(message.FilePath)
 				if err != nil {
-					log.Errorf("Remove file from inbox failed "+
+					logger.Errorf("Remove file from inbox failed "+
 						"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
 						delivered.CorrelationId,
 						message.User,
@@ -398,14 +480,8 @@ func main() {
 						err)
 
 					// Send the message to an error queue so it can be analyzed.
-					fileError := broker.InfoError{
-						Error:           "RemoveFile failed",
-						Reason:          err.Error(),
-						OriginalMessage: message,
-					}
-					body, _ := json.Marshal(fileError)
-					if e := mq.SendMessage(delivered.CorrelationId, conf.Broker.Exchange, conf.Broker.RoutingError, conf.Broker.Durable, body); e != nil {
-						log.Errorf("Failed to publish message (remove file error), to error queue "+
+					if e := mq.SendError(&delivered, conf.Broker, "RemoveFile failed", err.Error(), message); e != nil {
+						logger.Errorf("Failed to publish message (remove file error), to error queue "+
 							"(corr-id: %s, user: %s, filepath: %s, reason: %v)",
 							delivered.CorrelationId,
 							message.User,
@@ -413,14 +489,1803 @@ func main() {
 							e)
 					}
 
-					continue
+					return
+				}
+				logger.Debugf("Removed file from inbox: %s", message.FilePath)
+
+			} else {
+				archiveChecksum := fmt.Sprintf("%x", file.Checksum.Sum(nil))
+
+				storedChecksum, err := db.GetArchiveChecksumContext(ctx, message.FileID)
+				if err != nil {
+					logger.Errorf("GetArchiveChecksum failed "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						message.EncryptedChecksums,
+						message.ReVerify,
+						err)
+
+					metrics.done(settleFailure(work, logger, mq, &delivered, conf, categoryStorage, "GetArchiveChecksum failed", err, message))
+
+					return
+				}
+
+				drifted := archiveDrifted(storedChecksum, archiveChecksum)
+				if drifted {
+					logger.Warnf("Archive mutated since ingestion "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, storedchecksum: %s, archivechecksum: %s, action: %s, region: %s, zone: %s)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						message.FileID,
+						storedChecksum,
+						archiveChecksum,
+						conf.Verify.ArchiveDrift,
+						conf.Deployment.Region,
+						conf.Deployment.Zone)
+
+					publishMismatch(mq, conf, mismatchEvent{
+						FileID:         message.FileID,
+						FilePath:       message.FilePath,
+						ArchivePath:    message.ArchivePath,
+						User:           message.User,
+						Kind:           mismatchArchive,
+						Algorithm:      config.ChecksumSHA256,
+						Expected:       storedChecksum,
+						Actual:         archiveChecksum,
+						CorrelationID:  delivered.CorrelationId,
+						KeyFingerprint: fingerprint,
+					})
+
+					switch conf.Verify.ArchiveDrift {
+					case config.ArchiveDriftWarn:
+					case config.ArchiveDriftUpdate:
+						if err := db.UpdateArchiveChecksumContext(ctx, archiveChecksum, message.FileID); err != nil {
+							logger.Errorf("UpdateArchiveChecksum failed "+
+								"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, reason: %v)",
+								delivered.CorrelationId,
+								message.User,
+								message.FilePath,
+								message.ArchivePath,
+								message.FileID,
+								err)
+
+							metrics.done(settleFailure(work, logger, mq, &delivered, conf, categoryStorage, "UpdateArchiveChecksum failed", err, message))
+
+							return
+						}
+					default:
+						markFailed(ctx, db, message.FileID, categoryChecksum, fmt.Sprintf("stored archive checksum %s does not match computed checksum %s", storedChecksum, archiveChecksum))
+
+						err := fmt.Errorf("stored archive checksum %s does not match computed checksum %s (region: %s, zone: %s)", storedChecksum, archiveChecksum, conf.Deployment.Region, conf.Deployment.Zone)
+						metrics.done(settleFailure(work, logger, mq, &delivered, conf, categoryChecksum, "Archive mutated", permanentError(err), message))
+
+						return
+					}
+				}
+
+				result := newReVerified(message, decryptedChecksums, storedChecksum, archiveChecksum, drifted, conf)
+				result.KeyFingerprint = fingerprint
+				resultMessage, _ := json.Marshal(&result)
+
+				// Send the result of the re-verification for auditing
+				if err := mq.SendMessage(delivered.CorrelationId,
+					conf.Broker.Exchange,
+					conf.Verify.ReVerifyRoutingKey,
+					conf.Broker.Durable,
+					resultMessage); err != nil {
+					logger.Errorf("Sending of re-verify result failed "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						message.FileID,
+						err)
+
+					metrics.done(settleFailure(work, logger, mq, &delivered, conf, "", "Sending of re-verify result failed", err, message))
+
+					return
+				}
+
+				logger.Infof("File re-verified "+
+					"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, archivechecksum: %s, drifted: %t, region: %s, zone: %s)",
+					delivered.CorrelationId,
+					message.User,
+					message.FilePath,
+					message.ArchivePath,
+					message.FileID,
+					archiveChecksum,
+					drifted,
+					conf.Deployment.Region,
+					conf.Deployment.Zone)
+
+				if err := delivered.Ack(false); err != nil {
+					logger.Errorf("Failed acking re-verified work "+
+						"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, reason: %v)",
+						delivered.CorrelationId,
+						message.User,
+						message.FilePath,
+						message.ArchivePath,
+						message.FileID,
+						err)
+				}
+				metrics.done(outcomeReVerified)
+			}
+
+		}
+
+		for {
+			var delivered amqp.Delivery
+			select {
+			case <-quit:
+				return
+			case d, ok := <-deliveries:
+				if !ok {
+					return
 				}
-				log.Debugf("Removed file from inbox: %s", message.FilePath)
+				delivered = d
+			}
+
+			select {
+			case <-stopping:
+				requeueAfter(work, delivered, 0)
 
+				continue
+			default:
 			}
 
+			verifyMessage(delivered)
 		}
-	}()
+	}
+	workers := &workerPool{run: worker}
+	workers.resize(conf.Verify.Workers)
+
+	// The number of workers and the prefetch count can be changed with
+	// SIGHUP
+	conf.ReloadOnSIGHUP(func(r config.ReloadableConf) {
+		if err := mq.SetPrefetch(prefetchFor(r.PrefetchCount, r.Workers)); err != nil {
+			log.Errorf("Failed to change prefetch count: %v", err)
+		}
+		workers.resize(r.Workers)
+	})
+
+	sig := <-sigc
+	log.Infof("Received %v, shutting down (grace period: %v)", sig, conf.Verify.ShutdownGracePeriod)
+	close(stopping)
+	if err := mq.CancelMessages(); err != nil {
+		log.Errorf("Failed to stop consuming messages (error: %v)", err)
+	}
+	shutdown(&workers.running, cancelWork, conf.Verify.ShutdownGracePeriod)
+}
+
+// loadC4GHKeyring loads the configured c4gh keys, logging the fingerprints
+// that which key decrypted a file is recorded by
+func loadC4GHKeyring() (*config.C4GHKeyring, error) {
+	keyring, err := config.NewC4GHKeyring()
+	if err != nil {
+		return nil, err
+	}
+	c4ghKeys := keyring.Keys()
+	keyFingerprints := make([]string, len(c4ghKeys))
+	for i, key := range c4ghKeys {
+		keyFingerprints[i] = keyFingerprint(key)
+	}
+	log.Infof("Loaded %d c4gh keys (fingerprints: %s)", len(c4ghKeys), strings.Join(keyFingerprints, ", "))
+
+	return keyring, nil
+}
+
+// fileVerifier verifies the archive files of the messages a worker is
+// handed, or of the file ids of a batch
+type fileVerifier struct {
+	conf    *config.Config
+	db      *database.SQLdb
+	archive storage.Backend
+	// keyring provides the c4gh keys, the current one fetched again when
+	// it is read from vault and its ttl has passed
+	keyring *config.C4GHKeyring
+	// limiter is shared by all workers
+	limiter *fileLimiter
+	// The archive file is read, and the decrypted data hashed, through
+	// buffers of the configured sizes, reused for every file verified
+	buf           []byte
+	archiveReader *bufio.Reader
+}
+
+func newFileVerifier(conf *config.Config, db *database.SQLdb, archive storage.Backend, keyring *config.C4GHKeyring, limiter *fileLimiter) *fileVerifier {
+	return &fileVerifier{
+		conf:          conf,
+		db:            db,
+		archive:       archive,
+		keyring:       keyring,
+		limiter:       limiter,
+		buf:           make([]byte, conf.Verify.CopyBufferSize),
+		archiveReader: bufio.NewReaderSize(nil, conf.Archive.BufferSize()),
+	}
+}
+
+// verification is what verifying a file found
+type verification struct {
+	file               database.FileInfo
+	decryptedChecksums []checksums
+	// keyFingerprint is of the c4gh key that decrypted the file, empty
+	// until one did
+	keyFingerprint string
+}
+
+// Categories of the failures to verify a file, carried in the reason the
+// file is marked as failed with and in the error message, for failures to
+// be told apart
+const (
+	categoryDecryption = "DECRYPTION_FAILED"
+	categoryChecksum   = "CHECKSUM_MISMATCH"
+	categoryStorage    = "STORAGE_ERROR"
+	categorySize       = "SIZE_MISMATCH"
+	categorySchema     = broker.CategorySchemaInvalid
+)
+
+// categorized prefixes reason with the category of the failure, if it has
+// one
+func categorized(category, reason string) string {
+	if category == "" {
+		return reason
+	}
+
+	return category + ": " + reason
+}
+
+// decryptionCategory is the category of a failure to decrypt the archive
+// file, classified by progressReader: reading the archive file failed, or
+// the decryption did
+func decryptionCategory(err error) string {
+	if isTransient(err) {
+		return categoryStorage
+	}
+
+	return categoryDecryption
+}
+
+// verifyError is a failure to verify a file, with the category and the
+// description it is sent to the error queue with
+type verifyError struct {
+	category string
+	msg      string
+	err      error
+}
 
-	<-forever
+func (e *verifyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *verifyError) Unwrap() error {
+	return e.err
+}
+
+// verify decrypts and checksums the archive file of message, and checks it
+// against what was recorded at ingestion. A file found to be broken is
+// marked as failed, the error returned is a *verifyError classified as
+// transient or permanent. The archive file being restored is returned as
+// storage.ErrRestoreInProgress, to be retried later.
+func (v *fileVerifier) verify(ctx context.Context, logger *log.Entry, corrID string, message message, metrics *fileMetrics) (*verification, error) {
+	result := &verification{}
+
+	header, err := v.db.GetHeaderContext(ctx, message.FileID)
+	if err != nil {
+		logger.Errorf("GetHeader failed "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		return result, &verifyError{category: categoryStorage, msg: "Getheader failed", err: err}
+	}
+	if err := validateHeader(header); err != nil {
+		logger.Errorf("Stored header is invalid "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			err)
+
+		markFailed(ctx, v.db, message.FileID, categoryDecryption, err.Error())
+
+		return result, &verifyError{category: categoryDecryption, msg: "Invalid header", err: permanentError(err)}
+	}
+
+	file := database.FileInfo{VerifiedBy: v.conf.Deployment.Identity()}
+
+	file.Size, err = v.archive.GetFileSize(message.ArchivePath)
+
+	if err != nil {
+		logger.Errorf("Failed to get archived file size "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		err = archiveError(v.archive, message.ArchivePath, err)
+		if !isTransient(err) {
+			markFailed(ctx, v.db, message.FileID, categoryStorage, err.Error())
+		}
+
+		return result, &verifyError{category: categoryStorage, msg: "Archive file missing", err: err}
+	}
+
+	logger.Infof("Got archived file size "+
+		"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, archivedsize: %d)",
+		corrID,
+		message.User,
+		message.FilePath,
+		message.ArchivePath,
+		message.EncryptedChecksums,
+		message.ReVerify,
+		file.Size)
+
+	// A truncated or swapped archive file fails before it is read
+	archivedSize, err := v.db.GetArchiveSize(message.FileID)
+	if err != nil {
+		logger.Errorf("GetArchiveSize failed "+
+			"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.FileID,
+			message.ArchivePath,
+			err)
+
+		return result, &verifyError{category: categoryStorage, msg: "GetArchiveSize failed", err: err}
+	}
+	if err := checkArchiveSize(file.Size, archivedSize, v.conf.Verify.SizeTolerance); err != nil {
+		// Re-verifying an archive allowed to change since ingestion
+		// leaves it to the checksum comparison
+		if message.ReVerify && v.conf.Verify.ArchiveDrift != config.ArchiveDriftError {
+			logger.Warnf("Archive file size changed since ingestion "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, reason: %v)",
+				corrID,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				err)
+		} else {
+			logger.Errorf("Archive file size is wrong "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, archivepath: %s, reason: %v)",
+				corrID,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				message.ArchivePath,
+				err)
+
+			markFailed(ctx, v.db, message.FileID, categorySize, err.Error())
+
+			return result, &verifyError{category: categorySize, msg: "Archive size mismatch", err: permanentError(err)}
+		}
+	}
+
+	// Large files wait for others to finish, so that the files read at the
+	// same time stay within the limits
+	release, err := v.limiter.acquire(ctx, logger, file.Size)
+	if err != nil {
+		return result, &verifyError{msg: "Waiting for files in flight failed", err: err}
+	}
+	defer release()
+
+	// A file whose verification was interrupted resumes from its
+	// checkpoint, if it has one
+	keys := v.keyring.Keys()
+	var cp *checkpointer
+	if v.conf.Verify.CheckpointInterval > 0 && resumable(header, keys) {
+		cp = &checkpointer{
+			logger:      logger,
+			store:       v.db,
+			fileID:      message.FileID,
+			archiveSize: file.Size,
+			algorithms:  v.conf.Verify.DecryptedChecksums,
+			interval:    v.conf.Verify.CheckpointInterval,
+			saved:       time.Now(),
+		}
+	}
+
+	// Reading the start of the archive file may fail on a storage hiccup,
+	// so it is opened again, with fresh hashes, a few times before the
+	// message is requeued
+	var (
+		offset   int64
+		hashes   *fileHashes
+		progress *progressReader
+		c4ghr    *streaming.Crypt4GHReader
+		keyIndex int
+	)
+	for attempt := 0; ; attempt++ {
+		offset, hashes = 0, newFileHashes(header, v.conf.Verify.DecryptedChecksums)
+		if cp != nil {
+			if o, resumed := loadCheckpoint(logger, v.db, message.FileID, file.Size, v.conf.Verify.DecryptedChecksums); resumed != nil {
+				offset, hashes = o, resumed
+				logger.Infof("Resuming verification from checkpoint "+
+					"(corr-id: %s, fileid: %d, offset: %d, size: %d)",
+					corrID,
+					message.FileID,
+					offset,
+					file.Size)
+			}
+		}
+
+		f, err := openArchiveFile(ctx, v.archive, message.ArchivePath, offset, file.Size)
+		if errors.Is(err, storage.ErrRestoreInProgress) {
+			return result, &verifyError{category: categoryStorage, msg: "Archived file is being restored", err: err}
+		}
+		if err != nil {
+			logger.Errorf("Failed to open archived file "+
+				"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+				corrID,
+				message.User,
+				message.FilePath,
+				message.ArchivePath,
+				message.EncryptedChecksums,
+				message.ReVerify,
+				err)
+
+			err = archiveError(v.archive, message.ArchivePath, err)
+			if !isTransient(err) {
+				markFailed(ctx, v.db, message.FileID, categoryStorage, err.Error())
+			}
+
+			return result, &verifyError{category: categoryStorage, msg: "Failed to open archived file", err: err}
+		}
+
+		v.archiveReader.Reset(f)
+		progress = &progressReader{reader: v.archiveReader, done: offset, size: file.Size}
+
+		// Feed everything read from the archive file to its hashes
+		c4ghr, keyIndex, err = newCrypt4GHReader(header, io.TeeReader(progress, io.MultiWriter(hashes.archive, hashes.ingested)), keys)
+		if err == nil {
+			break
+		}
+
+		_ = f.Close()
+		err = progress.classify(fmt.Errorf("failed to decrypt the file header: %w", err))
+		if isTransient(err) && attempt < v.conf.Verify.ReaderRetries && sleepContext(ctx, readerRetryDelay<<attempt) {
+			logger.Warnf("Reading the archived file failed, opening it again "+
+				"(corr-id: %s, fileid: %d, archivepath: %s, attempt: %d, reason: %v)",
+				corrID,
+				message.FileID,
+				message.ArchivePath,
+				attempt+1,
+				err)
+
+			continue
+		}
+
+		logger.Errorf("Failed to open c4gh decryptor stream "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		if !isTransient(err) {
+			markFailed(ctx, v.db, message.FileID, categoryDecryption, err.Error())
+		}
+
+		return result, &verifyError{category: decryptionCategory(err), msg: "Failed to open c4gh decryptor stream", err: err}
+	}
+
+	metrics.progress, metrics.resumed = progress, offset
+	if cp != nil {
+		cp.progress = progress
+	}
+	stopProgress := reportProgress(v.db, message.FileID, file.Size, progress, v.conf.Verify.ProgressInterval)
+
+	result.keyFingerprint = keyFingerprint(keys[keyIndex])
+	logger.Infof("Decrypting with c4gh key %d (corr-id: %s, fingerprint: %s)", keyIndex, corrID, result.keyFingerprint)
+
+	result.decryptedChecksums, err = computeChecksums(&file, c4ghr, hashes, v.buf, v.conf.Verify.DecryptedChecksums, cp)
+	stopProgress()
+	// Only a file interrupted by a transient failure resumes
+	if cp != nil && (err == nil || !isTransient(progress.classify(err))) {
+		clearCheckpoint(logger, v.db, message.FileID)
+	}
+	if err != nil {
+		logger.Errorf("Failed to copy decrypted data to hash stream "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		// The partial checksums are discarded, and a file that won't
+		// decrypt marked as failed; one interrupted by the storage, a
+		// timeout or shutdown is verified again
+		classified := progress.classify(err)
+		if !isTransient(classified) {
+			markFailed(ctx, v.db, message.FileID, categoryDecryption, fmt.Sprintf("failed to read the decrypted file: %v", err))
+		}
+
+		return result, &verifyError{category: decryptionCategory(classified), msg: "Failed to decrypt the archived file", err: classified}
+	}
+
+	// A file corrupted in the archive may still decrypt
+	compared, err := hashes.ingested.compare(message.EncryptedChecksums)
+	if err != nil {
+		logger.Errorf("Archive file does not match the ingested file "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, encryptedchecksums: %v, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.FileID,
+			message.EncryptedChecksums,
+			message.ReVerify,
+			err)
+
+		markFailed(ctx, v.db, message.FileID, categoryChecksum, err.Error())
+
+		return result, &verifyError{category: categoryChecksum, msg: "Encrypted checksum mismatch", err: permanentError(err)}
+	}
+	if !compared {
+		logger.Warnf("No encrypted checksum to compare the archive file with "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, encryptedchecksums: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.EncryptedChecksums)
+	}
+
+	// A file verified before is expected to decrypt to the same
+	// size as it did then
+	expectedSize := message.DecryptedSize
+	if expectedSize == 0 && message.ReVerify {
+		if expectedSize, err = v.db.GetDecryptedSize(message.FileID); err != nil {
+			logger.Warnf("Failed to get the stored decrypted size, not comparing it "+
+				"(corr-id: %s, user: %s, filepath: %s, fileid: %d, reason: %v)",
+				corrID,
+				message.User,
+				message.FilePath,
+				message.FileID,
+				err)
+		}
+	}
+	if err := checkDecryptedSize(file.DecryptedSize, expectedSize); err != nil {
+		logger.Errorf("Decrypted size is wrong "+
+			"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, fileid: %d, reverify: %t, reason: %v)",
+			corrID,
+			message.User,
+			message.FilePath,
+			message.ArchivePath,
+			message.FileID,
+			message.ReVerify,
+			err)
+
+		markFailed(ctx, v.db, message.FileID, categorySize, err.Error())
+
+		return result, &verifyError{category: categorySize, msg: "Decrypted size mismatch", err: permanentError(err)}
+	}
+
+	logger.Infof("Calculated decrypted hash "+
+		"(corr-id: %s, user: %s, filepath: %s, archivepath: %s, "+
+		"encryptedchecksums: %v, reverify: %t, decryptedsize: %d, "+
+		"decryptedchecksum: %x)",
+		corrID,
+		message.User,
+		message.FilePath,
+		message.ArchivePath,
+		message.EncryptedChecksums,
+		message.ReVerify,
+		file.DecryptedSize,
+		file.DecryptedChecksum.Sum(nil))
+
+	result.file = file
+
+	return result, nil
+}
+
+// readerRetryDelay is how long to wait before opening an archive file again
+// after reading it failed, doubled for every following attempt
+var readerRetryDelay = 2 * time.Second
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// openArchiveFile opens the archive file of size bytes for reading from
+// offset, closed when ctx is done
+func openArchiveFile(ctx context.Context, archive storage.Backend, archivePath string, offset, size int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return archive.NewFileReaderContext(ctx, archivePath)
+	}
+
+	f, err := archive.NewFileReaderAt(archivePath, offset, size-offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.ReaderWithContext(ctx, f), nil
+}
+
+// fileContext returns the context verifying a file is tied to, ended after
+// timeout unless it is zero
+func fileContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	return context.WithTimeout(parent, timeout)
+}
+
+// shutdownCancelWait is how long the workers are waited for once their work
+// has been cancelled, before giving up on them
+var shutdownCancelWait = 10 * time.Second
+
+// shutdown waits for the workers to finish, cancelling their work after the
+// grace period. Messages left unacknowledged by workers that don't finish
+// are requeued by the broker as the channel is closed.
+func shutdown(workers *sync.WaitGroup, cancelWork context.CancelFunc, grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	log.Warn("Shutdown grace period is over, cancelling the files being verified")
+	cancelWork()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownCancelWait):
+		log.Warn("Workers did not stop, closing the channel to requeue their messages")
+	}
+}
+
+// workerPool runs a number of workers that can be changed while running
+type workerPool struct {
+	run     func(quit <-chan struct{})
+	running sync.WaitGroup
+
+	mu    sync.Mutex
+	quits []chan struct{}
+}
+
+// resize starts or stops workers until n are running. A stopped worker
+// finishes the message it is verifying first.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n != len(p.quits) && len(p.quits) != 0 {
+		log.Infof("Changing the number of workers from %d to %d", len(p.quits), n)
+	}
+
+	for len(p.quits) < n {
+		quit := make(chan struct{})
+		p.quits = append(p.quits, quit)
+		p.running.Add(1)
+		go func() {
+			defer p.running.Done()
+			p.run(quit)
+		}()
+	}
+
+	for len(p.quits) > n {
+		last := len(p.quits) - 1
+		close(p.quits[last])
+		p.quits = p.quits[:last]
+	}
+}
+
+// prefetchFor returns the prefetch count to use for the number of workers:
+// without a limit, and with more than one worker, as many messages as there
+// are workers are prefetched. A lower limit leaves workers idle.
+func prefetchFor(prefetch, workers int) int {
+	if prefetch == 0 && workers > 1 {
+		return workers
+	}
+	if prefetch != 0 && prefetch < workers {
+		log.Warnf("Prefetch count is lower than the number of workers, only %d of %d workers will be busy", prefetch, workers)
+	}
+
+	return prefetch
+}
+
+// statusReader looks up the status of a file
+type statusReader interface {
+	GetFileStatusContext(ctx context.Context, fileID int) (string, error)
+}
+
+// skipFile reports, with the status of the file, whether it should not be
+// verified: files marked as REMOVED never are, and files already marked as
+// COMPLETED only when re-verifying. A failed lookup is logged and the file
+// verified anyway.
+func skipFile(ctx context.Context, db statusReader, fileID int, reVerify bool) (string, bool) {
+	status, err := db.GetFileStatusContext(ctx, fileID)
+	if err != nil {
+		log.Warnf("Failed to get file status, verifying anyway (fileid: %d, reason: %v)", fileID, err)
+
+		return "", false
+	}
+
+	switch status {
+	case database.StatusRemoved:
+		return status, true
+	case "COMPLETED":
+		return status, !reVerify
+	}
+
+	return status, false
+}
+
+// verifiedReader looks up what was recorded when a file was verified
+type verifiedReader interface {
+	GetDecryptedChecksum(fileID int) (string, error)
+	GetDecryptedSize(fileID int) (int64, error)
+	GetAccessionRequested(fileID int) (bool, error)
+}
+
+// alreadyVerified tells whether a file marked as COMPLETED can be skipped
+// without decrypting it again: its decrypted checksum and size were
+// recorded, the size is the one the message expects, if any, and its
+// accession request was sent. Otherwise, and when the lookup fails, the file
+// is verified again, which sends the accession request.
+func alreadyVerified(logger *log.Entry, db verifiedReader, fileID int, expectedSize int64) bool {
+	checksum, err := db.GetDecryptedChecksum(fileID)
+	if err != nil {
+		logger.Warnf("Failed to get the stored decrypted checksum, verifying anyway (fileid: %d, reason: %v)", fileID, err)
+
+		return false
+	}
+	size, err := db.GetDecryptedSize(fileID)
+	if err != nil {
+		logger.Warnf("Failed to get the stored decrypted size, verifying anyway (fileid: %d, reason: %v)", fileID, err)
+
+		return false
+	}
+	requested, err := db.GetAccessionRequested(fileID)
+	if err != nil {
+		logger.Warnf("Failed to look up the accession request, verifying anyway (fileid: %d, reason: %v)", fileID, err)
+
+		return false
+	}
+
+	switch {
+	case checksum == "" || size == 0:
+		logger.Infof("File is COMPLETED without a decrypted checksum and size, verifying it again (fileid: %d)", fileID)
+
+		return false
+	case expectedSize != 0 && size != expectedSize:
+		logger.Infof("File is COMPLETED with decrypted size %d rather than %d, verifying it again (fileid: %d)", size, expectedSize, fileID)
+
+		return false
+	case !requested:
+		logger.Infof("File is COMPLETED without its accession request sent, verifying it again (fileid: %d)", fileID)
+
+		return false
+	}
+
+	return true
+}
+
+// archiveDrifted reports whether the checksum computed from the archive file
+// differs from the one recorded at ingestion. A missing stored checksum can't
+// be compared and is not considered drift.
+func archiveDrifted(stored, computed string) bool {
+	if stored == "" {
+		return false
+	}
+
+	return !strings.EqualFold(stored, computed)
+}
+
+// reVerified is the result of verifying an archived file again
+type reVerified struct {
+	User                  string      `json:"user"`
+	FilePath              string      `json:"filepath"`
+	FileID                int         `json:"file_id"`
+	ArchivePath           string      `json:"archive_path"`
+	DecryptedChecksums    []checksums `json:"decrypted_checksums"`
+	ArchiveChecksum       string      `json:"archive_checksum"`
+	StoredArchiveChecksum string      `json:"stored_archive_checksum,omitempty"`
+	ArchiveDrifted        bool        `json:"archive_drifted"`
+	// DriftAction is what was done about the drift, when there was any
+	DriftAction string `json:"drift_action,omitempty"`
+	// KeyFingerprint identifies the c4gh key that decrypted the file
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Zone           string `json:"zone,omitempty"`
+}
+
+// newReVerified builds the result of a re-verification that didn't fail
+func newReVerified(message message, decryptedChecksums []checksums, stored, computed string, drifted bool, conf *config.Config) reVerified {
+	r := reVerified{
+		User:                  message.User,
+		FilePath:              message.FilePath,
+		FileID:                message.FileID,
+		ArchivePath:           message.ArchivePath,
+		DecryptedChecksums:    decryptedChecksums,
+		ArchiveChecksum:       computed,
+		StoredArchiveChecksum: stored,
+		ArchiveDrifted:        drifted,
+		Region:                conf.Deployment.Region,
+		Zone:                  conf.Deployment.Zone,
+	}
+	if drifted {
+		r.DriftAction = conf.Verify.ArchiveDrift
+	}
+
+	return r
+}
+
+// newCrypt4GHReader opens a decryptor stream for the archive file using the
+// first of the keys that can decrypt the header, and returns the index of that
+// key. Only the header is read while trying the keys, so no archive data is
+// consumed by a failed attempt, and the file only fails to decrypt once every
+// key has been tried.
+func newCrypt4GHReader(header []byte, archive io.Reader, keys []*[32]byte) (*streaming.Crypt4GHReader, int, error) {
+	err := fmt.Errorf("no c4gh keys available")
+	for i, key := range keys {
+		var c4ghr *streaming.Crypt4GHReader
+		c4ghr, err = streaming.NewCrypt4GHReader(io.MultiReader(bytes.NewReader(header), archive), *key, nil)
+		if err == nil {
+			return c4ghr, i, nil
+		}
+	}
+	if len(keys) > 0 {
+		err = fmt.Errorf("none of the %d c4gh keys decrypts the header: %w", len(keys), err)
+	}
+
+	return nil, -1, err
+}
+
+// validateHeader checks that a stored header is a whole crypt4gh header and
+// nothing more, before it is put in front of the archive file
+func validateHeader(header []byte) error {
+	switch {
+	case len(header) == 0:
+		return errors.New("the stored header is empty")
+	case len(header) > database.MaxHeaderSize:
+		return fmt.Errorf("the stored header is %d bytes, more than the %d a header can plausibly be", len(header), database.MaxHeaderSize)
+	}
+
+	parsed, err := headers.ReadHeader(bytes.NewReader(header))
+	if err != nil {
+		return fmt.Errorf("the stored header of %d bytes is not a crypt4gh header: %v", len(header), err)
+	}
+	if len(parsed) != len(header) {
+		return fmt.Errorf("the stored header has %d bytes after the %d bytes of the crypt4gh header", len(header)-len(parsed), len(parsed))
+	}
+
+	return nil
+}
+
+// ingestedHashes hashes the encrypted file as it was ingested, the header
+// followed by the archive file, with each algorithm the encrypted checksums
+// of the messages may use
+type ingestedHashes map[string]hash.Hash
+
+// newIngestedHashes returns the hashes of an ingested file, to which the
+// archive file is written
+func newIngestedHashes(header []byte) ingestedHashes {
+	hashes := ingestedHashes{"sha256": sha256.New(), "md5": md5.New()} // #nosec
+	for _, h := range hashes {
+		h.Write(header)
+	}
+
+	return hashes
+}
+
+func (h ingestedHashes) Write(b []byte) (int, error) {
+	for _, hash := range h {
+		hash.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// compare checks the encrypted checksums against those computed, and
+// returns an error for the first that differs. Checksums of algorithms
+// that are not computed are skipped, compared tells whether any was not.
+func (h ingestedHashes) compare(expected []checksums) (compared bool, err error) {
+	for _, checksum := range expected {
+		hash, ok := h[strings.ToLower(checksum.Type)]
+		if !ok {
+			continue
+		}
+
+		computed := fmt.Sprintf("%x", hash.Sum(nil))
+		if !strings.EqualFold(computed, checksum.Value) {
+			return true, &checksumMismatch{algorithm: strings.ToLower(checksum.Type), expected: checksum.Value, actual: computed}
+		}
+		compared = true
+	}
+
+	return compared, nil
+}
+
+// checksumMismatch is the error for an archive file whose checksum doesn't
+// match the encrypted checksum of the ingested file
+type checksumMismatch struct {
+	algorithm, expected, actual string
+}
+
+func (e *checksumMismatch) Error() string {
+	return fmt.Sprintf("%s checksum %s of the archive file does not match the encrypted checksum %s", e.algorithm, e.actual, e.expected)
+}
+
+// Kinds of checksum mismatches, by what the archive file was compared with
+const (
+	mismatchEncrypted = "encrypted"
+	mismatchArchive   = "archive"
+)
+
+// mismatchEvent describes a checksum that doesn't match the expected one,
+// as published with the verify.mismatchRoutingKey routing key following the
+// checksum-mismatch schema
+type mismatchEvent struct {
+	FileID         int    `json:"file_id"`
+	FilePath       string `json:"filepath"`
+	ArchivePath    string `json:"archive_path,omitempty"`
+	User           string `json:"user,omitempty"`
+	Kind           string `json:"kind"`
+	Algorithm      string `json:"algorithm"`
+	Expected       string `json:"expected"`
+	Actual         string `json:"actual"`
+	CorrelationID  string `json:"correlation_id"`
+	Timestamp      string `json:"timestamp"`
+	Service        string `json:"service"`
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	Region         string `json:"region,omitempty"`
+	Zone           string `json:"zone,omitempty"`
+}
+
+// messageSender publishes messages
+type messageSender interface {
+	SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error
+}
+
+// publishMismatch publishes a checksum mismatch event, filling in when and
+// by which service instance it was found. A failure is only logged, as the
+// message being verified is settled regardless.
+func publishMismatch(mq messageSender, conf *config.Config, event mismatchEvent) {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	event.Service = conf.Deployment.Identity()
+	event.Region = conf.Deployment.Region
+	event.Zone = conf.Deployment.Zone
+
+	body, _ := json.Marshal(&event)
+	if err := mq.SendMessage(event.CorrelationID, conf.Broker.Exchange, conf.Verify.MismatchRoutingKey, conf.Broker.Durable, body); err != nil {
+		log.Errorf("Failed to publish checksum mismatch "+
+			"(corr-id: %s, fileid: %d, kind: %s, reason: %v)",
+			event.CorrelationID,
+			event.FileID,
+			event.Kind,
+			err)
+	}
+}
+
+// keyFingerprint identifies a c4gh key by the sha256 checksum of its public
+// key, which unlike the private key can be shown
+func keyFingerprint(key *[32]byte) string {
+	publicKey := keys.DerivePublicKey(*key)
+
+	return fmt.Sprintf("%x", sha256.Sum256(publicKey[:]))
+}
+
+// checkArchiveSize returns an error if the archive file size differs from the
+// size recorded at ingestion by more than tolerance bytes, unless none was
+// recorded
+func checkArchiveSize(size, expected, tolerance int64) error {
+	if expected == 0 {
+		return nil
+	}
+
+	switch diff := size - expected; {
+	case diff < -tolerance:
+		return fmt.Errorf("archive file size %d is %d bytes short of the %d bytes recorded at ingestion", size, -diff, expected)
+	case diff > tolerance:
+		return fmt.Errorf("archive file size %d is %d bytes over the %d bytes recorded at ingestion", size, diff, expected)
+	}
+
+	return nil
+}
+
+// checkDecryptedSize returns an error if the file decrypted to nothing, which
+// a wrong key or a corrupt header leads to rather than an empty file, or to
+// another size than expected, unless none is
+func checkDecryptedSize(size, expected int64) error {
+	if size == 0 {
+		return errors.New("the decrypted file is empty")
+	}
+	if expected != 0 && size != expected {
+		return fmt.Errorf("decrypted size %d does not match the expected size %d", size, expected)
+	}
+
+	return nil
+}
+
+// errorMarker marks a file as failed in the database
+type errorMarker interface {
+	MarkErrorContext(ctx context.Context, fileID int, reason string) error
+}
+
+// archiveMissing tells whether the archive file is known not to exist, as
+// opposed to the archive failing to answer
+func archiveMissing(archive storage.Backend, archivePath string) bool {
+	exists, err := archive.Exists(archivePath)
+	if err != nil {
+		log.Errorf("Failed to check if the archive file exists (archivepath: %s, reason: %v)", archivePath, err)
+
+		return false
+	}
+
+	return !exists
+}
+
+// archiveError classifies an error from the archive: a missing archive file
+// won't turn up by retrying, unlike one that couldn't be reached
+func archiveError(archive storage.Backend, archivePath string, err error) error {
+	if archiveMissing(archive, archivePath) {
+		return permanentError(fmt.Errorf("archive file %s is missing", archivePath))
+	}
+
+	return transientError(err)
+}
+
+// retryDelay is how long a message that failed for a transient reason is
+// left unacknowledged before it is requeued, so that a storage or database
+// that is down isn't asked again for every message in the queue at once
+var retryDelay = 10 * time.Second
+
+// classifiedError is an error whose kind is known where it happened, rather
+// than from its type
+type classifiedError struct {
+	error
+	transient bool
+}
+
+func (e classifiedError) Unwrap() error {
+	return e.error
+}
+
+// transientError marks err as one that may pass when retried, such as a
+// failed read of the archive file
+func transientError(err error) error {
+	return classifiedError{error: err, transient: true}
+}
+
+// permanentError marks err as one that retrying won't fix, whatever it
+// wraps, such as a missing archive file
+func permanentError(err error) error {
+	return classifiedError{error: err, transient: false}
+}
+
+// isTransient reports whether a message whose verification failed with err
+// may pass when retried. The first row that matches decides:
+//
+//	error                                               transient
+//	marked by transientError or permanentError          as marked
+//	context cancelled or timed out, e.g. on shutdown    yes
+//	broker connection                                   yes
+//	database or network connection                      yes
+//	anything else: schema, unmarshal, constraint,       no
+//	decryption, missing file, checksum mismatch
+func isTransient(err error) bool {
+	var classified classifiedError
+	if errors.As(err, &classified) {
+		return classified.transient
+	}
+
+	var amqpErr *amqp.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &amqpErr), errors.Is(err, amqp.ErrClosed):
+		return true
+	}
+
+	return database.IsTransient(err)
+}
+
+// errorSender publishes messages to the error queue, and sends messages
+// again to be retried or quarantined
+type errorSender interface {
+	SendCategorizedError(delivered *amqp.Delivery, conf broker.MQConf, category, errorMsg, reason string, originalMessage interface{}) error
+	Republish(delivered *amqp.Delivery, exchange, routingKey string, headers amqp.Table) error
+}
+
+// attemptsHeader counts the attempts at verifying a message that failed
+// transiently, on the copy sent back to the queue when verify.maxAttempts is
+// set
+const attemptsHeader = "verify-attempts"
+
+// deliveryAttempts returns how many earlier attempts at verifying a message
+// failed, by its attempts header, or the counts RabbitMQ keeps for quorum
+// queues and dead lettered messages, whichever is highest
+func deliveryAttempts(headers amqp.Table) int64 {
+	count := func(v interface{}) int64 {
+		switch n := v.(type) {
+		case int:
+			return int64(n)
+		case int16:
+			return int64(n)
+		case int32:
+			return int64(n)
+		case int64:
+			return n
+		default:
+			return 0
+		}
+	}
+
+	attempts := count(headers[attemptsHeader])
+	if n := count(headers["x-delivery-count"]); n > attempts {
+		attempts = n
+	}
+	deaths, _ := headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		if table, ok := death.(amqp.Table); ok {
+			if n := count(table["count"]); n > attempts {
+				attempts = n
+			}
+		}
+	}
+
+	return attempts
+}
+
+// settleFailure settles a message whose verification failed with err, for
+// every failure so that whether a message is retried is decided in one
+// place, by isTransient:
+//
+//   - a transient failure requeues the message after retryDelay, or at once
+//     when ctx is done on shutdown
+//   - a transient failure of the last of verify.maxAttempts attempts sends
+//     the message to the quarantine routing key instead, with errorMsg and
+//     err to the error queue, and ACKs it
+//   - a permanent failure sends errorMsg and err to the error queue, and
+//     NACKs the message without requeuing it
+//
+// The error message carries the category of the failure, if it has one.
+// Logging is done through the message's logger, with the category. The
+// outcome, retried, quarantined or failed, is returned.
+func settleFailure(ctx context.Context, logger *log.Entry, mq errorSender, delivered *amqp.Delivery, conf *config.Config, category, errorMsg string, err error, originalMessage interface{}) string {
+	if category != "" {
+		logger = logger.WithField("category", category)
+	}
+
+	//nolint:nestif
+	if isTransient(err) {
+		if conf.Verify.MaxAttempts == 0 {
+			logger.Infof("Retrying message in %v (corr-id: %s, reason: %v)", retryDelay, delivered.CorrelationId, err)
+			requeueAfter(ctx, delivered, retryDelay)
+
+			return outcomeRetried
+		}
+
+		attempt := deliveryAttempts(delivered.Headers) + 1
+		if attempt < int64(conf.Verify.MaxAttempts) {
+			logger.Infof("Retrying message in %v (corr-id: %s, attempt: %d of %d, reason: %v)",
+				retryDelay, delivered.CorrelationId, attempt, conf.Verify.MaxAttempts, err)
+			retryAfter(ctx, logger, mq, delivered, conf.Broker.Queue, attempt, retryDelay)
+
+			return outcomeRetried
+		}
+
+		if e := quarantine(mq, delivered, conf, attempt, category, errorMsg, err, originalMessage); e != nil {
+			logger.Errorf("Failed to quarantine message, retrying it "+
+				"(corr-id: %s, attempts: %d, reason: %v)",
+				delivered.CorrelationId,
+				attempt,
+				e)
+			requeueAfter(ctx, delivered, retryDelay)
+
+			return outcomeRetried
+		}
+		logger.Errorf("Quarantined message after %d attempts "+
+			"(corr-id: %s, routingkey: %s, error: %s, reason: %v)",
+			attempt,
+			delivered.CorrelationId,
+			conf.Verify.QuarantineRoutingKey,
+			errorMsg,
+			err)
+
+		return outcomeQuarantined
+	}
+
+	logger.Errorf("Verification failed "+
+		"(corr-id: %s, category: %s, error: %s, reason: %v)",
+		delivered.CorrelationId,
+		category,
+		errorMsg,
+		err)
+	if e := mq.SendCategorizedError(delivered, conf.Broker, category, errorMsg, err.Error(), originalMessage); e != nil {
+		logger.Errorf("Failed to publish error message "+
+			"(corr-id: %s, error: %s, reason: %v)",
+			delivered.CorrelationId,
+			errorMsg,
+			e)
+	}
+
+	// Nack message so the server gets notified that something is wrong but don't requeue the message
+	if e := delivered.Nack(false, false); e != nil {
+		logger.Errorf("Failed to nack message (corr-id: %s, reason: %v)", delivered.CorrelationId, e)
+	}
+
+	return outcomeFailed
+}
+
+// quarantine sends a message that failed its last attempt to the quarantine
+// routing key, followed by an error event saying why, and ACKs it. The
+// message is left as it is if it can't be quarantined.
+func quarantine(mq errorSender, delivered *amqp.Delivery, conf *config.Config, attempts int64, category, errorMsg string, err error, originalMessage interface{}) error {
+	headers := amqp.Table{
+		attemptsHeader:          attempts,
+		"verify-error":          errorMsg,
+		"verify-reason":         err.Error(),
+		"verify-quarantined-at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if category != "" {
+		headers["verify-category"] = category
+	}
+	if e := mq.Republish(delivered, conf.Broker.Exchange, conf.Verify.QuarantineRoutingKey, headers); e != nil {
+		return e
+	}
+
+	// The error event follows the message, which is safe in quarantine
+	// whether or not the event can be sent
+	if e := mq.SendCategorizedError(delivered, conf.Broker, category, fmt.Sprintf("Quarantined after %d attempts: %s", attempts, errorMsg), err.Error(), originalMessage); e != nil {
+		log.Errorf("Failed to publish quarantine error message (corr-id: %s, reason: %v)", delivered.CorrelationId, e)
+	}
+	if e := delivered.Ack(false); e != nil {
+		log.Errorf("Failed acking quarantined message (corr-id: %s, reason: %v)", delivered.CorrelationId, e)
+	}
+
+	return nil
+}
+
+// retryAfter sends the message back to queue after delay, counting the
+// attempt in its attempts header, and ACKs it. On shutdown, or if it can't
+// be sent, the message is requeued as it is instead.
+func retryAfter(ctx context.Context, logger *log.Entry, mq errorSender, delivered *amqp.Delivery, queue string, attempt int64, delay time.Duration) {
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		if ctx.Err() == nil {
+			err := mq.Republish(delivered, "", queue, amqp.Table{attemptsHeader: attempt})
+			if err == nil {
+				if err := delivered.Ack(false); err != nil {
+					logger.Errorf("Failed acking retried message (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+				}
+
+				return
+			}
+			logger.Errorf("Failed to send message back to the queue, requeuing it (corr-id: %s, reason: %v)", delivered.CorrelationId, err)
+		}
+		if err := delivered.Nack(false, true); err != nil {
+			logger.Errorf("Failed to requeue message (reason: %v)", err)
+		}
+	}()
+}
+
+// nacker is the part of a delivered message used to requeue it
+type nacker interface {
+	Nack(multiple, requeue bool) error
+}
+
+// requeueAfter returns the message to the queue after delay, it stays
+// unacknowledged until then, or until ctx is done on shutdown
+func requeueAfter(ctx context.Context, delivered nacker, delay time.Duration) {
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		if err := delivered.Nack(false, true); err != nil {
+			log.Errorf("Failed to requeue message (reason: %v)", err)
+		}
+	}()
+}
+
+// markFailed records in the database that verifying the file failed for a
+// reason that retrying won't fix, prefixed with the category of the failure
+func markFailed(ctx context.Context, db errorMarker, fileID int, category, reason string) {
+	if e := db.MarkErrorContext(ctx, fileID, categorized(category, reason)); e != nil {
+		log.Errorf("Failed to mark file as failed (fileid: %d, reason: %v)", fileID, e)
+	}
+}
+
+// newChecksumHash returns a hash for the algorithm, one of those accepted in
+// verify.decryptedChecksums
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case config.ChecksumMD5:
+		return md5.New() // #nosec
+	case config.ChecksumSHA512:
+		return sha512.New()
+	case config.ChecksumBLAKE2b:
+		h, _ := blake2b.New512(nil)
+
+		return h
+	default:
+		return sha256.New()
+	}
+}
+
+// computeChecksums reads the decrypted stream to the end and sets the archive
+// checksum and the decrypted size and sha256 checksum of file, returning the
+// checksums of the decrypted data for each of the algorithms. If reading
+// fails part way the partial checksums are discarded, leaving file without
+// any. The stream is read through buf, into hashes, which may hold what came
+// before it when resuming, with a checkpoint saved through cp, if set.
+func computeChecksums(file *database.FileInfo, decrypted io.Reader, hashes *fileHashes, buf []byte, algorithms []string, cp *checkpointer) ([]checksums, error) {
+	if len(buf) == 0 {
+		buf = make([]byte, 32*1024)
+	}
+
+	if err := copyHashed(hashes, decrypted, buf, cp.check); err != nil {
+		file.Checksum = nil
+		file.DecryptedChecksum = nil
+		file.DecryptedSize = 0
+
+		return nil, err
+	}
+
+	// The sha256 checksum is stored whether it is sent or not
+	file.Checksum = hashes.archive
+	file.DecryptedChecksum = hashes.decrypted[config.ChecksumSHA256]
+	file.DecryptedSize = hashes.decryptedSize
+
+	sums := make([]checksums, len(algorithms))
+	for i, algorithm := range algorithms {
+		sums[i] = checksums{algorithm, fmt.Sprintf("%x", hashes.decrypted[algorithm].Sum(nil))}
+	}
+
+	return sums, nil
+}
+
+// progressStore is where the progress of the file being verified is kept
+type progressStore interface {
+	UpsertProgress(fileID int, bytesDone, totalBytes int64) error
+	ClearProgress(fileID int) error
+}
+
+// progressReader counts the bytes read from the archive file, and remembers
+// whether reading it failed, or ended before the size of the file, if known
+type progressReader struct {
+	reader io.Reader
+	done   int64
+	size   int64
+	err    error
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	done := atomic.AddInt64(&p.done, int64(n))
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	if err == io.EOF && done < p.size {
+		p.err = fmt.Errorf("archive file ended after %d of %d bytes", done, p.size)
+	}
+
+	return n, err
+}
+
+// classify marks err as transient when reading the archive file failed, or
+// verifying the file was cancelled or timed out, and as permanent when what
+// was read didn't decrypt
+func (p *progressReader) classify(err error) error {
+	if p.err != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return transientError(err)
+	}
+
+	return permanentError(err)
+}
+
+// reportProgress writes the number of bytes read through p to the store
+// every interval until the returned function is called, which then clears the
+// progress. A zero interval disables the reporting.
+func reportProgress(store progressStore, fileID int, total int64, p *progressReader, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	upsert := func() {
+		if err := store.UpsertProgress(fileID, atomic.LoadInt64(&p.done), total); err != nil {
+			log.Warnf("Failed to update verification progress (fileid: %d, reason: %v)", fileID, err)
+		}
+	}
+
+	upsert()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				upsert()
+			case <-stop:
+				if err := store.ClearProgress(fileID); err != nil {
+					log.Warnf("Failed to clear verification progress (fileid: %d, reason: %v)", fileID, err)
+				}
+
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// memoryCheckInterval is how often the memory guard samples the heap size
+var memoryCheckInterval = 5 * time.Second
+
+// memoryGuard pauses consumption of new messages while the heap is above the
+// high water mark, until it has dropped below the low water mark again
+type memoryGuard struct {
+	highWater  uint64
+	lowWater   uint64
+	readMemory func() uint64
+
+	mu     sync.Mutex
+	paused bool
+	// pausing is closed when consumption is paused and resuming when it is
+	// resumed, each replaced with a new channel for the next change
+	pausing  chan struct{}
+	resuming chan struct{}
+}
+
+// newMemoryGuard returns a memoryGuard for the given limits, or nil if no
+// high water mark is configured
+func newMemoryGuard(highWater, lowWater uint64) *memoryGuard {
+	if highWater == 0 {
+		return nil
+	}
+
+	return &memoryGuard{
+		highWater:  highWater,
+		lowWater:   lowWater,
+		readMemory: heapAlloc,
+		pausing:    make(chan struct{}),
+		resuming:   make(chan struct{}),
+	}
+}
+
+// heapAlloc returns the number of bytes of allocated heap objects
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	return m.HeapAlloc
+}
+
+// check samples the memory use and updates the paused state
+func (g *memoryGuard) check() {
+	used := g.readMemory()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case !g.paused && used > g.highWater:
+		g.paused = true
+		close(g.pausing)
+		g.resuming = make(chan struct{})
+		log.Warnf("Memory use above high water mark, pausing message consumption (used: %d, highwater: %d)", used, g.highWater)
+	case g.paused && used < g.lowWater:
+		g.paused = false
+		close(g.resuming)
+		g.pausing = make(chan struct{})
+		log.Infof("Memory use below low water mark, resuming message consumption (used: %d, lowwater: %d)", used, g.lowWater)
+	}
+}
+
+// monitor periodically checks the memory use, forcing a garbage collection
+// while paused so that freed memory is accounted for
+func (g *memoryGuard) monitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if g.isPaused() {
+			runtime.GC()
+		}
+		g.check()
+	}
+}
+
+// isPaused reports whether message consumption is paused
+func (g *memoryGuard) isPaused() bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.paused
+}
+
+// pauses returns a channel that is closed when consumption is paused,
+// already closed if it is paused now
+func (g *memoryGuard) pauses() <-chan struct{} {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.pausing
+}
+
+// resumes returns a channel that is closed when consumption is resumed,
+// already closed if it isn't paused
+func (g *memoryGuard) resumes() <-chan struct{} {
+	if g == nil {
+		return closed
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		return closed
+	}
+
+	return g.resuming
+}
+
+// closed is a channel that is always closed
+var closed = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+
+	return c
+}()
+
+// wait blocks for as long as message consumption is paused, or until ctx
+// is done
+func (g *memoryGuard) wait(ctx context.Context) error {
+	select {
+	case <-g.resumes():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// messageConsumer starts and stops the consumer of a queue
+type messageConsumer interface {
+	GetMessages(queue string) (<-chan amqp.Delivery, error)
+	CancelMessages() error
+}
+
+// consume hands the messages of the queue, starting with those of
+// messages, to the workers on deliveries. While the memory guard is paused
+// the consumer is cancelled, so that the broker keeps the messages rather
+// than them piling up in memory, and a new one is started once it resumes.
+// Deliveries is closed when the consumer is cancelled after stopping.
+func consume(mq messageConsumer, queue string, messages <-chan amqp.Delivery, guard *memoryGuard, stopping <-chan struct{}, deliveries chan<- amqp.Delivery) error {
+	defer close(deliveries)
+
+	for {
+		pausing := guard.pauses()
+		cancelled := false
+		cancel := func() {
+			pausing, cancelled = nil, true
+			if err := mq.CancelMessages(); err != nil {
+				log.Errorf("Failed to pause consuming messages (error: %v)", err)
+			}
+		}
+
+	receive:
+		for {
+			select {
+			case delivered, ok := <-messages:
+				if !ok {
+					break receive
+				}
+				// the messages delivered before the consumer was
+				// cancelled are still handed on
+				select {
+				case deliveries <- delivered:
+				case <-pausing:
+					cancel()
+					deliveries <- delivered
+				}
+			case <-pausing:
+				cancel()
+			}
+		}
+
+		select {
+		case <-stopping:
+			return nil
+		default:
+		}
+		if !cancelled {
+			return errors.New("the broker stopped delivering messages")
+		}
+
+		select {
+		case <-guard.resumes():
+		case <-stopping:
+			return nil
+		}
+
+		var err error
+		if messages, err = mq.GetMessages(queue); err != nil {
+			return fmt.Errorf("failed to resume consuming messages (error: %v)", err)
+		}
+		// a shutdown while resuming cancelled the previous consumer
+		select {
+		case <-stopping:
+			if err := mq.CancelMessages(); err != nil {
+				log.Errorf("Failed to stop consuming messages (error: %v)", err)
+			}
+		default:
+		}
+	}
+}
+
+// fileLimiter bounds the number of files verified at the same time, and
+// the total size of their archive files, across workers
+type fileLimiter struct {
+	maxFiles int
+	maxBytes int64
+
+	mu    sync.Mutex
+	files int
+	bytes int64
+	// released is closed, and replaced, whenever a file is released
+	released chan struct{}
+}
+
+// newFileLimiter returns a fileLimiter for the given limits, zero meaning
+// no limit, or nil if there are none
+func newFileLimiter(maxFiles int, maxBytes int64) *fileLimiter {
+	if maxFiles == 0 && maxBytes == 0 {
+		return nil
+	}
+
+	return &fileLimiter{maxFiles: maxFiles, maxBytes: maxBytes, released: make(chan struct{})}
+}
+
+// fits reports whether a file of size bytes can be verified now. A file
+// larger than the byte limit is let through when no other file is.
+func (l *fileLimiter) fits(size int64) bool {
+	if l.maxFiles != 0 && l.files >= l.maxFiles {
+		return false
+	}
+
+	return l.maxBytes == 0 || l.files == 0 || l.bytes+size <= l.maxBytes
+}
+
+// acquire blocks until a file of size bytes fits, or ctx is done, and
+// returns the function releasing it
+func (l *fileLimiter) acquire(ctx context.Context, logger *log.Entry, size int64) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	logged := false
+	for {
+		l.mu.Lock()
+		if l.fits(size) {
+			l.files++
+			l.bytes += size
+			l.mu.Unlock()
+			filesInFlight.Inc()
+			bytesInFlight.Add(float64(size))
+
+			var once sync.Once
+
+			return func() { once.Do(func() { l.release(size) }) }, nil
+		}
+		released := l.released
+		if !logged {
+			logger.Infof("Waiting for files in flight to finish (files: %d, bytes: %d, size: %d)", l.files, l.bytes, size)
+			logged = true
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *fileLimiter) release(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.files--
+	l.bytes -= size
+	filesInFlight.Dec()
+	bytesInFlight.Sub(float64(size))
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// setupHTTP creates the http server serving the readiness and metrics
+// endpoints
+func setupHTTP(host string, port int, guard *memoryGuard) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", readinessResponse(guard))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", host, port),
+		Handler:           mux,
+		ReadHeaderTimeout: 20 * time.Second,
+	}
+}
+
+// readinessResponse reports the service as unavailable while message
+// consumption is paused
+func readinessResponse(guard *memoryGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if guard.isPaused() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("paused: memory use above high water mark\n"))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
 }
@@ -1,10 +1,47 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/common"
+	"sda-pipeline/internal/config"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/lib/pq"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	amqp "github.com/rabbitmq/amqp091-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/xeipuuv/gojsonschema"
+	"golang.org/x/crypto/blake2b"
 )
 
 type TestSuite struct {
@@ -18,3 +55,1097 @@ func TestConfigTestSuite(t *testing.T) {
 func (suite *TestSuite) SetupTest() {
 	viper.Set("log.level", "debug")
 }
+
+// fakeVerified returns what was recorded when a file was verified
+type fakeVerified struct {
+	checksum  string
+	size      int64
+	requested bool
+	err       error
+}
+
+func (f fakeVerified) GetDecryptedChecksum(fileID int) (string, error) {
+	return f.checksum, f.err
+}
+
+func (f fakeVerified) GetDecryptedSize(fileID int) (int64, error) {
+	return f.size, f.err
+}
+
+func (f fakeVerified) GetAccessionRequested(fileID int) (bool, error) {
+	return f.requested, f.err
+}
+
+func (suite *TestSuite) TestAlreadyVerified() {
+	logger := log.NewEntry(log.StandardLogger())
+	recorded := fakeVerified{checksum: "0f40", size: 1024, requested: true}
+
+	assert.True(suite.T(), alreadyVerified(logger, recorded, 42, 0))
+	assert.True(suite.T(), alreadyVerified(logger, recorded, 42, 1024))
+	assert.False(suite.T(), alreadyVerified(logger, recorded, 42, 2048), "skipped a file of another size than expected")
+	assert.False(suite.T(), alreadyVerified(logger, fakeVerified{size: 1024, requested: true}, 42, 0), "skipped a file without a checksum")
+	assert.False(suite.T(), alreadyVerified(logger, fakeVerified{checksum: "0f40", requested: true}, 42, 0), "skipped a file without a size")
+	// e.g. when sending the request failed after the file was marked
+	// completed
+	assert.False(suite.T(), alreadyVerified(logger, fakeVerified{checksum: "0f40", size: 1024}, 42, 0), "skipped a file whose accession request wasn't sent")
+	assert.False(suite.T(), alreadyVerified(logger, fakeVerified{err: errors.New("timeout")}, 42, 0), "a failed lookup should not skip the file")
+}
+
+func (suite *TestSuite) TestFileContext() {
+	ctx, cancel := fileContext(context.Background(), 0)
+	_, hasDeadline := ctx.Deadline()
+	assert.False(suite.T(), hasDeadline, "a zero timeout should not limit the verification")
+	cancel()
+
+	// a read of the archive file is cancelled at the timeout and the file
+	// retried
+	ctx, cancel = fileContext(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	dir := suite.T().TempDir()
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0600))
+	var conf storage.Conf
+	conf.Type = "posix"
+	conf.Posix.Location = dir
+	archive, err := storage.NewBackend(conf)
+	assert.NoError(suite.T(), err)
+	f, err := archive.NewFileReaderContext(ctx, "file")
+	assert.NoError(suite.T(), err)
+	<-ctx.Done()
+
+	progress := &progressReader{reader: f}
+	_, err = io.ReadAll(progress)
+	assert.ErrorIs(suite.T(), err, context.DeadlineExceeded)
+	assert.True(suite.T(), isTransient(progress.classify(err)), "a timed out file should be retried")
+}
+
+func (suite *TestSuite) TestArchiveDrifted() {
+	stored := "96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b"
+
+	assert.False(suite.T(), archiveDrifted(stored, stored), "identical checksums reported as drift")
+	assert.False(suite.T(), archiveDrifted(stored, strings.ToUpper(stored)), "checksum case reported as drift")
+	assert.False(suite.T(), archiveDrifted("", stored), "missing stored checksum reported as drift")
+	assert.True(suite.T(), archiveDrifted(stored, "b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba"), "drift not detected")
+}
+
+func (suite *TestSuite) TestNewReVerified() {
+	conf := &config.Config{}
+	conf.Verify.ArchiveDrift = config.ArchiveDriftUpdate
+	conf.Deployment.Region = "north"
+	msg := message{User: "user", FilePath: "dir/file.c4gh", FileID: 42, ArchivePath: "000/042", ReVerify: true}
+	decrypted := []checksums{{Type: "sha256", Value: "abc"}}
+
+	r := newReVerified(msg, decrypted, "stored", "stored", false, conf)
+	assert.Equal(suite.T(), 42, r.FileID)
+	assert.Equal(suite.T(), "000/042", r.ArchivePath)
+	assert.Equal(suite.T(), decrypted, r.DecryptedChecksums)
+	assert.Equal(suite.T(), "north", r.Region)
+	assert.False(suite.T(), r.ArchiveDrifted)
+	assert.Empty(suite.T(), r.DriftAction, "drift action set without drift")
+
+	r = newReVerified(msg, decrypted, "stored", "computed", true, conf)
+	assert.True(suite.T(), r.ArchiveDrifted)
+	assert.Equal(suite.T(), "stored", r.StoredArchiveChecksum)
+	assert.Equal(suite.T(), "computed", r.ArchiveChecksum)
+	assert.Equal(suite.T(), config.ArchiveDriftUpdate, r.DriftAction)
+}
+
+func (suite *TestSuite) TestFileLimiter() {
+	assert.Nil(suite.T(), newFileLimiter(0, 0), "limiter created without limits")
+
+	logger := log.NewEntry(log.StandardLogger())
+	limiter := newFileLimiter(2, 100)
+	acquired := func(size int64) (func(), bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		release, err := limiter.acquire(ctx, logger, size)
+
+		return release, err == nil
+	}
+
+	releaseFirst, ok := acquired(60)
+	assert.True(suite.T(), ok)
+	// over the byte limit together with the first file
+	_, ok = acquired(60)
+	assert.False(suite.T(), ok)
+	releaseSecond, ok := acquired(30)
+	assert.True(suite.T(), ok)
+	// over the file limit
+	_, ok = acquired(1)
+	assert.False(suite.T(), ok)
+
+	// a waiting file is let through once another is released, a release
+	// counting only once
+	done := make(chan struct{})
+	go func() {
+		release, err := limiter.acquire(context.Background(), logger, 50)
+		assert.NoError(suite.T(), err)
+		release()
+		close(done)
+	}()
+	releaseFirst()
+	releaseFirst()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.T().Fatal("acquire did not return after release")
+	}
+
+	// a file larger than the byte limit passes on its own
+	releaseSecond()
+	releaseHuge, ok := acquired(500)
+	assert.True(suite.T(), ok)
+	_, ok = acquired(1)
+	assert.False(suite.T(), ok)
+	releaseHuge()
+
+	// without a limiter there is nothing to wait for
+	var none *fileLimiter
+	release, err := none.acquire(context.Background(), logger, 1<<40)
+	assert.NoError(suite.T(), err)
+	release()
+}
+
+func (suite *TestSuite) TestMemoryGuard() {
+	assert.Nil(suite.T(), newMemoryGuard(0, 0), "guard created without high water mark")
+
+	var used uint64 = 50
+	guard := newMemoryGuard(100, 80)
+	guard.readMemory = func() uint64 { return used }
+
+	handler := readinessResponse(guard)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+		return w.Code
+	}
+
+	guard.check()
+	assert.False(suite.T(), guard.isPaused())
+	assert.Equal(suite.T(), http.StatusOK, ready())
+
+	// forced high memory reading
+	used = 150
+	guard.check()
+	assert.True(suite.T(), guard.isPaused())
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, ready())
+
+	// between the marks the guard stays paused
+	used = 90
+	guard.check()
+	assert.True(suite.T(), guard.isPaused())
+
+	// waiting ends when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(suite.T(), guard.wait(ctx), context.Canceled)
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(suite.T(), guard.wait(context.Background()))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		suite.T().Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	used = 70
+	guard.check()
+	assert.False(suite.T(), guard.isPaused())
+	assert.Equal(suite.T(), http.StatusOK, ready())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.T().Fatal("wait did not return after resume")
+	}
+}
+
+func (suite *TestSuite) TestWorkerPool() {
+	var running int32
+	pool := &workerPool{run: func(quit <-chan struct{}) {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		<-quit
+	}}
+	count := func() int32 { return atomic.LoadInt32(&running) }
+
+	pool.resize(2)
+	assert.Eventually(suite.T(), func() bool { return count() == 2 }, time.Second, time.Millisecond)
+
+	pool.resize(5)
+	assert.Eventually(suite.T(), func() bool { return count() == 5 }, time.Second, time.Millisecond)
+
+	pool.resize(1)
+	assert.Eventually(suite.T(), func() bool { return count() == 1 }, time.Second, time.Millisecond)
+
+	pool.resize(0)
+	pool.running.Wait()
+	assert.Zero(suite.T(), count())
+}
+
+// fakeConsumer hands out a new channel of deliveries for each consumer,
+// closing it when the consumer is cancelled
+type fakeConsumer struct {
+	mu       sync.Mutex
+	current  chan amqp.Delivery
+	consumed int
+}
+
+func (c *fakeConsumer) GetMessages(_ string) (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.consumed++
+	c.current = make(chan amqp.Delivery)
+
+	return c.current, nil
+}
+
+func (c *fakeConsumer) CancelMessages() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	close(c.current)
+
+	return nil
+}
+
+func (c *fakeConsumer) send(d amqp.Delivery) {
+	c.mu.Lock()
+	current := c.current
+	c.mu.Unlock()
+
+	current <- d
+}
+
+func (c *fakeConsumer) consumers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.consumed
+}
+
+func (suite *TestSuite) TestConsume() {
+	var used uint64 = 50
+	guard := newMemoryGuard(100, 80)
+	guard.readMemory = func() uint64 { return atomic.LoadUint64(&used) }
+
+	mq := &fakeConsumer{}
+	messages, _ := mq.GetMessages("verify")
+	stopping := make(chan struct{})
+	deliveries := make(chan amqp.Delivery)
+	result := make(chan error, 1)
+	go func() { result <- consume(mq, "verify", messages, guard, stopping, deliveries) }()
+
+	go mq.send(amqp.Delivery{CorrelationId: "1"})
+	assert.Equal(suite.T(), "1", (<-deliveries).CorrelationId)
+
+	// the consumer is cancelled while paused, even with every worker busy
+	atomic.StoreUint64(&used, 150)
+	guard.check()
+	assert.Eventually(suite.T(), func() bool {
+		mq.mu.Lock()
+		defer mq.mu.Unlock()
+		select {
+		case _, ok := <-mq.current:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	assert.Equal(suite.T(), 1, mq.consumers())
+
+	// and started again on resume
+	atomic.StoreUint64(&used, 50)
+	guard.check()
+	assert.Eventually(suite.T(), func() bool { return mq.consumers() == 2 }, time.Second, time.Millisecond)
+	go mq.send(amqp.Delivery{CorrelationId: "2"})
+	assert.Equal(suite.T(), "2", (<-deliveries).CorrelationId)
+
+	// deliveries is closed on shutdown
+	close(stopping)
+	assert.NoError(suite.T(), mq.CancelMessages())
+	_, ok := <-deliveries
+	assert.False(suite.T(), ok)
+	assert.NoError(suite.T(), <-result)
+
+	// the broker closing the consumer is an error
+	mq = &fakeConsumer{}
+	messages, _ = mq.GetMessages("verify")
+	deliveries = make(chan amqp.Delivery)
+	go func() { result <- consume(mq, "verify", messages, nil, make(chan struct{}), deliveries) }()
+	assert.NoError(suite.T(), mq.CancelMessages())
+	assert.EqualError(suite.T(), <-result, "the broker stopped delivering messages")
+}
+
+func (suite *TestSuite) TestVerifiedDeployment() {
+	c := verified{
+		User:     "user",
+		FilePath: "file.c4gh",
+		DecryptedChecksums: []checksums{
+			{"sha256", "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"},
+			{"md5", "7ac236b1a8dce2dac89e7cf45d2b48bd"},
+		},
+		Region: "eu-north-1",
+		Zone:   "eu-north-1a",
+	}
+
+	body, err := json.Marshal(&c)
+	assert.NoError(suite.T(), err)
+
+	var out map[string]interface{}
+	assert.NoError(suite.T(), json.Unmarshal(body, &out))
+	assert.Equal(suite.T(), "eu-north-1", out["region"])
+	assert.Equal(suite.T(), "eu-north-1a", out["zone"])
+
+	res, err := common.ValidateJSON("file://../../schemas/federated/ingestion-accession-request.json", body)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), res.Valid(), "verified message with region does not validate")
+
+	// left out when not configured
+	c.Region, c.Zone = "", ""
+	body, _ = json.Marshal(&c)
+	assert.NotContains(suite.T(), string(body), "region")
+}
+
+func (suite *TestSuite) TestVerifiedChecksums() {
+	data := []byte("some decrypted data")
+	validate := func(algorithms ...string) bool {
+		sums, err := computeChecksums(&database.FileInfo{}, bytes.NewReader(data), newFileHashes(nil, algorithms), nil, algorithms, nil)
+		assert.NoError(suite.T(), err)
+		body, _ := json.Marshal(&verified{User: "user", FilePath: "file.c4gh", DecryptedChecksums: sums})
+		res, err := common.ValidateJSON("file://../../schemas/federated/ingestion-accession-request.json", body)
+		assert.NoError(suite.T(), err)
+
+		return res.Valid()
+	}
+
+	assert.True(suite.T(), validate("sha256", "md5"))
+	assert.True(suite.T(), validate("md5", "sha512", "blake2b"))
+	// Central EGA requires the md5 checksum
+	assert.False(suite.T(), validate("sha256", "sha512"))
+}
+
+func (suite *TestSuite) TestVerifiedAuthoritative() {
+	c := verified{
+		User:     "user",
+		FilePath: "file.c4gh",
+		DecryptedChecksums: []checksums{
+			{"sha256", "82e4e60e7beb3db2e06a00a079788f7d71f75b61a4b75f28c4c942703dabb6d6"},
+			{"md5", "7ac236b1a8dce2dac89e7cf45d2b48bd"},
+		},
+		AuthoritativeChecksum: "md5",
+	}
+	assert.NoError(suite.T(), checkAuthoritative(c))
+
+	body, _ := json.Marshal(&c)
+	assert.Contains(suite.T(), string(body), `"authoritative_checksum":"md5"`)
+	res, err := common.ValidateJSON("file://../../schemas/federated/ingestion-accession-request.json", body)
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), res.Valid(), "verified message with authoritative checksum does not validate")
+
+	// the message is not sent without the authoritative checksum
+	c.AuthoritativeChecksum = "sha512"
+	assert.EqualError(suite.T(), checkAuthoritative(c), "authoritative checksum sha512 was not computed")
+
+	c.AuthoritativeChecksum = "crc32"
+	body, _ = json.Marshal(&c)
+	res, err = common.ValidateJSON("file://../../schemas/federated/ingestion-accession-request.json", body)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), res.Valid())
+}
+
+func (suite *TestSuite) TestNewCrypt4GHReader() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	devKey, err := config.GetC4GHKey()
+	assert.NoError(suite.T(), err)
+
+	_, other, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	data, err := os.ReadFile("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	r := bytes.NewReader(data)
+	header, err := headers.ReadHeader(r)
+	assert.NoError(suite.T(), err)
+	body, _ := io.ReadAll(r)
+
+	_, _, err = newCrypt4GHReader(header, bytes.NewReader(body), nil)
+	assert.EqualError(suite.T(), err, "no c4gh keys available")
+
+	_, _, err = newCrypt4GHReader(header, bytes.NewReader(body), []*[32]byte{&other})
+	assert.ErrorContains(suite.T(), err, "none of the 1 c4gh keys decrypts the header")
+
+	// the key that decrypts the file is found after a failed attempt,
+	// and the archive data is still intact for it
+	c4ghr, index, err := newCrypt4GHReader(header, bytes.NewReader(body), []*[32]byte{&other, devKey})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, index)
+
+	plain, err := io.ReadAll(c4ghr)
+	assert.NoError(suite.T(), err)
+	assert.NotEmpty(suite.T(), plain)
+}
+
+func (suite *TestSuite) TestValidateHeader() {
+	data, err := os.ReadFile("../../dev_utils/dummy_data.c4gh")
+	assert.NoError(suite.T(), err)
+	header, err := headers.ReadHeader(bytes.NewReader(data))
+	assert.NoError(suite.T(), err)
+
+	assert.NoError(suite.T(), validateHeader(header))
+
+	assert.EqualError(suite.T(), validateHeader(nil), "the stored header is empty")
+	assert.ErrorContains(suite.T(), validateHeader(make([]byte, database.MaxHeaderSize+1)), "more than the 65536 a header can plausibly be")
+	assert.ErrorContains(suite.T(), validateHeader([]byte("not a header")), "is not a crypt4gh header: not a Crypt4GH file")
+	assert.ErrorContains(suite.T(), validateHeader(header[:len(header)-10]), "is not a crypt4gh header")
+	assert.EqualError(suite.T(), validateHeader(data[:len(header)+3]),
+		fmt.Sprintf("the stored header has 3 bytes after the %d bytes of the crypt4gh header", len(header)))
+}
+
+// fakeProgress records the progress reported for a file
+type fakeProgress struct {
+	sync.Mutex
+	updates []int64
+	total   int64
+	cleared bool
+}
+
+func (f *fakeProgress) UpsertProgress(fileID int, bytesDone, totalBytes int64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.updates = append(f.updates, bytesDone)
+	f.total = totalBytes
+
+	return nil
+}
+
+func (f *fakeProgress) ClearProgress(fileID int) error {
+	f.Lock()
+	defer f.Unlock()
+	f.cleared = true
+
+	return nil
+}
+
+func (suite *TestSuite) TestReportProgress() {
+	store := &fakeProgress{}
+	p := &progressReader{reader: bytes.NewReader(make([]byte, 1024))}
+
+	stop := reportProgress(store, 42, 1024, p, time.Millisecond)
+	_, err := io.CopyN(io.Discard, p, 512)
+	assert.NoError(suite.T(), err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.Copy(io.Discard, p)
+	assert.NoError(suite.T(), err)
+	stop()
+
+	store.Lock()
+	defer store.Unlock()
+	assert.Equal(suite.T(), int64(0), store.updates[0], "progress not reported at start")
+	assert.Contains(suite.T(), store.updates, int64(512))
+	assert.Equal(suite.T(), int64(1024), store.total)
+	assert.True(suite.T(), store.cleared, "progress not cleared when done")
+
+	disabled := &fakeProgress{}
+	reportProgress(disabled, 42, 1024, p, 0)()
+	assert.Empty(suite.T(), disabled.updates)
+	assert.False(suite.T(), disabled.cleared)
+}
+
+// fakeErrorMarker records the files marked as failed
+type fakeErrorMarker struct {
+	failed  []int
+	reasons []string
+}
+
+func (f *fakeErrorMarker) MarkErrorContext(_ context.Context, fileID int, reason string) error {
+	f.failed = append(f.failed, fileID)
+	f.reasons = append(f.reasons, reason)
+
+	return nil
+}
+
+func (suite *TestSuite) TestFailureCategories() {
+	db := &fakeErrorMarker{}
+	markFailed(context.Background(), db, 42, categoryChecksum, "sha256 checksum mismatch")
+	markFailed(context.Background(), db, 42, "", "no category")
+	assert.Equal(suite.T(), []string{"CHECKSUM_MISMATCH: sha256 checksum mismatch", "no category"}, db.reasons)
+
+	// reading the archive file failing is told apart from decrypting it
+	// failing
+	read := &progressReader{reader: iotest.ErrReader(errors.New("connection reset"))}
+	_, _ = read.Read(make([]byte, 1))
+	assert.Equal(suite.T(), categoryStorage, decryptionCategory(read.classify(errors.New("connection reset"))))
+	assert.Equal(suite.T(), categoryDecryption, decryptionCategory((&progressReader{}).classify(errors.New("message authentication failed"))))
+}
+
+func (suite *TestSuite) TestComputeChecksums() {
+	data := []byte("some decrypted data")
+	algorithms := []string{"sha256", "md5"}
+
+	var file database.FileInfo
+	sums, err := computeChecksums(&file, bytes.NewReader(data), newFileHashes(nil, algorithms), make([]byte, 4), algorithms, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []checksums{
+		{"sha256", fmt.Sprintf("%x", sha256.Sum256(data))},
+		{"md5", fmt.Sprintf("%x", md5.Sum(data))}, // #nosec
+	}, sums)
+	assert.Equal(suite.T(), int64(len(data)), file.DecryptedSize)
+	assert.Equal(suite.T(), fmt.Sprintf("%x", sha256.Sum256(data)), fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)))
+	assert.NotNil(suite.T(), file.Checksum)
+
+	// a read error half way leaves no checksums to store
+	file = database.FileInfo{}
+	broken := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errors.New("connection reset")))
+	sums, err = computeChecksums(&file, broken, newFileHashes(nil, algorithms), make([]byte, 4), algorithms, nil)
+	assert.EqualError(suite.T(), err, "connection reset")
+	assert.Nil(suite.T(), sums)
+	assert.Nil(suite.T(), file.Checksum)
+	assert.Nil(suite.T(), file.DecryptedChecksum)
+	assert.Zero(suite.T(), file.DecryptedSize)
+
+	// the sha256 checksum is stored even when it isn't sent
+	file = database.FileInfo{}
+	algorithms = []string{"sha512", "blake2b"}
+	sums, err = computeChecksums(&file, bytes.NewReader(data), newFileHashes(nil, algorithms), nil, algorithms, nil)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []checksums{
+		{"sha512", fmt.Sprintf("%x", sha512.Sum512(data))},
+		{"blake2b", fmt.Sprintf("%x", blake2b.Sum512(data))},
+	}, sums)
+	assert.Equal(suite.T(), fmt.Sprintf("%x", sha256.Sum256(data)), fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)))
+}
+
+func (suite *TestSuite) TestIngestedHashes() {
+	header := []byte("crypt4gh header")
+	body := []byte("encrypted body")
+	ingested := append(append([]byte{}, header...), body...)
+	sha := fmt.Sprintf("%x", sha256.Sum256(ingested))
+	md := fmt.Sprintf("%x", md5.Sum(ingested)) // #nosec
+
+	hashes := func() ingestedHashes {
+		h := newIngestedHashes(header)
+		_, err := h.Write(body)
+		assert.NoError(suite.T(), err)
+
+		return h
+	}
+
+	compared, err := hashes().compare([]checksums{{"sha256", sha}})
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), compared)
+	compared, err = hashes().compare([]checksums{{"MD5", strings.ToUpper(md)}})
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), compared)
+
+	_, err = hashes().compare([]checksums{{"md5", md}, {"sha256", fmt.Sprintf("%x", sha256.Sum256(body))}})
+	assert.Error(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), sha)
+	var mismatch *checksumMismatch
+	if assert.ErrorAs(suite.T(), err, &mismatch) {
+		assert.Equal(suite.T(), "sha256", mismatch.algorithm)
+		assert.Equal(suite.T(), sha, mismatch.actual)
+	}
+
+	// checksums of other algorithms can't be compared
+	compared, err = hashes().compare([]checksums{{"sha512", "abc"}})
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), compared)
+	compared, err = hashes().compare(nil)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), compared)
+}
+
+// fakeMessageSender records the messages sent
+type fakeMessageSender struct {
+	routingKeys []string
+	bodies      [][]byte
+}
+
+func (f *fakeMessageSender) SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+	f.routingKeys = append(f.routingKeys, routingKey)
+	f.bodies = append(f.bodies, body)
+
+	return nil
+}
+
+func (suite *TestSuite) TestPublishMismatch() {
+	conf := &config.Config{}
+	conf.Verify.MismatchRoutingKey = "mismatch"
+	conf.Deployment.Service = "verify"
+	conf.Deployment.Hostname = "host"
+
+	sender := &fakeMessageSender{}
+	publishMismatch(sender, conf, mismatchEvent{
+		FileID:        42,
+		FilePath:      "dir/file.c4gh",
+		Kind:          mismatchEncrypted,
+		Algorithm:     "sha256",
+		Expected:      "abc",
+		Actual:        "def",
+		CorrelationID: "corr-id",
+	})
+	assert.Equal(suite.T(), []string{"mismatch"}, sender.routingKeys)
+
+	res, err := gojsonschema.Validate(gojsonschema.NewReferenceLoader("file://../../schemas/federated/checksum-mismatch.json"),
+		gojsonschema.NewBytesLoader(sender.bodies[0]))
+	assert.NoError(suite.T(), err)
+	assert.True(suite.T(), res.Valid(), "%v", res.Errors())
+
+	var event mismatchEvent
+	assert.NoError(suite.T(), json.Unmarshal(sender.bodies[0], &event))
+	assert.Equal(suite.T(), "verify@host", event.Service)
+	_, err = time.Parse(time.RFC3339, event.Timestamp)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TestSuite) TestKeyFingerprint() {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+
+	assert.Equal(suite.T(), fmt.Sprintf("%x", sha256.Sum256(publicKey[:])), keyFingerprint(&privateKey))
+}
+
+func (suite *TestSuite) TestCheckArchiveSize() {
+	assert.NoError(suite.T(), checkArchiveSize(2048, 2048, 0))
+	assert.NoError(suite.T(), checkArchiveSize(2048, 0, 0), "a size without a recorded one should not be checked")
+	assert.EqualError(suite.T(), checkArchiveSize(1024, 2048, 0), "archive file size 1024 is 1024 bytes short of the 2048 bytes recorded at ingestion")
+	assert.EqualError(suite.T(), checkArchiveSize(2050, 2048, 0), "archive file size 2050 is 2 bytes over the 2048 bytes recorded at ingestion")
+	assert.NoError(suite.T(), checkArchiveSize(2050, 2048, 2))
+	assert.NoError(suite.T(), checkArchiveSize(2046, 2048, 2))
+	assert.Error(suite.T(), checkArchiveSize(2045, 2048, 2))
+}
+
+func (suite *TestSuite) TestCheckDecryptedSize() {
+	assert.NoError(suite.T(), checkDecryptedSize(1024, 0))
+	assert.NoError(suite.T(), checkDecryptedSize(1024, 1024))
+	assert.EqualError(suite.T(), checkDecryptedSize(0, 0), "the decrypted file is empty")
+	assert.EqualError(suite.T(), checkDecryptedSize(0, 1024), "the decrypted file is empty")
+	assert.EqualError(suite.T(), checkDecryptedSize(1000, 1024), "decrypted size 1000 does not match the expected size 1024")
+}
+
+func (suite *TestSuite) TestPrefetchFor() {
+	assert.Equal(suite.T(), 0, prefetchFor(0, 1))
+	assert.Equal(suite.T(), 4, prefetchFor(0, 4))
+	assert.Equal(suite.T(), 10, prefetchFor(10, 4))
+	assert.Equal(suite.T(), 2, prefetchFor(2, 4))
+}
+
+func (suite *TestSuite) TestArchiveMissing() {
+	archive := storage.NewMemoryBackend(map[string][]byte{"archived": []byte("data")})
+	assert.False(suite.T(), archiveMissing(archive, "archived"))
+	assert.True(suite.T(), archiveMissing(archive, "missing"))
+
+	// an archive that can't be reached says nothing of the file
+	assert.False(suite.T(), archiveMissing(failingArchive{archive}, "missing"))
+}
+
+func (suite *TestSuite) TestRequeueAfter() {
+	delivered := &fakeDelivery{nacked: make(chan bool, 1)}
+	requeueAfter(context.Background(), delivered, 10*time.Millisecond)
+	select {
+	case <-delivered.nacked:
+		suite.T().Fatal("the message was requeued at once")
+	default:
+	}
+
+	select {
+	case requeue := <-delivered.nacked:
+		assert.True(suite.T(), requeue, "the message should be requeued")
+	case <-time.After(time.Second):
+		suite.T().Fatal("the message was not requeued")
+	}
+
+	// on shutdown the message is requeued without waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	requeueAfter(ctx, delivered, time.Hour)
+	cancel()
+	select {
+	case requeue := <-delivered.nacked:
+		assert.True(suite.T(), requeue, "the message should be requeued")
+	case <-time.After(time.Second):
+		suite.T().Fatal("the message was not requeued on shutdown")
+	}
+}
+
+func (suite *TestSuite) TestShutdown() {
+	// workers that finish within the grace period keep their work
+	var workers sync.WaitGroup
+	workers.Add(1)
+	cancelled := false
+	go func() {
+		defer workers.Done()
+		time.Sleep(10 * time.Millisecond)
+	}()
+	shutdown(&workers, func() { cancelled = true }, time.Second)
+	assert.False(suite.T(), cancelled, "work finishing in time should not be cancelled")
+
+	// others have it cancelled
+	work, cancelWork := context.WithCancel(context.Background())
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		<-work.Done()
+	}()
+	start := time.Now()
+	shutdown(&workers, cancelWork, 10*time.Millisecond)
+	assert.Error(suite.T(), work.Err())
+	assert.Less(suite.T(), time.Since(start), shutdownCancelWait)
+
+	// and are given up on if they don't stop
+	defer func(wait time.Duration) { shutdownCancelWait = wait }(shutdownCancelWait)
+	shutdownCancelWait = 10 * time.Millisecond
+	workers.Add(1)
+	shutdown(&workers, func() {}, 10*time.Millisecond)
+	workers.Done()
+}
+
+// fakeDelivery records how a message is nacked
+type fakeDelivery struct {
+	nacked chan bool
+}
+
+func (d *fakeDelivery) Nack(multiple, requeue bool) error {
+	d.nacked <- requeue
+
+	return nil
+}
+
+// fakeErrorSender records the errors sent to the error queue, with their
+// categories
+type fakeErrorSender struct {
+	errors     []string
+	categories []string
+	fail       bool
+	// republished are the routing keys messages were sent again to, with
+	// their headers
+	republished []string
+	headers     []amqp.Table
+	failPublish bool
+}
+
+func (f *fakeErrorSender) Republish(delivered *amqp.Delivery, exchange, routingKey string, headers amqp.Table) error {
+	if f.failPublish {
+		return errors.New("channel closed")
+	}
+	f.republished = append(f.republished, routingKey)
+	f.headers = append(f.headers, headers)
+
+	return nil
+}
+
+func (f *fakeErrorSender) SendCategorizedError(delivered *amqp.Delivery, conf broker.MQConf, category, errorMsg, reason string, originalMessage interface{}) error {
+	if f.fail {
+		return errors.New("channel closed")
+	}
+	f.errors = append(f.errors, errorMsg+": "+reason)
+	f.categories = append(f.categories, category)
+
+	return nil
+}
+
+// fakeAcknowledger records how a message is settled
+type fakeAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (suite *TestSuite) TestSettleFailure() {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	logger, hook := test.NewNullLogger()
+	entry := logger.WithField("corr-id", "corr-id-1")
+
+	mq := &fakeErrorSender{}
+	ack := &fakeAcknowledger{}
+	outcome := settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: ack}, &config.Config{}, categoryStorage, "Archive file missing", permanentError(errors.New("archive file 1/2 is missing")), nil)
+	assert.Equal(suite.T(), outcomeFailed, outcome)
+	assert.Equal(suite.T(), []string{"Archive file missing: archive file 1/2 is missing"}, mq.errors)
+	assert.Equal(suite.T(), []string{categoryStorage}, mq.categories)
+	assert.Equal(suite.T(), categoryStorage, hook.LastEntry().Data["category"])
+	assert.False(suite.T(), ack.acked)
+	assert.True(suite.T(), ack.nacked)
+	assert.False(suite.T(), ack.requeued)
+
+	// a message whose error can't be sent is still settled
+	mq = &fakeErrorSender{fail: true}
+	ack = &fakeAcknowledger{}
+	settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: ack}, &config.Config{}, categoryStorage, "Archive file missing", permanentError(errors.New("archive file 1/2 is missing")), nil)
+	assert.True(suite.T(), ack.nacked)
+	assert.False(suite.T(), ack.requeued)
+
+	// transient failures are retried, without an error
+	mq = &fakeErrorSender{}
+	nacked := &fakeDelivery{nacked: make(chan bool, 1)}
+	outcome = settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: deliveryAcknowledger{nacked}}, &config.Config{}, categoryStorage, "Failed to open archived file", transientError(errors.New("connection reset")), nil)
+	assert.Equal(suite.T(), outcomeRetried, outcome)
+	assert.Equal(suite.T(), "corr-id-1", hook.LastEntry().Data["corr-id"], "logged without the message's fields")
+	select {
+	case requeue := <-nacked.nacked:
+		assert.True(suite.T(), requeue, "the message should be requeued")
+	case <-time.After(time.Second):
+		suite.T().Fatal("the message was not requeued")
+	}
+	assert.Empty(suite.T(), mq.errors)
+}
+
+func (suite *TestSuite) TestSettleFailureAttempts() {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	conf := &config.Config{Broker: broker.MQConf{Queue: "archived", Exchange: "sda"}, Verify: config.VerifyConf{MaxAttempts: 3, QuarantineRoutingKey: "quarantine"}}
+	entry := log.NewEntry(log.StandardLogger())
+	failure := transientError(errors.New("connection reset"))
+
+	// a retried message goes back to its queue with the attempt counted
+	mq := &fakeErrorSender{}
+	acked := ackSignal(make(chan struct{}))
+	outcome := settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: acked, Headers: amqp.Table{attemptsHeader: int64(1)}}, conf, categoryStorage, "Failed to open archived file", failure, nil)
+	assert.Equal(suite.T(), outcomeRetried, outcome)
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		suite.T().Fatal("the retried message was not acked")
+	}
+	assert.Equal(suite.T(), []string{"archived"}, mq.republished)
+	assert.Equal(suite.T(), amqp.Table{attemptsHeader: int64(2)}, mq.headers[0])
+	assert.Empty(suite.T(), mq.errors)
+
+	// the last attempt quarantines the message, with a final error event
+	mq = &fakeErrorSender{}
+	ack := &fakeAcknowledger{}
+	outcome = settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{attemptsHeader: int32(2)}}, conf, categoryStorage, "Failed to open archived file", failure, nil)
+	assert.Equal(suite.T(), outcomeQuarantined, outcome)
+	assert.True(suite.T(), ack.acked)
+	assert.False(suite.T(), ack.nacked)
+	assert.Equal(suite.T(), []string{"quarantine"}, mq.republished)
+	assert.Equal(suite.T(), int64(3), mq.headers[0][attemptsHeader])
+	assert.Equal(suite.T(), "connection reset", mq.headers[0]["verify-reason"])
+	assert.Equal(suite.T(), categoryStorage, mq.headers[0]["verify-category"])
+	assert.Equal(suite.T(), []string{"Quarantined after 3 attempts: Failed to open archived file: connection reset"}, mq.errors)
+	assert.Equal(suite.T(), []string{categoryStorage}, mq.categories)
+
+	// a message that can't be quarantined is requeued as it is
+	mq = &fakeErrorSender{failPublish: true}
+	nacked := &fakeDelivery{nacked: make(chan bool, 1)}
+	outcome = settleFailure(context.Background(), entry, mq, &amqp.Delivery{Acknowledger: deliveryAcknowledger{nacked}, Headers: amqp.Table{attemptsHeader: int64(5)}}, conf, categoryStorage, "Failed to open archived file", failure, nil)
+	assert.Equal(suite.T(), outcomeRetried, outcome)
+	select {
+	case requeue := <-nacked.nacked:
+		assert.True(suite.T(), requeue)
+	case <-time.After(time.Second):
+		suite.T().Fatal("the message was not requeued")
+	}
+
+	// on shutdown the message is requeued without counting the attempt
+	mq = &fakeErrorSender{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	nacked = &fakeDelivery{nacked: make(chan bool, 1)}
+	settleFailure(ctx, entry, mq, &amqp.Delivery{Acknowledger: deliveryAcknowledger{nacked}}, conf, categoryStorage, "Failed to open archived file", failure, nil)
+	select {
+	case requeue := <-nacked.nacked:
+		assert.True(suite.T(), requeue)
+	case <-time.After(time.Second):
+		suite.T().Fatal("the message was not requeued")
+	}
+	assert.Empty(suite.T(), mq.republished)
+}
+
+func (suite *TestSuite) TestDeliveryAttempts() {
+	assert.Zero(suite.T(), deliveryAttempts(nil))
+	assert.Equal(suite.T(), int64(2), deliveryAttempts(amqp.Table{attemptsHeader: int64(2)}))
+	assert.Equal(suite.T(), int64(4), deliveryAttempts(amqp.Table{attemptsHeader: int64(2), "x-delivery-count": int32(4)}))
+	assert.Equal(suite.T(), int64(5), deliveryAttempts(amqp.Table{
+		"x-death": []interface{}{amqp.Table{"count": int64(5), "reason": "rejected"}, "not a table"},
+	}))
+	assert.Zero(suite.T(), deliveryAttempts(amqp.Table{attemptsHeader: "two"}))
+}
+
+// ackSignal is closed when the message is acked
+type ackSignal chan struct{}
+
+func (a ackSignal) Ack(tag uint64, multiple bool) error {
+	close(a)
+
+	return nil
+}
+
+func (a ackSignal) Nack(tag uint64, multiple, requeue bool) error {
+	return nil
+}
+
+func (a ackSignal) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+// deliveryAcknowledger settles a message through a fakeDelivery
+type deliveryAcknowledger struct {
+	*fakeDelivery
+}
+
+func (a deliveryAcknowledger) Ack(tag uint64, multiple bool) error {
+	return nil
+}
+
+func (a deliveryAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	return a.fakeDelivery.Nack(multiple, requeue)
+}
+
+func (a deliveryAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.fakeDelivery.Nack(false, requeue)
+}
+
+func (suite *TestSuite) TestIsTransient() {
+	for _, err := range []error{
+		transientError(errors.New("connection reset")),
+		context.Canceled,
+		fmt.Errorf("reading: %w", context.DeadlineExceeded),
+		amqp.ErrClosed,
+		&amqp.Error{Code: amqp.ChannelError, Reason: "channel closed"},
+		driver.ErrBadConn,
+		&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED},
+	} {
+		assert.True(suite.T(), isTransient(err), "%v should be transient", err)
+	}
+
+	for _, err := range []error{
+		permanentError(context.Canceled),
+		errors.New("validation failed"),
+		sql.ErrNoRows,
+		&json.SyntaxError{},
+		&pq.Error{Code: "23505"}, // unique_violation
+	} {
+		assert.False(suite.T(), isTransient(err), "%v should be permanent", err)
+	}
+}
+
+func (suite *TestSuite) TestArchiveError() {
+	archive := storage.NewMemoryBackend(map[string][]byte{"archived": []byte("data")})
+	err := archiveError(archive, "missing", errors.New("not found"))
+	assert.False(suite.T(), isTransient(err))
+	assert.EqualError(suite.T(), err, "archive file missing is missing")
+	assert.True(suite.T(), isTransient(archiveError(archive, "archived", errors.New("connection reset"))))
+}
+
+func (suite *TestSuite) TestProgressReaderClassify() {
+	p := &progressReader{reader: bytes.NewReader([]byte("data"))}
+	_, err := io.Copy(io.Discard, p)
+	assert.NoError(suite.T(), err)
+	assert.False(suite.T(), isTransient(p.classify(errors.New("bad data"))), "data that doesn't decrypt is no read failure")
+
+	p = &progressReader{reader: io.MultiReader(bytes.NewReader([]byte("data")), iotest.ErrReader(errors.New("connection reset")))}
+	_, err = io.Copy(io.Discard, p)
+	assert.Error(suite.T(), err)
+	assert.True(suite.T(), isTransient(p.classify(err)))
+
+	// a stream ending before the size of the archive file was cut short
+	p = &progressReader{reader: bytes.NewReader([]byte("data")), size: 10}
+	_, err = io.Copy(io.Discard, p)
+	assert.NoError(suite.T(), err)
+	assert.EqualError(suite.T(), p.err, "archive file ended after 4 of 10 bytes")
+	assert.True(suite.T(), isTransient(p.classify(io.ErrUnexpectedEOF)))
+
+	// a file cancelled on shutdown or at its timeout is verified again
+	p = &progressReader{reader: bytes.NewReader([]byte("data"))}
+	assert.True(suite.T(), isTransient(p.classify(fmt.Errorf("decrypting: %w", context.Canceled))))
+	assert.True(suite.T(), isTransient(p.classify(context.DeadlineExceeded)))
+}
+
+func (suite *TestSuite) TestSleepContext() {
+	assert.True(suite.T(), sleepContext(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(suite.T(), sleepContext(ctx, time.Hour))
+}
+
+// failingArchive fails to tell whether files exist
+type failingArchive struct {
+	storage.Backend
+}
+
+func (failingArchive) Exists(string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// fakeStatus returns a fixed file status
+type fakeStatus struct {
+	status string
+	err    error
+}
+
+func (f fakeStatus) GetFileStatusContext(ctx context.Context, fileID int) (string, error) {
+	return f.status, f.err
+}
+
+func (suite *TestSuite) TestSkipFile() {
+	ctx := context.Background()
+	skipped := func(db statusReader, reVerify bool) bool {
+		_, skip := skipFile(ctx, db, 42, reVerify)
+
+		return skip
+	}
+
+	assert.True(suite.T(), skipped(fakeStatus{status: "COMPLETED"}, false))
+	assert.False(suite.T(), skipped(fakeStatus{status: "COMPLETED"}, true), "completed file not re-verified")
+	assert.False(suite.T(), skipped(fakeStatus{status: "ARCHIVED"}, false))
+	assert.False(suite.T(), skipped(fakeStatus{status: "ERROR"}, false))
+	assert.True(suite.T(), skipped(fakeStatus{status: "REMOVED"}, false))
+	assert.True(suite.T(), skipped(fakeStatus{status: "REMOVED"}, true), "removed file re-verified")
+	assert.False(suite.T(), skipped(fakeStatus{err: errors.New("timeout")}, false), "a failed lookup should not skip the file")
+}
+
+// zeros is an endless stream of zeros, read a buffer at a time
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return len(b), nil
+}
+
+// BenchmarkComputeChecksums hashes a 2 GiB file through the default io.Copy
+// buffer size and through the default verify.copyBufferSize, run with
+// go test -run none -bench ComputeChecksums ./cmd/verify
+func BenchmarkComputeChecksums(b *testing.B) {
+	const size = 2 << 30
+
+	for _, bufSize := range []int{32 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("buffer-%dKiB", bufSize/1024), func(b *testing.B) {
+			buf := make([]byte, bufSize)
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				var file database.FileInfo
+				if _, err := computeChecksums(&file, io.LimitReader(zeros{}, size), newFileHashes(nil, []string{"sha256", "md5"}), buf, []string{"sha256", "md5"}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/xeipuuv/gojsonschema"
@@ -21,9 +22,11 @@ var logFatalf = log.Fatalf
 // The AMQPChannel interface gives access to the functions provided
 type AMQPChannel interface {
 	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
 	Confirm(noWait bool) error
 	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
 	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
 	Close() error
 	IsClosed() bool
 }
@@ -34,6 +37,9 @@ type AMQPBroker struct {
 	Channel      AMQPChannel
 	Conf         MQConf
 	confirmsChan <-chan amqp.Confirmation
+	// publishMu pairs each published message with its confirmation when
+	// messages are sent from several goroutines
+	publishMu sync.Mutex
 }
 
 // MQConf stores information about the message broker
@@ -41,7 +47,7 @@ type MQConf struct {
 	Host               string
 	Port               int
 	User               string
-	Password           string
+	Password           string `redact:"true"`
 	Vhost              string
 	Queue              string
 	Exchange           string
@@ -56,6 +62,9 @@ type MQConf struct {
 	ServerName         string
 	Durable            bool
 	SchemasPath        string
+	// PrefetchCount limits the number of unacknowledged messages delivered
+	// to the service, zero meaning no limit
+	PrefetchCount int
 }
 
 // InfoError struct for sending detailed error messages to analysis.
@@ -65,8 +74,14 @@ type InfoError struct {
 	Error           string      `json:"error"`
 	Reason          string      `json:"reason"`
 	OriginalMessage interface{} `json:"original-message"`
+	// Category of the failure, for errors to be filtered and routed by
+	Category string `json:"category,omitempty"`
 }
 
+// CategorySchemaInvalid is the category of the errors sent for messages
+// that aren't valid JSON or don't match their schema
+const CategorySchemaInvalid = "SCHEMA_INVALID"
+
 // NewMQ creates a new Broker that can communicate with a backend
 // amqp server.
 func NewMQ(config MQConf) (*AMQPBroker, error) {
@@ -110,6 +125,13 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 		}
 	}
 
+	if config.PrefetchCount > 0 {
+		// Set for the whole channel so that it can be changed while consuming
+		if err := Channel.Qos(config.PrefetchCount, 0, true); err != nil {
+			return nil, fmt.Errorf("failed to set prefetch count: %v", err)
+		}
+	}
+
 	if e := Channel.Confirm(false); e != nil {
 		fmt.Printf("channel could not be put into confirm mode: %s", e)
 		return nil, fmt.Errorf("channel could not be put into confirm mode: %s", e)
@@ -117,40 +139,94 @@ func NewMQ(config MQConf) (*AMQPBroker, error) {
 
 	confirms := Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
 
-	return &AMQPBroker{Connection, Channel, config, confirms}, nil
+	return &AMQPBroker{Connection: Connection, Channel: Channel, Conf: config, confirmsChan: confirms}, nil
 }
 
+// consumerTag identifies the consumer of GetMessages on the channel, so that
+// it can be cancelled
+const consumerTag = "sda-pipeline"
+
 // GetMessages reads messages from the queue
 func (broker *AMQPBroker) GetMessages(queue string) (<-chan amqp.Delivery, error) {
 	ch := broker.Channel
 	return ch.Consume(
-		queue, // queue
-		"",    // consumer
-		false, // auto-ack
-		false, // exclusive
-		false, // no-local
-		false, // no-wait
-		nil,   // args
+		queue,       // queue
+		consumerTag, // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
 	)
 }
 
-// SendMessage sends a message to RabbitMQ
+// CancelMessages stops the deliveries of GetMessages. The channel of
+// deliveries is closed once those already sent by the server have been
+// delivered, and messages left unacknowledged are requeued when the channel
+// is closed.
+func (broker *AMQPBroker) CancelMessages() error {
+	return broker.Channel.Cancel(consumerTag, false)
+}
+
+// SetPrefetch changes how many unacknowledged messages are delivered on the
+// channel, taking effect for the running consumer
+func (broker *AMQPBroker) SetPrefetch(count int) error {
+	if err := broker.Channel.Qos(count, 0, true); err != nil {
+		return err
+	}
+	broker.Conf.PrefetchCount = count
+
+	return nil
+}
+
+// SendMessage sends a message to RabbitMQ, and is safe to call from several
+// goroutines
 func (broker *AMQPBroker) SendMessage(corrID, exchange, routingKey string, reliable bool, body []byte) error {
+	return broker.publish(exchange, routingKey, amqp.Publishing{
+		Headers:         amqp.Table{},
+		ContentEncoding: "UTF-8",
+		ContentType:     "application/json",
+		DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
+		CorrelationId:   corrID,
+		Priority:        0, // 0-9
+		Body:            body,
+		// a bunch of application/implementation-specific fields
+	})
+}
+
+// Republish sends the body of a delivered message again, with its
+// correlation id and its headers with headers set, e.g. to put it back on
+// its queue with a count of attempts through the default exchange
+func (broker *AMQPBroker) Republish(delivered *amqp.Delivery, exchange, routingKey string, headers amqp.Table) error {
+	table := amqp.Table{}
+	for k, v := range delivered.Headers {
+		table[k] = v
+	}
+	for k, v := range headers {
+		table[k] = v
+	}
+
+	return broker.publish(exchange, routingKey, amqp.Publishing{
+		Headers:         table,
+		ContentEncoding: "UTF-8",
+		ContentType:     "application/json",
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   delivered.CorrelationId,
+		Body:            delivered.Body,
+	})
+}
+
+// publish sends msg and waits for it to be confirmed
+func (broker *AMQPBroker) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	broker.publishMu.Lock()
+	defer broker.publishMu.Unlock()
+
 	err := broker.Channel.Publish(
 		exchange,
 		routingKey,
 		false, // mandatory
 		false, // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentEncoding: "UTF-8",
-			ContentType:     "application/json",
-			DeliveryMode:    amqp.Persistent, // 1=non-persistent, 2=persistent
-			CorrelationId:   corrID,
-			Priority:        0, // 0-9
-			Body:            body,
-			// a bunch of application/implementation-specific fields
-		},
+		msg,
 	)
 	if err != nil {
 		return err
@@ -239,6 +315,27 @@ func (broker *AMQPBroker) ConnectionWatcher() *amqp.Error {
 	return amqpError
 }
 
+// SendError sends a message holding the error, the reason for it and the
+// original message to the error queue
+func (broker *AMQPBroker) SendError(delivered *amqp.Delivery, conf MQConf, errorMsg, reason string, originalMessage interface{}) error {
+	return broker.SendCategorizedError(delivered, conf, "", errorMsg, reason, originalMessage)
+}
+
+// SendCategorizedError sends message on error, with the category of the
+// failure
+func (broker *AMQPBroker) SendCategorizedError(delivered *amqp.Delivery, conf MQConf, category, errorMsg, reason string, originalMessage interface{}) error {
+	infoErrorMessage := InfoError{
+		Error:           errorMsg,
+		Reason:          reason,
+		OriginalMessage: originalMessage,
+		Category:        category,
+	}
+
+	body, _ := json.Marshal(infoErrorMessage)
+
+	return broker.SendMessage(delivered.CorrelationId, conf.Exchange, conf.RoutingError, conf.Durable, body)
+}
+
 // SendJSONError sends message on JSON error
 func (broker *AMQPBroker) SendJSONError(delivered *amqp.Delivery, originalBody []byte, conf MQConf, reason, errorMsg string) error {
 
@@ -246,6 +343,7 @@ func (broker *AMQPBroker) SendJSONError(delivered *amqp.Delivery, originalBody [
 		Error:           errorMsg,
 		Reason:          fmt.Sprintf("%v", reason),
 		OriginalMessage: string(originalBody),
+		Category:        CategorySchemaInvalid,
 	}
 
 	body, _ := json.Marshal(jsonErrorMessage)
@@ -341,10 +439,54 @@ func (broker *AMQPBroker) ValidateJSON(delivered *amqp.Delivery,
 	return err
 }
 
+// schemas holds the compiled schemas by reference, so that each is read and
+// parsed once rather than for every message
+var (
+	schemasMu sync.Mutex
+	schemas   = map[string]*gojsonschema.Schema{}
+)
+
+// compiledSchema returns the schema of the message type, compiling it the
+// first time it is asked for. A schema that fails to compile is tried again
+// the next time.
+func compiledSchema(messageType string, schemasPath string) (*gojsonschema.Schema, error) {
+	reference := schemasPath + "/" + messageType + ".json"
+
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	if schema, ok := schemas[reference]; ok {
+		return schema, nil
+	}
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader(reference))
+	if err != nil {
+		return nil, err
+	}
+	schemas[reference] = schema
+
+	return schema, nil
+}
+
+// LoadSchemas compiles the schemas of the message types, so that a service
+// fails at startup when one is missing or broken rather than on the first
+// message
+func (broker *AMQPBroker) LoadSchemas(messageTypes ...string) error {
+	for _, messageType := range messageTypes {
+		if _, err := compiledSchema(messageType, broker.Conf.SchemasPath); err != nil {
+			return fmt.Errorf("failed to load the %s schema: %v", messageType, err)
+		}
+	}
+
+	return nil
+}
+
 // validateJSON is a helper function for ValidateJson
 func validateJSON(messageType string, schemasPath string, body []byte) (*gojsonschema.Result, error) {
+	schema, err := compiledSchema(messageType, schemasPath)
+	if err != nil {
+		return nil, err
+	}
 
-	schema := gojsonschema.NewReferenceLoader(schemasPath + "/" + messageType + ".json")
-	res, err := gojsonschema.Validate(schema, gojsonschema.NewBytesLoader(body))
-	return res, err
+	return schema.Validate(gojsonschema.NewBytesLoader(body))
 }
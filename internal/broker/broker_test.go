@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	log "github.com/sirupsen/logrus"
@@ -32,13 +35,23 @@ func testLogFatalf(f string, args ...interface{}) {
 type mockChannel struct {
 	failConfirm    bool
 	failPublish    bool
+	failQos        bool
+	prefetch       int
 	confirmChannel chan amqp.Confirmation
+	published      []amqp.Publishing
+	cancelled      string
 }
 
 func (c *mockChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
 	return nil, fmt.Errorf("error")
 }
 
+func (c *mockChannel) Cancel(consumer string, noWait bool) error {
+	c.cancelled = consumer
+
+	return nil
+}
+
 func (c *mockChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
 	return amqp.Queue{}, fmt.Errorf("error")
 }
@@ -62,6 +75,7 @@ func (c *mockChannel) Publish(exchange, key string, mandatory, immediate bool, m
 	if c.failPublish {
 		return fmt.Errorf("failPublish")
 	}
+	c.published = append(c.published, msg)
 
 	ack := amqp.Confirmation{}
 	ack.DeliveryTag = 1
@@ -71,6 +85,15 @@ func (c *mockChannel) Publish(exchange, key string, mandatory, immediate bool, m
 	return nil
 }
 
+func (c *mockChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	if c.failQos {
+		return fmt.Errorf("failQos")
+	}
+	c.prefetch = prefetchCount
+
+	return nil
+}
+
 func (*mockChannel) Close() error {
 	return nil
 }
@@ -91,6 +114,14 @@ func TestGetMessages_Error(t *testing.T) {
 	assert.Error(t, err, "Must be an error")
 }
 
+func TestCancelMessages(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Channel: &c}
+
+	assert.NoError(t, b.CancelMessages())
+	assert.Equal(t, consumerTag, c.cancelled)
+}
+
 func TestSendMessage(t *testing.T) {
 	b := AMQPBroker{}
 	c := mockChannel{}
@@ -110,6 +141,48 @@ func TestSendMessage(t *testing.T) {
 
 }
 
+// slowConfirmChannel confirms a message a while after it is published, and
+// fails publishing while a confirmation is pending
+type slowConfirmChannel struct {
+	mockChannel
+	pending int32
+}
+
+func (c *slowConfirmChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirmChannel = make(chan amqp.Confirmation)
+
+	return c.confirmChannel
+}
+
+func (c *slowConfirmChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if !atomic.CompareAndSwapInt32(&c.pending, 0, 1) {
+		return fmt.Errorf("published before the previous message was confirmed")
+	}
+	go func() {
+		time.Sleep(time.Millisecond)
+		atomic.StoreInt32(&c.pending, 0)
+		c.confirmChannel <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	}()
+
+	return nil
+}
+
+func TestSendMessageConcurrent(t *testing.T) {
+	c := slowConfirmChannel{}
+	b := AMQPBroker{Channel: &c}
+	b.confirmsChan = b.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, b.SendMessage("corrID1", "exchange", "routingkey", true, []byte("Message")))
+		}()
+	}
+	wg.Wait()
+}
+
 var tMqconf = MQConf{"127.0.0.1",
 	6565,
 	"user",
@@ -127,7 +200,21 @@ var tMqconf = MQConf{"127.0.0.1",
 	"../../dev_utils/certs/client-key.pem",
 	"servername",
 	true,
-	"file://../../schemas/federated/"}
+	"file://../../schemas/federated/",
+	0}
+
+func TestSetPrefetch(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Channel: &c}
+
+	assert.NoError(t, b.SetPrefetch(10))
+	assert.Equal(t, 10, c.prefetch)
+	assert.Equal(t, 10, b.Conf.PrefetchCount)
+
+	c.failQos = true
+	assert.Error(t, b.SetPrefetch(20))
+	assert.Equal(t, 10, b.Conf.PrefetchCount)
+}
 
 func TestBuildMqURI(t *testing.T) {
 	amqps := buildMQURI("localhost", "user", "pass", "/vhost", 5555, true)
@@ -389,3 +476,72 @@ func TestSendJSONError(t *testing.T) {
 	err = b.SendJSONError(&msg, messageText, b.Conf, "some reason", "some error msg")
 	assert.Nil(t, err, "SendJSONError failed unexpectedly (string payload)")
 }
+
+func TestSendError(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Channel: &c, Conf: tMqconf}
+	b.confirmsChan = b.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	msg := amqp.Delivery{CorrelationId: "1"}
+	original := map[string]string{"filepath": "dummy.c4gh"}
+	assert.NoError(t, b.SendError(&msg, b.Conf, "some error msg", "some reason", original))
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, "1", c.published[0].CorrelationId)
+	assert.JSONEq(t, `{"error": "some error msg", "reason": "some reason", "original-message": {"filepath": "dummy.c4gh"}}`, string(c.published[0].Body))
+
+	c.failPublish = true
+	assert.Error(t, b.SendError(&msg, b.Conf, "some error msg", "some reason", original))
+}
+
+func TestSendCategorizedError(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Channel: &c, Conf: tMqconf}
+	b.confirmsChan = b.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	msg := amqp.Delivery{CorrelationId: "1", Body: []byte("{")}
+	original := map[string]string{"filepath": "dummy.c4gh"}
+	assert.NoError(t, b.SendCategorizedError(&msg, b.Conf, "CHECKSUM_MISMATCH", "some error msg", "some reason", original))
+	assert.JSONEq(t, `{"error": "some error msg", "reason": "some reason", "original-message": {"filepath": "dummy.c4gh"}, "category": "CHECKSUM_MISMATCH"}`, string(c.published[0].Body))
+
+	// messages failing validation are categorized as invalid
+	assert.NoError(t, b.SendJSONError(&msg, msg.Body, b.Conf, "some reason", "some error msg"))
+	var infoError InfoError
+	assert.NoError(t, json.Unmarshal(c.published[1].Body, &infoError))
+	assert.Equal(t, CategorySchemaInvalid, infoError.Category)
+}
+
+func TestRepublish(t *testing.T) {
+	c := mockChannel{}
+	b := AMQPBroker{Channel: &c, Conf: tMqconf}
+	b.confirmsChan = b.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	msg := amqp.Delivery{CorrelationId: "1", Body: []byte(`{"file_id": 42}`), Headers: amqp.Table{"verify-attempts": int64(1), "kept": "yes"}}
+	assert.NoError(t, b.Republish(&msg, "", "archived", amqp.Table{"verify-attempts": int64(2)}))
+	assert.Len(t, c.published, 1)
+	assert.Equal(t, "1", c.published[0].CorrelationId)
+	assert.Equal(t, msg.Body, c.published[0].Body)
+	assert.Equal(t, amqp.Table{"verify-attempts": int64(2), "kept": "yes"}, c.published[0].Headers)
+	assert.Equal(t, int64(1), msg.Headers["verify-attempts"], "the delivered message was changed")
+
+	c.failPublish = true
+	assert.Error(t, b.Republish(&msg, "", "archived", nil))
+}
+
+func TestLoadSchemas(t *testing.T) {
+	b := AMQPBroker{Conf: tMqconf}
+
+	assert.NoError(t, b.LoadSchemas("ingestion-verification", "ingestion-accession-request"))
+	assert.Contains(t, schemas, tMqconf.SchemasPath+"/ingestion-verification.json")
+
+	// the compiled schema is reused
+	schema := schemas[tMqconf.SchemasPath+"/ingestion-verification.json"]
+	res, err := validateJSON("ingestion-verification", tMqconf.SchemasPath, []byte(`{"user": "user"}`))
+	assert.NoError(t, err)
+	assert.False(t, res.Valid())
+	assert.Same(t, schema, schemas[tMqconf.SchemasPath+"/ingestion-verification.json"])
+
+	err = b.LoadSchemas("ingestion-verification", "no-such-message")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no-such-message")
+	assert.NotContains(t, schemas, tMqconf.SchemasPath+"/no-such-message.json")
+}
@@ -2,10 +2,15 @@
 package config
 
 import (
+	"bytes"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/neicnordic/crypt4gh/keys"
@@ -21,18 +26,82 @@ import (
 
 const POSIX = "posix"
 const S3 = "s3"
+const AZURE = "azure"
+const GCS = "gcs"
+const SFTP = "sftp"
+const HTTP = "http"
 
 var requiredConfVars []string
 
+// defaultConfigPaths are the locations searched for config.yaml, in order,
+// unless configFile points to a specific file
+var defaultConfigPaths = []string{".", "$HOME/.sda-pipeline", "/etc/sda-pipeline"}
+
+// secretConfVars are the settings that may instead be read from the file
+// named by the <KEY>_FILE environment variable, e.g. DB_PASSWORD_FILE, as
+// with Docker and Kubernetes secrets
+var secretConfVars = []string{
+	"broker.password", "db.password", "smtp.password", "c4gh.passphrase",
+	"archive.secretkey", "inbox.secretkey", "backup.secretkey", "output.secretkey",
+	"archive.accountkey", "inbox.accountkey", "backup.accountkey", "output.accountkey",
+	"archive.connectionstring", "inbox.connectionstring", "backup.connectionstring", "output.connectionstring",
+	"archive.password", "inbox.password", "backup.password", "output.password",
+	"archive.keypassphrase", "inbox.keypassphrase", "backup.keypassphrase", "output.keypassphrase",
+	"archive.sseckey", "inbox.sseckey", "backup.sseckey", "output.sseckey",
+	"archive.token", "inbox.token", "backup.token", "output.token",
+}
+
 // Config is a parent object for all the different configuration parts
 type Config struct {
-	Archive  storage.Conf
-	Broker   broker.MQConf
-	Inbox    storage.Conf
-	Backup   storage.Conf
-	Database database.DBConf
-	API      APIConf
-	Notify   SMTPConf
+	Archive    storage.Conf
+	Output     storage.Conf
+	Broker     broker.MQConf
+	Inbox      storage.Conf
+	Backup     storage.Conf
+	Database   database.DBConf
+	API        APIConf
+	Notify     SMTPConf
+	Verify     VerifyConf
+	Deployment DeploymentConf
+	C4GH       C4GHConf
+
+	reloadMu   sync.RWMutex
+	reloadable ReloadableConf
+}
+
+// C4GHConf stores settings for loading the c4gh private key
+type C4GHConf struct {
+	// LoadRetries is how many more times reading the key is attempted when
+	// it can't be read, e.g. while the key secret is still being mounted
+	LoadRetries int
+	// RetryDelay is the time to wait between attempts
+	RetryDelay time.Duration
+}
+
+// Errors returned when the c4gh private key can't be loaded, wrapping the
+// underlying error
+var (
+	ErrKeyNotFound   = errors.New("c4gh key file not found")
+	ErrKeyPassphrase = errors.New("wrong passphrase for c4gh key")
+	ErrKeyFormat     = errors.New("corrupt or unsupported c4gh key format")
+)
+
+// DeploymentConf describes where the service is running, and which service
+// instance it is
+type DeploymentConf struct {
+	Region   string
+	Zone     string
+	Service  string
+	Hostname string
+}
+
+// Identity names the service instance, as <service>@<hostname>
+func (d DeploymentConf) Identity() string {
+	if d.Hostname == "" {
+		return d.Service
+	}
+
+	return d.Service + "@" + d.Hostname
 }
 
 type APIConf struct {
@@ -44,6 +113,7 @@ type APIConf struct {
 	Session    SessionConfig
 	DB         *database.SQLdb
 	MQ         *broker.AMQPBroker
+	Archive    storage.Backend
 }
 
 type SessionConfig struct {
@@ -55,20 +125,113 @@ type SessionConfig struct {
 }
 
 type SMTPConf struct {
-	Password string
+	Password string `redact:"true"`
 	FromAddr string
 	Host     string
 	Port     int
 }
 
+// Behaviours for handling an archive file whose checksum differs from the
+// one recorded at ingestion
+const (
+	ArchiveDriftError  = "error"
+	ArchiveDriftUpdate = "update"
+	ArchiveDriftWarn   = "warn"
+)
+
+// Algorithms of the checksums of decrypted files
+const (
+	ChecksumMD5     = "md5"
+	ChecksumSHA256  = "sha256"
+	ChecksumSHA512  = "sha512"
+	ChecksumBLAKE2b = "blake2b"
+)
+
+// VerifyConf stores settings specific to the verify service
+type VerifyConf struct {
+	// ArchiveDrift selects how a re-verified archive file whose checksum no
+	// longer matches the stored one is handled (error, update or warn)
+	ArchiveDrift string
+	// MemoryHighWater is the heap size, in bytes, above which no new
+	// messages are consumed, zero disables the check
+	MemoryHighWater uint64
+	// MemoryLowWater is the heap size, in bytes, below which consuming
+	// messages is resumed
+	MemoryLowWater uint64
+	// Host and Port for the readiness endpoint, a zero port disables it
+	Host string
+	Port int
+	// ProgressInterval is how often the progress of the file being
+	// verified is written to the database, zero disables it
+	ProgressInterval time.Duration
+	// RestoreRetryDelay is how long to wait before verifying a file again
+	// whose archive file is being restored from an archive tier
+	RestoreRetryDelay time.Duration
+	// Workers is the number of messages verified at the same time
+	Workers int
+	// DecryptedChecksums are the algorithms of the checksums of the
+	// decrypted file sent in the verified message
+	DecryptedChecksums []string
+	// AuthoritativeChecksum is the one of the DecryptedChecksums marked in
+	// the verified message as the one accession is assigned by
+	AuthoritativeChecksum string
+	// ShutdownGracePeriod is how long the files being verified are given to
+	// finish on shutdown, before they are cancelled and their messages
+	// requeued
+	ShutdownGracePeriod time.Duration
+	// ReVerifyRoutingKey is the routing key of the results of re-verified
+	// files, kept apart from the verified messages that start accession
+	ReVerifyRoutingKey string
+	// MismatchRoutingKey is the routing key of the events published when a
+	// checksum of a verified file doesn't match the expected one
+	MismatchRoutingKey string
+	// CopyBufferSize is the size, in bytes, of the buffer the decrypted data
+	// is hashed through
+	CopyBufferSize int
+	// SkipCompleted acknowledges a message for a file already verified
+	// without decrypting it again, when what was recorded matches the message
+	SkipCompleted bool
+	// FileTimeout is how long verifying a file may take before it is
+	// cancelled and its message requeued, zero for no limit
+	FileTimeout time.Duration
+	// SizeTolerance is how many bytes the size of an archive file may
+	// differ from the size recorded at ingestion
+	SizeTolerance int64
+	// CheckpointInterval is how often the state of the hashes of the file
+	// being verified is saved, for verifying it to resume from if it is
+	// interrupted, zero disables it
+	CheckpointInterval time.Duration
+	// MaxConcurrentFiles limits the number of files verified at the same
+	// time, and MaxInFlightBytes the total size of their archive files,
+	// zero for no limit
+	MaxConcurrentFiles int
+	MaxInFlightBytes   int64
+	// ReaderRetries is how many times the archive file is opened again when
+	// reading its start fails before the decryption can begin
+	ReaderRetries int
+	// MaxAttempts is how many times a message that fails transiently is
+	// verified before it is quarantined, zero for no limit, and
+	// QuarantineRoutingKey where quarantined messages are sent
+	MaxAttempts          int
+	QuarantineRoutingKey string
+	// Batch is a file listing the ids of files to verify, or - for stdin,
+	// after which verify exits instead of consuming messages
+	Batch string
+}
+
 // NewConfig initializes and parses the config file and/or environment using
 // the viper library.
 func NewConfig(app string) (*Config, error) {
 	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
+	for _, p := range defaultConfigPaths {
+		viper.AddConfigPath(p)
+	}
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.SetConfigType("yaml")
+	if err := bindFlags(os.Args[1:]); err != nil {
+		return nil, fmt.Errorf("failed to parse command line: %v", err)
+	}
 	if viper.IsSet("configPath") {
 		configPath := viper.GetString("configPath")
 		splitPath := strings.Split(strings.TrimLeft(configPath, "/"), "/")
@@ -79,6 +242,8 @@ func NewConfig(app string) (*Config, error) {
 		viper.SetConfigFile(viper.GetString("configFile"))
 	}
 
+	viper.SetDefault("deployment.service", app)
+
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Infoln("No config file found, using ENVs only")
@@ -113,48 +278,74 @@ func NewConfig(app string) (*Config, error) {
 	}
 
 	if viper.GetString("archive.type") == S3 {
-		requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}...)
+		requiredConfVars = append(requiredConfVars, []string{"archive.url", "archive.bucket"}...)
 	} else if viper.GetString("archive.type") == POSIX {
 		requiredConfVars = append(requiredConfVars, []string{"archive.location"}...)
+	} else if viper.GetString("archive.type") == AZURE {
+		requiredConfVars = append(requiredConfVars, []string{"archive.container"}...)
+	} else if viper.GetString("archive.type") == GCS {
+		requiredConfVars = append(requiredConfVars, []string{"archive.bucket"}...)
+	} else if viper.GetString("archive.type") == SFTP {
+		requiredConfVars = append(requiredConfVars, []string{"archive.host", "archive.user"}...)
+	} else if viper.GetString("archive.type") == HTTP {
+		requiredConfVars = append(requiredConfVars, []string{"archive.url"}...)
 	}
 
 	if viper.GetString("inbox.type") == S3 {
-		requiredConfVars = append(requiredConfVars, []string{"inbox.url", "inbox.accesskey", "inbox.secretkey", "inbox.bucket"}...)
+		requiredConfVars = append(requiredConfVars, []string{"inbox.url", "inbox.bucket"}...)
 	} else if viper.GetString("inbox.type") == POSIX {
 		requiredConfVars = append(requiredConfVars, []string{"inbox.location"}...)
+	} else if viper.GetString("inbox.type") == AZURE {
+		requiredConfVars = append(requiredConfVars, []string{"inbox.container"}...)
+	} else if viper.GetString("inbox.type") == GCS {
+		requiredConfVars = append(requiredConfVars, []string{"inbox.bucket"}...)
+	} else if viper.GetString("inbox.type") == SFTP {
+		requiredConfVars = append(requiredConfVars, []string{"inbox.host", "inbox.user"}...)
+	} else if viper.GetString("inbox.type") == HTTP {
+		requiredConfVars = append(requiredConfVars, []string{"inbox.url"}...)
 	}
 
 	if viper.GetString("backup.type") == S3 {
-		requiredConfVars = append(requiredConfVars, []string{"backup.url", "backup.accesskey", "backup.secretkey", "backup.bucket"}...)
+		requiredConfVars = append(requiredConfVars, []string{"backup.url", "backup.bucket"}...)
 	} else if viper.GetString("backup.type") == POSIX {
 		requiredConfVars = append(requiredConfVars, []string{"backup.location"}...)
+	} else if viper.GetString("backup.type") == AZURE {
+		requiredConfVars = append(requiredConfVars, []string{"backup.container"}...)
+	} else if viper.GetString("backup.type") == GCS {
+		requiredConfVars = append(requiredConfVars, []string{"backup.bucket"}...)
+	} else if viper.GetString("backup.type") == SFTP {
+		requiredConfVars = append(requiredConfVars, []string{"backup.host", "backup.user"}...)
+	} else if viper.GetString("backup.type") == HTTP {
+		requiredConfVars = append(requiredConfVars, []string{"backup.url"}...)
 	}
 
-	for _, s := range requiredConfVars {
-		if !viper.IsSet(s) {
-			return nil, fmt.Errorf("%s not set", s)
-		}
+	if viper.GetString("output.type") == S3 {
+		requiredConfVars = append(requiredConfVars, []string{"output.url", "output.bucket"}...)
+	} else if viper.GetString("output.type") == POSIX {
+		requiredConfVars = append(requiredConfVars, []string{"output.location"}...)
+	} else if viper.GetString("output.type") == AZURE {
+		requiredConfVars = append(requiredConfVars, []string{"output.container"}...)
+	} else if viper.GetString("output.type") == GCS {
+		requiredConfVars = append(requiredConfVars, []string{"output.bucket"}...)
+	} else if viper.GetString("output.type") == SFTP {
+		requiredConfVars = append(requiredConfVars, []string{"output.host", "output.user"}...)
+	} else if viper.GetString("output.type") == HTTP {
+		requiredConfVars = append(requiredConfVars, []string{"output.url"}...)
 	}
 
-	if viper.IsSet("log.format") {
-		if viper.GetString("log.format") == "json" {
-			log.SetFormatter(&log.JSONFormatter{})
-			log.Info("The logs format is set to JSON")
-		}
+	if err := readSecretFiles(); err != nil {
+		return nil, err
 	}
 
-	if viper.IsSet("log.level") {
-		stringLevel := viper.GetString("log.level")
-		intLevel, err := log.ParseLevel(stringLevel)
-		if err != nil {
-			log.Printf("Log level '%s' not supported, setting to 'trace'", stringLevel)
-			intLevel = log.TraceLevel
-		}
-		log.SetLevel(intLevel)
-		log.Printf("Setting log level to '%s'", stringLevel)
+	if err := validate(app); err != nil {
+		return nil, err
+	}
+
+	c := &Config{reloadable: configReloadable()}
+	if err := applyLogSettings(c.reloadable); err != nil {
+		return nil, err
 	}
 
-	c := &Config{}
 	err := c.configBroker()
 	if err != nil {
 		return nil, err
@@ -168,66 +359,103 @@ func NewConfig(app string) (*Config, error) {
 			return nil, err
 		}
 
+		// the archive is only checked for readiness when configured
+		if viper.IsSet("archive.type") {
+			c.configArchive()
+		}
+
 		err = c.configAPI()
 		if err != nil {
 			return nil, err
 		}
-
-		return c, nil
 	case "ingest":
 		c.configInbox()
 		c.configArchive()
+		c.configOutput()
+		c.C4GH = configC4GH()
 
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
 	case "intercept":
-		return c, nil
 	case "verify":
 		c.configInbox()
 		c.configArchive()
+		c.C4GH = configC4GH()
 
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
+
+		err = c.configVerify()
+		if err != nil {
+			return nil, err
+		}
+
+		c.configDeployment()
 	case "finalize":
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
 	case "backup":
 		c.configArchive()
 		c.configBackup()
+		c.C4GH = configC4GH()
 
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
 	case "mapper":
 		err = c.configDatabase()
 		if err != nil {
 			return nil, err
 		}
-
-		return c, nil
 	case "notify":
 		c.configSMTP()
+	default:
+		return nil, fmt.Errorf("application '%s' doesn't exist", app)
+	}
 
-		return c, nil
+	log.Debugf("Loaded configuration: %+v", c.Redacted())
+
+	return c, nil
+}
+
+// readSecretFiles sets the secret settings that have a <KEY>_FILE variant in
+// the environment to the contents of the named file, without trailing
+// newlines
+func readSecretFiles() error {
+	for _, s := range secretConfVars {
+		env := strings.ToUpper(strings.ReplaceAll(s, ".", "_")) + "_FILE"
+		secretFile, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		secret, err := os.ReadFile(secretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from %s: %v", s, env, err)
+		}
+		viper.Set(s, strings.TrimRight(string(secret), "\r\n"))
 	}
 
-	return nil, fmt.Errorf("application '%s' doesn't exist", app)
+	return nil
 }
 
 // configSchemas configures the schemas to load depending on
-// the type IDs of connection Federated EGA or isolate (stand-alone)
+// the type IDs of connection Federated EGA or isolate (stand-alone),
+// unless an explicit schema.path is given
 func (c *Config) configSchemas() {
+	if viper.IsSet("schema.path") {
+		c.Broker.SchemasPath = "file://" + strings.TrimSuffix(strings.TrimPrefix(viper.GetString("schema.path"), "file://"), "/") + "/"
+
+		return
+	}
+
 	if viper.GetString("schema.type") == "federated" {
 		c.Broker.SchemasPath = "file://schemas/federated/"
 	} else {
@@ -241,20 +469,28 @@ func configS3Storage(prefix string) storage.S3Conf {
 	s3 := storage.S3Conf{}
 	// All these are required
 	s3.URL = viper.GetString(prefix + ".url")
+	s3.Bucket = viper.GetString(prefix + ".bucket")
+
+	// Without keys the credentials are taken from the AWS chain, such as
+	// the role of the service account or instance
 	s3.AccessKey = viper.GetString(prefix + ".accesskey")
 	s3.SecretKey = viper.GetString(prefix + ".secretkey")
-	s3.Bucket = viper.GetString(prefix + ".bucket")
+	s3.AssumeRoleARN = viper.GetString(prefix + ".assumerolearn")
 
 	// Defaults (move to viper?)
 
 	s3.Port = 443
 	s3.Region = "us-east-1"
-	s3.NonExistRetryTime = 2 * time.Minute
+	s3.ForcePathStyle = true
 
 	if viper.IsSet(prefix + ".port") {
 		s3.Port = viper.GetInt(prefix + ".port")
 	}
 
+	if viper.IsSet(prefix + ".forcepathstyle") {
+		s3.ForcePathStyle = viper.GetBool(prefix + ".forcepathstyle")
+	}
+
 	if viper.IsSet(prefix + ".region") {
 		s3.Region = viper.GetString(prefix + ".region")
 	}
@@ -263,6 +499,36 @@ func configS3Storage(prefix string) storage.S3Conf {
 		s3.Chunksize = viper.GetInt(prefix+".chunksize") * 1024 * 1024
 	}
 
+	if viper.IsSet(prefix + ".maxattempts") {
+		s3.MaxAttempts = viper.GetInt(prefix + ".maxattempts")
+	}
+
+	if viper.IsSet(prefix + ".downloadconcurrency") {
+		s3.DownloadConcurrency = viper.GetInt(prefix + ".downloadconcurrency")
+	}
+
+	if viper.IsSet(prefix + ".downloadchunksize") {
+		s3.DownloadChunksize = viper.GetInt(prefix+".downloadchunksize") * 1024 * 1024
+	}
+
+	s3.SSECKey = viper.GetString(prefix + ".sseckey")
+
+	if viper.IsSet(prefix + ".maxidleconns") {
+		s3.MaxIdleConns = viper.GetInt(prefix + ".maxidleconns")
+	}
+
+	if viper.IsSet(prefix + ".idleconntimeout") {
+		s3.IdleConnTimeout = viper.GetDuration(prefix + ".idleconntimeout")
+	}
+
+	s3.ConnectTimeout = viper.GetDuration(prefix + ".connecttimeout")
+	s3.ReadTimeout = viper.GetDuration(prefix + ".readtimeout")
+	s3.OperationTimeout = viper.GetDuration(prefix + ".operationtimeout")
+
+	s3.RestoreTier = viper.GetString(prefix + ".restoretier")
+	s3.RestoreDays = viper.GetInt(prefix + ".restoredays")
+	s3.RestoreWait = viper.GetDuration(prefix + ".restorewait")
+
 	if viper.IsSet(prefix + ".cacert") {
 		s3.Cacert = viper.GetString(prefix + ".cacert")
 	}
@@ -270,37 +536,146 @@ func configS3Storage(prefix string) storage.S3Conf {
 	return s3
 }
 
+// configAzureStorage populates and returns an AzureConf from the
+// configuration
+func configAzureStorage(prefix string) storage.AzureConf {
+	azure := storage.AzureConf{}
+	azure.Container = viper.GetString(prefix + ".container")
+	// Either a connection string, an account key or the managed identity
+	// of the host is used
+	azure.ConnectionString = viper.GetString(prefix + ".connectionstring")
+	azure.AccountName = viper.GetString(prefix + ".accountname")
+	azure.AccountKey = viper.GetString(prefix + ".accountkey")
+	azure.ClientID = viper.GetString(prefix + ".clientid")
+	azure.URL = viper.GetString(prefix + ".url")
+	azure.Prefix = viper.GetString(prefix + ".prefix")
+	azure.Cacert = viper.GetString(prefix + ".cacert")
+
+	if viper.IsSet(prefix + ".chunksize") {
+		azure.Chunksize = viper.GetInt(prefix+".chunksize") * 1024 * 1024
+	}
+
+	return azure
+}
+
+// configGCSStorage populates and returns a GCSConf from the configuration
+func configGCSStorage(prefix string) storage.GCSConf {
+	gcs := storage.GCSConf{}
+	gcs.Bucket = viper.GetString(prefix + ".bucket")
+	// The application default credentials are used unless a service
+	// account key is given
+	gcs.CredentialsFile = viper.GetString(prefix + ".credentialsfile")
+	gcs.URL = viper.GetString(prefix + ".url")
+	gcs.Prefix = viper.GetString(prefix + ".prefix")
+	gcs.Cacert = viper.GetString(prefix + ".cacert")
+
+	if viper.IsSet(prefix + ".chunksize") {
+		gcs.Chunksize = viper.GetInt(prefix+".chunksize") * 1024 * 1024
+	}
+
+	return gcs
+}
+
+// configSFTPStorage populates and returns an SFTPConf from the
+// configuration
+func configSFTPStorage(prefix string) storage.SFTPConf {
+	sftp := storage.SFTPConf{}
+	sftp.Host = viper.GetString(prefix + ".host")
+	sftp.Port = viper.GetInt(prefix + ".port")
+	sftp.User = viper.GetString(prefix + ".user")
+	// Either a private key, a password or both are used to log in
+	sftp.KeyFile = viper.GetString(prefix + ".keyfile")
+	sftp.KeyPassphrase = viper.GetString(prefix + ".keypassphrase")
+	sftp.Password = viper.GetString(prefix + ".password")
+	// The SHA256 fingerprint of the host key, not verified when empty
+	sftp.HostKey = viper.GetString(prefix + ".hostkey")
+	sftp.Location = viper.GetString(prefix + ".location")
+
+	return sftp
+}
+
+// configHTTPStorage populates and returns an HTTPConf from the
+// configuration under prefix
+func configHTTPStorage(prefix string) storage.HTTPConf {
+	http := storage.HTTPConf{}
+	http.URL = viper.GetString(prefix + ".url")
+	// The bearer token sent with the requests, none when empty
+	http.Token = viper.GetString(prefix + ".token")
+	http.Cacert = viper.GetString(prefix + ".cacert")
+
+	return http
+}
+
+// configStorage populates and returns a storage.Conf for the storage
+// configured under prefix, posix unless the type is s3, azure, gcs, sftp
+// or http
+func configStorage(prefix string) storage.Conf {
+	var conf storage.Conf
+	switch viper.GetString(prefix + ".type") {
+	case S3:
+		conf = storage.Conf{Type: S3, S3: configS3Storage(prefix)}
+	case AZURE:
+		conf = storage.Conf{Type: AZURE, Azure: configAzureStorage(prefix)}
+	case GCS:
+		conf = storage.Conf{Type: GCS, GCS: configGCSStorage(prefix)}
+	case SFTP:
+		conf = storage.Conf{Type: SFTP, SFTP: configSFTPStorage(prefix)}
+	case HTTP:
+		conf = storage.Conf{Type: HTTP, HTTP: configHTTPStorage(prefix)}
+	default:
+		conf = storage.Conf{Type: POSIX}
+		conf.Posix.Location = viper.GetString(prefix + ".location")
+		conf.Posix.FileMode = os.FileMode(viper.GetUint32(prefix + ".filemode"))
+		conf.Posix.DirMode = os.FileMode(viper.GetUint32(prefix + ".dirmode"))
+		conf.Posix.OperationTimeout = viper.GetDuration(prefix + ".operationtimeout")
+	}
+
+	if viper.IsSet(prefix + ".readbuffersize") {
+		conf.ReadBufferSize = int(viper.GetSizeInBytes(prefix + ".readbuffersize"))
+	}
+
+	if viper.IsSet(prefix + ".readratelimit") {
+		conf.ReadRateLimit = int64(viper.GetSizeInBytes(prefix + ".readratelimit"))
+	}
+
+	if viper.IsSet(prefix + ".sizecachettl") {
+		conf.SizeCacheTTL = viper.GetDuration(prefix + ".sizecachettl")
+	}
+
+	conf.Cache.Dir = viper.GetString(prefix + ".cache.dir")
+	if viper.IsSet(prefix + ".cache.maxsize") {
+		conf.Cache.MaxSize = viper.GetInt64(prefix+".cache.maxsize") * 1024 * 1024
+	}
+
+	return conf
+}
+
 // configArchive provides configuration for the archive storage
 func (c *Config) configArchive() {
-	if viper.GetString("archive.type") == S3 {
-		c.Archive.Type = S3
-		c.Archive.S3 = configS3Storage("archive")
-	} else {
-		c.Archive.Type = POSIX
-		c.Archive.Posix.Location = viper.GetString("archive.location")
+	c.Archive = configStorage("archive")
+}
+
+// configOutput provides configuration for the storage that archived files
+// are written to, which is the archive storage unless an output storage with
+// its own endpoint and credentials is configured
+func (c *Config) configOutput() {
+	if !viper.IsSet("output.type") {
+		c.Output = c.Archive
+
+		return
 	}
+
+	c.Output = configStorage("output")
 }
 
 // configInbox provides configuration for the inbox storage
 func (c *Config) configInbox() {
-	if viper.GetString("inbox.type") == S3 {
-		c.Inbox.Type = S3
-		c.Inbox.S3 = configS3Storage("inbox")
-	} else {
-		c.Inbox.Type = POSIX
-		c.Inbox.Posix.Location = viper.GetString("inbox.location")
-	}
+	c.Inbox = configStorage("inbox")
 }
 
 // configBackup provides configuration for the backup storage
 func (c *Config) configBackup() {
-	if viper.GetString("backup.type") == S3 {
-		c.Backup.Type = S3
-		c.Backup.S3 = configS3Storage("backup")
-	} else {
-		c.Backup.Type = POSIX
-		c.Backup.Posix.Location = viper.GetString("backup.location")
-	}
+	c.Backup = configStorage("backup")
 }
 
 // configBroker provides configuration for the message broker
@@ -320,6 +695,8 @@ func (c *Config) configBroker() error {
 		broker.RoutingKey = viper.GetString("broker.routingkey")
 	}
 
+	broker.PrefetchCount = viper.GetInt("broker.prefetchCount")
+
 	if viper.IsSet("broker.durable") {
 		broker.Durable = viper.GetBool("broker.durable")
 	}
@@ -372,13 +749,34 @@ func (c *Config) configDatabase() error {
 	db.Database = viper.GetString("db.database")
 	db.SslMode = viper.GetString("db.sslmode")
 
+	viper.SetDefault("db.maxOpenConns", 10)
+	viper.SetDefault("db.maxIdleConns", 2)
+	viper.SetDefault("db.connMaxLifetime", "30m")
+	db.MaxOpenConns = viper.GetInt("db.maxOpenConns")
+	db.MaxIdleConns = viper.GetInt("db.maxIdleConns")
+	db.ConnMaxLifetime = viper.GetDuration("db.connMaxLifetime")
+	db.StatementTimeout = viper.GetDuration("db.statementTimeout")
+
+	viper.SetDefault("db.headerCache.ttl", "10m")
+	db.HeaderCacheSize = viper.GetInt("db.headerCache.size")
+	db.HeaderCacheTTL = viper.GetDuration("db.headerCache.ttl")
+
 	// Optional settings
+	switch db.SslMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("db.sslMode '%s' is not one of disable, allow, prefer, require, verify-ca or verify-full", db.SslMode)
+	}
 	if db.SslMode == "verify-full" {
 		// Since verify-full is specified, these are required.
 		if !(viper.IsSet("db.clientCert") && viper.IsSet("db.clientKey")) {
 			return errors.New("when db.sslMode is set to verify-full both db.clientCert and db.clientKey are needed")
 		}
 	}
+	// The server certificate can't be verified without the root certificate
+	if strings.HasPrefix(db.SslMode, "verify-") && viper.GetString("db.cacert") == "" {
+		return fmt.Errorf("when db.sslMode is set to %s db.cacert, the root certificate, is needed", db.SslMode)
+	}
 	if viper.IsSet("db.clientKey") {
 		db.ClientKey = viper.GetString("db.clientKey")
 	}
@@ -388,6 +786,12 @@ func (c *Config) configDatabase() error {
 	if viper.IsSet("db.cacert") {
 		db.CACert = viper.GetString("db.cacert")
 	}
+	db.ReplicaHost = viper.GetString("db.replica.host")
+	db.ReplicaPort = viper.GetInt("db.replica.port")
+	db.RunMigrations = viper.GetBool("db.migrations.run")
+	db.MigrationsDryRun = viper.GetBool("db.migrations.dryRun")
+	db.ReconnectAttempts = viper.GetInt("db.reconnectAttempts")
+	db.Service = DeploymentConf{Service: viper.GetString("deployment.service"), Hostname: hostname()}.Identity()
 
 	c.Database = db
 	return nil
@@ -425,6 +829,236 @@ func (c *Config) apiDefaults() {
 	viper.SetDefault("api.session.name", "api_session_key")
 }
 
+// configVerify provides configuration for the verify service
+func (c *Config) configVerify() error {
+	viper.SetDefault("verify.archiveDrift", ArchiveDriftError)
+
+	verify := VerifyConf{}
+	verify.ArchiveDrift = strings.ToLower(viper.GetString("verify.archiveDrift"))
+
+	switch verify.ArchiveDrift {
+	case ArchiveDriftError, ArchiveDriftUpdate, ArchiveDriftWarn:
+	default:
+		return fmt.Errorf("verify.archiveDrift '%s' not supported, use one of %s, %s or %s",
+			verify.ArchiveDrift, ArchiveDriftError, ArchiveDriftUpdate, ArchiveDriftWarn)
+	}
+
+	// Memory limits are given in MB
+	verify.MemoryHighWater = viper.GetUint64("verify.memoryHighWater") * 1024 * 1024
+	verify.MemoryLowWater = verify.MemoryHighWater / 10 * 8
+	if viper.IsSet("verify.memoryLowWater") {
+		verify.MemoryLowWater = viper.GetUint64("verify.memoryLowWater") * 1024 * 1024
+	}
+	if verify.MemoryHighWater != 0 && verify.MemoryLowWater >= verify.MemoryHighWater {
+		return errors.New("verify.memoryLowWater must be lower than verify.memoryHighWater")
+	}
+
+	viper.SetDefault("verify.host", "0.0.0.0")
+	verify.Host = viper.GetString("verify.host")
+	verify.Port = viper.GetInt("verify.port")
+
+	viper.SetDefault("verify.progressInterval", 5*time.Second)
+	verify.ProgressInterval = viper.GetDuration("verify.progressInterval")
+
+	viper.SetDefault("verify.restoreRetryDelay", 10*time.Minute)
+	verify.RestoreRetryDelay = viper.GetDuration("verify.restoreRetryDelay")
+
+	viper.SetDefault("verify.workers", 1)
+	verify.Workers = viper.GetInt("verify.workers")
+	if verify.Workers < 1 {
+		return errors.New("verify.workers must be at least 1")
+	}
+
+	viper.SetDefault("verify.shutdownGracePeriod", 20*time.Second)
+	verify.ShutdownGracePeriod = viper.GetDuration("verify.shutdownGracePeriod")
+
+	viper.SetDefault("verify.reVerifyRoutingKey", "reverified")
+	verify.ReVerifyRoutingKey = viper.GetString("verify.reVerifyRoutingKey")
+	if verify.ReVerifyRoutingKey == "" {
+		return errors.New("verify.reVerifyRoutingKey must not be empty")
+	}
+
+	viper.SetDefault("verify.mismatchRoutingKey", "mismatch")
+	verify.MismatchRoutingKey = viper.GetString("verify.mismatchRoutingKey")
+	if verify.MismatchRoutingKey == "" {
+		return errors.New("verify.mismatchRoutingKey must not be empty")
+	}
+
+	viper.SetDefault("verify.copyBufferSize", "4MB")
+	verify.CopyBufferSize = int(viper.GetSizeInBytes("verify.copyBufferSize"))
+	if verify.CopyBufferSize <= 0 {
+		return errors.New("verify.copyBufferSize must be a positive size, e.g. 4MB")
+	}
+
+	viper.SetDefault("verify.skipCompleted", true)
+	verify.SkipCompleted = viper.GetBool("verify.skipCompleted")
+
+	verify.FileTimeout = viper.GetDuration("verify.fileTimeout")
+	if verify.FileTimeout < 0 {
+		return errors.New("verify.fileTimeout must not be negative")
+	}
+
+	verify.SizeTolerance = int64(viper.GetSizeInBytes("verify.sizeTolerance"))
+
+	verify.CheckpointInterval = viper.GetDuration("verify.checkpointInterval")
+	if verify.CheckpointInterval < 0 {
+		return errors.New("verify.checkpointInterval must not be negative")
+	}
+
+	verify.MaxConcurrentFiles = viper.GetInt("verify.maxConcurrentFiles")
+	if verify.MaxConcurrentFiles < 0 {
+		return errors.New("verify.maxConcurrentFiles must not be negative")
+	}
+	verify.MaxInFlightBytes = int64(viper.GetSizeInBytes("verify.maxInFlightBytes"))
+
+	viper.SetDefault("verify.readerRetries", 3)
+	verify.ReaderRetries = viper.GetInt("verify.readerRetries")
+	if verify.ReaderRetries < 0 {
+		return errors.New("verify.readerRetries must not be negative")
+	}
+
+	verify.MaxAttempts = viper.GetInt("verify.maxAttempts")
+	if verify.MaxAttempts < 0 {
+		return errors.New("verify.maxAttempts must not be negative")
+	}
+	viper.SetDefault("verify.quarantineRoutingKey", "quarantine")
+	verify.QuarantineRoutingKey = viper.GetString("verify.quarantineRoutingKey")
+	if verify.QuarantineRoutingKey == "" {
+		return errors.New("verify.quarantineRoutingKey must not be empty")
+	}
+
+	verify.Batch = viper.GetString("verify.batch")
+
+	// A list in the config file, or separated by commas in the environment
+	viper.SetDefault("verify.decryptedChecksums", []string{ChecksumSHA256, ChecksumMD5})
+	seen := map[string]bool{}
+	for _, names := range viper.GetStringSlice("verify.decryptedChecksums") {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			switch name {
+			case "":
+				continue
+			case ChecksumMD5, ChecksumSHA256, ChecksumSHA512, ChecksumBLAKE2b:
+			default:
+				return fmt.Errorf("verify.decryptedChecksums '%s' not supported, use %s, %s, %s or %s",
+					name, ChecksumMD5, ChecksumSHA256, ChecksumSHA512, ChecksumBLAKE2b)
+			}
+			if !seen[name] {
+				seen[name] = true
+				verify.DecryptedChecksums = append(verify.DecryptedChecksums, name)
+			}
+		}
+	}
+	if len(verify.DecryptedChecksums) == 0 {
+		return errors.New("verify.decryptedChecksums must name at least one algorithm")
+	}
+	viper.SetDefault("verify.authoritativeChecksum", ChecksumSHA256)
+	verify.AuthoritativeChecksum = strings.ToLower(strings.TrimSpace(viper.GetString("verify.authoritativeChecksum")))
+	if !seen[verify.AuthoritativeChecksum] {
+		return fmt.Errorf("verify.authoritativeChecksum '%s' is not one of verify.decryptedChecksums %v",
+			verify.AuthoritativeChecksum, verify.DecryptedChecksums)
+	}
+
+	c.Verify = verify
+
+	return nil
+}
+
+// Cloud metadata endpoints used to detect the region and zone, variables to
+// ease testing
+var (
+	awsMetadataURL = "http://169.254.169.254/latest"
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+)
+
+// configDeployment provides the service name and the hostname of the
+// instance, as well as the region and zone the service runs in, either from
+// the configuration or, when deployment.detect is set, from the cloud
+// provider's instance metadata
+func (c *Config) configDeployment() {
+	c.Deployment.Service = viper.GetString("deployment.service")
+	c.Deployment.Hostname = hostname()
+
+	c.Deployment.Region = viper.GetString("deployment.region")
+	c.Deployment.Zone = viper.GetString("deployment.zone")
+
+	if !viper.GetBool("deployment.detect") || (c.Deployment.Region != "" && c.Deployment.Zone != "") {
+		return
+	}
+
+	region, zone, err := detectDeployment(&http.Client{Timeout: 2 * time.Second})
+	if err != nil {
+		log.Warnf("Failed to detect deployment region and zone: %v", err)
+
+		return
+	}
+
+	if c.Deployment.Region == "" {
+		c.Deployment.Region = region
+	}
+	if c.Deployment.Zone == "" {
+		c.Deployment.Zone = zone
+	}
+	log.Infof("Detected deployment region: %s, zone: %s", region, zone)
+}
+
+// hostname returns the hostname of the instance, or nothing if it can't be
+// found
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Failed to get the hostname: %v", err)
+	}
+
+	return name
+}
+
+// detectDeployment asks the AWS and GCP instance metadata services for the
+// availability zone and derives the region from it
+func detectDeployment(client *http.Client) (string, string, error) {
+	// AWS, IMDSv2 requires a session token
+	req, _ := http.NewRequest(http.MethodPut, awsMetadataURL+"/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if token, err := metadataGet(client, req); err == nil {
+		req, _ = http.NewRequest(http.MethodGet, awsMetadataURL+"/meta-data/placement/availability-zone", nil)
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		if zone, err := metadataGet(client, req); err == nil && len(zone) > 1 {
+			return zone[:len(zone)-1], zone, nil
+		}
+	}
+
+	// GCP, returns projects/<number>/zones/<zone>
+	req, _ = http.NewRequest(http.MethodGet, gcpMetadataURL+"/instance/zone", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	zone, err := metadataGet(client, req)
+	if err != nil {
+		return "", "", errors.New("no cloud metadata service available")
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i], zone, nil
+	}
+
+	return "", zone, nil
+}
+
+// metadataGet performs a metadata request and returns the response body
+func metadataGet(client *http.Client, req *http.Request) (string, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request failed: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	return strings.TrimSpace(string(body)), err
+}
+
 // configNotify provides configuration for the backup storage
 func (c *Config) configSMTP() {
 	c.Notify = SMTPConf{}
@@ -434,24 +1068,187 @@ func (c *Config) configSMTP() {
 	c.Notify.FromAddr = viper.GetString("smtp.from")
 }
 
-// GetC4GHKey reads and decrypts and returns the c4gh key
+// configC4GH provides the settings for loading the c4gh private key
+func configC4GH() C4GHConf {
+	viper.SetDefault("c4gh.retryDelay", 5*time.Second)
+
+	return C4GHConf{
+		LoadRetries: viper.GetInt("c4gh.loadRetries"),
+		RetryDelay:  viper.GetDuration("c4gh.retryDelay"),
+	}
+}
+
+// GetC4GHKey reads and decrypts and returns the c4gh key. The key is read
+// from c4gh.filepath unless c4gh.source is set to vault, in which case the
+// fetched key is kept in memory for c4gh.vault.ttl (forever if unset).
+// Reading the key is retried c4gh.loadRetries times before giving up.
+// Errors wrap ErrKeyNotFound, ErrKeyPassphrase or ErrKeyFormat when the
+// cause is known.
 func GetC4GHKey() (*[32]byte, error) {
-	keyPath := viper.GetString("c4gh.filepath")
-	passphrase := viper.GetString("c4gh.passphrase")
+	source, ttl, err := c4ghKeySource()
+	if err != nil {
+		return nil, err
+	}
 
-	// Make sure the key path and passphrase is valid
-	keyFile, err := os.Open(keyPath)
+	return fetchC4GHKey(source, ttl, configC4GH())
+}
+
+// fetchC4GHKey returns the key of source. A key from vault is cached for
+// ttl, zero meaning forever. When fetching it again fails the cached key is
+// kept, and fetching is tried again after conf.RetryDelay.
+func fetchC4GHKey(source keySource, ttl time.Duration, conf C4GHConf) (*[32]byte, error) {
+	if _, remote := source.(*vaultKeySource); !remote {
+		return loadC4GHKey(source, conf)
+	}
+
+	cachedKey.Lock()
+	defer cachedKey.Unlock()
+
+	if cachedKey.key != nil {
+		if ttl == 0 || time.Since(cachedKey.fetchedAt) < ttl || time.Since(cachedKey.failedAt) < conf.RetryDelay {
+			return cachedKey.key, nil
+		}
+
+		keyPEM, passphrase, err := source.fetch()
+		var key *[32]byte
+		if err == nil {
+			key, err = parseC4GHKey(keyPEM, passphrase)
+		}
+		if err != nil {
+			log.Warnf("Failed to fetch the c4gh key again, keeping the current key: %v", err)
+			cachedKey.failedAt = time.Now()
+
+			return cachedKey.key, nil
+		}
+		cachedKey.key, cachedKey.fetchedAt = key, time.Now()
+
+		return key, nil
+	}
+
+	key, err := loadC4GHKey(source, conf)
 	if err != nil {
 		return nil, err
 	}
+	cachedKey.key, cachedKey.fetchedAt = key, time.Now()
 
-	key, err := keys.ReadPrivateKey(keyFile, []byte(passphrase))
+	return key, nil
+}
+
+// loadC4GHKey reads and decrypts the key of source, retrying
+// conf.LoadRetries times
+func loadC4GHKey(source keySource, conf C4GHConf) (*[32]byte, error) {
+	keyPEM, passphrase, err := source.fetch()
+	for i := 1; err != nil && i <= conf.LoadRetries; i++ {
+		log.Warnf("Failed to read c4gh key, retrying in %v (attempt %d of %d): %v", conf.RetryDelay, i, conf.LoadRetries, err)
+		time.Sleep(conf.RetryDelay)
+		keyPEM, passphrase, err = source.fetch()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	keyFile.Close()
-	return &key, nil
+	return parseC4GHKey(keyPEM, passphrase)
+}
+
+// parseC4GHKey decrypts a PEM encoded c4gh private key, telling a wrong
+// passphrase apart from a key that can't be parsed at all
+func parseC4GHKey(keyPEM, passphrase []byte) (*[32]byte, error) {
+	// crypt4gh doesn't check that the input is PEM encoded
+	if block, _ := pem.Decode(keyPEM); block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found", ErrKeyFormat)
+	}
+
+	key, err := keys.ReadPrivateKey(bytes.NewReader(keyPEM), passphrase)
+	switch {
+	case err == nil:
+		return &key, nil
+	case strings.Contains(err.Error(), "message authentication failed"):
+		return nil, fmt.Errorf("%w: %v", ErrKeyPassphrase, err)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrKeyFormat, err)
+	}
+}
+
+// GetC4GHKeys returns the configured c4gh private keys in order of
+// preference: the current key from GetC4GHKey followed by the keys listed in
+// c4gh.previousKeys, so that files encrypted before a key rotation can still
+// be decrypted.
+func GetC4GHKeys() ([]*[32]byte, error) {
+	keyring, err := NewC4GHKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring.Keys(), nil
+}
+
+// C4GHKeyring holds the configured c4gh private keys for services that
+// decrypt files while running. A key read from vault is fetched again once
+// c4gh.vault.ttl has passed, so that a key rotated in vault is used without
+// a restart. The configuration is only read by NewC4GHKeyring.
+type C4GHKeyring struct {
+	source   keySource
+	ttl      time.Duration
+	conf     C4GHConf
+	current  *[32]byte
+	previous []*[32]byte
+}
+
+// NewC4GHKeyring loads the current key, as GetC4GHKey does, and the keys
+// listed in c4gh.previousKeys
+func NewC4GHKeyring() (*C4GHKeyring, error) {
+	source, ttl, err := c4ghKeySource()
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &C4GHKeyring{source: source, ttl: ttl, conf: configC4GH()}
+	if keyring.current, err = fetchC4GHKey(source, ttl, keyring.conf); err != nil {
+		return nil, err
+	}
+
+	var previous []struct {
+		FilePath   string
+		Passphrase string
+	}
+	if err := viper.UnmarshalKey("c4gh.previousKeys", &previous); err != nil {
+		return nil, fmt.Errorf("c4gh.previousKeys: %v", err)
+	}
+
+	for i, p := range previous {
+		keyPEM, passphrase, err := fileKeySource{path: p.FilePath, passphrase: p.Passphrase}.fetch()
+		if err != nil {
+			return nil, fmt.Errorf("c4gh.previousKeys[%d]: %w", i, err)
+		}
+
+		key, err := parseC4GHKey(keyPEM, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("c4gh.previousKeys[%d]: %w", i, err)
+		}
+		keyring.previous = append(keyring.previous, key)
+	}
+
+	return keyring, nil
+}
+
+// Key returns the current key, fetched again from vault once the ttl has
+// passed. The key fetched before is kept while vault can't be reached.
+func (k *C4GHKeyring) Key() *[32]byte {
+	if _, remote := k.source.(*vaultKeySource); !remote {
+		return k.current
+	}
+
+	// fetchC4GHKey only fails when there is no cached key to fall back on
+	if key, err := fetchC4GHKey(k.source, k.ttl, k.conf); err == nil {
+		return key
+	}
+
+	return k.current
+}
+
+// Keys returns the current key followed by the previous keys
+func (k *C4GHKeyring) Keys() []*[32]byte {
+	return append([]*[32]byte{k.Key()}, k.previous...)
 }
 
 // GetC4GHPublicKey reads the c4gh public key
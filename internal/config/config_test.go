@@ -1,12 +1,26 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"sda-pipeline/internal/storage"
+
+	"github.com/neicnordic/crypt4gh/keys"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -31,6 +45,47 @@ func (suite *TestSuite) SetupTest() {
 	viper.Set("db.user", "test")
 	viper.Set("db.password", "test")
 	viper.Set("db.database", "test")
+	viper.Set("archive.location", "/archive")
+	viper.Set("inbox.location", "/inbox")
+	viper.Set("backup.location", "/backup")
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+}
+
+// testCertificate returns the paths to a self signed certificate and its
+// key, for settings that must point to valid TLS files
+func (suite *TestSuite) testCertificate() (string, string) {
+	dir := suite.T().TempDir()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(suite.T(), err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	assert.NoError(suite.T(), err)
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	assert.NoError(suite.T(), err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(suite.T(), os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(suite.T(), os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+// testFile returns the path to an empty file, for settings that must point
+// to an existing file
+func (suite *TestSuite) testFile() string {
+	f := filepath.Join(suite.T().TempDir(), "test")
+	assert.NoError(suite.T(), os.WriteFile(f, nil, 0600))
+
+	return f
 }
 
 func (suite *TestSuite) TearDownTest() {
@@ -50,12 +105,128 @@ func (suite *TestSuite) TestConfigFile() {
 	assert.Equal(suite.T(), "test", viper.ConfigFileUsed())
 }
 
+func (suite *TestSuite) TestConfigFileYAML() {
+	viper.Reset()
+	confFile := filepath.Join(suite.T().TempDir(), "config.yaml")
+	yaml := []byte(`
+broker:
+  host: "file"
+  port: 5672
+  user: "file"
+  password: "file"
+  queue: "file"
+  routingKey: "file"
+db:
+  host: "file"
+  port: 5432
+  user: "file"
+  password: "file"
+  database: "file"
+archive:
+  type: "posix"
+  location: "/archive"
+c4gh:
+  filepath: "../../dev_utils/c4gh.sec.pem"
+schema:
+  path: "/schemas/custom"
+`)
+	assert.NoError(suite.T(), os.WriteFile(confFile, yaml, 0600))
+
+	suite.T().Setenv("CONFIGFILE", confFile)
+	suite.T().Setenv("DB_HOST", "env")
+
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), confFile, viper.ConfigFileUsed())
+	assert.Equal(suite.T(), "file", config.Broker.Host)
+	assert.Equal(suite.T(), 5672, config.Broker.Port)
+	assert.Equal(suite.T(), "file", config.Broker.RoutingKey)
+	assert.Equal(suite.T(), "env", config.Database.Host)
+	assert.Equal(suite.T(), 5432, config.Database.Port)
+	assert.Equal(suite.T(), "/archive", config.Archive.Posix.Location)
+	assert.Equal(suite.T(), "file:///schemas/custom/", config.Broker.SchemasPath)
+
+	// required values missing from both file and env are all reported by name
+	yaml = []byte(`
+broker:
+  host: "file"
+`)
+	assert.NoError(suite.T(), os.WriteFile(confFile, yaml, 0600))
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "11 configuration errors: broker.port not set; broker.user not set; "+
+		"broker.password not set; broker.queue not set; broker.routingkey not set; db.port not set; db.user not set; "+
+		"db.password not set; db.database not set; archive.location not set; c4gh.filepath not set")
+}
+
+func (suite *TestSuite) TestValidate() {
+	assert.NoError(suite.T(), validate("verify"))
+
+	viper.Set("broker.port", "amqp")
+	viper.Set("db.clientCert", "/doesnotexist")
+	viper.Set("api.serverKey", suite.testFile())
+	viper.Set("c4gh.source", "vault")
+	err := validate("verify")
+	assert.Len(suite.T(), err, 6)
+	assert.EqualError(suite.T(), err, "6 configuration errors: c4gh.vault.address not set; c4gh.vault.path not set; "+
+		"broker.port must be a number, got 'amqp'; db.clientCert and db.clientKey must both be set or both be empty; "+
+		"api.serverCert and api.serverKey must both be set or both be empty; db.clientCert: file '/doesnotexist' does not exist")
+
+	// only the key is checked for services that don't decrypt files
+	viper.Set("broker.port", 5672)
+	viper.Set("db.clientCert", nil)
+	viper.Set("api.serverKey", nil)
+	assert.NoError(suite.T(), validate("mapper"))
+}
+
+func (suite *TestSuite) TestSecretFiles() {
+	dir := suite.T().TempDir()
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "db"), []byte("db secret\n"), 0600))
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "mq"), []byte("mq secret\r\n"), 0600))
+
+	suite.T().Setenv("DB_PASSWORD_FILE", filepath.Join(dir, "db"))
+	suite.T().Setenv("BROKER_PASSWORD_FILE", filepath.Join(dir, "mq"))
+	suite.T().Setenv("BROKER_PASSWORD", "plain")
+
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "db secret", config.Database.Password)
+	assert.Equal(suite.T(), "mq secret", config.Broker.Password)
+
+	suite.T().Setenv("C4GH_PASSPHRASE_FILE", filepath.Join(dir, "missing"))
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.ErrorContains(suite.T(), err, "failed to read c4gh.passphrase from C4GH_PASSPHRASE_FILE")
+}
+
+func (suite *TestSuite) TestValidateTLS() {
+	cert, key := suite.testCertificate()
+	otherCert, _ := suite.testCertificate()
+
+	viper.Set("api.serverCert", cert)
+	viper.Set("api.serverKey", key)
+	viper.Set("broker.cacert", cert)
+	assert.Empty(suite.T(), validateTLS())
+
+	viper.Set("db.clientCert", otherCert)
+	viper.Set("db.clientKey", key)
+	viper.Set("broker.cacert", key)
+	assert.Equal(suite.T(), []string{
+		"db.clientCert and db.clientKey are not a valid certificate and key pair: tls: private key does not match public key",
+		fmt.Sprintf("broker.cacert: no certificates found in '%s'", key),
+	}, validateTLS())
+
+	config, err := NewConfig("mapper")
+	assert.Nil(suite.T(), config)
+	assert.ErrorContains(suite.T(), err, "db.clientCert and db.clientKey are not a valid certificate and key pair")
+}
+
 func (suite *TestSuite) TestNonExistingApplication() {
 	expectedError := errors.New("application 'test' doesn't exist")
 	config, err := NewConfig("test")
 	assert.Nil(suite.T(), config)
 	if assert.Error(suite.T(), err) {
-		assert.Equal(suite.T(), expectedError, err)
+		assert.EqualError(suite.T(), err, expectedError.Error())
 	}
 }
 
@@ -67,7 +238,7 @@ func (suite *TestSuite) TestMissingRequiredConfVar() {
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -79,14 +250,14 @@ func (suite *TestSuite) TestMissingRequiredArchiveS3ConfVar() {
 	viper.Set("archive.accesskey", "test")
 	viper.Set("archive.secretkey", "test")
 	viper.Set("archive.bucket", "test")
-	for _, requiredConfVar := range append([]string{"archive.url", "archive.accesskey", "archive.secretkey", "archive.bucket"}, requiredConfVars...) {
+	for _, requiredConfVar := range append([]string{"archive.url", "archive.bucket"}, requiredConfVars...) {
 		requiredConfVarValue := viper.Get(requiredConfVar)
 		viper.Set(requiredConfVar, nil)
 		expectedError := fmt.Errorf("%s not set", requiredConfVar)
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -102,7 +273,7 @@ func (suite *TestSuite) TestMissingRequiredArchivePosixConfVar() {
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -114,14 +285,14 @@ func (suite *TestSuite) TestMissingRequiredBackupS3ConfVar() {
 	viper.Set("backup.accesskey", "test")
 	viper.Set("backup.secretkey", "test")
 	viper.Set("backup.bucket", "test")
-	for _, requiredConfVar := range append([]string{"backup.url", "backup.accesskey", "backup.secretkey", "backup.bucket"}, requiredConfVars...) {
+	for _, requiredConfVar := range append([]string{"backup.url", "backup.bucket"}, requiredConfVars...) {
 		requiredConfVarValue := viper.Get(requiredConfVar)
 		viper.Set(requiredConfVar, nil)
 		expectedError := fmt.Errorf("%s not set", requiredConfVar)
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -137,7 +308,7 @@ func (suite *TestSuite) TestMissingRequiredBackupPosixConfVar() {
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -149,14 +320,14 @@ func (suite *TestSuite) TestMissingRequiredInboxS3ConfVar() {
 	viper.Set("inbox.accesskey", "test")
 	viper.Set("inbox.secretkey", "test")
 	viper.Set("inbox.bucket", "test")
-	for _, requiredConfVar := range append([]string{"inbox.url", "inbox.accesskey", "inbox.secretkey", "inbox.bucket"}, requiredConfVars...) {
+	for _, requiredConfVar := range append([]string{"inbox.url", "inbox.bucket"}, requiredConfVars...) {
 		requiredConfVarValue := viper.Get(requiredConfVar)
 		viper.Set(requiredConfVar, nil)
 		expectedError := fmt.Errorf("%s not set", requiredConfVar)
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
@@ -172,13 +343,14 @@ func (suite *TestSuite) TestMissingRequiredInboxPosixConfVar() {
 		config, err := NewConfig("test")
 		assert.Nil(suite.T(), config)
 		if assert.Error(suite.T(), err) {
-			assert.Equal(suite.T(), expectedError, err)
+			assert.EqualError(suite.T(), err, expectedError.Error())
 		}
 		viper.Set(requiredConfVar, requiredConfVarValue)
 	}
 }
 
 func (suite *TestSuite) TestConfigS3Storage() {
+	testCert, _ := suite.testCertificate()
 	viper.Set("archive.type", S3)
 	viper.Set("archive.url", "test")
 	viper.Set("archive.accesskey", "test")
@@ -187,7 +359,20 @@ func (suite *TestSuite) TestConfigS3Storage() {
 	viper.Set("archive.port", 123)
 	viper.Set("archive.region", "test")
 	viper.Set("archive.chunksize", 123)
-	viper.Set("archive.cacert", "test")
+	viper.Set("archive.cacert", testCert)
+	viper.Set("archive.maxattempts", 7)
+	viper.Set("archive.sseckey", "c2VjcmV0")
+	viper.Set("archive.maxidleconns", 50)
+	viper.Set("archive.idleconntimeout", "2m")
+	viper.Set("archive.downloadconcurrency", 4)
+	viper.Set("archive.downloadchunksize", 32)
+	viper.Set("archive.forcepathstyle", false)
+	viper.Set("archive.connecttimeout", "5s")
+	viper.Set("archive.readtimeout", "30s")
+	viper.Set("archive.operationtimeout", "1m")
+	viper.Set("archive.restoretier", "Bulk")
+	viper.Set("archive.restoredays", 3)
+	viper.Set("archive.restorewait", "5m")
 	viper.Set("inbox.type", S3)
 	viper.Set("inbox.url", "test")
 	viper.Set("inbox.accesskey", "test")
@@ -196,7 +381,7 @@ func (suite *TestSuite) TestConfigS3Storage() {
 	viper.Set("inbox.port", 123)
 	viper.Set("inbox.region", "test")
 	viper.Set("inbox.chunksize", 123)
-	viper.Set("inbox.cacert", "test")
+	viper.Set("inbox.cacert", testCert)
 	config, err := NewConfig("ingest")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
@@ -210,7 +395,7 @@ func (suite *TestSuite) TestConfigS3Storage() {
 	assert.Equal(suite.T(), 123, config.Inbox.S3.Port)
 	assert.Equal(suite.T(), "test", config.Inbox.S3.Region)
 	assert.Equal(suite.T(), 128974848, config.Inbox.S3.Chunksize)
-	assert.Equal(suite.T(), "test", config.Inbox.S3.Cacert)
+	assert.Equal(suite.T(), testCert, config.Inbox.S3.Cacert)
 	assert.NotNil(suite.T(), config.Archive)
 	assert.NotNil(suite.T(), config.Archive.S3)
 	assert.Equal(suite.T(), S3, config.Archive.Type)
@@ -221,10 +406,198 @@ func (suite *TestSuite) TestConfigS3Storage() {
 	assert.Equal(suite.T(), 123, config.Archive.S3.Port)
 	assert.Equal(suite.T(), "test", config.Archive.S3.Region)
 	assert.Equal(suite.T(), 128974848, config.Archive.S3.Chunksize)
-	assert.Equal(suite.T(), "test", config.Archive.S3.Cacert)
+	assert.Equal(suite.T(), testCert, config.Archive.S3.Cacert)
+	assert.Equal(suite.T(), 7, config.Archive.S3.MaxAttempts)
+	assert.Equal(suite.T(), "c2VjcmV0", config.Archive.S3.SSECKey)
+	assert.Equal(suite.T(), 50, config.Archive.S3.MaxIdleConns)
+	assert.Equal(suite.T(), 2*time.Minute, config.Archive.S3.IdleConnTimeout)
+	assert.Equal(suite.T(), 4, config.Archive.S3.DownloadConcurrency)
+	assert.Equal(suite.T(), 32*1024*1024, config.Archive.S3.DownloadChunksize)
+	assert.Equal(suite.T(), 0, config.Inbox.S3.MaxAttempts)
+	assert.False(suite.T(), config.Archive.S3.ForcePathStyle)
+	assert.True(suite.T(), config.Inbox.S3.ForcePathStyle, "path style should be the default")
+	assert.Equal(suite.T(), 5*time.Second, config.Archive.S3.ConnectTimeout)
+	assert.Equal(suite.T(), 30*time.Second, config.Archive.S3.ReadTimeout)
+	assert.Equal(suite.T(), time.Minute, config.Archive.S3.OperationTimeout)
+	assert.Zero(suite.T(), config.Inbox.S3.OperationTimeout, "there should be no timeout by default")
+	assert.Equal(suite.T(), "Bulk", config.Archive.S3.RestoreTier)
+	assert.Equal(suite.T(), 3, config.Archive.S3.RestoreDays)
+	assert.Equal(suite.T(), 5*time.Minute, config.Archive.S3.RestoreWait)
+}
+
+func (suite *TestSuite) TestConfigS3StorageRole() {
+	viper.Set("archive.type", S3)
+	viper.Set("archive.url", "test")
+	viper.Set("archive.bucket", "test")
+	viper.Set("archive.assumerolearn", "arn:aws:iam::123456789012:role/archive")
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err, "keys should not be required")
+	assert.Empty(suite.T(), config.Archive.S3.AccessKey)
+	assert.Empty(suite.T(), config.Archive.S3.SecretKey)
+	assert.Equal(suite.T(), "arn:aws:iam::123456789012:role/archive", config.Archive.S3.AssumeRoleARN)
+}
+
+func (suite *TestSuite) TestConfigAzureStorage() {
+	viper.Set("archive.type", AZURE)
+	viper.Set("archive.container", "archive")
+	viper.Set("archive.connectionstring", "AccountName=test;AccountKey=dGVzdA==")
+	viper.Set("archive.prefix", "sda")
+	viper.Set("archive.chunksize", 4)
+	viper.Set("inbox.type", AZURE)
+	viper.Set("inbox.container", "inbox")
+	viper.Set("inbox.accountname", "test")
+	viper.Set("inbox.clientid", "client")
+	viper.Set("inbox.url", "https://test.blob.core.windows.net")
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), AZURE, config.Archive.Type)
+	assert.Equal(suite.T(), "archive", config.Archive.Azure.Container)
+	assert.Equal(suite.T(), "AccountName=test;AccountKey=dGVzdA==", config.Archive.Azure.ConnectionString)
+	assert.Equal(suite.T(), "sda", config.Archive.Azure.Prefix)
+	assert.Equal(suite.T(), 4194304, config.Archive.Azure.Chunksize)
+	assert.Equal(suite.T(), AZURE, config.Inbox.Type)
+	assert.Equal(suite.T(), "inbox", config.Inbox.Azure.Container)
+	assert.Equal(suite.T(), "test", config.Inbox.Azure.AccountName)
+	assert.Equal(suite.T(), "client", config.Inbox.Azure.ClientID)
+	assert.Equal(suite.T(), "https://test.blob.core.windows.net", config.Inbox.Azure.URL)
+
+	viper.Set("archive.container", nil)
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "archive.container not set")
+}
+
+func (suite *TestSuite) TestConfigGCSStorage() {
+	viper.Set("archive.type", GCS)
+	viper.Set("archive.bucket", "archive")
+	viper.Set("archive.prefix", "sda")
+	viper.Set("archive.credentialsfile", "/etc/sda/gcs.json")
+	viper.Set("archive.chunksize", 16)
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), GCS, config.Archive.Type)
+	assert.Equal(suite.T(), "archive", config.Archive.GCS.Bucket)
+	assert.Equal(suite.T(), "sda", config.Archive.GCS.Prefix)
+	assert.Equal(suite.T(), "/etc/sda/gcs.json", config.Archive.GCS.CredentialsFile)
+	assert.Equal(suite.T(), 16777216, config.Archive.GCS.Chunksize)
+
+	viper.Set("archive.bucket", nil)
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "archive.bucket not set")
+}
+
+func (suite *TestSuite) TestConfigSFTPStorage() {
+	viper.Set("archive.type", SFTP)
+	viper.Set("archive.host", "sftp.example.org")
+	viper.Set("archive.port", 2222)
+	viper.Set("archive.user", "sda")
+	viper.Set("archive.keyfile", "/etc/sda/id_ed25519")
+	viper.Set("archive.hostkey", "SHA256:abc")
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), SFTP, config.Archive.Type)
+	assert.Equal(suite.T(), "sftp.example.org", config.Archive.SFTP.Host)
+	assert.Equal(suite.T(), 2222, config.Archive.SFTP.Port)
+	assert.Equal(suite.T(), "sda", config.Archive.SFTP.User)
+	assert.Equal(suite.T(), "/etc/sda/id_ed25519", config.Archive.SFTP.KeyFile)
+	assert.Equal(suite.T(), "SHA256:abc", config.Archive.SFTP.HostKey)
+	assert.Equal(suite.T(), "/archive", config.Archive.SFTP.Location)
+
+	viper.Set("archive.user", nil)
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "archive.user not set")
+}
+
+func (suite *TestSuite) TestConfigHTTPStorage() {
+	viper.Set("archive.type", HTTP)
+	viper.Set("archive.url", "https://data.example.org/reference")
+	viper.Set("archive.token", "secret")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), HTTP, config.Archive.Type)
+	assert.Equal(suite.T(), "https://data.example.org/reference", config.Archive.HTTP.URL)
+	assert.Equal(suite.T(), "secret", config.Archive.HTTP.Token)
+
+	viper.Set("archive.url", nil)
+	_, err = NewConfig("verify")
+	assert.EqualError(suite.T(), err, "archive.url not set")
+}
+
+func (suite *TestSuite) TestConfigPosixStorage() {
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), POSIX, config.Archive.Type)
+	assert.Equal(suite.T(), "/archive", config.Archive.Posix.Location)
+	assert.Zero(suite.T(), config.Archive.Posix.FileMode)
+
+	viper.Set("archive.filemode", "0600")
+	viper.Set("archive.dirmode", "0750")
+	viper.Set("archive.operationtimeout", "10s")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), os.FileMode(0600), config.Archive.Posix.FileMode)
+	assert.Equal(suite.T(), os.FileMode(0750), config.Archive.Posix.DirMode)
+	assert.Equal(suite.T(), 10*time.Second, config.Archive.Posix.OperationTimeout)
+}
+
+func (suite *TestSuite) TestConfigReadBufferSize() {
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), storage.DefaultReadBufferSize, config.Archive.BufferSize())
+
+	viper.Set("archive.readbuffersize", "4MB")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4*1024*1024, config.Archive.BufferSize())
+}
+
+func (suite *TestSuite) TestConfigReadRateLimit() {
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), config.Archive.ReadRateLimit)
+
+	viper.Set("archive.readratelimit", "50MB")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(50*1024*1024), config.Archive.ReadRateLimit)
+}
+
+func (suite *TestSuite) TestConfigSizeCacheTTL() {
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), config.Archive.SizeCacheTTL)
+
+	viper.Set("archive.sizecachettl", "30s")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 30*time.Second, config.Archive.SizeCacheTTL)
+}
+
+func (suite *TestSuite) TestConfigStorageCache() {
+	viper.Set("archive.location", "/archive")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Empty(suite.T(), config.Archive.Cache.Dir)
+
+	viper.Set("archive.type", S3)
+	viper.Set("archive.url", "test")
+	viper.Set("archive.accesskey", "test")
+	viper.Set("archive.secretkey", "test")
+	viper.Set("archive.bucket", "test")
+	viper.Set("archive.cache.dir", "/cache")
+	viper.Set("archive.cache.maxsize", 2048)
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "/cache", config.Archive.Cache.Dir)
+	assert.Equal(suite.T(), int64(2048*1024*1024), config.Archive.Cache.MaxSize)
 }
 
 func (suite *TestSuite) TestConfigBackupS3Storage() {
+	testCert, _ := suite.testCertificate()
 	viper.Set("archive.type", S3)
 	viper.Set("archive.url", "test")
 	viper.Set("archive.accesskey", "test")
@@ -233,7 +606,7 @@ func (suite *TestSuite) TestConfigBackupS3Storage() {
 	viper.Set("archive.port", 123)
 	viper.Set("archive.region", "test")
 	viper.Set("archive.chunksize", 123)
-	viper.Set("archive.cacert", "test")
+	viper.Set("archive.cacert", testCert)
 	viper.Set("backup.type", S3)
 	viper.Set("backup.url", "test")
 	viper.Set("backup.accesskey", "test")
@@ -242,7 +615,7 @@ func (suite *TestSuite) TestConfigBackupS3Storage() {
 	viper.Set("backup.port", 123)
 	viper.Set("backup.region", "test")
 	viper.Set("backup.chunksize", 123)
-	viper.Set("backup.cacert", "test")
+	viper.Set("backup.cacert", testCert)
 	config, err := NewConfig("backup")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
@@ -256,7 +629,7 @@ func (suite *TestSuite) TestConfigBackupS3Storage() {
 	assert.Equal(suite.T(), 123, config.Archive.S3.Port)
 	assert.Equal(suite.T(), "test", config.Archive.S3.Region)
 	assert.Equal(suite.T(), 128974848, config.Archive.S3.Chunksize)
-	assert.Equal(suite.T(), "test", config.Archive.S3.Cacert)
+	assert.Equal(suite.T(), testCert, config.Archive.S3.Cacert)
 	assert.NotNil(suite.T(), config.Backup)
 	assert.NotNil(suite.T(), config.Backup.S3)
 	assert.Equal(suite.T(), S3, config.Backup.Type)
@@ -267,10 +640,11 @@ func (suite *TestSuite) TestConfigBackupS3Storage() {
 	assert.Equal(suite.T(), 123, config.Backup.S3.Port)
 	assert.Equal(suite.T(), "test", config.Backup.S3.Region)
 	assert.Equal(suite.T(), 128974848, config.Backup.S3.Chunksize)
-	assert.Equal(suite.T(), "test", config.Backup.S3.Cacert)
+	assert.Equal(suite.T(), testCert, config.Backup.S3.Cacert)
 }
 
 func (suite *TestSuite) TestConfigBroker() {
+	testCert, testKey := suite.testCertificate()
 	viper.Set("broker.durable", true)
 	viper.Set("broker.routingerror", "test")
 	viper.Set("broker.vhost", "test")
@@ -278,9 +652,9 @@ func (suite *TestSuite) TestConfigBroker() {
 	viper.Set("broker.verifyPeer", true)
 	_, err := NewConfig("ingest")
 	assert.Error(suite.T(), err, "Error expected")
-	viper.Set("broker.clientCert", "test")
-	viper.Set("broker.clientKey", "test")
-	viper.Set("broker.cacert", "test")
+	viper.Set("broker.clientCert", testCert)
+	viper.Set("broker.clientKey", testKey)
+	viper.Set("broker.cacert", testCert)
 	config, err := NewConfig("ingest")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
@@ -288,9 +662,9 @@ func (suite *TestSuite) TestConfigBroker() {
 	assert.Equal(suite.T(), true, config.Broker.Durable)
 	assert.Equal(suite.T(), "/test", config.Broker.Vhost)
 	assert.Equal(suite.T(), true, config.Broker.Ssl)
-	assert.Equal(suite.T(), "test", config.Broker.ClientCert)
-	assert.Equal(suite.T(), "test", config.Broker.ClientKey)
-	assert.Equal(suite.T(), "test", config.Broker.CACert)
+	assert.Equal(suite.T(), testCert, config.Broker.ClientCert)
+	assert.Equal(suite.T(), testKey, config.Broker.ClientKey)
+	assert.Equal(suite.T(), testCert, config.Broker.CACert)
 	assert.Equal(suite.T(), "file://schemas/federated/", config.Broker.SchemasPath)
 	viper.Set("schema.type", "standalone")
 	viper.Set("broker.vhost", "/test")
@@ -303,20 +677,51 @@ func (suite *TestSuite) TestConfigBroker() {
 }
 
 func (suite *TestSuite) TestConfigDatabase() {
+	testCert, testKey := suite.testCertificate()
 	viper.Set("db.sslmode", "verify-full")
 	_, err := NewConfig("ingest")
 	assert.Error(suite.T(), err)
-	viper.Set("db.clientCert", "test")
-	viper.Set("db.clientKey", "test")
-	viper.Set("db.cacert", "test")
+	viper.Set("db.clientCert", testCert)
+	viper.Set("db.clientKey", testKey)
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "when db.sslMode is set to verify-full db.cacert, the root certificate, is needed")
+	viper.Set("db.sslmode", "verify")
+	_, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "db.sslMode 'verify' is not one of disable, allow, prefer, require, verify-ca or verify-full")
+	viper.Set("db.sslmode", "verify-full")
+	viper.Set("db.cacert", testCert)
 	config, err := NewConfig("ingest")
 	assert.NotNil(suite.T(), config)
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), config.Broker)
 	assert.Equal(suite.T(), "verify-full", config.Database.SslMode)
-	assert.Equal(suite.T(), "test", config.Database.ClientCert)
-	assert.Equal(suite.T(), "test", config.Database.ClientKey)
-	assert.Equal(suite.T(), "test", config.Database.CACert)
+	assert.Equal(suite.T(), testCert, config.Database.ClientCert)
+	assert.Equal(suite.T(), testKey, config.Database.ClientKey)
+	assert.Equal(suite.T(), testCert, config.Database.CACert)
+	assert.Equal(suite.T(), 10, config.Database.MaxOpenConns)
+	assert.Equal(suite.T(), 2, config.Database.MaxIdleConns)
+	assert.Equal(suite.T(), 30*time.Minute, config.Database.ConnMaxLifetime)
+	assert.Equal(suite.T(), 0, config.Database.HeaderCacheSize)
+	assert.Equal(suite.T(), 10*time.Minute, config.Database.HeaderCacheTTL)
+
+	viper.Set("db.maxOpenConns", 50)
+	viper.Set("db.maxIdleConns", 10)
+	viper.Set("db.connMaxLifetime", "5m")
+	viper.Set("db.statementTimeout", "10s")
+	viper.Set("db.replica.host", "replica")
+	viper.Set("db.replica.port", 5433)
+	viper.Set("db.migrations.run", true)
+	viper.Set("db.migrations.dryRun", true)
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 50, config.Database.MaxOpenConns)
+	assert.Equal(suite.T(), 10, config.Database.MaxIdleConns)
+	assert.Equal(suite.T(), 5*time.Minute, config.Database.ConnMaxLifetime)
+	assert.Equal(suite.T(), 10*time.Second, config.Database.StatementTimeout)
+	assert.Equal(suite.T(), "replica", config.Database.ReplicaHost)
+	assert.Equal(suite.T(), 5433, config.Database.ReplicaPort)
+	assert.True(suite.T(), config.Database.RunMigrations)
+	assert.True(suite.T(), config.Database.MigrationsDryRun)
 }
 
 func (suite *TestSuite) TestMapperConfiguration() {
@@ -462,6 +867,191 @@ func (suite *TestSuite) TestVerifyConfiguration() {
 
 }
 
+func (suite *TestSuite) TestVerifyArchiveDrift() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), ArchiveDriftError, config.Verify.ArchiveDrift)
+
+	viper.Set("verify.archiveDrift", "Update")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), ArchiveDriftUpdate, config.Verify.ArchiveDrift)
+
+	viper.Set("verify.archiveDrift", "ignore")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.archiveDrift 'ignore' not supported, use one of error, update or warn")
+}
+
+func (suite *TestSuite) TestC4GHConf() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 0, config.C4GH.LoadRetries)
+	assert.Equal(suite.T(), 5*time.Second, config.C4GH.RetryDelay)
+
+	viper.Set("c4gh.loadRetries", 3)
+	viper.Set("c4gh.retryDelay", "1m")
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 3, config.C4GH.LoadRetries)
+	assert.Equal(suite.T(), time.Minute, config.C4GH.RetryDelay)
+}
+
+func (suite *TestSuite) TestVerifyMemoryWaterMarks() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), uint64(0), config.Verify.MemoryHighWater)
+	assert.Equal(suite.T(), 0, config.Verify.Port)
+	assert.Equal(suite.T(), 5*time.Second, config.Verify.ProgressInterval)
+	assert.Equal(suite.T(), 10*time.Minute, config.Verify.RestoreRetryDelay)
+	assert.Equal(suite.T(), 1, config.Verify.Workers)
+	assert.Equal(suite.T(), 20*time.Second, config.Verify.ShutdownGracePeriod)
+	assert.Equal(suite.T(), []string{"sha256", "md5"}, config.Verify.DecryptedChecksums)
+	assert.Equal(suite.T(), "sha256", config.Verify.AuthoritativeChecksum)
+	assert.True(suite.T(), config.Verify.SkipCompleted)
+	assert.Zero(suite.T(), config.Verify.FileTimeout)
+	assert.Zero(suite.T(), config.Verify.CheckpointInterval)
+	assert.Empty(suite.T(), config.Verify.Batch)
+	assert.Zero(suite.T(), config.Verify.MaxConcurrentFiles)
+	assert.Zero(suite.T(), config.Verify.MaxInFlightBytes)
+	assert.Equal(suite.T(), 3, config.Verify.ReaderRetries)
+	assert.Zero(suite.T(), config.Verify.MaxAttempts)
+	assert.Equal(suite.T(), "quarantine", config.Verify.QuarantineRoutingKey)
+	assert.Zero(suite.T(), config.Verify.SizeTolerance)
+
+	viper.Set("verify.memoryHighWater", 100)
+	viper.Set("verify.port", 8080)
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), uint64(100*1024*1024), config.Verify.MemoryHighWater)
+	assert.Equal(suite.T(), uint64(80*1024*1024), config.Verify.MemoryLowWater)
+	assert.Equal(suite.T(), "0.0.0.0", config.Verify.Host)
+	assert.Equal(suite.T(), 8080, config.Verify.Port)
+
+	viper.Set("verify.memoryLowWater", 100)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.memoryLowWater must be lower than verify.memoryHighWater")
+}
+
+func (suite *TestSuite) TestVerifyWorkers() {
+	viper.Set("verify.workers", 4)
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4, config.Verify.Workers)
+
+	viper.Set("verify.workers", 0)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.workers must be at least 1")
+}
+
+func (suite *TestSuite) TestVerifyDecryptedChecksums() {
+	viper.Set("verify.decryptedChecksums", []string{"SHA256", "sha512", "blake2b", "sha256"})
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"sha256", "sha512", "blake2b"}, config.Verify.DecryptedChecksums)
+
+	// as given in the environment
+	viper.Set("verify.decryptedChecksums", "sha512, md5")
+	viper.Set("verify.authoritativeChecksum", "md5")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), []string{"sha512", "md5"}, config.Verify.DecryptedChecksums)
+
+	viper.Set("verify.decryptedChecksums", []string{"sha256", "crc32"})
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.decryptedChecksums 'crc32' not supported, use md5, sha256, sha512 or blake2b")
+
+	viper.Set("verify.decryptedChecksums", []string{})
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.decryptedChecksums must name at least one algorithm")
+}
+
+func (suite *TestSuite) TestVerifyAuthoritativeChecksum() {
+	viper.Set("verify.decryptedChecksums", "sha256, md5")
+	viper.Set("verify.authoritativeChecksum", "MD5")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "md5", config.Verify.AuthoritativeChecksum)
+
+	// the authoritative checksum must be one of those computed
+	viper.Set("verify.authoritativeChecksum", "sha512")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.authoritativeChecksum 'sha512' is not one of verify.decryptedChecksums [sha256 md5]")
+
+	viper.Set("verify.decryptedChecksums", "sha512, md5")
+	viper.Set("verify.authoritativeChecksum", nil)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.authoritativeChecksum 'sha256' is not one of verify.decryptedChecksums [sha512 md5]")
+}
+
+func (suite *TestSuite) TestVerifyDeployment() {
+	viper.Set("deployment.region", "se-north")
+	viper.Set("deployment.zone", "se-north-1")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "se-north", config.Deployment.Region)
+	assert.Equal(suite.T(), "se-north-1", config.Deployment.Zone)
+
+	hostname, _ := os.Hostname()
+	assert.Equal(suite.T(), "verify", config.Deployment.Service)
+	assert.Equal(suite.T(), "verify@"+hostname, config.Deployment.Identity())
+	assert.Equal(suite.T(), "verify@"+hostname, config.Database.Service)
+
+	viper.Set("deployment.service", "verify-eu")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "verify-eu@"+hostname, config.Deployment.Identity())
+}
+
+func (suite *TestSuite) TestDetectDeployment() {
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/api/token":
+			_, _ = w.Write([]byte("token"))
+		case r.URL.Path == "/meta-data/placement/availability-zone" && r.Header.Get("X-aws-ec2-metadata-token") == "token":
+			_, _ = w.Write([]byte("eu-north-1a"))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer aws.Close()
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		_, _ = w.Write([]byte("projects/1234/zones/europe-west1-b"))
+	}))
+	defer gcp.Close()
+
+	defer func(a, g string) { awsMetadataURL, gcpMetadataURL = a, g }(awsMetadataURL, gcpMetadataURL)
+
+	awsMetadataURL = aws.URL
+	region, zone, err := detectDeployment(http.DefaultClient)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "eu-north-1", region)
+	assert.Equal(suite.T(), "eu-north-1a", zone)
+
+	awsMetadataURL = "http://127.0.0.1:1"
+	gcpMetadataURL = gcp.URL
+	viper.Set("deployment.detect", true)
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "europe-west1", config.Deployment.Region)
+	assert.Equal(suite.T(), "europe-west1-b", config.Deployment.Zone)
+
+	gcpMetadataURL = "http://127.0.0.1:1"
+	_, _, err = detectDeployment(http.DefaultClient)
+	assert.EqualError(suite.T(), err, "no cloud metadata service available")
+}
+
 func (suite *TestSuite) TestIngestConfiguration() {
 	viper.Set("inbox.location", "test")
 	viper.Set("archive.location", "test")
@@ -518,6 +1108,43 @@ func (suite *TestSuite) TestIngestConfiguration() {
 
 }
 
+func (suite *TestSuite) TestIngestOutputStorage() {
+	config, err := NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), config.Archive, config.Output)
+
+	viper.Set("output.type", "s3")
+	viper.Set("output.url", "https://output")
+	viper.Set("output.accesskey", "outputaccess")
+	viper.Set("output.secretkey", "outputsecret")
+	config, err = NewConfig("ingest")
+	assert.EqualError(suite.T(), err, "output.bucket not set")
+	assert.Nil(suite.T(), config)
+
+	viper.Set("output.bucket", "output")
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), POSIX, config.Archive.Type)
+	assert.Equal(suite.T(), "/archive", config.Archive.Posix.Location)
+	assert.Equal(suite.T(), S3, config.Output.Type)
+	assert.Equal(suite.T(), "https://output", config.Output.S3.URL)
+	assert.Equal(suite.T(), "outputaccess", config.Output.S3.AccessKey)
+	assert.Equal(suite.T(), "outputsecret", config.Output.S3.SecretKey)
+	assert.Equal(suite.T(), "output", config.Output.S3.Bucket)
+
+	// the output credentials can be read from secret files too
+	dir := suite.T().TempDir()
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "secretkey"), []byte("filesecret\n"), 0600))
+	assert.NoError(suite.T(), os.WriteFile(filepath.Join(dir, "sseckey"), []byte("filessec\n"), 0600))
+	suite.T().Setenv("OUTPUT_SECRETKEY_FILE", filepath.Join(dir, "secretkey"))
+	suite.T().Setenv("OUTPUT_SSECKEY_FILE", filepath.Join(dir, "sseckey"))
+	config, err = NewConfig("ingest")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "filesecret", config.Output.S3.SecretKey)
+	assert.Equal(suite.T(), "filessec", config.Output.S3.SSECKey)
+	assert.Equal(suite.T(), redactedValue, config.Redacted().Output.S3.SecretKey)
+}
+
 func (suite *TestSuite) TestInterceptConfiguration() {
 	config, err := NewConfig("intercept")
 	assert.NotNil(suite.T(), config)
@@ -551,11 +1178,39 @@ func (suite *TestSuite) TestInterceptConfiguration() {
 	assert.NotNil(suite.T(), config)
 }
 func (suite *TestSuite) TestDefaultLogLevel() {
+	defer log.SetLevel(log.InfoLevel)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	log.SetLevel(log.InfoLevel)
+	config, err := NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), log.InfoLevel, log.GetLevel())
+	assert.Equal(suite.T(), "", config.Reloadable().LogLevel)
+
+	viper.Set("log.level", "warn")
+	viper.Set("log.format", "json")
+	config, err = NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), log.WarnLevel, log.GetLevel())
+	assert.IsType(suite.T(), &log.JSONFormatter{}, log.StandardLogger().Formatter)
+	assert.Equal(suite.T(), "json", config.Reloadable().LogFormat)
+}
+
+func (suite *TestSuite) TestUnknownLogSettings() {
+	defer log.SetLevel(log.InfoLevel)
+
+	log.SetLevel(log.InfoLevel)
 	viper.Set("log.level", "test")
-	config, err := NewConfig("test")
+	config, err := NewConfig("mapper")
 	assert.Nil(suite.T(), config)
-	assert.Error(suite.T(), err)
-	assert.Equal(suite.T(), log.TraceLevel, log.GetLevel())
+	assert.EqualError(suite.T(), err, "log.level 'test' not supported, use one of panic, fatal, error, warn, info, debug or trace")
+	assert.Equal(suite.T(), log.InfoLevel, log.GetLevel())
+
+	viper.Set("log.level", "debug")
+	viper.Set("log.format", "xml")
+	config, err = NewConfig("mapper")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "log.format 'xml' not supported, use text or json")
 }
 
 func (suite *TestSuite) TestConfigPath() {
@@ -581,7 +1236,8 @@ func (suite *TestSuite) TestGetC4GHKey_keyError() {
 
 	byte, err := GetC4GHKey()
 	assert.Nil(suite.T(), byte)
-	assert.EqualError(suite.T(), err, "open /doesnotexist: no such file or directory")
+	assert.ErrorIs(suite.T(), err, ErrKeyNotFound)
+	assert.EqualError(suite.T(), err, "c4gh key file not found: open /doesnotexist: no such file or directory")
 }
 
 func (suite *TestSuite) TestGetC4GHKey_passError() {
@@ -591,7 +1247,147 @@ func (suite *TestSuite) TestGetC4GHKey_passError() {
 
 	key, err := GetC4GHKey()
 	assert.Nil(suite.T(), key)
-	assert.EqualError(suite.T(), err, "chacha20poly1305: message authentication failed")
+	assert.ErrorIs(suite.T(), err, ErrKeyPassphrase)
+	assert.EqualError(suite.T(), err, "wrong passphrase for c4gh key: chacha20poly1305: message authentication failed")
+}
+
+func (suite *TestSuite) TestGetC4GHKey_formatError() {
+	keyPath := filepath.Join(suite.T().TempDir(), "c4gh.sec.pem")
+	assert.NoError(suite.T(), os.WriteFile(keyPath, []byte("not a key"), 0600))
+
+	viper.Set("c4gh.filepath", keyPath)
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	key, err := GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorIs(suite.T(), err, ErrKeyFormat)
+
+	// a key encrypted with an unsupported KDF
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh-new.sec.pem")
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.EqualError(suite.T(), err, "corrupt or unsupported c4gh key format: KDF none not supported")
+}
+
+func (suite *TestSuite) TestGetC4GHKey_retry() {
+	keyPath := filepath.Join(suite.T().TempDir(), "c4gh.sec.pem")
+	viper.Set("c4gh.filepath", keyPath)
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	viper.Set("c4gh.retryDelay", "10ms")
+
+	// retries are exhausted before the key shows up
+	viper.Set("c4gh.loadRetries", 2)
+	key, err := GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorIs(suite.T(), err, ErrKeyNotFound)
+
+	// the key is mounted while retrying
+	viper.Set("c4gh.loadRetries", 50)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		pem, _ := os.ReadFile("../../dev_utils/c4gh.sec.pem")
+		_ = os.WriteFile(keyPath, pem, 0600)
+	}()
+	key, err = GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	// a wrong passphrase is not retried
+	viper.Set("c4gh.passphrase", "asdf")
+	viper.Set("c4gh.retryDelay", "10s")
+	start := time.Now()
+	_, err = GetC4GHKey()
+	assert.ErrorIs(suite.T(), err, ErrKeyPassphrase)
+	assert.Less(suite.T(), time.Since(start), 10*time.Second)
+}
+
+func (suite *TestSuite) TestGetC4GHKey_passphraseEnv() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "from the config")
+
+	suite.T().Setenv("C4GH_PASSPHRASE", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+	key, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	suite.T().Setenv("C4GH_PASSPHRASE", "wrong")
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorIs(suite.T(), err, ErrKeyPassphrase)
+
+	// the file takes precedence over the variable
+	passphraseFile := filepath.Join(suite.T().TempDir(), "passphrase")
+	assert.NoError(suite.T(), os.WriteFile(passphraseFile, []byte("oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm\n"), 0600))
+	suite.T().Setenv("C4GH_PASSPHRASE_FILE", passphraseFile)
+	key, err = GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	suite.T().Setenv("C4GH_PASSPHRASE_FILE", "/doesnotexist")
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.EqualError(suite.T(), err, "failed to read the c4gh passphrase from C4GH_PASSPHRASE_FILE: open /doesnotexist: no such file or directory")
+}
+
+func (suite *TestSuite) TestGetC4GHKey_inline() {
+	viper.Set("c4gh.filepath", "/doesnotexist")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	pemKey, err := os.ReadFile("../../dev_utils/c4gh.sec.pem")
+	assert.NoError(suite.T(), err)
+	encoded := base64.StdEncoding.EncodeToString(pemKey)
+
+	// line wrapped output from base64 is accepted
+	suite.T().Setenv("C4GH_KEY_B64", encoded[:40]+"\n"+encoded[40:]+"\n")
+	key, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	suite.T().Setenv("C4GH_KEY_B64", "not base64!")
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorIs(suite.T(), err, ErrKeyFormat)
+	assert.Contains(suite.T(), err.Error(), "C4GH_KEY_B64 is not valid base64")
+
+	suite.T().Setenv("C4GH_KEY_B64", base64.StdEncoding.EncodeToString([]byte("not a key")))
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorIs(suite.T(), err, ErrKeyFormat)
+
+	suite.T().Setenv("C4GH_KEY_B64", "")
+	key, err = GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.EqualError(suite.T(), err, "corrupt or unsupported c4gh key format: C4GH_KEY_B64 is empty")
+}
+
+func (suite *TestSuite) TestGetC4GHKeys() {
+	viper.Set("c4gh.filepath", "../../dev_utils/c4gh.sec.pem")
+	viper.Set("c4gh.passphrase", "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm")
+
+	c4ghKeys, err := GetC4GHKeys()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), c4ghKeys, 1)
+
+	current, _ := GetC4GHKey()
+	assert.Equal(suite.T(), current, c4ghKeys[0])
+
+	_, previous, _ := keys.GenerateKeyPair()
+	previousPath := filepath.Join(suite.T().TempDir(), "previous.sec.pem")
+	f, _ := os.Create(previousPath)
+	assert.NoError(suite.T(), keys.WriteCrypt4GHX25519PrivateKey(f, previous, []byte("rotated")))
+	f.Close()
+
+	viper.Set("c4gh.previousKeys", []map[string]string{{"filepath": previousPath, "passphrase": "rotated"}})
+	c4ghKeys, err = GetC4GHKeys()
+	assert.NoError(suite.T(), err)
+	assert.Len(suite.T(), c4ghKeys, 2)
+	assert.Equal(suite.T(), current, c4ghKeys[0])
+	assert.Equal(suite.T(), previous, *c4ghKeys[1])
+
+	viper.Set("c4gh.previousKeys", []map[string]string{{"filepath": "/doesnotexist"}})
+	c4ghKeys, err = GetC4GHKeys()
+	assert.Nil(suite.T(), c4ghKeys)
+	assert.EqualError(suite.T(), err, "c4gh.previousKeys[0]: c4gh key file not found: open /doesnotexist: no such file or directory")
 }
 
 func (suite *TestSuite) TestGetC4GHPublicKey() {
@@ -707,6 +1503,13 @@ func (suite *TestSuite) TestAPIConfiguration() {
 	assert.Equal(suite.T(), false, config.API.Session.Secure)
 	assert.Equal(suite.T(), "test", config.API.Session.Domain)
 	assert.Equal(suite.T(), 60*time.Second, config.API.Session.Expiration)
+	assert.Empty(suite.T(), config.Archive.Type, "the archive is only configured when its type is set")
+
+	viper.Set("archive.type", POSIX)
+	config, err = NewConfig("api")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), POSIX, config.Archive.Type)
+	assert.Equal(suite.T(), "/archive", config.Archive.Posix.Location)
 }
 
 func (suite *TestSuite) TestNotifyConfiguration() {
@@ -732,3 +1535,130 @@ func (suite *TestSuite) TestNotifyConfiguration() {
 	assert.NotNil(suite.T(), config)
 
 }
+
+func (suite *TestSuite) TestVerifyReVerifyRoutingKey() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "reverified", config.Verify.ReVerifyRoutingKey)
+
+	viper.Set("verify.reVerifyRoutingKey", "audit")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "audit", config.Verify.ReVerifyRoutingKey)
+
+	viper.Set("verify.reVerifyRoutingKey", "")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.reVerifyRoutingKey must not be empty")
+}
+
+func (suite *TestSuite) TestVerifyMismatchRoutingKey() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "mismatch", config.Verify.MismatchRoutingKey)
+
+	viper.Set("verify.mismatchRoutingKey", "")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.mismatchRoutingKey must not be empty")
+}
+
+func (suite *TestSuite) TestVerifySizeTolerance() {
+	viper.Set("verify.sizeTolerance", "1KB")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), int64(1024), config.Verify.SizeTolerance)
+}
+
+func (suite *TestSuite) TestVerifyFileTimeout() {
+	viper.Set("verify.fileTimeout", "2h")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2*time.Hour, config.Verify.FileTimeout)
+
+	viper.Set("verify.fileTimeout", "-1s")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.fileTimeout must not be negative")
+}
+
+func (suite *TestSuite) TestVerifyCheckpointInterval() {
+	viper.Set("verify.checkpointInterval", "5m")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5*time.Minute, config.Verify.CheckpointInterval)
+
+	viper.Set("verify.checkpointInterval", "-1s")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.checkpointInterval must not be negative")
+}
+
+func (suite *TestSuite) TestVerifyInFlightLimits() {
+	viper.Set("verify.maxConcurrentFiles", 2)
+	viper.Set("verify.maxInFlightBytes", "10GB")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, config.Verify.MaxConcurrentFiles)
+	assert.Equal(suite.T(), int64(10<<30), config.Verify.MaxInFlightBytes)
+
+	viper.Set("verify.maxConcurrentFiles", -1)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.maxConcurrentFiles must not be negative")
+}
+
+func (suite *TestSuite) TestVerifyReaderRetries() {
+	viper.Set("verify.readerRetries", 0)
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Zero(suite.T(), config.Verify.ReaderRetries)
+
+	viper.Set("verify.readerRetries", -1)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.readerRetries must not be negative")
+}
+
+func (suite *TestSuite) TestVerifyMaxAttempts() {
+	viper.Set("verify.maxAttempts", 5)
+	viper.Set("verify.quarantineRoutingKey", "poison")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, config.Verify.MaxAttempts)
+	assert.Equal(suite.T(), "poison", config.Verify.QuarantineRoutingKey)
+
+	viper.Set("verify.maxAttempts", -1)
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.maxAttempts must not be negative")
+
+	viper.Set("verify.maxAttempts", 5)
+	viper.Set("verify.quarantineRoutingKey", "")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.quarantineRoutingKey must not be empty")
+}
+
+func (suite *TestSuite) TestVerifyBatch() {
+	viper.Set("verify.batch", "-")
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "-", config.Verify.Batch)
+}
+
+func (suite *TestSuite) TestVerifyCopyBufferSize() {
+	config, err := NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 4*1024*1024, config.Verify.CopyBufferSize)
+
+	viper.Set("verify.copyBufferSize", "256KB")
+	config, err = NewConfig("verify")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 256*1024, config.Verify.CopyBufferSize)
+
+	viper.Set("verify.copyBufferSize", "0")
+	config, err = NewConfig("verify")
+	assert.Nil(suite.T(), config)
+	assert.EqualError(suite.T(), err, "verify.copyBufferSize must be a positive size, e.g. 4MB")
+}
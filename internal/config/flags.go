@@ -0,0 +1,65 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// flagAliases are shorter names accepted on the command line for some
+// settings
+var flagAliases = map[string]string{
+	"config":    "configFile",
+	"loglevel":  "log.level",
+	"logformat": "log.format",
+}
+
+// bindFlags lets any setting be overridden on the command line as
+// --<key> <value> or --<key>=<value>, e.g. --broker.host localhost, taking
+// precedence over the environment and the config file. A --<key> followed by
+// another flag, or by nothing, sets the setting to true. Arguments not
+// starting with -- are left alone.
+func bindFlags(args []string) error {
+	flags := pflag.NewFlagSet("sda-pipeline", pflag.ContinueOnError)
+
+	var longArgs []string
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") || args[i] == "--" {
+			continue
+		}
+
+		name := strings.TrimPrefix(args[i], "--")
+		switch n := strings.IndexByte(name, '='); {
+		case n >= 0:
+			longArgs = append(longArgs, args[i])
+			name = name[:n]
+		case i+1 < len(args) && !strings.HasPrefix(args[i+1], "--"):
+			longArgs = append(longArgs, args[i], args[i+1])
+			i++
+		default:
+			longArgs = append(longArgs, args[i]+"=true")
+		}
+
+		if flags.Lookup(name) == nil {
+			flags.String(name, "", "")
+		}
+	}
+
+	if err := flags.Parse(longArgs); err != nil {
+		return err
+	}
+
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		key := f.Name
+		if alias, ok := flagAliases[key]; ok {
+			key = alias
+		}
+		if e := viper.BindPFlag(key, f); e != nil && err == nil {
+			err = e
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) TestBindFlags() {
+	// values set in the tests would take precedence over the flags
+	viper.Reset()
+	viper.AutomaticEnv()
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	suite.T().Setenv("BROKER_USER", "env")
+	suite.T().Setenv("BROKER_QUEUE", "env")
+
+	args := []string{"-test.v", "--broker.host", "localhost", "--broker.user=flag", "--loglevel", "debug", "positional"}
+	assert.NoError(suite.T(), bindFlags(args))
+
+	assert.Equal(suite.T(), "localhost", viper.GetString("broker.host"))
+	assert.Equal(suite.T(), "flag", viper.GetString("broker.user"))
+	assert.Equal(suite.T(), "debug", viper.GetString("log.level"))
+	// settings not given on the command line keep their value
+	assert.Equal(suite.T(), "env", viper.GetString("broker.queue"))
+
+	// a flag without a value is true, rather than taking the next flag as
+	// its value
+	viper.Reset()
+	assert.NoError(suite.T(), bindFlags([]string{"--verify.skipCompleted", "--broker.host", "localhost", "--broker.durable"}))
+	assert.True(suite.T(), viper.GetBool("verify.skipCompleted"))
+	assert.Equal(suite.T(), "localhost", viper.GetString("broker.host"))
+	assert.True(suite.T(), viper.GetBool("broker.durable"))
+}
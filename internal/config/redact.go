@@ -0,0 +1,44 @@
+package config
+
+import (
+	"reflect"
+)
+
+// redactedValue replaces the value of sensitive settings in Redacted
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the configuration that is safe to log, with
+// every field tagged `redact:"true"` masked. Empty fields are left empty so
+// that it still shows whether a secret was set. Connection handles, such as
+// the database, broker and archive in APIConf, are not part of the copy.
+func (c *Config) Redacted() *Config {
+	r := &Config{}
+	redact(reflect.ValueOf(r).Elem(), reflect.ValueOf(c).Elem())
+
+	return r
+}
+
+// redact copies the exported fields of the struct src to dst, masking the
+// sensitive ones and descending into nested structs
+func redact(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		field := src.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		switch {
+		case field.Tag.Get("redact") == "true":
+			if field.Type.Kind() == reflect.String && src.Field(i).String() != "" {
+				dst.Field(i).SetString(redactedValue)
+			}
+		case field.Type.Kind() == reflect.Struct:
+			dst.Field(i).Set(src.Field(i))
+			redact(dst.Field(i), src.Field(i))
+		case field.Type.Kind() == reflect.Ptr, field.Type.Kind() == reflect.Interface:
+			dst.Field(i).Set(reflect.Zero(field.Type))
+		default:
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
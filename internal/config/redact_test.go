@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"sda-pipeline/internal/broker"
+	"sda-pipeline/internal/database"
+	"sda-pipeline/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedacted(t *testing.T) {
+	archiveConf := storage.Conf{Type: POSIX}
+	archiveConf.Posix.Location = t.TempDir()
+	archive, err := storage.NewBackend(archiveConf)
+	assert.NoError(t, err)
+
+	output := storage.Conf{Type: SFTP}
+	output.SFTP = storage.SFTPConf{Host: "sftp", Password: "sftppass", KeyPassphrase: "keypass"}
+	output.Azure = storage.AzureConf{ConnectionString: "connstr", AccountKey: "accountkey"}
+	output.HTTP = storage.HTTPConf{URL: "https://output", Token: "token"}
+
+	c := &Config{
+		Archive:  storage.Conf{Type: S3, S3: storage.S3Conf{URL: "https://archive", AccessKey: "access", SecretKey: "secret", SSECKey: "ssec"}},
+		Output:   output,
+		Broker:   broker.MQConf{Host: "mq", User: "user", Password: "mqpass"},
+		Database: database.DBConf{Host: "db", Password: "dbpass"},
+		Notify:   SMTPConf{Host: "smtp"},
+		API:      APIConf{DB: &database.SQLdb{}, Archive: archive},
+	}
+
+	r := c.Redacted()
+	assert.Equal(t, "https://archive", r.Archive.S3.URL)
+	assert.Equal(t, redactedValue, r.Archive.S3.AccessKey)
+	assert.Equal(t, redactedValue, r.Archive.S3.SecretKey)
+	assert.Equal(t, redactedValue, r.Archive.S3.SSECKey)
+	assert.Equal(t, "sftp", r.Output.SFTP.Host)
+	assert.Equal(t, redactedValue, r.Output.SFTP.Password)
+	assert.Equal(t, redactedValue, r.Output.SFTP.KeyPassphrase)
+	assert.Equal(t, redactedValue, r.Output.Azure.ConnectionString)
+	assert.Equal(t, redactedValue, r.Output.Azure.AccountKey)
+	assert.Equal(t, "https://output", r.Output.HTTP.URL)
+	assert.Equal(t, redactedValue, r.Output.HTTP.Token)
+	assert.Equal(t, "user", r.Broker.User)
+	assert.Equal(t, redactedValue, r.Broker.Password)
+	assert.Equal(t, "db", r.Database.Host)
+	assert.Equal(t, redactedValue, r.Database.Password)
+	assert.Equal(t, "", r.Notify.Password, "unset secrets should stay empty")
+	assert.Nil(t, r.API.DB)
+	assert.Nil(t, r.API.Archive)
+
+	// The original is left untouched
+	assert.Equal(t, "mqpass", c.Broker.Password)
+	assert.Equal(t, "secret", c.Archive.S3.SecretKey)
+
+	dump := fmt.Sprintf("%+v", r)
+	for _, secret := range []string{"access", "secret", "ssec", "mqpass", "dbpass", "sftppass", "keypass", "connstr", "accountkey", "token"} {
+		assert.NotContains(t, dump, ":"+secret+" ")
+	}
+}
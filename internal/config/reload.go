@@ -0,0 +1,138 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ReloadableConf holds the settings that are re-read by Reload. Connection
+// level settings can't be changed while running and are left out.
+type ReloadableConf struct {
+	// LogLevel and LogFormat are applied to the logger on reload
+	LogLevel  string
+	LogFormat string
+	// Workers is the number of messages verify verifies at the same time
+	Workers int
+	// PrefetchCount limits the number of unacknowledged messages delivered
+	// by the broker
+	PrefetchCount int
+}
+
+// configReloadable reads the settings that can be changed while running
+func configReloadable() ReloadableConf {
+	viper.SetDefault("verify.workers", 1)
+
+	return ReloadableConf{
+		LogLevel:      viper.GetString("log.level"),
+		LogFormat:     viper.GetString("log.format"),
+		Workers:       viper.GetInt("verify.workers"),
+		PrefetchCount: viper.GetInt("broker.prefetchCount"),
+	}
+}
+
+// logSettings parses the configured log level and format, a missing level
+// meaning that the current one is kept
+func logSettings(r ReloadableConf) (*log.Level, log.Formatter, error) {
+	var formatter log.Formatter
+	switch r.LogFormat {
+	case "", "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return nil, nil, fmt.Errorf("log.format '%s' not supported, use text or json", r.LogFormat)
+	}
+
+	if r.LogLevel == "" {
+		return nil, formatter, nil
+	}
+
+	level, err := log.ParseLevel(r.LogLevel)
+	if err != nil {
+		return nil, nil, fmt.Errorf("log.level '%s' not supported, use one of panic, fatal, error, warn, info, debug or trace", r.LogLevel)
+	}
+
+	return &level, formatter, nil
+}
+
+// applyLogSettings sets the log format and level
+func applyLogSettings(r ReloadableConf) error {
+	level, formatter, err := logSettings(r)
+	if err != nil {
+		return err
+	}
+
+	log.SetFormatter(formatter)
+	if r.LogFormat == "json" {
+		log.Info("The logs format is set to JSON")
+	}
+
+	if level != nil {
+		log.SetLevel(*level)
+		log.Printf("Setting log level to '%s'", r.LogLevel)
+	}
+
+	return nil
+}
+
+// Reloadable returns the current values of the settings that can change
+// while running
+func (c *Config) Reloadable() ReloadableConf {
+	c.reloadMu.RLock()
+	defer c.reloadMu.RUnlock()
+
+	return c.reloadable
+}
+
+// Reload re-reads the config file and environment and swaps in the new values
+// of the reloadable settings, applying the log settings right away
+func (c *Config) Reload() error {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return err
+		}
+	}
+
+	r := configReloadable()
+	if r.Workers < 1 {
+		return errors.New("verify.workers must be at least 1")
+	}
+	if err := applyLogSettings(r); err != nil {
+		return err
+	}
+
+	c.reloadMu.Lock()
+	c.reloadable = r
+	c.reloadMu.Unlock()
+
+	return nil
+}
+
+// ReloadOnSIGHUP reloads the configuration each time the process receives
+// SIGHUP and passes the new settings to apply, if given, for the service to
+// act on the ones that need it
+func (c *Config) ReloadOnSIGHUP(apply func(ReloadableConf)) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			if err := c.Reload(); err != nil {
+				log.Errorf("Failed to reload configuration: %v", err)
+
+				continue
+			}
+			log.Info("Configuration reloaded")
+
+			if apply != nil {
+				apply(c.Reloadable())
+			}
+		}
+	}()
+}
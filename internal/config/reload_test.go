@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) TestReload() {
+	defer log.SetLevel(log.InfoLevel)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	confFile := filepath.Join(suite.T().TempDir(), "config.yaml")
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("log:\n  level: info\nbroker:\n  prefetchCount: 2\n"), 0600))
+	viper.Set("configFile", confFile)
+
+	config, err := NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), ReloadableConf{LogLevel: "info", Workers: 1, PrefetchCount: 2}, config.Reloadable())
+	assert.Equal(suite.T(), 2, config.Broker.PrefetchCount)
+
+	yaml := []byte("log:\n  level: debug\n  format: json\nbroker:\n  host: other\n  prefetchCount: 10\nverify:\n  workers: 4\n")
+	assert.NoError(suite.T(), os.WriteFile(confFile, yaml, 0600))
+	assert.NoError(suite.T(), config.Reload())
+
+	assert.Equal(suite.T(), ReloadableConf{LogLevel: "debug", LogFormat: "json", Workers: 4, PrefetchCount: 10}, config.Reloadable())
+	assert.Equal(suite.T(), log.DebugLevel, log.GetLevel())
+	assert.IsType(suite.T(), &log.JSONFormatter{}, log.StandardLogger().Formatter)
+	// connection settings are left as they were
+	assert.Equal(suite.T(), "test", config.Broker.Host)
+	assert.Equal(suite.T(), 2, config.Broker.PrefetchCount)
+
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("log:\n  level: loud\n"), 0600))
+	assert.EqualError(suite.T(), config.Reload(), "log.level 'loud' not supported, use one of panic, fatal, error, warn, info, debug or trace")
+	assert.Equal(suite.T(), "debug", config.Reloadable().LogLevel)
+	assert.Equal(suite.T(), log.DebugLevel, log.GetLevel())
+
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("verify:\n  workers: 0\n"), 0600))
+	assert.EqualError(suite.T(), config.Reload(), "verify.workers must be at least 1")
+	assert.Equal(suite.T(), 4, config.Reloadable().Workers)
+
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("log: [unterminated"), 0600))
+	assert.Error(suite.T(), config.Reload())
+	assert.Equal(suite.T(), 10, config.Reloadable().PrefetchCount)
+}
+
+func (suite *TestSuite) TestReloadOnSIGHUP() {
+	defer log.SetLevel(log.InfoLevel)
+
+	confFile := filepath.Join(suite.T().TempDir(), "config.yaml")
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("broker:\n  prefetchCount: 2\n"), 0600))
+	viper.Set("configFile", confFile)
+
+	config, err := NewConfig("mapper")
+	assert.NoError(suite.T(), err)
+
+	// viper is only read by the reload from here on, the new value comes
+	// from the config file
+	applied := make(chan ReloadableConf, 1)
+	config.ReloadOnSIGHUP(func(r ReloadableConf) { applied <- r })
+
+	assert.NoError(suite.T(), os.WriteFile(confFile, []byte("broker:\n  prefetchCount: 5\n"), 0600))
+	assert.NoError(suite.T(), syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	select {
+	case r := <-applied:
+		assert.Equal(suite.T(), 5, r.PrefetchCount)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("configuration not reloaded on SIGHUP")
+	}
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ValidationError lists every problem found in the configuration, so that
+// a misconfigured deployment can be fixed in one go
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	if len(e) == 1 {
+		return e[0]
+	}
+
+	return fmt.Sprintf("%d configuration errors: %s", len(e), strings.Join(e, "; "))
+}
+
+// Settings checked by validate, whenever they are set
+var (
+	portConfVars = []string{"broker.port", "db.port", "db.replica.port", "smtp.port", "api.port", "verify.port", "archive.port", "inbox.port", "backup.port", "output.port"}
+	fileConfVars = []string{
+		"broker.cacert", "broker.clientCert", "broker.clientKey",
+		"db.cacert", "db.clientCert", "db.clientKey",
+		"api.cacert", "api.serverCert", "api.serverKey",
+		"archive.cacert", "inbox.cacert", "backup.cacert", "output.cacert",
+		"c4gh.backupPubKey",
+	}
+	caConfVars      = []string{"broker.cacert", "db.cacert", "api.cacert", "archive.cacert", "inbox.cacert", "backup.cacert", "output.cacert"}
+	tlsPairConfVars = [][2]string{
+		{"broker.clientCert", "broker.clientKey"},
+		{"db.clientCert", "db.clientKey"},
+		{"api.serverCert", "api.serverKey"},
+	}
+)
+
+// validate checks that everything needed by app is present and sane and
+// returns a ValidationError holding all the problems found
+func validate(app string) error {
+	var problems ValidationError
+
+	required := requiredConfVars
+	switch app {
+	case "ingest":
+		required = append(required, storageConfVars("inbox")...)
+		required = append(required, storageConfVars("archive")...)
+	case "verify":
+		required = append(required, storageConfVars("archive")...)
+	case "backup":
+		required = append(required, storageConfVars("archive")...)
+		required = append(required, storageConfVars("backup")...)
+	}
+	for _, s := range required {
+		if !viper.IsSet(s) {
+			problems = append(problems, fmt.Sprintf("%s not set", s))
+		}
+	}
+
+	switch app {
+	case "ingest", "verify", "backup":
+		problems = append(problems, validateC4GH()...)
+	}
+
+	for _, s := range portConfVars {
+		if !viper.IsSet(s) {
+			continue
+		}
+		if _, err := strconv.Atoi(fmt.Sprint(viper.Get(s))); err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be a number, got '%v'", s, viper.Get(s)))
+		}
+	}
+
+	for _, pair := range tlsPairConfVars {
+		if viper.GetString(pair[0]) == "" != (viper.GetString(pair[1]) == "") {
+			problems = append(problems, fmt.Sprintf("%s and %s must both be set or both be empty", pair[0], pair[1]))
+		}
+	}
+
+	for _, s := range fileConfVars {
+		problems = append(problems, validateFile(s)...)
+	}
+
+	problems = append(problems, validateTLS()...)
+
+	if _, _, err := logSettings(configReloadable()); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) != 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// storageConfVars returns the settings needed for the default posix storage
+// when no storage type is given, the s3 and posix settings are otherwise
+// already part of requiredConfVars
+func storageConfVars(prefix string) []string {
+	if viper.IsSet(prefix + ".type") {
+		return nil
+	}
+
+	return []string{prefix + ".location"}
+}
+
+// validateC4GH checks that the c4gh private key can be found
+func validateC4GH() []string {
+	if viper.GetString("c4gh.source") == "vault" {
+		var problems []string
+		for _, s := range []string{"c4gh.vault.address", "c4gh.vault.path"} {
+			if !viper.IsSet(s) {
+				problems = append(problems, fmt.Sprintf("%s not set", s))
+			}
+		}
+
+		return problems
+	}
+
+	// The key file itself may not be mounted yet, GetC4GHKey retries
+	// reading it and explains what is wrong with it
+	if _, ok := os.LookupEnv("C4GH_KEY_B64"); ok {
+		return nil
+	}
+	if !viper.IsSet("c4gh.filepath") {
+		return []string{"c4gh.filepath not set"}
+	}
+
+	return nil
+}
+
+// validateFile checks that the file named by the setting exists, if set
+func validateFile(s string) []string {
+	p := viper.GetString(s)
+	if p == "" {
+		return nil
+	}
+	_, err := os.Stat(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return []string{fmt.Sprintf("%s: file '%s' does not exist", s, p)}
+	case err != nil:
+		return []string{fmt.Sprintf("%s: %v", s, err)}
+	}
+
+	return nil
+}
+
+// validateTLS checks that the configured certificate and key pairs load and
+// that the CA bundles hold at least one certificate. Missing files are
+// reported by validateFile.
+func validateTLS() []string {
+	var problems []string
+
+	for _, pair := range tlsPairConfVars {
+		cert, key := viper.GetString(pair[0]), viper.GetString(pair[1])
+		if !fileExists(cert) || !fileExists(key) {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			problems = append(problems, fmt.Sprintf("%s and %s are not a valid certificate and key pair: %v", pair[0], pair[1], err))
+		}
+	}
+
+	for _, s := range caConfVars {
+		ca := viper.GetString(s)
+		if !fileExists(ca) {
+			continue
+		}
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", s, err))
+
+			continue
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			problems = append(problems, fmt.Sprintf("%s: no certificates found in '%s'", s, ca))
+		}
+	}
+
+	return problems
+}
+
+// fileExists reports whether p names an existing file
+func fileExists(p string) bool {
+	if p == "" {
+		return false
+	}
+	_, err := os.Stat(p)
+
+	return err == nil
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// keySource provides the PEM encoded c4gh private key and its passphrase
+type keySource interface {
+	fetch() (key []byte, passphrase []byte, err error)
+}
+
+// fileKeySource reads the c4gh key from the local file system
+type fileKeySource struct {
+	path       string
+	passphrase string
+}
+
+func (s fileKeySource) fetch() ([]byte, []byte, error) {
+	key, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %v", ErrKeyNotFound, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, []byte(s.passphrase), nil
+}
+
+// inlineKeySource holds a c4gh key passed base64 encoded in C4GH_KEY_B64,
+// for environments where the key can't be mounted as a file
+type inlineKeySource struct {
+	key        []byte
+	passphrase string
+}
+
+func (s inlineKeySource) fetch() ([]byte, []byte, error) {
+	return s.key, []byte(s.passphrase), nil
+}
+
+// decodeInlineKey decodes the base64 encoded key file content, ignoring
+// any line breaks added by the encoder
+func decodeInlineKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: C4GH_KEY_B64 is not valid base64: %v", ErrKeyFormat, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: C4GH_KEY_B64 is empty", ErrKeyFormat)
+	}
+
+	return key, nil
+}
+
+// vaultKeySource reads the c4gh key and passphrase from a HashiCorp Vault
+// KV secret
+type vaultKeySource struct {
+	Address         string
+	Token           string
+	AuthMethod      string
+	AuthPath        string
+	Role            string
+	JWTPath         string
+	Mount           string
+	Path            string
+	KVVersion       int
+	KeyField        string
+	PassphraseField string
+	Client          *http.Client
+}
+
+// cachedKey holds the last key fetched from a remote key source
+var cachedKey struct {
+	sync.Mutex
+	key       *[32]byte
+	fetchedAt time.Time
+	// failedAt is when fetching the key again last failed
+	failedAt time.Time
+}
+
+// c4ghKeySource returns the configured source for the c4gh private key and
+// how long a fetched key may be cached, zero meaning forever. Unless vault is
+// used, a key given in C4GH_KEY_B64 takes precedence over c4gh.filepath.
+func c4ghKeySource() (keySource, time.Duration, error) {
+	if viper.GetString("c4gh.source") != "vault" {
+		passphrase, err := c4ghPassphrase()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if encoded, ok := os.LookupEnv("C4GH_KEY_B64"); ok {
+			key, err := decodeInlineKey(encoded)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			return inlineKeySource{key: key, passphrase: passphrase}, 0, nil
+		}
+
+		return fileKeySource{
+			path:       viper.GetString("c4gh.filepath"),
+			passphrase: passphrase,
+		}, 0, nil
+	}
+
+	viper.SetDefault("c4gh.vault.authMethod", "token")
+	viper.SetDefault("c4gh.vault.authPath", "kubernetes")
+	viper.SetDefault("c4gh.vault.jwtPath", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	viper.SetDefault("c4gh.vault.mount", "secret")
+	viper.SetDefault("c4gh.vault.kvVersion", 2)
+	viper.SetDefault("c4gh.vault.keyField", "key")
+	viper.SetDefault("c4gh.vault.passphraseField", "passphrase")
+
+	return &vaultKeySource{
+		Address:         strings.TrimSuffix(viper.GetString("c4gh.vault.address"), "/"),
+		Token:           viper.GetString("c4gh.vault.token"),
+		AuthMethod:      viper.GetString("c4gh.vault.authMethod"),
+		AuthPath:        strings.Trim(viper.GetString("c4gh.vault.authPath"), "/"),
+		Role:            viper.GetString("c4gh.vault.role"),
+		JWTPath:         viper.GetString("c4gh.vault.jwtPath"),
+		Mount:           strings.Trim(viper.GetString("c4gh.vault.mount"), "/"),
+		Path:            strings.Trim(viper.GetString("c4gh.vault.path"), "/"),
+		KVVersion:       viper.GetInt("c4gh.vault.kvVersion"),
+		KeyField:        viper.GetString("c4gh.vault.keyField"),
+		PassphraseField: viper.GetString("c4gh.vault.passphraseField"),
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}, viper.GetDuration("c4gh.vault.ttl"), nil
+}
+
+// c4ghPassphrase returns the passphrase for the c4gh key file, read from the
+// file named by C4GH_PASSPHRASE_FILE, from C4GH_PASSPHRASE or, for existing
+// setups, from c4gh.passphrase in that order
+func c4ghPassphrase() (string, error) {
+	if passphraseFile, ok := os.LookupEnv("C4GH_PASSPHRASE_FILE"); ok {
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the c4gh passphrase from C4GH_PASSPHRASE_FILE: %v", err)
+		}
+
+		return strings.TrimRight(string(passphrase), "\r\n"), nil
+	}
+
+	if passphrase, ok := os.LookupEnv("C4GH_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+
+	if viper.IsSet("c4gh.passphrase") {
+		log.Debug("Using c4gh.passphrase from the configuration, prefer C4GH_PASSPHRASE or C4GH_PASSPHRASE_FILE")
+	}
+
+	return viper.GetString("c4gh.passphrase"), nil
+}
+
+func (s *vaultKeySource) fetch() ([]byte, []byte, error) {
+	if s.Address == "" || s.Path == "" {
+		return nil, nil, fmt.Errorf("c4gh.vault.address and c4gh.vault.path are needed to read the key from vault")
+	}
+
+	token, err := s.token()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s", s.Address, s.Mount, s.Path)
+	if s.KVVersion == 2 {
+		url = fmt.Sprintf("%s/v1/%s/data/%s", s.Address, s.Mount, s.Path)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := s.do(req, &secret); err != nil {
+		return nil, nil, fmt.Errorf("failed to read c4gh key from vault: %v", err)
+	}
+
+	data := secret.Data
+	if s.KVVersion == 2 {
+		data, _ = secret.Data["data"].(map[string]interface{})
+	}
+
+	key, _ := data[s.KeyField].(string)
+	if key == "" {
+		return nil, nil, fmt.Errorf("vault secret %s has no field '%s'", s.Path, s.KeyField)
+	}
+	passphrase, _ := data[s.PassphraseField].(string)
+
+	return []byte(key), []byte(passphrase), nil
+}
+
+// token returns the vault token to use, logging in with the kubernetes
+// service account token when configured to do so
+func (s *vaultKeySource) token() (string, error) {
+	switch s.AuthMethod {
+	case "token":
+		if s.Token == "" {
+			return "", fmt.Errorf("c4gh.vault.token is needed for vault token authentication")
+		}
+
+		return s.Token, nil
+	case "kubernetes":
+		jwt, err := os.ReadFile(s.JWTPath)
+		if err != nil {
+			return "", err
+		}
+
+		body, _ := json.Marshal(map[string]string{"role": s.Role, "jwt": strings.TrimSpace(string(jwt))})
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/auth/%s/login", s.Address, s.AuthPath), bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := s.do(req, &login); err != nil {
+			return "", fmt.Errorf("vault kubernetes login failed: %v", err)
+		}
+
+		return login.Auth.ClientToken, nil
+	default:
+		return "", fmt.Errorf("c4gh.vault.authMethod '%s' not supported", s.AuthMethod)
+	}
+}
+
+// do performs the request and decodes the json response into dest
+func (s *vaultKeySource) do(req *http.Request, dest interface{}) error {
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(res.Body).Decode(dest)
+}
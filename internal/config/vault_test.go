@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault serves the dev c4gh key from a KV v2 secret and counts reads
+func fakeVault(reads *int) *httptest.Server {
+	key, _ := os.ReadFile("../../dev_utils/c4gh.sec.pem")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		var login map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&login)
+		if login["role"] != "verify" || login["jwt"] != "sa-token" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"k8s-token"}}`))
+	})
+	mux.HandleFunc("/v1/secret/data/c4gh", func(w http.ResponseWriter, r *http.Request) {
+		if t := r.Header.Get("X-Vault-Token"); t != "root" && t != "k8s-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+
+			return
+		}
+		*reads++
+		body, _ := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": map[string]string{
+					"key":        string(key),
+					"passphrase": "oaagCP1YgAZeEyl2eJAkHv9lkcWXWFgm",
+				},
+			},
+		})
+		_, _ = w.Write(body)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func (suite *TestSuite) TestGetC4GHKey_vaultToken() {
+	reads := 0
+	ts := fakeVault(&reads)
+	defer ts.Close()
+	defer func() { cachedKey.key = nil }()
+
+	viper.Set("c4gh.source", "vault")
+	viper.Set("c4gh.vault.address", ts.URL)
+	viper.Set("c4gh.vault.path", "c4gh")
+	viper.Set("c4gh.vault.token", "wrong")
+
+	key, err := GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.ErrorContains(suite.T(), err, "403 Forbidden")
+
+	viper.Set("c4gh.vault.token", "root")
+	key, err = GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+
+	// served from the cache
+	_, err = GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 1, reads)
+
+	// re-fetched once the ttl has passed
+	viper.Set("c4gh.vault.ttl", "1ms")
+	time.Sleep(2 * time.Millisecond)
+	again, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), key, again)
+	assert.Equal(suite.T(), 2, reads)
+}
+
+func (suite *TestSuite) TestGetC4GHKey_vaultKubernetes() {
+	reads := 0
+	ts := fakeVault(&reads)
+	defer ts.Close()
+	defer func() { cachedKey.key = nil }()
+
+	jwt := filepath.Join(suite.T().TempDir(), "token")
+	assert.NoError(suite.T(), os.WriteFile(jwt, []byte("sa-token\n"), 0600))
+
+	viper.Set("c4gh.source", "vault")
+	viper.Set("c4gh.vault.address", ts.URL)
+	viper.Set("c4gh.vault.path", "c4gh")
+	viper.Set("c4gh.vault.authMethod", "kubernetes")
+	viper.Set("c4gh.vault.role", "verify")
+	viper.Set("c4gh.vault.jwtPath", jwt)
+
+	key, err := GetC4GHKey()
+	assert.NoError(suite.T(), err)
+	assert.NotNil(suite.T(), key)
+	assert.Equal(suite.T(), 1, reads)
+}
+
+func (suite *TestSuite) TestGetC4GHKey_vaultMissingConfig() {
+	viper.Set("c4gh.source", "vault")
+
+	key, err := GetC4GHKey()
+	assert.Nil(suite.T(), key)
+	assert.EqualError(suite.T(), err, "c4gh.vault.address and c4gh.vault.path are needed to read the key from vault")
+}
+
+func (suite *TestSuite) TestC4GHKeyring_vault() {
+	reads := 0
+	ts := fakeVault(&reads)
+	defer func() { cachedKey.key, cachedKey.failedAt = nil, time.Time{} }()
+
+	viper.Set("c4gh.source", "vault")
+	viper.Set("c4gh.vault.address", ts.URL)
+	viper.Set("c4gh.vault.path", "c4gh")
+	viper.Set("c4gh.vault.token", "root")
+	viper.Set("c4gh.vault.ttl", "1ms")
+	viper.Set("c4gh.retryDelay", "1h")
+
+	keyring, err := NewC4GHKeyring()
+	assert.NoError(suite.T(), err)
+	key := keyring.Key()
+	assert.NotNil(suite.T(), key)
+	assert.Equal(suite.T(), 1, reads)
+
+	// the key is fetched again once the ttl has passed
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(suite.T(), []*[32]byte{key}, keyring.Keys())
+	assert.Equal(suite.T(), 2, reads)
+
+	// and kept while vault can't be reached, without asking again before
+	// the retry delay
+	ts.Close()
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(suite.T(), key, keyring.Key())
+	assert.Equal(suite.T(), key, keyring.Key())
+	assert.False(suite.T(), cachedKey.failedAt.IsZero())
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// headerCache is a least recently used cache of file headers keyed by file
+// id, whose entries expire after a fixed time
+type headerCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[int64]*list.Element
+}
+
+// cachedHeader is the value kept in the list of a headerCache
+type cachedHeader struct {
+	fileID   int64
+	header   []byte
+	storedAt time.Time
+}
+
+// newHeaderCache returns a cache holding at most size headers for ttl each,
+// a zero ttl meaning they don't expire
+func newHeaderCache(size int, ttl time.Duration) *headerCache {
+	return &headerCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[int64]*list.Element),
+	}
+}
+
+// get returns the cached header for fileID, if there is one that hasn't
+// expired
+func (c *headerCache) get(fileID int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[fileID]
+	if !ok {
+		return nil, false
+	}
+
+	h := e.Value.(*cachedHeader)
+	if c.ttl > 0 && time.Since(h.storedAt) > c.ttl {
+		c.order.Remove(e)
+		delete(c.entries, fileID)
+
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+
+	return h.header, true
+}
+
+// put stores header for fileID, evicting the least recently used header
+// when the cache is full
+func (c *headerCache) put(fileID int64, header []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[fileID]; ok {
+		e.Value = &cachedHeader{fileID: fileID, header: header, storedAt: time.Now()}
+		c.order.MoveToFront(e)
+
+		return
+	}
+
+	c.entries[fileID] = c.order.PushFront(&cachedHeader{fileID: fileID, header: header, storedAt: time.Now()})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedHeader).fileID)
+	}
+}
+
+// remove drops the header for fileID from the cache
+func (c *headerCache) remove(fileID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[fileID]; ok {
+		c.order.Remove(e)
+		delete(c.entries, fileID)
+	}
+}
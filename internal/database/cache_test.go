@@ -0,0 +1,39 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderCache(t *testing.T) {
+	c := newHeaderCache(2, 0)
+
+	c.put(1, []byte("one"))
+	c.put(2, []byte("two"))
+	_, ok := c.get(1)
+	assert.True(t, ok)
+
+	// 2 is now the least recently used
+	c.put(3, []byte("three"))
+	_, ok = c.get(2)
+	assert.False(t, ok, "least recently used header should have been evicted")
+	h, ok := c.get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("one"), h)
+
+	c.put(1, []byte("uno"))
+	h, _ = c.get(1)
+	assert.Equal(t, []byte("uno"), h)
+
+	c.remove(1)
+	_, ok = c.get(1)
+	assert.False(t, ok)
+
+	expiring := newHeaderCache(2, time.Millisecond)
+	expiring.put(1, []byte("one"))
+	time.Sleep(5 * time.Millisecond)
+	_, ok = expiring.get(1)
+	assert.False(t, ok, "expired header should not be returned")
+}
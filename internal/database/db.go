@@ -3,235 +3,1963 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"net"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+)
+
+// Database defines methods to be implemented by SQLdb
+type Database interface {
+	GetHeader(fileID int) ([]byte, error)
+	MarkCompleted(checksum string, fileID int) error
+	MarkReady(accessionID, user, filepath, checksum string) error
+	GetArchived(user, filepath, checksum string) (string, int, error)
+	Close()
+}
+
+// SQLdb struct that acts as a receiver for the DB update methods
+type SQLdb struct {
+	// DB is the connection pool, it is replaced when reconnecting so
+	// methods get it with pool rather than reading the field
+	DB       *sql.DB
+	ConnInfo string
+	conf     DBConf
+	headers  *headerCache
+	// replica serves the read-only queries when a replica is configured
+	replica *sql.DB
+	// poolMu guards DB against being replaced while it is read
+	poolMu sync.RWMutex
+	// reconnectMu keeps simultaneous reconnects from opening a pool each
+	reconnectMu sync.Mutex
+}
+
+// DBConf stores information about the database backend
+type DBConf struct {
+	Host       string
+	Port       int
+	User       string
+	Password   string `redact:"true"`
+	Database   string
+	CACert     string
+	SslMode    string
+	ClientCert string
+	ClientKey  string
+	// Connection pool settings, zero keeps the database/sql default of no
+	// limit on open connections, two idle connections and reusing
+	// connections forever
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// StatementTimeout bounds each statement run by the context aware
+	// methods, zero means dbStatementTimeout
+	StatementTimeout time.Duration
+	// HeaderCacheSize is the number of headers kept in memory by GetHeader,
+	// zero disables the cache
+	HeaderCacheSize int
+	// HeaderCacheTTL is how long a cached header is used, zero means until
+	// it is evicted or replaced with StoreHeader
+	HeaderCacheTTL time.Duration
+	// ReplicaHost is a read replica that read-only queries are sent to,
+	// using the same credentials and TLS settings as the primary. ReplicaPort
+	// defaults to Port.
+	ReplicaHost string
+	ReplicaPort int
+	// RunMigrations applies the pending schema migrations in NewDB, or only
+	// logs them with MigrationsDryRun
+	RunMigrations    bool
+	MigrationsDryRun bool
+	// Service names the service instance using the database, it is recorded
+	// with the file state transitions
+	Service string
+	// ReconnectAttempts is how many times Reconnect tries to connect, zero
+	// means dbReconnectAttempts
+	ReconnectAttempts int
+}
+
+// FileInfo is used by ingest for file metadata (path, size, checksum)
+type FileInfo struct {
+	Checksum          hash.Hash
+	Size              int64
+	Path              string
+	DecryptedChecksum hash.Hash
+	DecryptedSize     int64
+	// VerifiedBy names the service instance that verified the file, it is
+	// recorded by MarkCompleted
+	VerifiedBy string
+	// ID is the database id of the file, set by GetFileByAccession
+	ID int64
+	// User and InboxPath are who submitted the file and where to, set by
+	// GetFile
+	User      string
+	InboxPath string
+}
+
+// Progress holds how far the verification of a file has come
+type Progress struct {
+	FileID     int
+	BytesDone  int64
+	TotalBytes int64
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Checkpoint is how far verifying a file got, for verifying it to resume
+// from
+type Checkpoint struct {
+	FileID int
+	// ArchiveOffset is how many bytes of the archive file were read
+	ArchiveOffset int64
+	// ArchiveSize is the size of the archive file when it was read
+	ArchiveSize int64
+	// DecryptedSize is how many bytes they decrypted to
+	DecryptedSize int64
+	// State is the state of the hashes, as saved by verify
+	State     []byte
+	UpdatedAt time.Time
+}
+
+// dbRetryTimes is the number of times to retry the same function if it fails
+var dbRetryTimes = 8
+
+// dbReconnectTimeout is how long to try to re-establish a connection to the database
+var dbReconnectTimeout = 5 * time.Minute
+
+// dbReconnectSleep is how long to wait between attempts to connect to the database
+var dbReconnectSleep = 5 * time.Second
+
+// dbReconnectAttempts is how many times Reconnect tries to connect unless
+// configured otherwise
+var dbReconnectAttempts = 5
+
+// dbRetryBackoff is how long to wait before the first retry after a
+// transient error, doubled for every following retry up to dbRetryMaxBackoff
+var dbRetryBackoff = 500 * time.Millisecond
+
+// dbRetryMaxBackoff is the longest wait between retries after transient
+// errors
+var dbRetryMaxBackoff = 10 * time.Second
+
+// dbStatementTimeout is how long a statement may run unless configured
+// otherwise
+var dbStatementTimeout = 30 * time.Second
+
+// sqlOpen is an internal variable to ease testing
+var sqlOpen = sql.Open
+
+// logFatalf is an internal variable to ease testing
+var logFatalf = log.Fatalf
+
+// StatusRemoved is the status of files withdrawn with MarkRemoved, which
+// are kept for the audit trail but not processed any further
+const StatusRemoved = "REMOVED"
+
+// ErrFileRemoved is returned when changing the status of a file marked as
+// "REMOVED", which is left as it is
+var ErrFileRemoved = errors.New("file has been removed")
+
+// ErrAlreadyCompleted is returned by MarkCompleted when the file was already
+// marked as "COMPLETED", in which case nothing is changed
+var ErrAlreadyCompleted = errors.New("file is already marked completed")
+
+// ErrFileNotFound is returned by GetFileByAccession when no file has the
+// accession id
+var ErrFileNotFound = errors.New("no file with the accession id")
+
+// ErrNoFileID is returned by GetFile when no file has the file id
+var ErrNoFileID = errors.New("no file with the file id")
+
+// ErrNoCorrelationID is returned by GetCorrelationID for files ingested
+// without a recorded correlation id
+var ErrNoCorrelationID = errors.New("no correlation id recorded for the file")
+
+// hashType returns the identification string for the hash type
+func hashType(h hash.Hash) string {
+	// TODO: Support/check type
+	return "SHA256"
+}
+
+// NewDB creates a new DB connection
+func NewDB(config DBConf) (*SQLdb, error) {
+	connInfo := buildConnInfo(config)
+
+	log.Debugf("Connecting to DB %s:%d on database: %s with user: %s", config.Host, config.Port, config.Database, config.User)
+	db, err := sqlOpen("postgres", connInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	setPoolLimits(db, config)
+
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+
+	dbs := &SQLdb{DB: db, ConnInfo: connInfo, conf: config}
+
+	if config.ReplicaHost != "" {
+		replicaConf := config
+		replicaConf.Host = config.ReplicaHost
+		if config.ReplicaPort != 0 {
+			replicaConf.Port = config.ReplicaPort
+		}
+
+		log.Debugf("Connecting to DB replica %s:%d", replicaConf.Host, replicaConf.Port)
+		dbs.replica, err = sqlOpen("postgres", buildConnInfo(replicaConf))
+		if err != nil {
+			return nil, err
+		}
+
+		setPoolLimits(dbs.replica, config)
+
+		if err = dbs.replica.Ping(); err != nil {
+			return nil, fmt.Errorf("failed to connect to the database replica: %v", err)
+		}
+	}
+
+	if config.RunMigrations {
+		if _, err := dbs.Migrate(config.MigrationsDryRun); err != nil {
+			return nil, fmt.Errorf("database migration failed: %v", err)
+		}
+	}
+
+	if config.HeaderCacheSize > 0 {
+		dbs.headers = newHeaderCache(config.HeaderCacheSize, config.HeaderCacheTTL)
+	}
+
+	return dbs, nil
+}
+
+// setPoolLimits applies the connection pool settings that are set to db
+func setPoolLimits(db *sql.DB, config DBConf) {
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+}
+
+// buildConnInfo builds a connection string for the database
+func buildConnInfo(config DBConf) string {
+	connInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.Host, config.Port, config.User, config.Password, config.Database, config.SslMode)
+
+	if config.SslMode == "disable" {
+		return connInfo
+	}
+
+	if config.CACert != "" {
+		connInfo += fmt.Sprintf(" sslrootcert=%s", config.CACert)
+	}
+
+	if config.ClientCert != "" {
+		connInfo += fmt.Sprintf(" sslcert=%s", config.ClientCert)
+	}
+
+	if config.ClientKey != "" {
+		connInfo += fmt.Sprintf(" sslkey=%s", config.ClientKey)
+	}
+
+	return connInfo
+}
+
+// Reconnect replaces the connection pool with a new one, trying up to
+// ReconnectAttempts times with backoff until a ping passes. Calls made while
+// another call is reconnecting wait for it, and don't open a pool of their
+// own when it succeeded. The current pool is kept until a new one answers.
+func (dbs *SQLdb) Reconnect() error {
+	dbs.reconnectMu.Lock()
+	defer dbs.reconnectMu.Unlock()
+
+	if db := dbs.pool(); db != nil && dbs.ping(db) == nil {
+		return nil
+	}
+
+	attempts := dbs.conf.ReconnectAttempts
+	if attempts <= 0 {
+		attempts = dbReconnectAttempts
+	}
+	backoff := dbRetryBackoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		log.Debugf("Reconnecting to the database (attempt %d of %d)", attempt, attempts)
+
+		if err = dbs.reopen(); err == nil {
+			return nil
+		}
+		log.Debugf("Failed to reconnect to the database (attempt %d of %d): %v", attempt, attempts, err)
+
+		if attempt == attempts {
+			break
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > dbRetryMaxBackoff {
+			backoff = dbRetryMaxBackoff
+		}
+	}
+
+	return fmt.Errorf("failed to reconnect to the database after %d attempts: %v", attempts, err)
+}
+
+// reopen opens a new connection pool and swaps it in once a ping passes.
+// The caller must hold reconnectMu.
+func (dbs *SQLdb) reopen() error {
+	db, err := sqlOpen("postgres", dbs.ConnInfo)
+	if err != nil {
+		return err
+	}
+	setPoolLimits(db, dbs.conf)
+	if err = dbs.ping(db); err != nil {
+		db.Close()
+
+		return err
+	}
+
+	dbs.poolMu.Lock()
+	old := dbs.DB
+	dbs.DB = db
+	dbs.poolMu.Unlock()
+
+	dbs.retire(old)
+
+	return nil
+}
+
+// retire closes a replaced pool once the statements that may have been
+// started on it by other goroutines have had time to finish
+func (dbs *SQLdb) retire(db *sql.DB) {
+	if db == nil {
+		return
+	}
+
+	ctx, cancel := dbs.statementContext(context.Background())
+	go func() {
+		<-ctx.Done()
+		cancel()
+		db.Close()
+	}()
+}
+
+// pool returns the current connection pool
+func (dbs *SQLdb) pool() *sql.DB {
+	dbs.poolMu.RLock()
+	defer dbs.poolMu.RUnlock()
+
+	return dbs.DB
+}
+
+// ping checks the connection of db, waiting at most the statement timeout
+func (dbs *SQLdb) ping(db *sql.DB) error {
+	ctx, cancel := dbs.statementContext(context.Background())
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+// checkAndReconnectIfNeeded validates the current connection with a ping
+// and tries to reconnect if necessary
+func (dbs *SQLdb) checkAndReconnectIfNeeded() {
+	start := time.Now()
+
+	for dbs.pool().Ping() != nil {
+		log.Errorln("Database unreachable, reconnecting")
+
+		if time.Since(start) > dbReconnectTimeout {
+			logFatalf("Could not reconnect to failed database in reasonable time, giving up")
+		}
+		time.Sleep(dbReconnectSleep)
+		log.Debugln("Reconnecting to DB")
+		dbs.reconnectOnce()
+	}
+
+}
+
+// reconnectOnce makes one attempt at replacing the pool, unless another
+// goroutine replaced it with one that answers while waiting for the lock
+func (dbs *SQLdb) reconnectOnce() {
+	dbs.reconnectMu.Lock()
+	defer dbs.reconnectMu.Unlock()
+
+	if dbs.pool().Ping() == nil {
+		return
+	}
+	if err := dbs.reopen(); err != nil {
+		log.Debugf("Failed to reconnect to the database: %v", err)
+	}
+}
+
+// reader returns the connection to use for read-only queries, the replica
+// if there is one
+func (dbs *SQLdb) reader() *sql.DB {
+	if dbs.replica != nil {
+		return dbs.replica
+	}
+
+	return dbs.pool()
+}
+
+// statementContext returns a context for running a single statement,
+// bounded by the configured statement timeout
+func (dbs *SQLdb) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := dbs.conf.StatementTimeout
+	if timeout == 0 {
+		timeout = dbStatementTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError wraps err with the reason ctx is done, if it is, as the
+// driver reports a cancelled statement with an error of its own
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+
+	return err
+}
+
+// isTransient reports whether err is a connection problem or a conflict
+// with another transaction, such as seen during a database failover, that
+// is likely to go away when the operation is retried
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+
+		// Class 08 holds the connection exceptions
+		return pqErr.Code.Class() == "08"
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr)
+}
+
+// IsTransient reports whether err, returned by the database, is a connection
+// problem or a conflict that may go away when the operation is retried
+func IsTransient(err error) bool {
+	return isTransient(err)
+}
+
+// retryTransient runs op, reconnecting and retrying it with backoff as long
+// as it fails with a transient error, at most dbRetryTimes times in total.
+// Other errors are returned right away.
+func (dbs *SQLdb) retryTransient(ctx context.Context, op func() error) error {
+	backoff := dbRetryBackoff
+
+	err := op()
+	for attempt := 1; err != nil && attempt < dbRetryTimes && isTransient(err); attempt++ {
+		log.Warnf("Transient database error, reconnecting and retrying in %v (attempt %d of %d): %v", backoff, attempt, dbRetryTimes-1, err)
+		// A failed reconnect shows when op is run again
+		_ = dbs.Reconnect()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > dbRetryMaxBackoff {
+			backoff = dbRetryMaxBackoff
+		}
+
+		err = op()
+	}
+
+	return err
+}
+
+// Health is the result of HealthCheck
+type Health struct {
+	// Latency is how long the check took
+	Latency time.Duration
+	// MissingTables lists the required tables that don't exist
+	MissingTables []string
+}
+
+// HealthCheck checks that the database answers queries and that the given
+// tables, such as local_ega.files, exist, which a ping doesn't tell when
+// connected to the wrong database. An error is returned when the check
+// fails for any reason.
+func (dbs *SQLdb) HealthCheck(ctx context.Context, tables ...string) (health Health, err error) {
+	db := dbs.pool()
+	if db == nil {
+		return health, errors.New("database is nil")
+	}
+
+	start := time.Now()
+	defer func() { health.Latency = time.Since(start) }()
+
+	var one int
+	if err = db.QueryRowContext(ctx, "SELECT 1;").Scan(&one); err != nil {
+		return health, err
+	}
+
+	for _, table := range tables {
+		var exists bool
+		if err = db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL;", table).Scan(&exists); err != nil {
+			return health, err
+		}
+		if !exists {
+			health.MissingTables = append(health.MissingTables, table)
+		}
+	}
+
+	if len(health.MissingTables) != 0 {
+		return health, fmt.Errorf("missing tables: %s", strings.Join(health.MissingTables, ", "))
+	}
+
+	return health, nil
+}
+
+// GetHeader retrieves the file header
+func (dbs *SQLdb) GetHeader(fileID int) ([]byte, error) {
+	return dbs.GetHeaderContext(context.Background(), fileID)
+}
+
+// GetHeaderContext retrieves the file header, giving up when ctx is done.
+// Transient errors are retried. When the header cache is enabled a cached
+// header is returned without asking the database, the returned header must
+// not be modified.
+func (dbs *SQLdb) GetHeaderContext(ctx context.Context, fileID int) ([]byte, error) {
+	if dbs.headers != nil {
+		if header, ok := dbs.headers.get(int64(fileID)); ok {
+			return header, nil
+		}
+	}
+
+	var r []byte
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		r, err = dbs.getHeader(ctx, fileID)
+
+		return err
+	})
+
+	if err == nil && dbs.headers != nil {
+		dbs.headers.put(int64(fileID), r)
+	}
+
+	return r, err
+}
+
+// getHeader is the actual function performing work for GetHeader
+func (dbs *SQLdb) getHeader(ctx context.Context, fileID int) (_ []byte, err error) {
+	defer observeQuery("get_header", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT header from local_ega.files WHERE id = $1"
+
+	var hexString string
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&hexString); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	header, err := hex.DecodeString(hexString)
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// GetHeaders retrieves the headers of several files in a single query,
+// keyed by file id. Files that don't exist are left out of the map rather
+// than causing an error. Cached headers are used when the header cache is
+// enabled, and the returned headers must not be modified.
+func (dbs *SQLdb) GetHeaders(fileIDs []int) (map[int][]byte, error) {
+	headers := make(map[int][]byte, len(fileIDs))
+
+	var missing []int
+	for _, fileID := range fileIDs {
+		if dbs.headers != nil {
+			if header, ok := dbs.headers.get(int64(fileID)); ok {
+				headers[fileID] = header
+
+				continue
+			}
+		}
+		missing = append(missing, fileID)
+	}
+	if len(missing) == 0 {
+		return headers, nil
+	}
+
+	ctx := context.Background()
+
+	var found map[int][]byte
+	err := dbs.retryTransient(ctx, func() (err error) {
+		found, err = dbs.getHeaders(ctx, missing)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for fileID, header := range found {
+		headers[fileID] = header
+		if dbs.headers != nil {
+			dbs.headers.put(int64(fileID), header)
+		}
+	}
+
+	return headers, nil
+}
+
+// getHeaders is the actual function performing work for GetHeaders
+func (dbs *SQLdb) getHeaders(ctx context.Context, fileIDs []int) (_ map[int][]byte, err error) {
+	defer observeQuery("get_headers", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	ids := make(pq.Int64Array, len(fileIDs))
+	for i, fileID := range fileIDs {
+		ids[i] = int64(fileID)
+	}
+
+	db := dbs.reader()
+	const query = "SELECT id, header from local_ega.files WHERE id = ANY($1)"
+
+	rows, err := db.QueryContext(ctx, query, ids)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	headers := make(map[int][]byte, len(fileIDs))
+	for rows.Next() {
+		var (
+			fileID    int
+			hexString string
+		)
+		if err = rows.Scan(&fileID, &hexString); err != nil {
+			return nil, err
+		}
+
+		if headers[fileID], err = hex.DecodeString(hexString); err != nil {
+			return nil, fmt.Errorf("bad header for file %d: %v", fileID, err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return headers, nil
+}
+
+// GetFileStatus returns the current status of the file, such as ARCHIVED,
+// COMPLETED or ERROR
+func (dbs *SQLdb) GetFileStatus(fileID int) (string, error) {
+	return dbs.GetFileStatusContext(context.Background(), fileID)
+}
+
+// GetFileStatusContext returns the current status of the file, giving up
+// when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetFileStatusContext(ctx context.Context, fileID int) (string, error) {
+	var status string
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		status, err = dbs.getFileStatus(ctx, fileID)
+
+		return err
+	})
+
+	return status, err
+}
+
+// getFileStatus performs actual work for GetFileStatus
+func (dbs *SQLdb) getFileStatus(ctx context.Context, fileID int) (_ string, err error) {
+	defer observeQuery("get_file_status", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT status from local_ega.files WHERE id = $1"
+
+	var status string
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&status); err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	return status, nil
+}
+
+// GetHeaderForStableId retrieves the file header by using stable id
+func (dbs *SQLdb) GetHeaderForStableId(stableID string) (string, error) {
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.pool()
+	const query = "SELECT header from local_ega.files WHERE stable_id = $1"
+
+	var header string
+	if err := db.QueryRow(query, stableID).Scan(&header); err != nil {
+		return "", err
+	}
+
+	return header, nil
+}
+
+// GetFileByAccession returns the database id, archive path and sizes of the
+// file with the accession id. The checksums are not set. ErrFileNotFound is
+// returned if there is no such file.
+func (dbs *SQLdb) GetFileByAccession(accessionID string) (FileInfo, error) {
+	return dbs.GetFileByAccessionContext(context.Background(), accessionID)
+}
+
+// GetFileByAccessionContext returns the file with the accession id, giving
+// up when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetFileByAccessionContext(ctx context.Context, accessionID string) (FileInfo, error) {
+	var file FileInfo
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		file, err = dbs.getFileByAccession(ctx, accessionID)
+
+		return err
+	})
+
+	return file, err
+}
+
+// getFileByAccession performs actual work for GetFileByAccession
+func (dbs *SQLdb) getFileByAccession(ctx context.Context, accessionID string) (_ FileInfo, err error) {
+	defer observeQuery("get_file_by_accession", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT id, archive_path, archive_filesize, decrypted_file_size " +
+		"FROM local_ega.files WHERE stable_id = $1"
+
+	var (
+		file          FileInfo
+		path          sql.NullString
+		size          sql.NullInt64
+		decryptedSize sql.NullInt64
+	)
+	err = db.QueryRowContext(ctx, query, accessionID).Scan(&file.ID, &path, &size, &decryptedSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FileInfo{}, ErrFileNotFound
+	}
+	if err != nil {
+		return FileInfo{}, contextError(ctx, err)
+	}
+
+	file.Path = path.String
+	file.Size = size.Int64
+	file.DecryptedSize = decryptedSize.Int64
+
+	return file, nil
+}
+
+// GetFile returns the archive path and size, the decrypted size, and who
+// submitted the file with fileID and where to
+func (dbs *SQLdb) GetFile(fileID int) (FileInfo, error) {
+	return dbs.GetFileContext(context.Background(), fileID)
+}
+
+// GetFileContext returns the file with fileID, giving up when ctx is done.
+// Transient errors are retried.
+func (dbs *SQLdb) GetFileContext(ctx context.Context, fileID int) (FileInfo, error) {
+	var file FileInfo
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		file, err = dbs.getFile(ctx, fileID)
+
+		return err
+	})
+
+	return file, err
+}
+
+// getFile performs actual work for GetFile
+func (dbs *SQLdb) getFile(ctx context.Context, fileID int) (_ FileInfo, err error) {
+	defer observeQuery("get_file", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT id, archive_path, archive_filesize, decrypted_file_size, elixir_id, inbox_path " +
+		"FROM local_ega.files WHERE id = $1"
+
+	var (
+		file          FileInfo
+		path          sql.NullString
+		size          sql.NullInt64
+		decryptedSize sql.NullInt64
+		user          sql.NullString
+		inboxPath     sql.NullString
+	)
+	err = db.QueryRowContext(ctx, query, fileID).Scan(&file.ID, &path, &size, &decryptedSize, &user, &inboxPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FileInfo{}, ErrNoFileID
+	}
+	if err != nil {
+		return FileInfo{}, contextError(ctx, err)
+	}
+
+	file.Path = path.String
+	file.Size = size.Int64
+	file.DecryptedSize = decryptedSize.Int64
+	file.User = user.String
+	file.InboxPath = inboxPath.String
+
+	return file, nil
+}
+
+// ListFilter selects the files returned by ListFiles and counted by
+// CountFiles, fields left at their zero value don't filter. Removed files
+// are only included when Status is "REMOVED".
+type ListFilter struct {
+	// Status is the status the files have, such as ARCHIVED or COMPLETED
+	Status string
+	// User is the user that submitted the files
+	User string
+	// CreatedAfter and CreatedBefore bound when the files were created,
+	// CreatedAfter inclusive and CreatedBefore exclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// where returns the WHERE clause for the filter and its arguments
+func (f ListFilter) where() (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	} else {
+		conditions = append(conditions, "status <> '"+StatusRemoved+"'")
+	}
+	if f.User != "" {
+		add("elixir_id = $%d", f.User)
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at >= $%d", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at < $%d", f.CreatedBefore)
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ListFiles returns a page of at most limit files matching filter, skipping
+// the first offset. Files are ordered by id, so pages don't overlap or skip
+// files that were there when the first page was read. CountFiles gives the
+// number of files for the filter.
+func (dbs *SQLdb) ListFiles(filter ListFilter, limit, offset int) ([]FileInfo, error) {
+	return dbs.ListFilesContext(context.Background(), filter, limit, offset)
+}
+
+// ListFilesContext returns a page of files matching filter, giving up when
+// ctx is done. Transient errors are retried.
+func (dbs *SQLdb) ListFilesContext(ctx context.Context, filter ListFilter, limit, offset int) ([]FileInfo, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset can't be negative, got %d", offset)
+	}
+
+	var files []FileInfo
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		files, err = dbs.listFiles(ctx, filter, limit, offset)
+
+		return err
+	})
+
+	return files, err
+}
+
+// listFiles performs actual work for ListFiles
+func (dbs *SQLdb) listFiles(ctx context.Context, filter ListFilter, limit, offset int) (_ []FileInfo, err error) {
+	defer observeQuery("list_files", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	where, args := filter.where()
+	query := "SELECT id, archive_path, archive_filesize, decrypted_file_size " +
+		"FROM local_ega.files" + where +
+		fmt.Sprintf(" ORDER BY id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2)
+
+	db := dbs.reader()
+	rows, err := db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	files := make([]FileInfo, 0, limit)
+	for rows.Next() {
+		var (
+			file          FileInfo
+			path          sql.NullString
+			size          sql.NullInt64
+			decryptedSize sql.NullInt64
+		)
+		if err = rows.Scan(&file.ID, &path, &size, &decryptedSize); err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		file.Path = path.String
+		file.Size = size.Int64
+		file.DecryptedSize = decryptedSize.Int64
+		files = append(files, file)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return files, nil
+}
 
-	// Needed implicitly to enable Postgres driver
-	_ "github.com/lib/pq"
-)
+// CountFiles returns the number of files matching filter, the total for
+// the pages returned by ListFiles
+func (dbs *SQLdb) CountFiles(filter ListFilter) (int, error) {
+	return dbs.CountFilesContext(context.Background(), filter)
+}
+
+// CountFilesContext returns the number of files matching filter, giving up
+// when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) CountFilesContext(ctx context.Context, filter ListFilter) (int, error) {
+	var count int
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		count, err = dbs.countFiles(ctx, filter)
+
+		return err
+	})
+
+	return count, err
+}
+
+// countFiles performs actual work for CountFiles
+func (dbs *SQLdb) countFiles(ctx context.Context, filter ListFilter) (_ int, err error) {
+	defer observeQuery("count_files", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	where, args := filter.where()
+	query := "SELECT COUNT(*) FROM local_ega.files" + where
+
+	var count int
+	if err = dbs.reader().QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return count, nil
+}
+
+// MarkCompleted marks the file as "COMPLETED" and records when, and by
+// file.VerifiedBy, it was verified. A file that already is "COMPLETED" is
+// left as it is and ErrAlreadyCompleted is returned, so that handling the
+// same message twice has no further effect. ErrFileRemoved is returned for
+// removed files.
+func (dbs *SQLdb) MarkCompleted(file FileInfo, fileID int) error {
+	return dbs.MarkCompletedContext(context.Background(), file, fileID)
+}
+
+// MarkCompletedContext marks the file as "COMPLETED", giving up when ctx is
+// done. Transient errors are retried.
+func (dbs *SQLdb) MarkCompletedContext(ctx context.Context, file FileInfo, fileID int) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.markCompleted(ctx, file, fileID)
+	})
+}
+
+// markCompleted performs actual work for MarkCompleted. The updates are
+// done in a transaction so that the file row is left untouched on failure.
+func (dbs *SQLdb) markCompleted(ctx context.Context, file FileInfo, fileID int) (err error) {
+	defer observeQuery("mark_completed", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	tx, err := dbs.pool().BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// A transaction whose context is done is already rolled back
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			log.Errorf("Failed to roll back marking file %d completed: %v", fileID, e)
+		}
+	}()
+
+	from, err := fileStatus(ctx, tx, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	switch from {
+	case "COMPLETED":
+		return ErrAlreadyCompleted
+	case StatusRemoved:
+		return ErrFileRemoved
+	}
+
+	// The status is checked again in case another delivery of the same
+	// message got here first
+	const completed = "UPDATE local_ega.files SET status = 'COMPLETED', " +
+		"archive_filesize = $2, " +
+		"archive_file_checksum = $3, " +
+		"archive_file_checksum_type = $4, " +
+		"decrypted_file_size = $5, " +
+		"decrypted_file_checksum = $6, " +
+		"decrypted_file_checksum_type = $7 " +
+		"WHERE id = $1 AND status <> 'COMPLETED';"
+	result, err := tx.ExecContext(ctx, completed,
+		fileID,
+		file.Size,
+		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
+		hashType(file.Checksum),
+		file.DecryptedSize,
+		fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)),
+		hashType(file.DecryptedChecksum))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrAlreadyCompleted
+	}
+
+	if _, err = tx.ExecContext(ctx, recordVerification, fileID, file.VerifiedBy); err != nil {
+		return contextError(ctx, err)
+	}
+
+	if err = dbs.logTransition(ctx, tx, fileID, from, "COMPLETED", "verified"); err != nil {
+		return contextError(ctx, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return contextError(ctx, err)
+	}
+
+	return nil
+}
+
+// recordVerification records when, and by whom, a file was verified. The
+// accession request of a file verified again is yet to be sent.
+const recordVerification = "INSERT INTO local_ega.file_verifications (file_id, verified_at, verified_by) " +
+	"VALUES ($1, now(), $2) " +
+	"ON CONFLICT (file_id) DO UPDATE SET verified_at = now(), verified_by = $2, accession_requested_at = NULL;"
+
+// BulkError holds, by file id, why files in a BulkMarkCompleted batch
+// couldn't be marked completed
+type BulkError map[int]error
+
+func (e BulkError) Error() string {
+	ids := make([]int, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	reasons := make([]string, len(ids))
+	for i, id := range ids {
+		reasons[i] = fmt.Sprintf("%d: %v", id, e[id])
+	}
+
+	return fmt.Sprintf("%d files could not be marked completed (%s)", len(ids), strings.Join(reasons, "; "))
+}
+
+// BulkMarkCompleted marks the files as "COMPLETED" like MarkCompleted, with
+// files[i] describing the file with id ids[i], in a single statement, and
+// logs their transitions. The batch is atomic: if any file can't be updated,
+// e.g. because it is already completed or removed, nothing is, and a
+// BulkError tells which files failed, with ErrAlreadyCompleted or
+// ErrFileRemoved.
+func (dbs *SQLdb) BulkMarkCompleted(files []FileInfo, ids []int) error {
+	if len(files) != len(ids) {
+		return fmt.Errorf("got %d files but %d ids", len(files), len(ids))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.bulkMarkCompleted(ctx, files, ids)
+	})
+}
+
+// bulkMarkCompleted performs actual work for BulkMarkCompleted
+func (dbs *SQLdb) bulkMarkCompleted(ctx context.Context, files []FileInfo, ids []int) (err error) {
+	defer observeQuery("bulk_mark_completed", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	var (
+		fileIDs           = make(pq.Int64Array, len(ids))
+		sizes             = make(pq.Int64Array, len(ids))
+		checksums         = make(pq.StringArray, len(ids))
+		checksumTypes     = make(pq.StringArray, len(ids))
+		decryptedSizes    = make(pq.Int64Array, len(ids))
+		decryptedSums     = make(pq.StringArray, len(ids))
+		decryptedSumTypes = make(pq.StringArray, len(ids))
+		verifiers         = make(pq.StringArray, len(ids))
+	)
+	for i, file := range files {
+		fileIDs[i] = int64(ids[i])
+		sizes[i] = file.Size
+		checksums[i] = fmt.Sprintf("%x", file.Checksum.Sum(nil))
+		checksumTypes[i] = hashType(file.Checksum)
+		decryptedSizes[i] = file.DecryptedSize
+		decryptedSums[i] = fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil))
+		decryptedSumTypes[i] = hashType(file.DecryptedChecksum)
+		verifiers[i] = file.VerifiedBy
+	}
+
+	tx, err := dbs.pool().BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			log.Errorf("Failed to roll back marking %d files completed: %v", len(ids), e)
+		}
+	}()
+
+	// Like MarkCompleted, files already completed or removed are left as
+	// they are, failing the batch
+	from, err := fileStatuses(ctx, tx, fileIDs)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	failed := BulkError{}
+	fromStatuses := make(pq.StringArray, len(ids))
+	for i, id := range ids {
+		status, ok := from[id]
+		switch {
+		case !ok:
+			failed[id] = errors.New("no such file")
+		case status == "COMPLETED":
+			failed[id] = ErrAlreadyCompleted
+		case status == StatusRemoved:
+			failed[id] = ErrFileRemoved
+		}
+		fromStatuses[i] = status
+	}
+	if len(failed) != 0 {
+		return failed
+	}
+
+	// The status is checked again in case another delivery got here first
+	const completed = "UPDATE local_ega.files AS f SET status = 'COMPLETED', " +
+		"archive_filesize = u.archive_filesize, " +
+		"archive_file_checksum = u.archive_file_checksum, " +
+		"archive_file_checksum_type = u.archive_file_checksum_type, " +
+		"decrypted_file_size = u.decrypted_file_size, " +
+		"decrypted_file_checksum = u.decrypted_file_checksum, " +
+		"decrypted_file_checksum_type = u.decrypted_file_checksum_type " +
+		"FROM UNNEST($1::bigint[], $2::bigint[], $3::text[], $4::text[], $5::bigint[], $6::text[], $7::text[]) " +
+		"AS u(id, archive_filesize, archive_file_checksum, archive_file_checksum_type, " +
+		"decrypted_file_size, decrypted_file_checksum, decrypted_file_checksum_type) " +
+		"WHERE f.id = u.id AND f.status NOT IN ('COMPLETED', 'REMOVED') RETURNING f.id;"
+	rows, err := tx.QueryContext(ctx, completed,
+		fileIDs, sizes, checksums, checksumTypes, decryptedSizes, decryptedSums, decryptedSumTypes)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	updated := make(map[int]bool, len(ids))
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+
+			return err
+		}
+		updated[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return contextError(ctx, err)
+	}
+
+	for _, id := range ids {
+		if !updated[id] {
+			failed[id] = ErrAlreadyCompleted
+		}
+	}
+	if len(failed) != 0 {
+		return failed
+	}
+
+	const record = "INSERT INTO local_ega.file_verifications (file_id, verified_at, verified_by) " +
+		"SELECT id, now(), verified_by FROM UNNEST($1::bigint[], $2::text[]) AS v(id, verified_by) " +
+		"ON CONFLICT (file_id) DO UPDATE SET verified_at = now(), verified_by = EXCLUDED.verified_by, accession_requested_at = NULL;"
+	if _, err = tx.ExecContext(ctx, record, fileIDs, verifiers); err != nil {
+		return contextError(ctx, err)
+	}
+
+	const transitions = "INSERT INTO local_ega.file_transitions " +
+		"(file_id, from_status, to_status, reason, correlation_id, service) " +
+		"SELECT t.id, t.from_status, 'COMPLETED', 'verified', c.correlation_id, $3 " +
+		"FROM UNNEST($1::bigint[], $2::text[]) AS t(id, from_status) " +
+		"LEFT JOIN local_ega.file_correlation AS c ON c.file_id = t.id;"
+	if _, err = tx.ExecContext(ctx, transitions, fileIDs, fromStatuses, dbs.conf.Service); err != nil {
+		return contextError(ctx, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return contextError(ctx, err)
+	}
+
+	return nil
+}
+
+// MarkError marks the file as "ERROR" and records why, with the time, in
+// local_ega.file_errors. ErrFileRemoved is returned for removed files.
+func (dbs *SQLdb) MarkError(fileID int, reason string) error {
+	return dbs.MarkErrorContext(context.Background(), fileID, reason)
+}
+
+// MarkErrorContext marks the file as "ERROR", giving up when ctx is done.
+// Transient errors are retried.
+func (dbs *SQLdb) MarkErrorContext(ctx context.Context, fileID int, reason string) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.markError(ctx, fileID, reason)
+	})
+}
+
+// markError performs actual work for MarkError
+func (dbs *SQLdb) markError(ctx context.Context, fileID int, reason string) (err error) {
+	defer observeQuery("mark_error", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	tx, err := dbs.pool().BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// A transaction whose context is done is already rolled back
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			log.Errorf("Failed to roll back marking file %d as failed: %v", fileID, e)
+		}
+	}()
+
+	from, err := fileStatus(ctx, tx, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if from == StatusRemoved {
+		return ErrFileRemoved
+	}
+
+	const query = "UPDATE local_ega.files SET status = 'ERROR' WHERE id = $1;"
+	result, err := tx.ExecContext(ctx, query, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	const record = "INSERT INTO local_ega.file_errors (file_id, reason) VALUES ($1, $2);"
+	if _, err = tx.ExecContext(ctx, record, fileID, reason); err != nil {
+		return contextError(ctx, err)
+	}
+
+	if err = dbs.logTransition(ctx, tx, fileID, from, "ERROR", reason); err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// MarkRemoved marks the file as withdrawn, with status "REMOVED", so that it
+// is no longer processed. Nothing is deleted: when and why the file was
+// removed is logged with LogTransition. Transient errors are retried.
+func (dbs *SQLdb) MarkRemoved(fileID int, reason string) error {
+	ctx := context.Background()
+
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.markRemoved(ctx, fileID, reason)
+	})
+}
+
+// markRemoved performs actual work for MarkRemoved
+func (dbs *SQLdb) markRemoved(ctx context.Context, fileID int, reason string) (err error) {
+	defer observeQuery("mark_removed", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	tx, err := dbs.pool().BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// A transaction whose context is done is already rolled back
+		if e := tx.Rollback(); e != nil && !errors.Is(e, sql.ErrTxDone) {
+			log.Errorf("Failed to roll back marking file %d removed: %v", fileID, e)
+		}
+	}()
+
+	from, err := fileStatus(ctx, tx, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if from == StatusRemoved {
+		return contextError(ctx, tx.Commit())
+	}
+
+	const query = "UPDATE local_ega.files SET status = 'REMOVED' WHERE id = $1;"
+	result, err := tx.ExecContext(ctx, query, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+
+	if err = dbs.logTransition(ctx, tx, fileID, from, StatusRemoved, reason); err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// querier is what fileStatus and logTransition need, so that they can run
+// both on their own and as part of a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// fileStatus returns the current status of the file
+func fileStatus(ctx context.Context, q querier, fileID int) (string, error) {
+	var status string
+	err := q.QueryRowContext(ctx, "SELECT status from local_ega.files WHERE id = $1", fileID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no file with id %d", fileID)
+	}
+
+	return status, err
+}
+
+// fileStatuses looks up the status of the files in tx, by file id. Files
+// that don't exist are left out.
+func fileStatuses(ctx context.Context, tx *sql.Tx, fileIDs pq.Int64Array) (map[int]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, status from local_ega.files WHERE id = ANY($1::bigint[])", fileIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[int]string, len(fileIDs))
+	for rows.Next() {
+		var (
+			id     int
+			status string
+		)
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
+		}
+		statuses[id] = status
+	}
+
+	return statuses, rows.Err()
+}
+
+// LogTransition appends a change of the file status, with the reason, to
+// the audit history in local_ega.file_transitions. The correlation id the
+// file was ingested with and the service are recorded with it.
+// MarkCompleted and MarkError log their transitions themselves. Transient
+// errors are retried.
+func (dbs *SQLdb) LogTransition(fileID int, from, to, reason string) error {
+	ctx := context.Background()
+
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.logTransitionOnce(ctx, fileID, from, to, reason)
+	})
+}
+
+// logTransitionOnce performs actual work for LogTransition
+func (dbs *SQLdb) logTransitionOnce(ctx context.Context, fileID int, from, to, reason string) (err error) {
+	defer observeQuery("log_transition", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	return contextError(ctx, dbs.logTransition(ctx, dbs.pool(), fileID, from, to, reason))
+}
+
+// logTransition records a file status change using q
+func (dbs *SQLdb) logTransition(ctx context.Context, q querier, fileID int, from, to, reason string) error {
+	const query = "INSERT INTO local_ega.file_transitions " +
+		"(file_id, from_status, to_status, reason, correlation_id, service) " +
+		"VALUES ($1, $2, $3, $4, (SELECT correlation_id FROM local_ega.file_correlation WHERE file_id = $1), $5);"
+	_, err := q.ExecContext(ctx, query, fileID, from, to, reason, dbs.conf.Service)
+
+	return err
+}
+
+// GetArchiveChecksum retrieves the archive file checksum recorded at
+// ingestion. Transient errors are retried.
+func (dbs *SQLdb) GetArchiveChecksum(fileID int) (string, error) {
+	return dbs.GetArchiveChecksumContext(context.Background(), fileID)
+}
+
+// GetArchiveChecksumContext retrieves the archive file checksum, giving up
+// when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetArchiveChecksumContext(ctx context.Context, fileID int) (string, error) {
+	var r string
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		r, err = dbs.getArchiveChecksum(ctx, fileID)
+
+		return err
+	})
+
+	return r, err
+}
+
+// getArchiveChecksum is the actual function performing work for GetArchiveChecksum
+func (dbs *SQLdb) getArchiveChecksum(ctx context.Context, fileID int) (_ string, err error) {
+	defer observeQuery("get_archive_checksum", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT archive_file_checksum from local_ega.files WHERE id = $1"
+
+	var checksum sql.NullString
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&checksum); err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	return checksum.String, nil
+}
+
+// GetArchiveSize returns the size of the archive file recorded at ingestion,
+// zero if there is none. Transient errors are retried.
+func (dbs *SQLdb) GetArchiveSize(fileID int) (int64, error) {
+	return dbs.GetArchiveSizeContext(context.Background(), fileID)
+}
+
+// GetArchiveSizeContext returns the size of the archive file, giving up when
+// ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetArchiveSizeContext(ctx context.Context, fileID int) (int64, error) {
+	var size int64
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		size, err = dbs.getArchiveSize(ctx, fileID)
+
+		return err
+	})
+
+	return size, err
+}
+
+// getArchiveSize is the actual function performing work for GetArchiveSize
+func (dbs *SQLdb) getArchiveSize(ctx context.Context, fileID int) (_ int64, err error) {
+	defer observeQuery("get_archive_size", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT archive_filesize from local_ega.files WHERE id = $1"
+
+	var size sql.NullInt64
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&size); err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return size.Int64, nil
+}
+
+// GetDecryptedSize returns the decrypted size recorded for the file when it
+// was verified, zero if there is none. Transient errors are retried.
+func (dbs *SQLdb) GetDecryptedSize(fileID int) (int64, error) {
+	return dbs.GetDecryptedSizeContext(context.Background(), fileID)
+}
+
+// GetDecryptedSizeContext returns the decrypted size of the file, giving up
+// when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetDecryptedSizeContext(ctx context.Context, fileID int) (int64, error) {
+	var size int64
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		size, err = dbs.getDecryptedSize(ctx, fileID)
+
+		return err
+	})
+
+	return size, err
+}
+
+// getDecryptedSize is the actual function performing work for GetDecryptedSize
+func (dbs *SQLdb) getDecryptedSize(ctx context.Context, fileID int) (_ int64, err error) {
+	defer observeQuery("get_decrypted_size", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.reader()
+	const query = "SELECT decrypted_file_size from local_ega.files WHERE id = $1"
+
+	var size sql.NullInt64
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&size); err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return size.Int64, nil
+}
+
+// GetDecryptedChecksum returns the sha256 checksum of the decrypted file
+// recorded when it was verified, empty if there is none. Transient errors
+// are retried.
+func (dbs *SQLdb) GetDecryptedChecksum(fileID int) (string, error) {
+	return dbs.GetDecryptedChecksumContext(context.Background(), fileID)
+}
+
+// GetDecryptedChecksumContext returns the checksum of the decrypted file,
+// giving up when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetDecryptedChecksumContext(ctx context.Context, fileID int) (string, error) {
+	var checksum string
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		checksum, err = dbs.getDecryptedChecksum(ctx, fileID)
+
+		return err
+	})
 
-// Database defines methods to be implemented by SQLdb
-type Database interface {
-	GetHeader(fileID int) ([]byte, error)
-	MarkCompleted(checksum string, fileID int) error
-	MarkReady(accessionID, user, filepath, checksum string) error
-	GetArchived(user, filepath, checksum string) (string, int, error)
-	Close()
+	return checksum, err
 }
 
-// SQLdb struct that acts as a receiver for the DB update methods
-type SQLdb struct {
-	DB       *sql.DB
-	ConnInfo string
+// getDecryptedChecksum is the actual function performing work for
+// GetDecryptedChecksum
+func (dbs *SQLdb) getDecryptedChecksum(ctx context.Context, fileID int) (_ string, err error) {
+	defer observeQuery("get_decrypted_checksum", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.pool()
+	const query = "SELECT decrypted_file_checksum from local_ega.files WHERE id = $1"
+
+	var checksum sql.NullString
+	if err := db.QueryRowContext(ctx, query, fileID).Scan(&checksum); err != nil {
+		return "", contextError(ctx, err)
+	}
+
+	return checksum.String, nil
 }
 
-// DBConf stores information about the database backend
-type DBConf struct {
-	Host       string
-	Port       int
-	User       string
-	Password   string
-	Database   string
-	CACert     string
-	SslMode    string
-	ClientCert string
-	ClientKey  string
+// MarkAccessionRequested records that the accession request of a verified
+// file was sent. Transient errors are retried.
+func (dbs *SQLdb) MarkAccessionRequested(fileID int) error {
+	return dbs.MarkAccessionRequestedContext(context.Background(), fileID)
 }
 
-// FileInfo is used by ingest for file metadata (path, size, checksum)
-type FileInfo struct {
-	Checksum          hash.Hash
-	Size              int64
-	Path              string
-	DecryptedChecksum hash.Hash
-	DecryptedSize     int64
+// MarkAccessionRequestedContext records that the accession request of the
+// file was sent, giving up when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) MarkAccessionRequestedContext(ctx context.Context, fileID int) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.markAccessionRequested(ctx, fileID)
+	})
 }
 
-// dbRetryTimes is the number of times to retry the same function if it fails
-var dbRetryTimes = 8
+// markAccessionRequested is the actual function performing work for
+// MarkAccessionRequested
+func (dbs *SQLdb) markAccessionRequested(ctx context.Context, fileID int) (err error) {
+	defer observeQuery("mark_accession_requested", time.Now(), &err)
 
-// dbReconnectTimeout is how long to try to re-establish a connection to the database
-var dbReconnectTimeout = 5 * time.Minute
+	dbs.checkAndReconnectIfNeeded()
 
-// dbReconnectSleep is how long to wait between attempts to connect to the database
-var dbReconnectSleep = 5 * time.Second
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
 
-// sqlOpen is an internal variable to ease testing
-var sqlOpen = sql.Open
+	db := dbs.pool()
+	const query = "UPDATE local_ega.file_verifications SET accession_requested_at = now() WHERE file_id = $1;"
 
-// logFatalf is an internal variable to ease testing
-var logFatalf = log.Fatalf
+	if _, err = db.ExecContext(ctx, query, fileID); err != nil {
+		return contextError(ctx, err)
+	}
 
-// hashType returns the identification string for the hash type
-func hashType(h hash.Hash) string {
-	// TODO: Support/check type
-	return "SHA256"
+	return nil
 }
 
-// NewDB creates a new DB connection
-func NewDB(config DBConf) (*SQLdb, error) {
-	connInfo := buildConnInfo(config)
+// GetAccessionRequested tells whether the accession request of the file was
+// sent since it was last verified, false if it wasn't verified. Transient
+// errors are retried.
+func (dbs *SQLdb) GetAccessionRequested(fileID int) (bool, error) {
+	return dbs.GetAccessionRequestedContext(context.Background(), fileID)
+}
 
-	log.Debugf("Connecting to DB %s:%d on database: %s with user: %s", config.Host, config.Port, config.Database, config.User)
-	db, err := sqlOpen("postgres", connInfo)
-	if err != nil {
-		return nil, err
-	}
+// GetAccessionRequestedContext tells whether the accession request of the file
+// was sent, giving up when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) GetAccessionRequestedContext(ctx context.Context, fileID int) (bool, error) {
+	var requested bool
 
-	if err = db.Ping(); err != nil {
-		return nil, err
-	}
+	err := dbs.retryTransient(ctx, func() (err error) {
+		requested, err = dbs.getAccessionRequested(ctx, fileID)
+
+		return err
+	})
 
-	return &SQLdb{DB: db, ConnInfo: connInfo}, nil
+	return requested, err
 }
 
-// buildConnInfo builds a connection string for the database
-func buildConnInfo(config DBConf) string {
-	connInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		config.Host, config.Port, config.User, config.Password, config.Database, config.SslMode)
+// getAccessionRequested is the actual function performing work for
+// GetAccessionRequested
+func (dbs *SQLdb) getAccessionRequested(ctx context.Context, fileID int) (_ bool, err error) {
+	defer observeQuery("get_accession_requested", time.Now(), &err)
 
-	if config.SslMode == "disable" {
-		return connInfo
-	}
+	dbs.checkAndReconnectIfNeeded()
 
-	if config.CACert != "" {
-		connInfo += fmt.Sprintf(" sslrootcert=%s", config.CACert)
-	}
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
 
-	if config.ClientCert != "" {
-		connInfo += fmt.Sprintf(" sslcert=%s", config.ClientCert)
-	}
+	db := dbs.pool()
+	const query = "SELECT accession_requested_at IS NOT NULL FROM local_ega.file_verifications WHERE file_id = $1"
 
-	if config.ClientKey != "" {
-		connInfo += fmt.Sprintf(" sslkey=%s", config.ClientKey)
+	var requested bool
+	err = db.QueryRowContext(ctx, query, fileID).Scan(&requested)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, contextError(ctx, err)
 	}
 
-	return connInfo
+	return requested, nil
 }
 
-func (dbs *SQLdb) Reconnect() {
-	dbs.DB.Close()
-	dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
+// UpdateArchiveChecksum replaces the recorded archive file checksum.
+// Transient errors are retried.
+func (dbs *SQLdb) UpdateArchiveChecksum(checksum string, fileID int) error {
+	return dbs.UpdateArchiveChecksumContext(context.Background(), checksum, fileID)
 }
 
-// checkAndReconnectIfNeeded validates the current connection with a ping
-// and tries to reconnect if necessary
-func (dbs *SQLdb) checkAndReconnectIfNeeded() {
-	start := time.Now()
+// UpdateArchiveChecksumContext replaces the recorded archive file checksum,
+// giving up when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) UpdateArchiveChecksumContext(ctx context.Context, checksum string, fileID int) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.updateArchiveChecksum(ctx, checksum, fileID)
+	})
+}
 
-	for dbs.DB.Ping() != nil {
-		log.Errorln("Database unreachable, reconnecting")
-		dbs.DB.Close()
+// updateArchiveChecksum performs actual work for UpdateArchiveChecksum
+func (dbs *SQLdb) updateArchiveChecksum(ctx context.Context, checksum string, fileID int) (err error) {
+	defer observeQuery("update_archive_checksum", time.Now(), &err)
 
-		if time.Since(start) > dbReconnectTimeout {
-			logFatalf("Could not reconnect to failed database in reasonable time, giving up")
-		}
-		time.Sleep(dbReconnectSleep)
-		log.Debugln("Reconnecting to DB")
-		dbs.DB, _ = sqlOpen("postgres", dbs.ConnInfo)
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.pool()
+	const query = "UPDATE local_ega.files SET archive_file_checksum = $1 WHERE id = $2;"
+	result, err := db.ExecContext(ctx, query, checksum, fileID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
 	}
+	return nil
+}
 
+// UpsertProgress records how many bytes of the file have been verified.
+// Transient errors are retried.
+func (dbs *SQLdb) UpsertProgress(fileID int, bytesDone, totalBytes int64) error {
+	return dbs.retryTransient(context.Background(), func() error {
+		return dbs.upsertProgress(fileID, bytesDone, totalBytes)
+	})
 }
 
-// GetHeader retrieves the file header
-func (dbs *SQLdb) GetHeader(fileID int) ([]byte, error) {
-	var (
-		r     []byte = nil
-		err   error  = nil
-		count int    = 0
-	)
+// upsertProgress performs actual work for UpsertProgress
+func (dbs *SQLdb) upsertProgress(fileID int, bytesDone, totalBytes int64) (err error) {
+	defer observeQuery("upsert_progress", time.Now(), &err)
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		r, err = dbs.getHeader(fileID)
-		count++
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.pool()
+	const query = "INSERT INTO local_ega.verify_progress(file_id, bytes_done, total_bytes, started_at, updated_at) " +
+		"VALUES($1, $2, $3, now(), now()) " +
+		"ON CONFLICT (file_id) DO UPDATE SET bytes_done = $2, total_bytes = $3, updated_at = now();"
+	result, err := db.Exec(query, fileID, bytesDone, totalBytes)
+	if err != nil {
+		return err
 	}
-	return r, err
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
+	return nil
 }
 
-// getHeader is the actual function performing work for GetHeader
-func (dbs *SQLdb) getHeader(fileID int) ([]byte, error) {
+// ClearProgress removes the progress of the file once it is no longer being
+// verified. Transient errors are retried.
+func (dbs *SQLdb) ClearProgress(fileID int) error {
+	return dbs.retryTransient(context.Background(), func() error {
+		return dbs.clearProgress(fileID)
+	})
+}
+
+// clearProgress performs actual work for ClearProgress
+func (dbs *SQLdb) clearProgress(fileID int) (err error) {
+	defer observeQuery("clear_progress", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
-	const query = "SELECT header from local_ega.files WHERE id = $1"
+	db := dbs.pool()
+	const query = "DELETE FROM local_ega.verify_progress WHERE file_id = $1;"
+	_, err = db.Exec(query, fileID)
+	return err
+}
 
-	var hexString string
-	if err := db.QueryRow(query, fileID).Scan(&hexString); err != nil {
-		return nil, err
-	}
+// GetProgress returns the verification progress of the file, or nil if the
+// file is not being verified. Transient errors are retried.
+func (dbs *SQLdb) GetProgress(fileID int) (*Progress, error) {
+	var p *Progress
 
-	header, err := hex.DecodeString(hexString)
+	err := dbs.retryTransient(context.Background(), func() (err error) {
+		p, err = dbs.getProgress(fileID)
+
+		return err
+	})
+
+	return p, err
+}
+
+// getProgress performs actual work for GetProgress
+func (dbs *SQLdb) getProgress(fileID int) (_ *Progress, err error) {
+	defer observeQuery("get_progress", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.pool()
+	const query = "SELECT bytes_done, total_bytes, started_at, updated_at from local_ega.verify_progress WHERE file_id = $1"
+
+	p := Progress{FileID: fileID}
+	err = db.QueryRow(query, fileID).Scan(&p.BytesDone, &p.TotalBytes, &p.StartedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return header, nil
+	return &p, nil
 }
 
-// GetHeaderForStableId retrieves the file header by using stable id
-func (dbs *SQLdb) GetHeaderForStableId(stableID string) (string, error) {
+// SaveCheckpoint records how far verifying a file got, replacing any earlier
+// checkpoint. Transient errors are retried.
+func (dbs *SQLdb) SaveCheckpoint(c Checkpoint) error {
+	return dbs.SaveCheckpointContext(context.Background(), c)
+}
+
+// SaveCheckpointContext records how far verifying a file got, giving up
+// when ctx is done. Transient errors are retried.
+func (dbs *SQLdb) SaveCheckpointContext(ctx context.Context, c Checkpoint) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.saveCheckpoint(ctx, c)
+	})
+}
+
+// saveCheckpoint is the actual function performing work for SaveCheckpoint
+func (dbs *SQLdb) saveCheckpoint(ctx context.Context, c Checkpoint) (err error) {
+	defer observeQuery("save_checkpoint", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
-	const query = "SELECT header from local_ega.files WHERE stable_id = $1"
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
 
-	var header string
-	if err := db.QueryRow(query, stableID).Scan(&header); err != nil {
-		return "", err
+	db := dbs.pool()
+	const query = "INSERT INTO local_ega.verify_checkpoints(file_id, archive_offset, archive_size, decrypted_size, state, updated_at) " +
+		"VALUES($1, $2, $3, $4, $5, now()) " +
+		"ON CONFLICT (file_id) DO UPDATE SET archive_offset = $2, archive_size = $3, decrypted_size = $4, state = $5, updated_at = now();"
+	if _, err = db.ExecContext(ctx, query, c.FileID, c.ArchiveOffset, c.ArchiveSize, c.DecryptedSize, c.State); err != nil {
+		return contextError(ctx, err)
 	}
 
-	return header, nil
+	return nil
 }
 
-// MarkCompleted marks the file as "COMPLETED"
-func (dbs *SQLdb) MarkCompleted(file FileInfo, fileID int) error {
-	var (
-		err   error = nil
-		count int   = 0
-	)
+// GetCheckpoint returns the checkpoint of the file, or nil if there is none.
+// Transient errors are retried.
+func (dbs *SQLdb) GetCheckpoint(fileID int) (*Checkpoint, error) {
+	return dbs.GetCheckpointContext(context.Background(), fileID)
+}
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		err = dbs.markCompleted(file, fileID)
-		count++
-	}
-	return err
+// GetCheckpointContext returns the checkpoint of the file, giving up when ctx
+// is done. Transient errors are retried.
+func (dbs *SQLdb) GetCheckpointContext(ctx context.Context, fileID int) (*Checkpoint, error) {
+	var c *Checkpoint
+
+	err := dbs.retryTransient(ctx, func() (err error) {
+		c, err = dbs.getCheckpoint(ctx, fileID)
+
+		return err
+	})
+
+	return c, err
 }
 
-// markCompleted performs actual work for MarkCompleted
-func (dbs *SQLdb) markCompleted(file FileInfo, fileID int) error {
+// getCheckpoint is the actual function performing work for GetCheckpoint
+func (dbs *SQLdb) getCheckpoint(ctx context.Context, fileID int) (_ *Checkpoint, err error) {
+	defer observeQuery("get_checkpoint", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
-	const completed = "UPDATE local_ega.files SET status = 'COMPLETED', " +
-		"archive_filesize = $2, " +
-		"archive_file_checksum = $3, " +
-		"archive_file_checksum_type = $4, " +
-		"decrypted_file_size = $5, " +
-		"decrypted_file_checksum = $6, " +
-		"decrypted_file_checksum_type = $7 " +
-		"WHERE id = $1;"
-	result, err := db.Exec(completed,
-		fileID,
-		file.Size,
-		fmt.Sprintf("%x", file.Checksum.Sum(nil)),
-		hashType(file.Checksum),
-		file.DecryptedSize,
-		fmt.Sprintf("%x", file.DecryptedChecksum.Sum(nil)),
-		hashType(file.DecryptedChecksum))
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.pool()
+	const query = "SELECT archive_offset, archive_size, decrypted_size, state, updated_at " +
+		"from local_ega.verify_checkpoints WHERE file_id = $1"
+
+	c := Checkpoint{FileID: fileID}
+	err = db.QueryRowContext(ctx, query, fileID).Scan(&c.ArchiveOffset, &c.ArchiveSize, &c.DecryptedSize, &c.State, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, contextError(ctx, err)
 	}
-	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
-		return errors.New("something went wrong with the query zero rows were changed")
+
+	return &c, nil
+}
+
+// ClearCheckpoint removes the checkpoint of the file once verifying it no
+// longer needs to resume. Transient errors are retried.
+func (dbs *SQLdb) ClearCheckpoint(fileID int) error {
+	return dbs.ClearCheckpointContext(context.Background(), fileID)
+}
+
+// ClearCheckpointContext removes the checkpoint of the file, giving up when
+// ctx is done. Transient errors are retried.
+func (dbs *SQLdb) ClearCheckpointContext(ctx context.Context, fileID int) error {
+	return dbs.retryTransient(ctx, func() error {
+		return dbs.clearCheckpoint(ctx, fileID)
+	})
+}
+
+// clearCheckpoint is the actual function performing work for
+// ClearCheckpoint
+func (dbs *SQLdb) clearCheckpoint(ctx context.Context, fileID int) (err error) {
+	defer observeQuery("clear_checkpoint", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	ctx, cancel := dbs.statementContext(ctx)
+	defer cancel()
+
+	db := dbs.pool()
+	const query = "DELETE FROM local_ega.verify_checkpoints WHERE file_id = $1;"
+	if _, err = db.ExecContext(ctx, query, fileID); err != nil {
+		return contextError(ctx, err)
 	}
+
 	return nil
 }
 
@@ -251,12 +1979,14 @@ func (dbs *SQLdb) InsertFile(filename, user string) (int64, error) {
 }
 
 // insertFile performs actual work for InsertFile
-func (dbs *SQLdb) insertFile(filename, user string) (int64, error) {
+func (dbs *SQLdb) insertFile(filename, user string) (_ int64, err error) {
+	defer observeQuery("insert_file", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
 	// Not really idempotent, but close enough for us
 
-	db := dbs.DB
+	db := dbs.pool()
 	const query = "INSERT INTO local_ega.main(submission_file_path, " +
 		"submission_file_extension, " +
 		"submission_user, " +
@@ -264,32 +1994,42 @@ func (dbs *SQLdb) insertFile(filename, user string) (int64, error) {
 		"encryption_method) " +
 		"VALUES($1, $2, $3,'INIT', 'CRYPT4GH') RETURNING id;"
 	var fileID int64
-	err := db.QueryRow(query, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user).Scan(&fileID)
+	err = db.QueryRow(query, filename, strings.Replace(filepath.Ext(filename), ".", "", -1), user).Scan(&fileID)
 	if err != nil {
 		return 0, err
 	}
 	return fileID, nil
 }
 
-// StoreHeader stores the file header in the database
-func (dbs *SQLdb) StoreHeader(header []byte, id int64) error {
-	var (
-		err   error = nil
-		count int   = 0
-	)
+// MaxHeaderSize is the largest crypt4gh header StoreHeader accepts, and the
+// size above which a stored header is taken to be broken. A header is a few
+// hundred bytes per recipient, so anything larger is not a header.
+const MaxHeaderSize = 64 * 1024
 
-	for count == 0 || (err != nil && count < dbRetryTimes) {
-		err = dbs.storeHeader(header, id)
-		count++
+// StoreHeader stores the file header in the database, hex encoded as
+// GetHeader expects it. The header of the file is replaced, so ingesting a
+// file again updates the stored header rather than adding another. Empty
+// and implausibly large headers are refused. Transient errors are retried.
+func (dbs *SQLdb) StoreHeader(header []byte, id int64) error {
+	if len(header) == 0 {
+		return errors.New("refusing to store an empty header")
 	}
-	return err
+	if len(header) > MaxHeaderSize {
+		return fmt.Errorf("refusing to store a %d byte header, the limit is %d bytes", len(header), MaxHeaderSize)
+	}
+
+	return dbs.retryTransient(context.Background(), func() error {
+		return dbs.storeHeader(header, id)
+	})
 }
 
 // storeHeader performs actual work for StoreHeader
-func (dbs *SQLdb) storeHeader(header []byte, id int64) error {
+func (dbs *SQLdb) storeHeader(header []byte, id int64) (err error) {
+	defer observeQuery("store_header", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.pool()
 	const query = "UPDATE local_ega.files SET header = $1 WHERE id = $2;"
 	result, err := db.Exec(query, hex.EncodeToString(header), id)
 	if err != nil {
@@ -298,9 +2038,79 @@ func (dbs *SQLdb) storeHeader(header []byte, id int64) error {
 	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
 		return errors.New("something went wrong with the query zero rows were changed")
 	}
+
+	// Only this process' cache is invalidated, others rely on the TTL
+	if dbs.headers != nil {
+		dbs.headers.remove(id)
+	}
+
+	return nil
+}
+
+// StoreCorrelationID records the correlation id of the message the file was
+// ingested with, replacing any recorded earlier. Transient errors are
+// retried.
+func (dbs *SQLdb) StoreCorrelationID(fileID int64, correlationID string) error {
+	return dbs.retryTransient(context.Background(), func() error {
+		return dbs.storeCorrelationID(fileID, correlationID)
+	})
+}
+
+// storeCorrelationID performs actual work for StoreCorrelationID
+func (dbs *SQLdb) storeCorrelationID(fileID int64, correlationID string) (err error) {
+	defer observeQuery("store_correlation_id", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.pool()
+	const query = "INSERT INTO local_ega.file_correlation (file_id, correlation_id) VALUES ($1, $2) " +
+		"ON CONFLICT (file_id) DO UPDATE SET correlation_id = $2;"
+	result, err := db.Exec(query, fileID, correlationID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errors.New("something went wrong with the query zero rows were changed")
+	}
 	return nil
 }
 
+// GetCorrelationID returns the correlation id the file was ingested with,
+// so that messages about the file sent outside the normal message flow can
+// keep it. ErrNoCorrelationID is returned if none was recorded.
+func (dbs *SQLdb) GetCorrelationID(fileID int) (string, error) {
+	var correlationID string
+
+	err := dbs.retryTransient(context.Background(), func() (err error) {
+		correlationID, err = dbs.getCorrelationID(fileID)
+
+		return err
+	})
+
+	return correlationID, err
+}
+
+// getCorrelationID performs actual work for GetCorrelationID
+func (dbs *SQLdb) getCorrelationID(fileID int) (_ string, err error) {
+	defer observeQuery("get_correlation_id", time.Now(), &err)
+
+	dbs.checkAndReconnectIfNeeded()
+
+	db := dbs.reader()
+	const query = "SELECT correlation_id FROM local_ega.file_correlation WHERE file_id = $1"
+
+	var correlationID string
+	err = db.QueryRow(query, fileID).Scan(&correlationID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && correlationID == "") {
+		return "", ErrNoCorrelationID
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return correlationID, nil
+}
+
 // SetArchived marks the file as 'ARCHIVED'
 func (dbs *SQLdb) SetArchived(file FileInfo, id int64) error {
 	var (
@@ -316,10 +2126,12 @@ func (dbs *SQLdb) SetArchived(file FileInfo, id int64) error {
 }
 
 // setArchived performs actual work for SetArchived
-func (dbs *SQLdb) setArchived(file FileInfo, id int64) error {
+func (dbs *SQLdb) setArchived(file FileInfo, id int64) (err error) {
+	defer observeQuery("set_archived", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.pool()
 	const query = "UPDATE local_ega.files SET status = 'ARCHIVED', " +
 		"archive_path = $1, " +
 		"archive_filesize = $2, " +
@@ -357,10 +2169,12 @@ func (dbs *SQLdb) MarkReady(accessionID, user, filepath, checksum string) error
 }
 
 // MarkReady marks the file as "READY"
-func (dbs *SQLdb) markReady(accessionID, user, filepath, checksum string) error {
+func (dbs *SQLdb) markReady(accessionID, user, filepath, checksum string) (err error) {
+	defer observeQuery("mark_ready", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.pool()
 	const ready = "UPDATE local_ega.files SET status = 'READY', stable_id = $1 WHERE " +
 		"elixir_id = $2 and inbox_path = $3 and decrypted_file_checksum = $4 and status = 'COMPLETED';"
 	result, err := db.Exec(ready, accessionID, user, filepath, checksum)
@@ -388,14 +2202,16 @@ func (dbs *SQLdb) MapFilesToDataset(datasetID string, accessionIDs []string) err
 }
 
 // mapFilesToDataset performs the real work of MapFilesToDataset
-func (dbs *SQLdb) mapFilesToDataset(datasetID string, accessionIDs []string) error {
+func (dbs *SQLdb) mapFilesToDataset(datasetID string, accessionIDs []string) (err error) {
+	defer observeQuery("map_files_to_dataset", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
 	const getID = "SELECT file_id FROM local_ega.archive_files WHERE stable_id = $1"
 	const mapping = "INSERT INTO local_ega_ebi.filedataset (file_id, dataset_stable_id) " +
 		"VALUES ($1, $2) ON CONFLICT " +
 		"DO NOTHING;"
-	db := dbs.DB
+	db := dbs.pool()
 	var fileID int64
 	transaction, _ := db.Begin()
 	for _, accessionID := range accessionIDs {
@@ -436,10 +2252,12 @@ func (dbs *SQLdb) GetArchived(user, filepath, checksum string) (string, int, err
 }
 
 // getArchived is the actual function performing work for GetArchived
-func (dbs *SQLdb) getArchived(user, filepath, checksum string) (string, int, error) {
+func (dbs *SQLdb) getArchived(user, filepath, checksum string) (_ string, _ int, err error) {
+	defer observeQuery("get_archived", time.Now(), &err)
+
 	dbs.checkAndReconnectIfNeeded()
 
-	db := dbs.DB
+	db := dbs.pool()
 	const query = "SELECT archive_path, archive_filesize from local_ega.files WHERE " +
 		"elixir_id = $1 and inbox_path = $2 and decrypted_file_checksum = $3 and status in ('COMPLETED', 'READY');"
 
@@ -454,6 +2272,10 @@ func (dbs *SQLdb) getArchived(user, filepath, checksum string) (string, int, err
 
 // Close terminates the connection to the database
 func (dbs *SQLdb) Close() {
-	db := dbs.DB
+	db := dbs.pool()
 	db.Close()
+
+	if dbs.replica != nil {
+		dbs.replica.Close()
+	}
 }
@@ -2,16 +2,27 @@ package database
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +42,19 @@ var testPgconf = DBConf{"localhost",
 	"cacert",
 	"verify-full",
 	"clientcert",
-	"clientkey"}
+	"clientkey",
+	0,
+	0,
+	0,
+	0,
+	0,
+	0,
+	"",
+	0,
+	false,
+	false,
+	"verify@host",
+	0}
 
 const testConnInfo = "host=localhost port=42 user=user password=password dbname=database sslmode=verify-full sslrootcert=cacert sslcert=clientcert sslkey=clientkey"
 
@@ -41,6 +64,7 @@ func TestMain(m *testing.M) {
 	dbRetryTimes = 0
 	dbReconnectTimeout = 200 * time.Millisecond
 	dbReconnectSleep = time.Millisecond
+	dbRetryBackoff = time.Millisecond
 	code := m.Run()
 
 	os.Exit(code)
@@ -75,12 +99,12 @@ func TestCheckAndReconnect(t *testing.T) {
 
 	mock.ExpectPing().WillReturnError(fmt.Errorf("ping fail for testing bad conn"))
 
-	err := CatchPanicCheckAndReconnect(SQLdb{db, ""})
+	err := CatchPanicCheckAndReconnect(&SQLdb{DB: db})
 	assert.Error(t, err, "Should have received error from checkAndReconnectOnNeeded fataling")
 
 }
 
-func CatchPanicCheckAndReconnect(db SQLdb) (err error) {
+func CatchPanicCheckAndReconnect(db *SQLdb) (err error) {
 	defer func() {
 		r := recover()
 		if r != nil {
@@ -169,6 +193,119 @@ func TestNewDB(t *testing.T) {
 
 }
 
+func TestNewDBPoolLimits(t *testing.T) {
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		return db, nil
+	}
+
+	conf := testPgconf
+	conf.MaxOpenConns = 7
+	conf.MaxIdleConns = 3
+	conf.ConnMaxLifetime = time.Minute
+
+	mock.ExpectPing()
+	testDb, err := NewDB(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, testDb.DB.Stats().MaxOpenConnections)
+
+	// the limits survive a reconnect
+	mock.ExpectPing().WillReturnError(errors.New("connection lost"))
+	db, _, _ = sqlmock.New()
+	assert.NoError(t, testDb.Reconnect())
+	assert.Equal(t, db, testDb.DB)
+	assert.Equal(t, 7, testDb.DB.Stats().MaxOpenConnections)
+}
+
+func TestReconnect(t *testing.T) {
+	conf := testPgconf
+	conf.ReconnectAttempts = 3
+
+	// a live connection is kept
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	testDb := &SQLdb{DB: db, conf: conf}
+	mock.ExpectPing()
+	opened := 0
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		opened++
+
+		return nil, errors.New("should not reconnect")
+	}
+	assert.NoError(t, testDb.Reconnect())
+	assert.Zero(t, opened)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a new pool is opened until a ping passes
+	mock.ExpectPing().WillReturnError(errors.New("connection lost"))
+	var pools []sqlmock.Sqlmock
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		db, m, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if len(pools) < 2 {
+			m.ExpectPing().WillReturnError(errors.New("connection refused"))
+		} else {
+			m.ExpectPing()
+		}
+		pools = append(pools, m)
+
+		return db, nil
+	}
+	assert.NoError(t, testDb.Reconnect())
+	assert.Len(t, pools, 3)
+	for _, m := range pools {
+		assert.NoError(t, m.ExpectationsWereMet())
+	}
+
+	// giving up after the configured number of attempts
+	pools[2].ExpectPing().WillReturnError(errors.New("connection lost"))
+	current := testDb.DB
+	opened = 0
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		opened++
+
+		return nil, errors.New("connection refused")
+	}
+	assert.EqualError(t, testDb.Reconnect(), "failed to reconnect to the database after 3 attempts: connection refused")
+	assert.Equal(t, 3, opened)
+	assert.Equal(t, current, testDb.DB, "the pool should be kept until a new one answers")
+
+	// simultaneous calls share the new pool
+	opened = 0
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		opened++
+		db, _, _ := sqlmock.New()
+
+		return db, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, testDb.Reconnect())
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, opened)
+
+	// the pool is read safely while it is replaced, and the replaced pool
+	// stays open for statements already started on it
+	replaced, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	testDb.DB = replaced
+	mock.ExpectPing().WillReturnError(errors.New("connection lost"))
+	mock.ExpectPing()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NotNil(t, testDb.pool())
+		}()
+	}
+	assert.NoError(t, testDb.Reconnect())
+	wg.Wait()
+	assert.NotEqual(t, replaced, testDb.pool())
+	assert.NoError(t, replaced.Ping(), "the replaced pool should not be closed right away")
+}
+
 // Helper function for "simple" sql tests
 func sqlTesterHelper(t *testing.T, f func(sqlmock.Sqlmock, *SQLdb) error) error {
 	db, mock, err := sqlmock.New()
@@ -189,8 +326,28 @@ func sqlTesterHelper(t *testing.T, f func(sqlmock.Sqlmock, *SQLdb) error) error
 	return returnErr
 }
 
+// expectStatus expects the status of the file to be read
+func expectStatus(mock sqlmock.Sqlmock, fileID int, status string) {
+	rows := sqlmock.NewRows([]string{"status"})
+	if status != "" {
+		rows.AddRow(status)
+	}
+	mock.ExpectQuery("SELECT status from local_ega.files WHERE id = \\$1").
+		WithArgs(fileID).
+		WillReturnRows(rows)
+}
+
+// expectTransition expects a file status change to be logged
+func expectTransition(mock sqlmock.Sqlmock, fileID int, from, to, reason string) {
+	mock.ExpectExec("INSERT INTO local_ega.file_transitions "+
+		"\\(file_id, from_status, to_status, reason, correlation_id, service\\) "+
+		"VALUES \\(\\$1, \\$2, \\$3, \\$4, \\(SELECT correlation_id FROM local_ega.file_correlation WHERE file_id = \\$1\\), \\$5\\);").
+		WithArgs(fileID, from, to, reason, "verify@host").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
 func TestMarkCompleted(t *testing.T) {
-	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48}
+	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, "verify@host", 0, "", ""}
 
 	_, err := file.Checksum.Write([]byte("checksum"))
 
@@ -208,6 +365,8 @@ func TestMarkCompleted(t *testing.T) {
 
 		r := sqlmock.NewResult(10, 1)
 
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
 		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED', "+
 			"archive_filesize = \\$2, "+
 			"archive_file_checksum = \\$3, "+
@@ -215,7 +374,7 @@ func TestMarkCompleted(t *testing.T) {
 			"decrypted_file_size = \\$5, "+
 			"decrypted_file_checksum = \\$6, "+
 			"decrypted_file_checksum_type = \\$7 "+
-			"WHERE id = \\$1;").WithArgs(
+			"WHERE id = \\$1 AND status <> 'COMPLETED';").WithArgs(
 			10,
 			file.Size,
 			"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
@@ -223,6 +382,13 @@ func TestMarkCompleted(t *testing.T) {
 			file.DecryptedSize,
 			"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 			"SHA256").WillReturnResult(r)
+		mock.ExpectExec("INSERT INTO local_ega.file_verifications \\(file_id, verified_at, verified_by\\) "+
+			"VALUES \\(\\$1, now\\(\\), \\$2\\) "+
+			"ON CONFLICT \\(file_id\\) DO UPDATE SET verified_at = now\\(\\), verified_by = \\$2, accession_requested_at = NULL;").
+			WithArgs(10, "verify@host").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTransition(mock, 10, "ARCHIVED", "COMPLETED", "verified")
+		mock.ExpectCommit()
 
 		return testDb.MarkCompleted(file, 10)
 	})
@@ -235,6 +401,8 @@ func TestMarkCompleted(t *testing.T) {
 	buf.Reset()
 	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
 
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
 		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED', "+
 			"archive_filesize = \\$2, "+
 			"archive_file_checksum = \\$3, "+
@@ -242,7 +410,7 @@ func TestMarkCompleted(t *testing.T) {
 			"decrypted_file_size = \\$5, "+
 			"decrypted_file_checksum = \\$6, "+
 			"decrypted_file_checksum_type = \\$7 "+
-			"WHERE id = \\$1;").
+			"WHERE id = \\$1 AND status <> 'COMPLETED';").
 			WithArgs(10,
 				file.Size,
 				"96fa8f226d3801741e807533552bc4b177ac4544d834073b6a5298934d34b40b",
@@ -251,12 +419,74 @@ func TestMarkCompleted(t *testing.T) {
 				"b353d3058b350466bb75a4e5e2263c73a7b900e2c48804780c6dd820b8b151ba",
 				"SHA256").
 			WillReturnError(fmt.Errorf("error for testing"))
+		mock.ExpectRollback()
 
 		return testDb.MarkCompleted(file, 10)
 	})
 
 	assert.NotNil(t, r, "MarkCompleted did not fail as expected")
 
+	// nothing is changed for a file that doesn't exist
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "")
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted(file, 10)
+	})
+
+	assert.EqualError(t, r, "no file with id 10")
+
+	// marking a completed file again changes nothing
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "COMPLETED")
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted(file, 10)
+	})
+
+	assert.ErrorIs(t, r, ErrAlreadyCompleted)
+
+	// removed files stay removed
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "REMOVED")
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted(file, 10)
+	})
+
+	assert.ErrorIs(t, r, ErrFileRemoved)
+
+	// nor when another delivery completes it in the meantime
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED'").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted(file, 10)
+	})
+
+	assert.ErrorIs(t, r, ErrAlreadyCompleted)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED'").
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		mock.ExpectExec("INSERT INTO local_ega.file_verifications").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTransition(mock, 10, "ARCHIVED", "COMPLETED", "verified")
+		mock.ExpectCommit().WillReturnError(fmt.Errorf("commit failed"))
+
+		return testDb.MarkCompleted(file, 10)
+	})
+
+	assert.EqualError(t, r, "commit failed")
+
 	log.SetOutput(os.Stdout)
 }
 
@@ -306,44 +536,1067 @@ func TestGetHeader(t *testing.T) {
 	log.SetOutput(os.Stdout)
 }
 
-func TestGetHeaderForStableId(t *testing.T) {
+func TestGetHeaderContext(t *testing.T) {
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
-
-		header := "0f40"
-		mock.ExpectQuery("SELECT header from local_ega.files WHERE stable_id = \\$1").
-			WithArgs("42").
+		testDb.conf.StatementTimeout = 10 * time.Millisecond
+		mock.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillDelayFor(time.Second).
 			WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f40"))
 
-		x, err := testDb.GetHeaderForStableId("42")
+		start := time.Now()
+		_, err := testDb.GetHeaderContext(context.Background(), 42)
+		assert.Less(t, time.Since(start), time.Second, "the statement timeout should have been applied")
 
-		assert.Equal(t, x, header, "did not get expected header")
+		return err
+	})
+
+	assert.ErrorIs(t, r, context.DeadlineExceeded)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := testDb.GetHeaderContext(ctx, 42)
 
 		return err
 	})
 
-	assert.Nil(t, r, "GetHeaderForStableId failed unexpectedly")
+	assert.ErrorIs(t, r, context.Canceled)
+}
 
-	var buf bytes.Buffer
-	log.SetOutput(&buf)
+func TestMarkCompletedContext(t *testing.T) {
+	file := FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, "verify@host", 0, "", ""}
 
-	buf.Reset()
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		testDb.conf.StatementTimeout = 10 * time.Millisecond
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED'").
+			WillDelayFor(time.Second).
+			WillReturnResult(sqlmock.NewResult(10, 1))
 
-	log.SetOutput(os.Stdout)
+		return testDb.MarkCompletedContext(context.Background(), file, 10)
+	})
+
+	assert.ErrorIs(t, r, context.DeadlineExceeded)
 }
 
-func TestStoreHeader(t *testing.T) {
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		transient bool
+	}{
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "40001"}, true},
+		{fmt.Errorf("wrapped: %w", &pq.Error{Code: "08003"}), true},
+		{&pq.Error{Code: "23505"}, false},
+		{driver.ErrBadConn, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{sql.ErrNoRows, false},
+		{fmt.Errorf("%w: canceled", context.DeadlineExceeded), false},
+		{errors.New("something else"), false},
+	} {
+		assert.Equal(t, test.transient, isTransient(test.err), "unexpected result for %v", test.err)
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	defer func(times int, backoff time.Duration) {
+		dbRetryTimes = times
+		dbRetryBackoff = backoff
+	}(dbRetryTimes, dbRetryBackoff)
+	dbRetryTimes = 3
+	dbRetryBackoff = time.Millisecond
+
+	db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	testDb := &SQLdb{DB: db}
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnError(&pq.Error{Code: "57P01", Message: "terminating connection due to administrator command"})
+	mock.ExpectPing().WillReturnError(&pq.Error{Code: "57P01"})
+
+	// the retry runs on a new connection
+	db, reconnected, err := sqlmock.New()
+	assert.NoError(t, err)
+	sqlOpen = func(_ string, _ string) (*sql.DB, error) {
+		return db, nil
+	}
+	reconnected.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f40"))
+
+	header, err := testDb.GetHeader(42)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{15, 64}, header)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, reconnected.ExpectationsWereMet())
+
+	// constraint violations are not retried
 	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
-		header := []byte{15, 45, 20, 40, 48}
-		r := sqlmock.NewResult(10, 1)
+		mock.ExpectBegin()
+		expectStatus(mock, 10, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED'").
+			WillReturnError(&pq.Error{Code: "23505"})
+		mock.ExpectRollback()
+
+		return testDb.MarkCompleted(FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, "verify@host", 0, "", ""}, 10)
+	})
+	assert.Error(t, r)
 
+	// nor are other errors
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("UPDATE local_ega.files SET archive_file_checksum = \\$1 WHERE id = \\$2;").
+			WithArgs("deadbeef", 10).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		return testDb.UpdateArchiveChecksum("deadbeef", 10)
+	})
+	assert.Error(t, r)
+}
+
+func TestGetHeaderCached(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		testDb.headers = newHeaderCache(10, time.Minute)
+
+		// only the first and the lookup after StoreHeader reach the database
+		mock.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f40"))
 		mock.ExpectExec("UPDATE local_ega.files SET header = \\$1 WHERE id = \\$2;").
-			WithArgs("0f2d142830", 42).
-			WillReturnResult(r)
+			WithArgs("0f41", 42).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f41"))
 
-		return testDb.StoreHeader(header, 42)
+		for i := 0; i < 3; i++ {
+			header, err := testDb.GetHeader(42)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{15, 64}, header)
+		}
+
+		if err := testDb.StoreHeader([]byte{15, 65}, 42); err != nil {
+			return err
+		}
+
+		header, err := testDb.GetHeader(42)
+		assert.Equal(t, []byte{15, 65}, header)
+
+		return err
 	})
 
-	assert.Nil(t, r, "StoreHeader failed unexpectedly")
+	assert.NoError(t, r)
+}
+
+func TestGetHeaders(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		testDb.headers = newHeaderCache(10, time.Minute)
+		testDb.headers.put(41, []byte{15, 63})
+
+		// the cached header is not asked for and 44 does not exist
+		mock.ExpectQuery("SELECT id, header from local_ega.files WHERE id = ANY\\(\\$1\\)").
+			WithArgs(pq.Int64Array{42, 43, 44}).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "header"}).
+				AddRow(42, "0f40").
+				AddRow(43, "0f41"))
+
+		headers, err := testDb.GetHeaders([]int{41, 42, 43, 44})
+		assert.Equal(t, map[int][]byte{41: {15, 63}, 42: {15, 64}, 43: {15, 65}}, headers)
+
+		// the headers read are cached
+		cached, _ := testDb.headers.get(43)
+		assert.Equal(t, []byte{15, 65}, cached)
+
+		return err
+	})
+
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT id, header from local_ega.files WHERE id = ANY\\(\\$1\\)").
+			WithArgs(pq.Int64Array{42}).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "header"}).AddRow(42, "zz"))
+
+		_, err := testDb.GetHeaders([]int{42})
+
+		return err
+	})
+
+	assert.ErrorContains(t, r, "bad header for file 42")
+}
+
+func TestGetFileStatus(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT status from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("COMPLETED"))
+
+		status, err := testDb.GetFileStatus(42)
+		assert.Equal(t, "COMPLETED", status)
+
+		return err
+	})
+
+	assert.NoError(t, r)
+}
+
+func TestQueryMetrics(t *testing.T) {
+	failures := testutil.ToFloat64(queryErrors.WithLabelValues("get_file_status"))
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT status from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("COMPLETED"))
+		mock.ExpectQuery("SELECT status from local_ega.files WHERE id = \\$1").
+			WithArgs(43).
+			WillReturnError(sql.ErrNoRows)
+
+		_, err := testDb.GetFileStatus(42)
+		assert.NoError(t, err)
+		_, err = testDb.GetFileStatus(43)
+		assert.Error(t, err)
+
+		return nil
+	})
+	assert.NoError(t, r)
+
+	assert.Equal(t, failures+1, testutil.ToFloat64(queryErrors.WithLabelValues("get_file_status")))
+
+	var m dto.Metric
+	assert.NoError(t, queryDuration.WithLabelValues("get_file_status").(prometheus.Histogram).Write(&m))
+	assert.GreaterOrEqual(t, m.GetHistogram().GetSampleCount(), uint64(2))
+}
+
+func TestReadReplica(t *testing.T) {
+	primary, primaryMock, _ := sqlmock.New()
+	replica, replicaMock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+
+	conf := testPgconf
+	conf.ReplicaHost = "replica"
+	conf.ReplicaPort = 43
+	sqlOpen = func(_ string, connInfo string) (*sql.DB, error) {
+		if strings.HasPrefix(connInfo, "host=replica port=43 ") {
+			return replica, nil
+		}
+
+		return primary, nil
+	}
+
+	replicaMock.ExpectPing()
+	testDb, err := NewDB(conf)
+	assert.NoError(t, err)
+
+	replicaMock.ExpectQuery("SELECT header from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f40"))
+	replicaMock.ExpectQuery("SELECT status from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("ARCHIVED"))
+	replicaMock.ExpectQuery("SELECT archive_file_checksum from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"archive_file_checksum"}).AddRow("deadbeef"))
+	replicaMock.ExpectQuery("SELECT archive_filesize from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"archive_filesize"}).AddRow(46))
+	replicaMock.ExpectQuery("SELECT decrypted_file_size from local_ega.files WHERE id = \\$1").
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"decrypted_file_size"}).AddRow(48))
+	primaryMock.ExpectBegin()
+	expectStatus(primaryMock, 42, "ARCHIVED")
+	primaryMock.ExpectExec("UPDATE local_ega.files SET status = 'COMPLETED'").
+		WillReturnResult(sqlmock.NewResult(10, 1))
+	primaryMock.ExpectExec("INSERT INTO local_ega.file_verifications").
+		WithArgs(42, "verify@host").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectTransition(primaryMock, 42, "ARCHIVED", "COMPLETED", "verified")
+	primaryMock.ExpectCommit()
+
+	_, err = testDb.GetHeader(42)
+	assert.NoError(t, err)
+	_, err = testDb.GetFileStatus(42)
+	assert.NoError(t, err)
+	_, err = testDb.GetArchiveChecksum(42)
+	assert.NoError(t, err)
+	_, err = testDb.GetArchiveSize(42)
+	assert.NoError(t, err)
+	_, err = testDb.GetDecryptedSize(42)
+	assert.NoError(t, err)
+	assert.NoError(t, testDb.MarkCompleted(FileInfo{sha256.New(), 46, "/somepath", sha256.New(), 48, "verify@host", 0, "", ""}, 42))
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+
+	// an unreachable replica is reported
+	replicaMock.ExpectPing().WillReturnError(errors.New("no route to host"))
+	_, err = NewDB(conf)
+	assert.EqualError(t, err, "failed to connect to the database replica: no route to host")
+}
+
+func TestHealthCheck(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT 1;").WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+		mock.ExpectQuery("SELECT to_regclass\\(\\$1\\) IS NOT NULL;").
+			WithArgs("local_ega.files").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectQuery("SELECT to_regclass\\(\\$1\\) IS NOT NULL;").
+			WithArgs("local_ega.missing").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		health, err := testDb.HealthCheck(context.Background(), "local_ega.files", "local_ega.missing")
+		assert.Equal(t, []string{"local_ega.missing"}, health.MissingTables)
+		assert.NotZero(t, health.Latency)
+
+		return err
+	})
+	assert.EqualError(t, r, "missing tables: local_ega.missing")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT 1;").WillReturnError(errors.New("connection refused"))
+
+		_, err := testDb.HealthCheck(context.Background())
+
+		return err
+	})
+	assert.EqualError(t, r, "connection refused")
+
+	_, err := (&SQLdb{}).HealthCheck(context.Background())
+	assert.EqualError(t, err, "database is nil")
+}
+
+func TestBulkMarkCompleted(t *testing.T) {
+	files := []FileInfo{
+		{sha256.New(), 46, "/somepath", sha256.New(), 48, "verify@host", 0, "", ""},
+		{sha256.New(), 47, "/otherpath", sha256.New(), 49, "verify@host", 0, "", ""},
+	}
+	const emptySum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	expectStatuses := func(mock sqlmock.Sqlmock, ids string, statuses map[int]string) {
+		rows := sqlmock.NewRows([]string{"id", "status"})
+		for _, id := range []int{10, 11, 12} {
+			if status, ok := statuses[id]; ok {
+				rows.AddRow(id, status)
+			}
+		}
+		mock.ExpectQuery("SELECT id, status from local_ega.files WHERE id = ANY\\(\\$1::bigint\\[\\]\\)").
+			WithArgs(ids).
+			WillReturnRows(rows)
+	}
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatuses(mock, "{10,11}", map[int]string{10: "ARCHIVED", 11: "ERROR"})
+		mock.ExpectQuery("UPDATE local_ega.files AS f SET status = 'COMPLETED', .* FROM UNNEST\\(.*\\) .* "+
+			"WHERE f.id = u.id AND f.status NOT IN \\('COMPLETED', 'REMOVED'\\) RETURNING f.id;").
+			WithArgs("{10,11}", "{46,47}", `{"`+emptySum+`","`+emptySum+`"}`, `{"SHA256","SHA256"}`, "{48,49}", `{"`+emptySum+`","`+emptySum+`"}`, `{"SHA256","SHA256"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10).AddRow(11))
+		mock.ExpectExec("INSERT INTO local_ega.file_verifications \\(file_id, verified_at, verified_by\\) "+
+			"SELECT id, now\\(\\), verified_by FROM UNNEST").
+			WithArgs("{10,11}", `{"verify@host","verify@host"}`).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("INSERT INTO local_ega.file_transitions "+
+			"\\(file_id, from_status, to_status, reason, correlation_id, service\\) "+
+			"SELECT t.id, t.from_status, 'COMPLETED', 'verified', c.correlation_id, \\$3 ").
+			WithArgs("{10,11}", `{"ARCHIVED","ERROR"}`, "verify@host").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		return testDb.BulkMarkCompleted(files, []int{10, 11})
+	})
+	assert.NoError(t, r)
+
+	// a missing, completed or removed file fails the whole batch
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatuses(mock, "{10,12}", map[int]string{10: "ARCHIVED"})
+		mock.ExpectRollback()
+
+		return testDb.BulkMarkCompleted(files, []int{10, 12})
+	})
+	var bulkErr BulkError
+	assert.ErrorAs(t, r, &bulkErr)
+	assert.Len(t, bulkErr, 1)
+	assert.Contains(t, bulkErr, 12)
+	assert.EqualError(t, r, "1 files could not be marked completed (12: no such file)")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatuses(mock, "{10,11}", map[int]string{10: "COMPLETED", 11: StatusRemoved})
+		mock.ExpectRollback()
+
+		return testDb.BulkMarkCompleted(files, []int{10, 11})
+	})
+	assert.ErrorAs(t, r, &bulkErr)
+	assert.ErrorIs(t, bulkErr[10], ErrAlreadyCompleted)
+	assert.ErrorIs(t, bulkErr[11], ErrFileRemoved)
+
+	// a file completed by another delivery in the meantime
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatuses(mock, "{10,11}", map[int]string{10: "ARCHIVED", 11: "ARCHIVED"})
+		mock.ExpectQuery("UPDATE local_ega.files AS f SET status = 'COMPLETED'").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+		mock.ExpectRollback()
+
+		return testDb.BulkMarkCompleted(files, []int{10, 11})
+	})
+	assert.ErrorAs(t, r, &bulkErr)
+	assert.Len(t, bulkErr, 1)
+	assert.ErrorIs(t, bulkErr[11], ErrAlreadyCompleted)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		return testDb.BulkMarkCompleted(files, []int{10})
+	})
+	assert.EqualError(t, r, "got 2 files but 1 ids")
+}
+
+func TestMarkError(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'ERROR' WHERE id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		mock.ExpectExec("INSERT INTO local_ega.file_errors \\(file_id, reason\\) VALUES \\(\\$1, \\$2\\);").
+			WithArgs(42, "checksum mismatch").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		expectTransition(mock, 42, "ARCHIVED", "ERROR", "checksum mismatch")
+		mock.ExpectCommit()
+
+		return testDb.MarkError(42, "checksum mismatch")
+	})
+
+	assert.Nil(t, r, "MarkError failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'ERROR' WHERE id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(10, 0))
+		mock.ExpectRollback()
+
+		return testDb.MarkError(42, "checksum mismatch")
+	})
+
+	assert.NotNil(t, r, "MarkError did not fail on zero rows changed")
+
+	// the status is not changed without a recorded reason
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "ARCHIVED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'ERROR' WHERE id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+		mock.ExpectExec("INSERT INTO local_ega.file_errors").
+			WillReturnError(errors.New("insert failed"))
+		mock.ExpectRollback()
+
+		return testDb.MarkError(42, "checksum mismatch")
+	})
+
+	assert.EqualError(t, r, "insert failed")
+
+	// the file is left alone once the context of the message is done
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		return testDb.MarkErrorContext(ctx, 42, "checksum mismatch")
+	})
+	assert.ErrorIs(t, r, context.Canceled)
+}
+
+func TestMarkRemoved(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "COMPLETED")
+		mock.ExpectExec("UPDATE local_ega.files SET status = 'REMOVED' WHERE id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectTransition(mock, 42, "COMPLETED", "REMOVED", "submission withdrawn")
+		mock.ExpectCommit()
+
+		return testDb.MarkRemoved(42, "submission withdrawn")
+	})
+	assert.NoError(t, r, "MarkRemoved failed unexpectedly")
+
+	// removing a file again logs nothing
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "REMOVED")
+		mock.ExpectCommit()
+
+		return testDb.MarkRemoved(42, "submission withdrawn")
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "")
+		mock.ExpectRollback()
+
+		return testDb.MarkRemoved(42, "submission withdrawn")
+	})
+	assert.EqualError(t, r, "no file with id 42")
+
+	// and a removed file can't fail
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectBegin()
+		expectStatus(mock, 42, "REMOVED")
+		mock.ExpectRollback()
+
+		return testDb.MarkError(42, "checksum mismatch")
+	})
+	assert.ErrorIs(t, r, ErrFileRemoved)
+}
+
+func TestLogTransition(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expectTransition(mock, 42, "INIT", "ARCHIVED", "ingested")
+
+		return testDb.LogTransition(42, "INIT", "ARCHIVED", "ingested")
+	})
+
+	assert.NoError(t, r, "LogTransition failed unexpectedly")
+}
+
+func TestGetArchiveChecksum(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery("SELECT archive_file_checksum from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_file_checksum"}).AddRow("0f40"))
+
+		x, err := testDb.GetArchiveChecksum(42)
+
+		assert.Equal(t, "0f40", x, "did not get expected checksum")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetArchiveChecksum failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectQuery("SELECT archive_file_checksum from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetArchiveChecksum(42)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "GetArchiveChecksum did not fail as expected")
+}
+
+func TestGetArchiveSize(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT archive_filesize from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_filesize"}).AddRow(2048))
+		mock.ExpectQuery("SELECT archive_filesize from local_ega.files WHERE id = \\$1").
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_filesize"}).AddRow(nil))
+
+		size, err := testDb.GetArchiveSize(42)
+		assert.Equal(t, int64(2048), size, "did not get expected size")
+		if err != nil {
+			return err
+		}
+
+		size, err = testDb.GetArchiveSize(43)
+		assert.Zero(t, size, "a file that wasn't archived should have no size")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetArchiveSize failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT archive_filesize from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetArchiveSize(42)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "GetArchiveSize did not fail as expected")
+}
+
+func TestGetDecryptedSize(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT decrypted_file_size from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"decrypted_file_size"}).AddRow(1024))
+		mock.ExpectQuery("SELECT decrypted_file_size from local_ega.files WHERE id = \\$1").
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows([]string{"decrypted_file_size"}).AddRow(nil))
+
+		size, err := testDb.GetDecryptedSize(42)
+		assert.Equal(t, int64(1024), size, "did not get expected size")
+		if err != nil {
+			return err
+		}
+
+		size, err = testDb.GetDecryptedSize(43)
+		assert.Zero(t, size, "a file that wasn't verified should have no size")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetDecryptedSize failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT decrypted_file_size from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetDecryptedSize(42)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "GetDecryptedSize did not fail as expected")
+}
+
+func TestAccessionRequested(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("UPDATE local_ega.file_verifications SET accession_requested_at = now\\(\\) WHERE file_id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT accession_requested_at IS NOT NULL FROM local_ega.file_verifications WHERE file_id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"requested"}).AddRow(true))
+		mock.ExpectQuery("SELECT accession_requested_at IS NOT NULL FROM local_ega.file_verifications WHERE file_id = \\$1").
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows([]string{"requested"}))
+
+		if err := testDb.MarkAccessionRequested(42); err != nil {
+			return err
+		}
+
+		requested, err := testDb.GetAccessionRequested(42)
+		assert.True(t, requested)
+		if err != nil {
+			return err
+		}
+
+		requested, err = testDb.GetAccessionRequested(43)
+		assert.False(t, requested, "a file that wasn't verified had its accession requested")
+
+		return err
+	})
+
+	assert.Nil(t, r, "accession request lookup failed unexpectedly")
+}
+
+func TestGetDecryptedChecksum(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT decrypted_file_checksum from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"decrypted_file_checksum"}).AddRow("0f40"))
+		mock.ExpectQuery("SELECT decrypted_file_checksum from local_ega.files WHERE id = \\$1").
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows([]string{"decrypted_file_checksum"}).AddRow(nil))
+
+		checksum, err := testDb.GetDecryptedChecksum(42)
+		assert.Equal(t, "0f40", checksum, "did not get expected checksum")
+		if err != nil {
+			return err
+		}
+
+		checksum, err = testDb.GetDecryptedChecksum(43)
+		assert.Empty(t, checksum, "a file that wasn't verified should have no checksum")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetDecryptedChecksum failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT decrypted_file_checksum from local_ega.files WHERE id = \\$1").
+			WithArgs(42).
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		_, err := testDb.GetDecryptedChecksum(42)
+
+		return err
+	})
+
+	assert.NotNil(t, r, "GetDecryptedChecksum did not fail as expected")
+}
+
+func TestUpdateArchiveChecksum(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec("UPDATE local_ega.files SET archive_file_checksum = \\$1 WHERE id = \\$2;").
+			WithArgs("0f40", 42).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+
+		return testDb.UpdateArchiveChecksum("0f40", 42)
+	})
+
+	assert.Nil(t, r, "UpdateArchiveChecksum failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		mock.ExpectExec("UPDATE local_ega.files SET archive_file_checksum = \\$1 WHERE id = \\$2;").
+			WithArgs("0f40", 42).
+			WillReturnResult(sqlmock.NewResult(10, 0))
+
+		return testDb.UpdateArchiveChecksum("0f40", 42)
+	})
+
+	assert.NotNil(t, r, "UpdateArchiveChecksum did not fail on zero rows changed")
+}
+
+func TestProgressLifecycle(t *testing.T) {
+	started := time.Now().Add(-time.Minute)
+	updated := time.Now()
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("INSERT INTO local_ega.verify_progress\\(file_id, bytes_done, total_bytes, started_at, updated_at\\) "+
+			"VALUES\\(\\$1, \\$2, \\$3, now\\(\\), now\\(\\)\\) "+
+			"ON CONFLICT \\(file_id\\) DO UPDATE SET bytes_done = \\$2, total_bytes = \\$3, updated_at = now\\(\\);").
+			WithArgs(42, 512, 1024).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT bytes_done, total_bytes, started_at, updated_at from local_ega.verify_progress WHERE file_id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"bytes_done", "total_bytes", "started_at", "updated_at"}).
+				AddRow(512, 1024, started, updated))
+		mock.ExpectExec("DELETE FROM local_ega.verify_progress WHERE file_id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT bytes_done, total_bytes, started_at, updated_at from local_ega.verify_progress WHERE file_id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"bytes_done", "total_bytes", "started_at", "updated_at"}))
+
+		if err := testDb.UpsertProgress(42, 512, 1024); err != nil {
+			return err
+		}
+
+		p, err := testDb.GetProgress(42)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, &Progress{FileID: 42, BytesDone: 512, TotalBytes: 1024, StartedAt: started, UpdatedAt: updated}, p)
+
+		if err := testDb.ClearProgress(42); err != nil {
+			return err
+		}
+
+		p, err = testDb.GetProgress(42)
+		assert.Nil(t, p, "progress not cleared")
+
+		return err
+	})
+
+	assert.Nil(t, r, "progress lifecycle failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("INSERT INTO local_ega.verify_progress").
+			WithArgs(42, 512, 1024).
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		return testDb.UpsertProgress(42, 512, 1024)
+	})
+
+	assert.NotNil(t, r, "UpsertProgress did not fail as expected")
+}
+
+func TestCheckpointLifecycle(t *testing.T) {
+	updated := time.Now()
+	state := []byte(`{"archive":"AAAA"}`)
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("INSERT INTO local_ega.verify_checkpoints\\(file_id, archive_offset, archive_size, decrypted_size, state, updated_at\\) "+
+			"VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5, now\\(\\)\\) "+
+			"ON CONFLICT \\(file_id\\) DO UPDATE SET archive_offset = \\$2, archive_size = \\$3, decrypted_size = \\$4, state = \\$5, updated_at = now\\(\\);").
+			WithArgs(42, 65564, 131128, 65536, state).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT archive_offset, archive_size, decrypted_size, state, updated_at from local_ega.verify_checkpoints WHERE file_id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_offset", "archive_size", "decrypted_size", "state", "updated_at"}).
+				AddRow(65564, 131128, 65536, state, updated))
+		mock.ExpectExec("DELETE FROM local_ega.verify_checkpoints WHERE file_id = \\$1;").
+			WithArgs(42).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT archive_offset, archive_size, decrypted_size, state, updated_at from local_ega.verify_checkpoints WHERE file_id = \\$1").
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"archive_offset", "archive_size", "decrypted_size", "state", "updated_at"}))
+
+		c := Checkpoint{FileID: 42, ArchiveOffset: 65564, ArchiveSize: 131128, DecryptedSize: 65536, State: state}
+		if err := testDb.SaveCheckpoint(c); err != nil {
+			return err
+		}
+
+		saved, err := testDb.GetCheckpoint(42)
+		if err != nil {
+			return err
+		}
+		c.UpdatedAt = updated
+		assert.Equal(t, &c, saved)
+
+		if err := testDb.ClearCheckpoint(42); err != nil {
+			return err
+		}
+
+		saved, err = testDb.GetCheckpoint(42)
+		assert.Nil(t, saved, "checkpoint not cleared")
+
+		return err
+	})
+
+	assert.Nil(t, r, "checkpoint lifecycle failed unexpectedly")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("INSERT INTO local_ega.verify_checkpoints").
+			WillReturnError(fmt.Errorf("error for testing"))
+
+		return testDb.SaveCheckpoint(Checkpoint{FileID: 42, State: state})
+	})
+
+	assert.NotNil(t, r, "SaveCheckpoint did not fail as expected")
+}
+
+func TestGetFileByAccession(t *testing.T) {
+	const query = "SELECT id, archive_path, archive_filesize, decrypted_file_size " +
+		"FROM local_ega.files WHERE stable_id = \\$1"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000001").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "archive_path", "archive_filesize", "decrypted_file_size"}).
+				AddRow(42, "/archive/42", 1070, 1024))
+
+		file, err := testDb.GetFileByAccession("EGAF00000000001")
+		assert.Equal(t, int64(42), file.ID)
+		assert.Equal(t, "/archive/42", file.Path)
+		assert.Equal(t, int64(1070), file.Size)
+		assert.Equal(t, int64(1024), file.DecryptedSize)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000002").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "archive_path", "archive_filesize", "decrypted_file_size"}))
+
+		_, err := testDb.GetFileByAccession("EGAF00000000002")
+
+		return err
+	})
+	assert.ErrorIs(t, r, ErrFileNotFound)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs("EGAF00000000003").
+			WillReturnError(errors.New("permission denied"))
+
+		_, err := testDb.GetFileByAccession("EGAF00000000003")
+
+		return err
+	})
+	assert.EqualError(t, r, "permission denied")
+}
+
+func TestGetFile(t *testing.T) {
+	const query = "SELECT id, archive_path, archive_filesize, decrypted_file_size, elixir_id, inbox_path " +
+		"FROM local_ega.files WHERE id = \\$1"
+	columns := []string{"id", "archive_path", "archive_filesize", "decrypted_file_size", "elixir_id", "inbox_path"}
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(42, "/archive/42", 1070, 1024, "dummy@example.org", "dir/file.c4gh"))
+
+		file, err := testDb.GetFile(42)
+		assert.Equal(t, FileInfo{ID: 42, Path: "/archive/42", Size: 1070, DecryptedSize: 1024, User: "dummy@example.org", InboxPath: "dir/file.c4gh"}, file)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		_, err := testDb.GetFile(43)
+
+		return err
+	})
+	assert.ErrorIs(t, r, ErrNoFileID)
+}
+
+func TestListFiles(t *testing.T) {
+	columns := []string{"id", "archive_path", "archive_filesize", "decrypted_file_size"}
+	after := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		// removed files are left out unless asked for
+		mock.ExpectQuery("SELECT id, archive_path, archive_filesize, decrypted_file_size "+
+			"FROM local_ega.files WHERE status <> 'REMOVED' ORDER BY id LIMIT \\$1 OFFSET \\$2").
+			WithArgs(2, 0).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(41, "/archive/41", 1070, 1024).
+				AddRow(42, nil, nil, nil))
+
+		files, err := testDb.ListFiles(ListFilter{}, 2, 0)
+		assert.Equal(t, []FileInfo{{Path: "/archive/41", Size: 1070, DecryptedSize: 1024, ID: 41}, {ID: 42}}, files)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("FROM local_ega.files WHERE status = \\$1 AND elixir_id = \\$2 AND created_at >= \\$3 "+
+			"ORDER BY id LIMIT \\$4 OFFSET \\$5").
+			WithArgs("REMOVED", "dummy@example.org", after, 10, 20).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		files, err := testDb.ListFiles(ListFilter{Status: "REMOVED", User: "dummy@example.org", CreatedAfter: after}, 10, 20)
+		assert.Empty(t, files)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	_, err := (&SQLdb{}).ListFiles(ListFilter{}, 0, 0)
+	assert.EqualError(t, err, "limit must be positive, got 0")
+	_, err = (&SQLdb{}).ListFiles(ListFilter{}, 10, -1)
+	assert.EqualError(t, err, "offset can't be negative, got -1")
+}
+
+func TestCountFiles(t *testing.T) {
+	before := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM local_ega.files "+
+			"WHERE status = \\$1 AND created_at < \\$2$").
+			WithArgs("COMPLETED", before).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1234))
+
+		count, err := testDb.CountFiles(ListFilter{Status: "COMPLETED", CreatedBefore: before})
+		assert.Equal(t, 1234, count)
+
+		return err
+	})
+	assert.NoError(t, r)
+}
+
+func TestGetHeaderForStableId(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+
+		header := "0f40"
+		mock.ExpectQuery("SELECT header from local_ega.files WHERE stable_id = \\$1").
+			WithArgs("42").
+			WillReturnRows(sqlmock.NewRows([]string{"header"}).AddRow("0f40"))
+
+		x, err := testDb.GetHeaderForStableId("42")
+
+		assert.Equal(t, x, header, "did not get expected header")
+
+		return err
+	})
+
+	assert.Nil(t, r, "GetHeaderForStableId failed unexpectedly")
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	buf.Reset()
+
+	log.SetOutput(os.Stdout)
+}
+
+func TestStoreCorrelationID(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectExec("INSERT INTO local_ega.file_correlation \\(file_id, correlation_id\\) VALUES \\(\\$1, \\$2\\) "+
+			"ON CONFLICT \\(file_id\\) DO UPDATE SET correlation_id = \\$2;").
+			WithArgs(42, "f8b3e4c0-2a6c-4e0d-9a1b-5d0c7f3e9a11").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		return testDb.StoreCorrelationID(42, "f8b3e4c0-2a6c-4e0d-9a1b-5d0c7f3e9a11")
+	})
+
+	assert.NoError(t, r, "StoreCorrelationID failed unexpectedly")
+}
+
+func TestGetCorrelationID(t *testing.T) {
+	const query = "SELECT correlation_id FROM local_ega.file_correlation WHERE file_id = \\$1"
+
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs(42).
+			WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}).AddRow("f8b3e4c0-2a6c-4e0d-9a1b-5d0c7f3e9a11"))
+
+		correlationID, err := testDb.GetCorrelationID(42)
+		assert.Equal(t, "f8b3e4c0-2a6c-4e0d-9a1b-5d0c7f3e9a11", correlationID)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs(43).
+			WillReturnRows(sqlmock.NewRows([]string{"correlation_id"}))
+
+		_, err := testDb.GetCorrelationID(43)
+
+		return err
+	})
+	assert.ErrorIs(t, r, ErrNoCorrelationID)
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		mock.ExpectQuery(query).
+			WithArgs(44).
+			WillReturnError(errors.New("permission denied"))
+
+		_, err := testDb.GetCorrelationID(44)
+
+		return err
+	})
+	assert.EqualError(t, r, "permission denied")
+}
+
+func TestStoreHeader(t *testing.T) {
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		header := []byte{15, 45, 20, 40, 48}
+		r := sqlmock.NewResult(10, 1)
+
+		mock.ExpectExec("UPDATE local_ega.files SET header = \\$1 WHERE id = \\$2;").
+			WithArgs("0f2d142830", 42).
+			WillReturnResult(r)
+
+		return testDb.StoreHeader(header, 42)
+	})
+
+	assert.Nil(t, r, "StoreHeader failed unexpectedly")
+
+	// nothing reaches the database for headers that can't be right
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		return testDb.StoreHeader(nil, 42)
+	})
+	assert.EqualError(t, r, "refusing to store an empty header")
+
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		return testDb.StoreHeader(make([]byte, MaxHeaderSize+1), 42)
+	})
+	assert.EqualError(t, r, fmt.Sprintf("refusing to store a %d byte header, the limit is %d bytes", MaxHeaderSize+1, MaxHeaderSize))
 
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
@@ -355,7 +1608,7 @@ func TestStoreHeader(t *testing.T) {
 
 func TestSetArchived(t *testing.T) {
 
-	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1}
+	file := FileInfo{sha256.New(), 1000, "/tmp/file.c4gh", sha256.New(), -1, "", 0, "", ""}
 	_, err := file.Checksum.Write([]byte("checksum"))
 
 	if err != nil {
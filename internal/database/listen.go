@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// listenMinReconnect and listenMaxReconnect bound the wait between attempts
+// to reconnect a lost listener connection
+var (
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+)
+
+// listenPingInterval is how often an idle listener checks that its
+// connection is still alive, a dead connection is only noticed when used
+var listenPingInterval = 90 * time.Second
+
+// Notification is a message sent with NOTIFY on a channel that is listened
+// to
+type Notification struct {
+	Channel string
+	Payload string
+}
+
+// notificationListener is the part of pq.Listener used by Listen
+type notificationListener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+// newListener is an internal variable to ease testing
+var newListener = func(connInfo string, callback pq.EventCallbackType) notificationListener {
+	return pq.NewListener(connInfo, listenMinReconnect, listenMaxReconnect, callback)
+}
+
+// Listen subscribes to the notifications sent on channel with NOTIFY, until
+// ctx is done when the returned channel is closed. The listener has a
+// connection of its own, outside of the pool, that is re-established when
+// lost. Notifications sent while the connection is down are lost, which is
+// logged when it is back.
+func (dbs *SQLdb) Listen(ctx context.Context, channel string) (<-chan Notification, error) {
+	l := newListener(dbs.ConnInfo, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Warnf("Lost the connection listening on %s (error: %v)", channel, err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Debugf("Failed to reconnect the listener on %s (error: %v)", channel, err)
+		case pq.ListenerEventReconnected:
+			log.Infof("Reconnected the listener on %s", channel)
+		}
+	})
+
+	// Listen blocks until there is a connection, closing the listener is
+	// the only way to give up on it
+	listening := make(chan error, 1)
+	go func() { listening <- l.Listen(channel) }()
+
+	select {
+	case err := <-listening:
+		if err != nil {
+			_ = l.Close()
+
+			return nil, fmt.Errorf("failed to listen on %s: %v", channel, err)
+		}
+	case <-ctx.Done():
+		_ = l.Close()
+		<-listening
+
+		return nil, ctx.Err()
+	}
+
+	notifications := make(chan Notification)
+	go func() {
+		defer close(notifications)
+		defer l.Close()
+
+		ping := time.NewTicker(listenPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n, ok := <-l.NotificationChannel():
+				if !ok {
+					return
+				}
+				// pq sends nil after a reconnect
+				if n == nil {
+					log.Warnf("Notifications on %s may have been lost while reconnecting", channel)
+
+					continue
+				}
+
+				select {
+				case notifications <- Notification{Channel: n.Channel, Payload: n.Extra}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ping.C:
+				if err := l.Ping(); err != nil {
+					log.Debugf("Listener on %s is not connected (error: %v)", channel, err)
+				}
+			}
+		}
+	}()
+
+	return notifications, nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeListener hands out the notifications it is given
+type fakeListener struct {
+	listenErr     error
+	notifications chan *pq.Notification
+	closed        chan struct{}
+}
+
+func (f *fakeListener) Listen(channel string) error { return f.listenErr }
+func (f *fakeListener) NotificationChannel() <-chan *pq.Notification {
+	return f.notifications
+}
+func (f *fakeListener) Ping() error { return nil }
+func (f *fakeListener) Close() error {
+	close(f.closed)
+
+	return nil
+}
+
+func TestListen(t *testing.T) {
+	fake := &fakeListener{notifications: make(chan *pq.Notification), closed: make(chan struct{})}
+	newListener = func(connInfo string, _ pq.EventCallbackType) notificationListener {
+		assert.Equal(t, testConnInfo, connInfo)
+
+		return fake
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notifications, err := (&SQLdb{ConnInfo: testConnInfo}).Listen(ctx, "file_status")
+	assert.NoError(t, err)
+
+	fake.notifications <- &pq.Notification{Channel: "file_status", Extra: "42 COMPLETED"}
+	assert.Equal(t, Notification{Channel: "file_status", Payload: "42 COMPLETED"}, <-notifications)
+
+	// the marker pq sends after reconnecting is not passed on
+	fake.notifications <- nil
+	fake.notifications <- &pq.Notification{Channel: "file_status", Extra: "43 ERROR"}
+	assert.Equal(t, "43 ERROR", (<-notifications).Payload)
+
+	cancel()
+	select {
+	case _, ok := <-notifications:
+		assert.False(t, ok, "notification after cancel")
+	case <-time.After(time.Second):
+		t.Fatal("notifications not closed when the context was cancelled")
+	}
+	<-fake.closed
+
+	failing := &fakeListener{listenErr: errors.New("permission denied"), closed: make(chan struct{})}
+	newListener = func(string, pq.EventCallbackType) notificationListener { return failing }
+
+	_, err = (&SQLdb{ConnInfo: testConnInfo}).Listen(context.Background(), "file_status")
+	assert.EqualError(t, err, "failed to listen on file_status: permission denied")
+	<-failing.closed
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Query metrics, registered on the default prometheus registry so that they
+// are served by whichever /metrics endpoint the service exposes
+var (
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Time spent on a database operation, per attempt.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation"})
+
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Number of database operation attempts that failed.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(queryDuration, queryErrors)
+}
+
+// observeQuery records how long the operation took since start and whether
+// it failed. It is meant to be deferred at the top of the functions doing
+// the actual work, with a pointer to their named error result, so that
+// each retry is observed on its own. The sentinel errors describing an
+// expected outcome, such as ErrAlreadyCompleted, are not counted as errors.
+func observeQuery(operation string, start time.Time, err *error) {
+	queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil && !errors.Is(*err, ErrAlreadyCompleted) &&
+		!errors.Is(*err, ErrNoCorrelationID) && !errors.Is(*err, ErrFileNotFound) &&
+		!errors.Is(*err, ErrFileRemoved) {
+		queryErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationFiles holds the schema migrations, named <version>_<name>.sql
+// and applied in version order
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock held while migrating, so that
+// services starting at the same time don't apply the same migration twice
+const migrationLockID = 7462891
+
+// migration is a single schema change
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations sorted by version
+func loadMigrations(files fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		prefix := strings.SplitN(name, "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s doesn't start with a version number", e.Name())
+		}
+
+		sql, err := fs.ReadFile(files, "migrations/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, sql: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies the schema migrations that haven't been applied yet, in
+// a single transaction, and records them in local_ega.schema_migrations.
+// With dryRun nothing is changed. The names of the pending migrations are
+// returned either way.
+func (dbs *SQLdb) Migrate(dryRun bool) ([]string, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	dbs.checkAndReconnectIfNeeded()
+
+	tx, err := dbs.pool().Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a commit is a no-op
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1);", migrationLockID); err != nil {
+		return nil, err
+	}
+
+	const create = "CREATE TABLE IF NOT EXISTS local_ega.schema_migrations (" +
+		"version INTEGER PRIMARY KEY, " +
+		"name TEXT NOT NULL, " +
+		"applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now());"
+	if _, err := tx.Exec(create); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT version FROM local_ega.schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+
+			return nil, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		pending = append(pending, m.name)
+
+		if dryRun {
+			log.Infof("Pending database migration: %s", m.name)
+
+			continue
+		}
+
+		log.Infof("Applying database migration: %s", m.name)
+		if _, err := tx.Exec(m.sql); err != nil {
+			return nil, fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO local_ega.schema_migrations (version, name) VALUES ($1, $2);", m.version, m.name); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return pending, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
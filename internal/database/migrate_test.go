@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"migrations/0002_second.sql": {Data: []byte("SELECT 2;")},
+		"migrations/0001_first.sql":  {Data: []byte("SELECT 1;")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []migration{{1, "0001_first", "SELECT 1;"}, {2, "0002_second", "SELECT 2;"}}, migrations)
+
+	_, err = loadMigrations(fstest.MapFS{"migrations/first.sql": {Data: []byte("SELECT 1;")}})
+	assert.EqualError(t, err, "migration first.sql doesn't start with a version number")
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_first.sql": {Data: []byte("SELECT 1;")},
+		"migrations/1_other.sql":    {Data: []byte("SELECT 1;")},
+	})
+	assert.Error(t, err)
+
+	// the embedded migrations are valid
+	_, err = loadMigrations(migrationFiles)
+	assert.NoError(t, err)
+}
+
+// expectMigrationStart sets up the expectations for locking and reading the
+// applied migrations
+func expectMigrationStart(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1\\);").
+		WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS local_ega.schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version"})
+	for _, v := range applied {
+		rows.AddRow(v)
+	}
+	mock.ExpectQuery("SELECT version FROM local_ega.schema_migrations;").WillReturnRows(rows)
+}
+
+func TestMigrate(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	assert.NoError(t, err)
+
+	// only the migrations after the first are applied
+	r := sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expectMigrationStart(mock, migrations[0].version)
+		var names []string
+		for _, m := range migrations[1:] {
+			mock.ExpectExec(regexp.QuoteMeta(m.sql)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO local_ega.schema_migrations \\(version, name\\) VALUES \\(\\$1, \\$2\\);").
+				WithArgs(m.version, m.name).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			names = append(names, m.name)
+		}
+		mock.ExpectCommit()
+
+		applied, err := testDb.Migrate(false)
+		assert.Equal(t, names, applied)
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	// a dry run changes nothing
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expectMigrationStart(mock)
+		mock.ExpectRollback()
+
+		pending, err := testDb.Migrate(true)
+		assert.Contains(t, pending, "0001_verify_progress")
+
+		return err
+	})
+	assert.NoError(t, r)
+
+	// a failing migration is rolled back
+	r = sqlTesterHelper(t, func(mock sqlmock.Sqlmock, testDb *SQLdb) error {
+		expectMigrationStart(mock)
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS local_ega.verify_progress").
+			WillReturnError(errors.New("permission denied"))
+		mock.ExpectRollback()
+
+		_, err := testDb.Migrate(false)
+
+		return err
+	})
+	assert.EqualError(t, r, "migration 0001_verify_progress failed: permission denied")
+}
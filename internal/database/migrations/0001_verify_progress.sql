@@ -0,0 +1,8 @@
+-- Progress of the file currently being verified, see cmd/verify/verify.md
+CREATE TABLE IF NOT EXISTS local_ega.verify_progress (
+    file_id     INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    bytes_done  BIGINT NOT NULL,
+    total_bytes BIGINT NOT NULL,
+    started_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    updated_at  TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
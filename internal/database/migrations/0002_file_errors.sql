@@ -0,0 +1,9 @@
+-- Why files were marked as ERROR, see MarkError
+CREATE TABLE IF NOT EXISTS local_ega.file_errors (
+    id          SERIAL PRIMARY KEY,
+    file_id     INTEGER NOT NULL REFERENCES local_ega.main (id),
+    reason      TEXT NOT NULL,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS file_errors_file_id_idx ON local_ega.file_errors (file_id);
@@ -0,0 +1,6 @@
+-- The correlation id of the message a file was ingested with, see
+-- StoreCorrelationID and GetCorrelationID
+CREATE TABLE IF NOT EXISTS local_ega.file_correlation (
+    file_id        INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    correlation_id TEXT NOT NULL
+);
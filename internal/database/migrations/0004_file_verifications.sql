@@ -0,0 +1,7 @@
+-- When, and by which service instance, files were last verified, see
+-- MarkCompleted
+CREATE TABLE IF NOT EXISTS local_ega.file_verifications (
+    file_id     INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    verified_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    verified_by TEXT NOT NULL
+);
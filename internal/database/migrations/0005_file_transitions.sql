@@ -0,0 +1,13 @@
+-- Append-only history of the file status changes, see LogTransition
+CREATE TABLE IF NOT EXISTS local_ega.file_transitions (
+    id             SERIAL PRIMARY KEY,
+    file_id        INTEGER NOT NULL REFERENCES local_ega.main (id),
+    from_status    TEXT NOT NULL,
+    to_status      TEXT NOT NULL,
+    reason         TEXT NOT NULL,
+    correlation_id TEXT,
+    service        TEXT NOT NULL,
+    occurred_at    TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS file_transitions_file_id_idx ON local_ega.file_transitions (file_id);
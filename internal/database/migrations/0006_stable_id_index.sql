@@ -0,0 +1,2 @@
+-- Files are looked up by accession id, see GetFileByAccession
+CREATE INDEX IF NOT EXISTS main_stable_id_idx ON local_ega.main (stable_id);
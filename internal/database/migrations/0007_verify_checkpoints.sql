@@ -0,0 +1,9 @@
+-- Where verifying a file can resume from, see cmd/verify/verify.md
+CREATE TABLE IF NOT EXISTS local_ega.verify_checkpoints (
+    file_id        INTEGER PRIMARY KEY REFERENCES local_ega.main (id),
+    archive_offset BIGINT NOT NULL,
+    archive_size   BIGINT NOT NULL,
+    decrypted_size BIGINT NOT NULL,
+    state          BYTEA NOT NULL,
+    updated_at     TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+-- When the accession request of a verified file was sent, so that a
+-- redelivered message only skips a file whose request went out, see
+-- MarkAccessionRequested
+ALTER TABLE local_ega.file_verifications ADD COLUMN IF NOT EXISTS accession_requested_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,712 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// azureAPIVersion is the version of the Blob service REST API used
+const azureAPIVersion = "2020-10-02"
+
+// azureBlockSize is the size of the blocks uploaded when no chunk size is
+// configured
+const azureBlockSize = 8 * 1024 * 1024
+
+// azureIMDSEndpoint is where managed identity tokens are requested on Azure
+// VMs and in AKS, an internal variable to ease testing
+var azureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// azureBackend stores files as block blobs in an Azure storage container
+type azureBackend struct {
+	Client    *http.Client
+	Endpoint  *url.URL
+	Container string
+	Conf      *AzureConf
+	auth      azureAuthorizer
+}
+
+// AzureConf stores information about the Azure Blob storage backend. The
+// backend authenticates with the account key from ConnectionString or
+// AccountKey, or else with the managed identity of the host, ClientID
+// choosing a user assigned identity.
+type AzureConf struct {
+	ConnectionString string `redact:"true"`
+	AccountName      string
+	AccountKey       string `redact:"true"`
+	ClientID         string
+	URL              string
+	Container        string
+	Prefix           string
+	Chunksize        int
+	Cacert           string
+}
+
+// azureAuthorizer adds the credentials to a request for the Blob service
+type azureAuthorizer interface {
+	authorize(req *http.Request) error
+}
+
+func init() {
+	RegisterBackend("azure", func(config Conf) (Backend, error) {
+		return newAzureBackend(config.Azure)
+	})
+}
+
+func newAzureBackend(config AzureConf) (*azureBackend, error) {
+	if config.Container == "" {
+		return nil, fmt.Errorf("no container given for the azure backend")
+	}
+
+	account, key, endpoint := config.AccountName, config.AccountKey, config.URL
+	if config.ConnectionString != "" {
+		settings, err := parseAzureConnectionString(config.ConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		account, key = settings["AccountName"], settings["AccountKey"]
+		if endpoint == "" {
+			endpoint = settings["BlobEndpoint"]
+		}
+		if endpoint == "" && settings["EndpointSuffix"] != "" {
+			protocol := settings["DefaultEndpointsProtocol"]
+			if protocol == "" {
+				protocol = "https"
+			}
+			endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account, settings["EndpointSuffix"])
+		}
+		if key == "" {
+			return nil, fmt.Errorf("the azure connection string has no AccountKey")
+		}
+	}
+	if account == "" {
+		return nil, fmt.Errorf("either a connection string or an account name is needed for the azure backend")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("bad azure endpoint %s: %v", endpoint, err)
+	}
+
+	ab := &azureBackend{
+		Client:    &http.Client{Transport: transportConfig(config.Cacert)},
+		Endpoint:  u,
+		Container: config.Container,
+		Conf:      &config,
+	}
+
+	if key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("the azure account key is not base64 encoded: %v", err)
+		}
+		ab.auth = &azureSharedKey{account: account, key: decoded}
+	} else {
+		ab.auth = &azureManagedIdentity{client: &http.Client{Timeout: 30 * time.Second}, clientID: config.ClientID}
+	}
+
+	container := url.Values{"restype": {"container"}}
+
+	// Attempt to create the container, but we really expect an error here
+	// (ContainerAlreadyExists)
+	resp, err := ab.do(http.MethodPut, ab.containerURL(container), nil, 0, nil)
+	if err == nil {
+		if err = checkAzureStatus(resp, http.StatusCreated); err == nil {
+			resp.Body.Close()
+		} else if resp.Header.Get("x-ms-error-code") != "ContainerAlreadyExists" {
+			log.Error("Unexpected issue while creating container", err)
+		}
+	}
+
+	resp, err = ab.do(http.MethodHead, ab.containerURL(container), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to access container %s: %v", config.Container, err)
+	}
+	resp.Body.Close()
+
+	return ab, nil
+}
+
+// parseAzureConnectionString splits a connection string, such as the one
+// shown for the storage account in the portal, into its settings
+func parseAzureConnectionString(connectionString string) (map[string]string, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		setting := strings.SplitN(part, "=", 2)
+		if len(setting) != 2 {
+			return nil, fmt.Errorf("bad azure connection string, %q is not a setting", part)
+		}
+		settings[strings.TrimSpace(setting[0])] = strings.TrimSpace(setting[1])
+	}
+
+	return settings, nil
+}
+
+// containerURL returns the URL of the container with the query
+func (ab *azureBackend) containerURL(query url.Values) string {
+	u := *ab.Endpoint
+	u.Path = path.Join(u.Path, ab.Container)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// blobURL returns the URL of the blob for filePath, below the configured
+// prefix, with the query
+func (ab *azureBackend) blobURL(filePath string, query url.Values) string {
+	u := *ab.Endpoint
+	u.Path = path.Join(u.Path, ab.Container, ab.Conf.Prefix, filePath)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// do sends an authorized request to the Blob service
+func (ab *azureBackend) do(method, target string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	return ab.doContext(context.Background(), method, target, body, length, header)
+}
+
+// doContext sends an authorized request to the Blob service, aborted when
+// ctx is done
+func (ab *azureBackend) doContext(ctx context.Context, method, target string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.ContentLength = length
+
+	if err := ab.auth.authorize(req); err != nil {
+		return nil, err
+	}
+
+	return ab.Client.Do(req)
+}
+
+// checkAzureStatus returns an error, with the error code given by the Blob
+// service, unless the response has the expected status. The body is
+// closed when there is an error.
+func checkAzureStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	if code := resp.Header.Get("x-ms-error-code"); code != "" {
+		err = fmt.Errorf("%v (%s)", err, code)
+	}
+
+	return err
+}
+
+// NewFileReader returns an io.Reader instance
+func (ab *azureBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return ab.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the blob that stops
+// reading when ctx is done
+func (ab *azureBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if ab == nil {
+		return nil, fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.doContext(ctx, http.MethodGet, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the blob from
+// offset
+func (ab *azureBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if ab == nil {
+		return nil, fmt.Errorf("Invalid azureBackend")
+	}
+
+	size, err := ab.GetFileSize(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, size, offset, length); err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{"X-Ms-Range": {httpRange(offset, length)}}
+	resp, err := ab.do(http.MethodGet, ab.blobURL(filePath, nil), nil, 0, header)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusPartialContent)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// NewFileWriter uploads the contents written to it as a block blob, the
+// upload is done when Close returns
+func (ab *azureBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if ab == nil {
+		return nil, fmt.Errorf("Invalid azureBackend")
+	}
+
+	reader, writer := io.Pipe()
+	w := &uploadWriter{PipeWriter: writer, done: make(chan error, 1)}
+	go func() {
+		err := ab.upload(filePath, reader)
+		if err != nil {
+			_ = reader.CloseWithError(err)
+		}
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// upload puts what is read from reader in blocks and then commits the
+// blocks as the blob for filePath
+func (ab *azureBackend) upload(filePath string, reader io.Reader) error {
+	blockSize := ab.Conf.Chunksize
+	if blockSize <= 0 {
+		blockSize = azureBlockSize
+	}
+
+	var (
+		blocks []string
+		buf    = make([]byte, blockSize)
+	)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			// block ids must all have the same length
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blocks))))
+			resp, err := ab.do(http.MethodPut,
+				ab.blobURL(filePath, url.Values{"comp": {"block"}, "blockid": {id}}),
+				bytes.NewReader(buf[:n]), int64(n), nil)
+			if err == nil {
+				err = checkAzureStatus(resp, http.StatusCreated)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to upload block %d of %s: %v", len(blocks), filePath, err)
+			}
+			resp.Body.Close()
+			blocks = append(blocks, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blocks {
+		fmt.Fprintf(&blockList, "<Latest>%s</Latest>", id)
+	}
+	blockList.WriteString("</BlockList>")
+
+	header := http.Header{
+		"Content-Type":           {"application/xml"},
+		"X-Ms-Blob-Content-Type": {"application/octet-stream"},
+	}
+	resp, err := ab.do(http.MethodPut, ab.blobURL(filePath, url.Values{"comp": {"blocklist"}}),
+		&blockList, int64(blockList.Len()), header)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusCreated)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to commit %s: %v", filePath, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// GetFileSize returns the size of a specific blob
+func (ab *azureBackend) GetFileSize(filePath string) (int64, error) {
+	if ab == nil {
+		return 0, fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.do(http.MethodHead, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Errorln(err)
+
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+// Exists tells whether the blob exists, an error is only returned when that
+// can't be told
+func (ab *azureBackend) Exists(filePath string) (bool, error) {
+	if ab == nil {
+		return false, fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.do(http.MethodHead, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+
+		return false, nil
+	}
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// GetObjectMetadata returns the properties and user defined metadata of
+// the blob
+func (ab *azureBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if ab == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.do(http.MethodHead, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return ObjectMetadata{}, err
+	}
+	resp.Body.Close()
+
+	return headerMetadata(resp, "x-ms-meta-"), nil
+}
+
+// RemoveFile removes a blob from the container
+func (ab *azureBackend) RemoveFile(filePath string) error {
+	if ab == nil {
+		return fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.do(http.MethodDelete, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusAccepted)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Delete removes a blob from the container, a blob that is already gone is
+// not an error
+func (ab *azureBackend) Delete(filePath string) error {
+	if ab == nil {
+		return fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.do(http.MethodDelete, ab.blobURL(filePath, nil), nil, 0, nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+
+		return nil
+	}
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusAccepted)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// HealthCheck returns an error unless the container can be reached
+func (ab *azureBackend) HealthCheck(ctx context.Context) error {
+	if ab == nil {
+		return fmt.Errorf("Invalid azureBackend")
+	}
+
+	resp, err := ab.doContext(ctx, http.MethodHead, ab.containerURL(url.Values{"restype": {"container"}}), nil, 0, nil)
+	if err == nil {
+		err = checkAzureStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// PresignGet returns ErrUnsupported, presigned URLs are only made for S3
+func (ab *azureBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+// List returns the blobs below the configured prefix whose names, without
+// it, start with prefix
+func (ab *azureBackend) List(prefix string) ([]ObjectInfo, error) {
+	if ab == nil {
+		return nil, fmt.Errorf("Invalid azureBackend")
+	}
+
+	base := strings.TrimPrefix(path.Join("/", ab.Conf.Prefix), "/")
+	if base != "" {
+		base += "/"
+	}
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {base + strings.TrimPrefix(prefix, "/")}}
+
+	objects := []ObjectInfo{}
+	for {
+		resp, err := ab.do(http.MethodGet, ab.containerURL(query), nil, 0, nil)
+		if err == nil {
+			err = checkAzureStatus(resp, http.StatusOK)
+		}
+		if err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+
+		var list struct {
+			Blobs []struct {
+				Name       string
+				Properties struct {
+					LastModified  string `xml:"Last-Modified"`
+					ContentLength int64  `xml:"Content-Length"`
+				}
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad blob list for %s: %v", ab.Container, err)
+		}
+
+		for _, blob := range list.Blobs {
+			modified, err := http.ParseTime(blob.Properties.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("bad modification time for %s: %v", blob.Name, err)
+			}
+			objects = append(objects, ObjectInfo{
+				Path:         strings.TrimPrefix(blob.Name, base),
+				Size:         blob.Properties.ContentLength,
+				LastModified: modified})
+		}
+		if list.NextMarker == "" {
+			return objects, nil
+		}
+		query.Set("marker", list.NextMarker)
+	}
+}
+
+// azureSharedKey signs requests with the storage account key
+type azureSharedKey struct {
+	account string
+	key     []byte
+}
+
+func (a *azureSharedKey) authorize(req *http.Request) error {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(a.stringToSign(req)))
+	req.Header.Set("Authorization",
+		fmt.Sprintf("SharedKey %s:%s", a.account, base64.StdEncoding.EncodeToString(mac.Sum(nil))))
+
+	return nil
+}
+
+// stringToSign returns what is signed for the request, as described in
+// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (a *azureSharedKey) stringToSign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	parts := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	var headers []string
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(headers)
+	parts = append(parts, headers...)
+
+	resource := "/" + a.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	return strings.Join(append(parts, resource), "\n")
+}
+
+// azureManagedIdentity authorizes requests with tokens for the managed
+// identity of the host, from the App Service identity endpoint when there
+// is one and from the instance metadata service otherwise
+type azureManagedIdentity struct {
+	client   *http.Client
+	clientID string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (a *azureManagedIdentity) authorize(req *http.Request) error {
+	token, err := a.getToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+// getToken returns the current token, fetching a new one when it is about
+// to expire
+func (a *azureManagedIdentity) getToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Until(a.expires) > 5*time.Minute {
+		return a.token, nil
+	}
+
+	query := url.Values{"resource": {"https://storage.azure.com/"}}
+	if a.clientID != "" {
+		query.Set("client_id", a.clientID)
+	}
+
+	endpoint, header := azureIMDSEndpoint, http.Header{"Metadata": {"true"}}
+	query.Set("api-version", "2018-02-01")
+	if identityEndpoint := os.Getenv("IDENTITY_ENDPOINT"); identityEndpoint != "" {
+		endpoint = identityEndpoint
+		header = http.Header{"X-Identity-Header": {os.Getenv("IDENTITY_HEADER")}}
+		query.Set("api-version", "2019-08-01")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get a managed identity token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a managed identity token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresOn   json.RawMessage `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("bad managed identity token: %v", err)
+	}
+
+	// expires_on is seconds since the epoch, as a string or a number
+	expiresOn, err := strconv.ParseInt(strings.Trim(string(token.ExpiresOn), `"`), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad managed identity token expiry %s: %v", token.ExpiresOn, err)
+	}
+
+	a.token, a.expires = token.AccessToken, time.Unix(expiresOn, 0)
+
+	return a.token, nil
+}
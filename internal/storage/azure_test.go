@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testAzureKey is the well known key of the Azurite storage emulator
+const testAzureKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeAzure is a Blob service with just enough of the API for the backend
+type fakeAzure struct {
+	sync.Mutex
+	account    string
+	token      string
+	containers map[string]bool
+	blocks     map[string][]byte
+	blobs      map[string][]byte
+}
+
+func newFakeAzure(account string) *fakeAzure {
+	return &fakeAzure{
+		account:    account,
+		containers: map[string]bool{},
+		blocks:     map[string][]byte{},
+		blobs:      map[string][]byte{},
+	}
+}
+
+func (f *fakeAzure) authorized(r *http.Request) bool {
+	if f.token != "" {
+		return r.Header.Get("Authorization") == "Bearer "+f.token
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(testAzureKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte((&azureSharedKey{account: f.account}).stringToSign(r)))
+	expected := fmt.Sprintf("SharedKey %s:%s", f.account, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	return r.Header.Get("Authorization") == expected
+}
+
+func (f *fakeAzure) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.authorized(r) {
+		f.fail(w, http.StatusForbidden, "AuthenticationFailed")
+
+		return
+	}
+
+	// paths are /<account>/<container>[/<blob>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"+f.account+"/"), "/", 2)
+	container, query := parts[0], r.URL.Query()
+
+	if len(parts) == 1 && query.Get("comp") == "list" {
+		f.list(w, container, query)
+
+		return
+	}
+	if len(parts) == 1 && query.Get("restype") == "container" {
+		switch {
+		case r.Method == http.MethodPut && f.containers[container]:
+			f.fail(w, http.StatusConflict, "ContainerAlreadyExists")
+		case r.Method == http.MethodPut:
+			f.containers[container] = true
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodHead && f.containers[container]:
+			w.WriteHeader(http.StatusOK)
+		default:
+			f.fail(w, http.StatusNotFound, "ContainerNotFound")
+		}
+
+		return
+	}
+
+	blob := r.URL.Path
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		f.blocks[blob+"/"+query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			f.fail(w, http.StatusBadRequest, "InvalidXmlDocument")
+
+			return
+		}
+		content := []byte{}
+		for _, id := range list.Latest {
+			content = append(content, f.blocks[blob+"/"+id]...)
+		}
+		f.blobs[blob] = content
+		w.WriteHeader(http.StatusCreated)
+	case f.blobs[blob] == nil:
+		f.fail(w, http.StatusNotFound, "BlobNotFound")
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.blobs[blob])))
+		w.Header().Set("ETag", `"0x8D4BCC2E4835CD0"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("x-ms-meta-Checksum", "abc")
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet:
+		if blobRange := r.Header.Get("x-ms-range"); blobRange != "" {
+			r.Header.Set("Range", blobRange)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.blobs[blob]))
+	case r.Method == http.MethodDelete:
+		delete(f.blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		f.fail(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// list lists the blobs of the container, two at a time
+func (f *fakeAzure) list(w http.ResponseWriter, container string, query url.Values) {
+	root := "/" + f.account + "/" + container + "/"
+	names := []string{}
+	for blob := range f.blobs {
+		name := strings.TrimPrefix(blob, root)
+		if name != blob && strings.HasPrefix(name, query.Get("prefix")) && name >= query.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > 2 {
+		next, names = names[2], names[:2]
+	}
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, name := range names {
+		fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><Last-Modified>Mon, 02 Jan 2006 15:04:05 GMT</Last-Modified>`+
+			`<Content-Length>%d</Content-Length></Properties></Blob>`, name, len(f.blobs[root+name]))
+	}
+	fmt.Fprintf(w, `</Blobs><NextMarker>%s</NextMarker></EnumerationResults>`, next)
+}
+
+func TestAzureBackend(t *testing.T) {
+	fake := newFakeAzure("devstoreaccount1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	conf := Conf{Type: "azure", Azure: AzureConf{
+		ConnectionString: "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+			"AccountKey=" + testAzureKey + ";BlobEndpoint=" + server.URL + "/devstoreaccount1;",
+		Container: "archive",
+		Prefix:    "sda",
+		Chunksize: 4,
+	}}
+
+	backend, err := NewBackend(conf)
+	assert.NoError(t, err)
+	assert.IsType(t, &azureBackend{}, unwrapBackend(backend))
+	assert.True(t, fake.containers["archive"], "the container was not created")
+
+	assert.NoError(t, backend.HealthCheck(context.Background()))
+
+	// the container exists the second time
+	_, err = NewBackend(conf)
+	assert.NoError(t, err)
+
+	writer, err := backend.NewFileWriter("dir/file")
+	assert.NoError(t, err)
+	written, err := writer.Write(writeData)
+	assert.NoError(t, err)
+	assert.Equal(t, len(writeData), written)
+	assert.NoError(t, writer.Close())
+
+	// blocks of four bytes below the prefix
+	assert.Equal(t, writeData, fake.blobs["/devstoreaccount1/archive/sda/dir/file"])
+	assert.Len(t, fake.blocks, 4)
+
+	size, err := backend.GetFileSize("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+	exists, err := backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	metadata, err := backend.GetObjectMetadata("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectMetadata{
+		Size:         size,
+		ETag:         "0x8D4BCC2E4835CD0",
+		LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		Metadata:     map[string]string{"checksum": "abc"}}, metadata)
+
+	reader, err := backend.NewFileReader("dir/file")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, writeData, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backend.NewFileReaderContext(ctx, "dir/file")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	reader, err = backend.NewFileReaderAt("dir/file", 5, 2)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, writeData[5:7], content)
+
+	assert.NoError(t, backend.RemoveFile("dir/file"))
+
+	_, err = backend.GetFileSize("dir/file")
+	assert.EqualError(t, err, "HEAD /devstoreaccount1/archive/sda/dir/file: 404 Not Found (BlobNotFound)")
+	exists, err = backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	_, err = backend.NewFileReader("dir/file")
+	assert.EqualError(t, err, "GET /devstoreaccount1/archive/sda/dir/file: 404 Not Found (BlobNotFound)")
+	assert.Error(t, backend.RemoveFile("dir/file"))
+	assert.NoError(t, backend.Delete("dir/file"), "a blob that is already gone is deleted")
+	fake.blobs["/devstoreaccount1/archive/sda/deleted"] = writeData
+	assert.NoError(t, backend.Delete("deleted"))
+	assert.NotContains(t, fake.blobs, "/devstoreaccount1/archive/sda/deleted")
+
+	// an empty file is committed as an empty blob
+	writer, err = backend.NewFileWriter("empty")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, []byte{}, fake.blobs["/devstoreaccount1/archive/sda/empty"])
+}
+
+func TestAzureList(t *testing.T) {
+	fake := newFakeAzure("devstoreaccount1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	backend, err := NewBackend(Conf{Type: "azure", Azure: AzureConf{
+		ConnectionString: "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+			"AccountKey=" + testAzureKey + ";BlobEndpoint=" + server.URL + "/devstoreaccount1;",
+		Container: "archive",
+		Prefix:    "sda",
+	}})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"sda/a", "sda/dir/b", "sda/dir/c", "sda/dir/sub/d", "other/e"} {
+		fake.blobs["/devstoreaccount1/archive/"+name] = []byte(name)
+	}
+
+	// over several pages
+	objects, err := backend.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectInfo{
+		{Path: "a", Size: 5, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/b", Size: 9, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/c", Size: 9, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/sub/d", Size: 13, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+	}, objects)
+
+	objects, err = backend.List("/dir/s")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "dir/sub/d", objects[0].Path)
+
+	objects, err = backend.List("none")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	fake := newFakeAzure("account")
+	fake.token = "token"
+	fake.containers["archive"] = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	requests := 0
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "https://storage.azure.com/", r.URL.Query().Get("resource"))
+		assert.Equal(t, "client", r.URL.Query().Get("client_id"))
+		fmt.Fprintf(w, `{"access_token": "token", "expires_on": "%d"}`, time.Now().Add(time.Hour).Unix())
+	}))
+	defer imds.Close()
+	azureIMDSEndpoint = imds.URL
+
+	backend, err := newAzureBackend(AzureConf{
+		AccountName: "account",
+		ClientID:    "client",
+		URL:         server.URL + "/account",
+		Container:   "archive",
+	})
+	assert.NoError(t, err)
+
+	writer, err := backend.NewFileWriter("file")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	size, err := backend.GetFileSize("file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+
+	// the token is reused until it is about to expire
+	assert.Equal(t, 1, requests)
+
+	// a rejected token is reported
+	fake.token = "other"
+	_, err = backend.GetFileSize("file")
+	assert.EqualError(t, err, "HEAD /account/archive/file: 403 Forbidden (AuthenticationFailed)")
+}
+
+func TestAzureBackendFail(t *testing.T) {
+	fake := newFakeAzure("devstoreaccount1")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	_, err := newAzureBackend(AzureConf{AccountName: "devstoreaccount1"})
+	assert.EqualError(t, err, "no container given for the azure backend")
+
+	_, err = newAzureBackend(AzureConf{Container: "archive"})
+	assert.EqualError(t, err, "either a connection string or an account name is needed for the azure backend")
+
+	_, err = newAzureBackend(AzureConf{ConnectionString: "AccountName=devstoreaccount1", Container: "archive"})
+	assert.EqualError(t, err, "the azure connection string has no AccountKey")
+
+	_, err = newAzureBackend(AzureConf{ConnectionString: "AccountName", Container: "archive"})
+	assert.EqualError(t, err, `bad azure connection string, "AccountName" is not a setting`)
+
+	_, err = newAzureBackend(AzureConf{AccountName: "devstoreaccount1", AccountKey: "not base64!", Container: "archive"})
+	assert.ErrorContains(t, err, "the azure account key is not base64 encoded")
+
+	// a key that the service doesn't accept
+	_, err = newAzureBackend(AzureConf{
+		AccountName: "devstoreaccount1",
+		AccountKey:  base64.StdEncoding.EncodeToString([]byte("wrong")),
+		URL:         server.URL + "/devstoreaccount1",
+		Container:   "archive",
+	})
+	assert.EqualError(t, err, "failed to access container archive: "+
+		"HEAD /devstoreaccount1/archive: 403 Forbidden (AuthenticationFailed)")
+
+	// an upload that fails is reported when closing
+	backend, err := newAzureBackend(AzureConf{
+		AccountName: "devstoreaccount1",
+		AccountKey:  testAzureKey,
+		URL:         server.URL + "/devstoreaccount1",
+		Container:   "archive",
+	})
+	assert.NoError(t, err)
+	backend.auth = &azureSharedKey{account: "devstoreaccount1", key: []byte("wrong")}
+	writer, err := backend.NewFileWriter("file")
+	assert.NoError(t, err)
+	_, _ = writer.Write(writeData)
+	assert.EqualError(t, writer.Close(), "failed to upload block 0 of file: "+
+		"PUT /devstoreaccount1/archive/file: 403 Forbidden (AuthenticationFailed)")
+}
+
+func TestAzureStringToSign(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPut,
+		"https://account.blob.core.windows.net/archive/dir/my%20file?comp=block&blockid=MDA%3D",
+		bytes.NewReader(writeData))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("x-ms-date", "Mon, 02 Jan 2023 15:04:05 GMT")
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	assert.Equal(t, "PUT\n\n\n14\n\napplication/octet-stream\n\n\n\n\n\n\n"+
+		"x-ms-date:Mon, 02 Jan 2023 15:04:05 GMT\n"+
+		"x-ms-version:2020-10-02\n"+
+		"/account/archive/dir/my%20file\n"+
+		"blockid:MDA=\n"+
+		"comp:block", (&azureSharedKey{account: "account"}).stringToSign(req))
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheConf configures a local disk cache of the files read from a backend
+type CacheConf struct {
+	// Dir is the directory the cached files are kept in, no cache is used
+	// when it is not set
+	Dir string
+	// MaxSize is the most bytes kept in the cache, the least recently used
+	// files are removed to make room for new ones
+	MaxSize int64
+}
+
+// cacheMaxSize is the size of the cache when none is configured
+const cacheMaxSize = 10 * 1024 * 1024 * 1024
+
+// cacheTempSuffix ends the names of the files being filled
+const cacheTempSuffix = ".tmp"
+
+// cacheBackend serves the files read from the wrapped backend from a local
+// disk cache when they are there, and adds them as they are read otherwise.
+// Cached files are checked against the size and the ETag, or the
+// modification time when there is none, of the file in the backend.
+type cacheBackend struct {
+	Backend
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a file in the cache, kept in a file named by the key and
+// the version of the file it is a copy of
+type cacheEntry struct {
+	key     string
+	version string
+	size    int64
+}
+
+// name returns the name of the file the entry is kept in
+func (e *cacheEntry) name() string {
+	return cacheFileName(e.key, e.version)
+}
+
+func newCacheBackend(backend Backend, config CacheConf) (*cacheBackend, error) {
+	if config.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid cache size %d", config.MaxSize)
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = cacheMaxSize
+	}
+
+	if err := os.MkdirAll(config.Dir, 0750); err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	cb := &cacheBackend{
+		Backend: backend,
+		dir:     config.Dir,
+		maxSize: config.MaxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element)}
+
+	// the files left by an earlier run are kept, the most recently modified,
+	// which is when they were last read, taken as the most recently used
+	files := make([]os.FileInfo, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), cacheTempSuffix) {
+			_ = os.Remove(filepath.Join(config.Dir, entry.Name()))
+
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		key, version := info.Name(), ""
+		if i := strings.IndexByte(key, '.'); i >= 0 {
+			key, version = key[:i], key[i+1:]
+		}
+		cb.add(key, version, info.Size())
+	}
+
+	return cb, nil
+}
+
+// unwrap returns the backend whose files are cached
+func (cb *cacheBackend) unwrap() Backend {
+	return cb.Backend
+}
+
+// cacheKey returns the name of the cached copy of filePath
+func cacheKey(filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheVersion returns what tells apart the versions of a file, its ETag or
+// when there is none its modification time, hashed to be part of a file
+// name. An empty version, when the backend gives neither, leaves only the
+// size to compare.
+func cacheVersion(metadata ObjectMetadata) string {
+	version := metadata.ETag
+	if version == "" && !metadata.LastModified.IsZero() {
+		version = metadata.LastModified.UTC().Format(time.RFC3339Nano)
+	}
+	if version == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(version))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// cacheFileName returns the name of the cached copy of a version of a file
+func cacheFileName(key, version string) string {
+	if version == "" {
+		return key
+	}
+
+	return key + "." + version
+}
+
+// add records a version of a file of size bytes as the most recently used,
+// and removes the least recently used files while the cache is too large
+func (cb *cacheBackend) add(key, version string, size int64) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if elem, ok := cb.entries[key]; ok {
+		if elem.Value.(*cacheEntry).version != version {
+			cb.removeEntry(elem)
+		} else {
+			cb.size -= elem.Value.(*cacheEntry).size
+			cb.lru.Remove(elem)
+		}
+	}
+	cb.entries[key] = cb.lru.PushFront(&cacheEntry{key: key, version: version, size: size})
+	cb.size += size
+
+	for cb.size > cb.maxSize {
+		oldest := cb.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		cb.removeEntry(oldest)
+		log.Debugf("removed %s from the cache", entry.key)
+	}
+}
+
+// removeEntry drops a file from the cache, cb.mu must be held
+func (cb *cacheBackend) removeEntry(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	cb.lru.Remove(elem)
+	delete(cb.entries, entry.key)
+	cb.size -= entry.size
+	if err := os.Remove(filepath.Join(cb.dir, entry.name())); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+}
+
+// drop removes the cached copy of filePath, if any
+func (cb *cacheBackend) drop(filePath string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if elem, ok := cb.entries[cacheKey(filePath)]; ok {
+		cb.removeEntry(elem)
+	}
+}
+
+// open returns the cached copy of a version of a file of size bytes, marked
+// as the most recently used, or nil when it isn't cached
+func (cb *cacheBackend) open(key, version string, size int64) *os.File {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	elem, ok := cb.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.size != size || entry.version != version {
+		// the file has changed since it was cached
+		cb.removeEntry(elem)
+
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(cb.dir, entry.name()))
+	if err != nil {
+		log.Error(err)
+		cb.removeEntry(elem)
+
+		return nil
+	}
+	cb.lru.MoveToFront(elem)
+	now := time.Now()
+	_ = os.Chtimes(file.Name(), now, now)
+
+	return file
+}
+
+// NewFileReader returns an io.Reader for the file, from the cache when it
+// is there
+func (cb *cacheBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return cb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the file, from the cache
+// when it is there, that is closed when ctx is done. Files not in the cache
+// are added as they are read to the end.
+func (cb *cacheBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("Invalid cacheBackend")
+	}
+
+	metadata, err := cb.Backend.GetObjectMetadata(filePath)
+	if err != nil {
+		return nil, err
+	}
+	size, version := metadata.Size, cacheVersion(metadata)
+
+	key := cacheKey(filePath)
+	if file := cb.open(key, version, size); file != nil {
+		log.Debugf("reading %s from the cache", filePath)
+
+		return newContextReader(ctx, file), nil
+	}
+
+	reader, err := cb.Backend.NewFileReaderContext(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if size > cb.maxSize {
+		return reader, nil
+	}
+
+	temp, err := os.CreateTemp(cb.dir, key+".*"+cacheTempSuffix)
+	if err != nil {
+		// the file can still be read, only not cached
+		log.Errorf("failed to cache %s: %v", filePath, err)
+
+		return reader, nil
+	}
+
+	return &cacheFiller{ReadCloser: reader, cache: cb, key: key, version: version, size: size, temp: temp}, nil
+}
+
+// NewFileWriter returns an io.Writer for the file, whose cached copy is
+// removed
+func (cb *cacheBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if cb == nil {
+		return nil, fmt.Errorf("Invalid cacheBackend")
+	}
+	cb.drop(filePath)
+
+	return cb.Backend.NewFileWriter(filePath)
+}
+
+// RemoveFile removes the file and its cached copy
+func (cb *cacheBackend) RemoveFile(filePath string) error {
+	if cb == nil {
+		return fmt.Errorf("Invalid cacheBackend")
+	}
+	cb.drop(filePath)
+
+	return cb.Backend.RemoveFile(filePath)
+}
+
+// Delete removes the file and its cached copy, and succeeds when the file
+// doesn't exist
+func (cb *cacheBackend) Delete(filePath string) error {
+	if cb == nil {
+		return fmt.Errorf("Invalid cacheBackend")
+	}
+	cb.drop(filePath)
+
+	return cb.Backend.Delete(filePath)
+}
+
+// cacheFiller copies what is read from a file to a temporary file, which
+// is added to the cache when all of the file has been read
+type cacheFiller struct {
+	io.ReadCloser
+	cache   *cacheBackend
+	key     string
+	version string
+	size    int64
+	temp    *os.File
+	written int64
+}
+
+func (r *cacheFiller) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if r.temp == nil {
+		return n, err
+	}
+
+	if n > 0 {
+		if _, werr := r.temp.Write(b[:n]); werr != nil {
+			log.Errorf("failed to cache %s: %v", r.key, werr)
+			r.discard()
+
+			return n, err
+		}
+		r.written += int64(n)
+	}
+
+	if err == io.EOF {
+		r.finish()
+	} else if err != nil {
+		r.discard()
+	}
+
+	return n, err
+}
+
+// finish adds the temporary file to the cache if it holds all of the file
+func (r *cacheFiller) finish() {
+	temp := r.temp
+	r.temp = nil
+
+	if err := temp.Close(); err != nil || r.written != r.size {
+		_ = os.Remove(temp.Name())
+
+		return
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(r.cache.dir, cacheFileName(r.key, r.version))); err != nil {
+		log.Error(err)
+		_ = os.Remove(temp.Name())
+
+		return
+	}
+	r.cache.add(r.key, r.version, r.size)
+}
+
+// discard removes the temporary file
+func (r *cacheFiller) discard() {
+	if r.temp == nil {
+		return
+	}
+	_ = r.temp.Close()
+	_ = os.Remove(r.temp.Name())
+	r.temp = nil
+}
+
+// Close closes the file, leaving it out of the cache unless it was read to
+// the end
+func (r *cacheFiller) Close() error {
+	r.discard()
+
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingBackend counts the files read from the backend it wraps
+type countingBackend struct {
+	Backend
+	reads int
+}
+
+func (cb *countingBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	cb.reads++
+
+	return cb.Backend.NewFileReaderContext(ctx, filePath)
+}
+
+func readAll(t *testing.T, backend Backend, filePath string) []byte {
+	reader, err := backend.NewFileReader(filePath)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+
+	return content
+}
+
+// cached tells whether a copy of filePath is in the cache directory
+func cached(t *testing.T, dir, filePath string) bool {
+	matches, err := filepath.Glob(filepath.Join(dir, cacheKey(filePath)+"*"))
+	assert.NoError(t, err)
+
+	return len(matches) != 0
+}
+
+func TestCacheBackend(t *testing.T) {
+	location := t.TempDir()
+	posix, err := newPosixBackend(posixConf{Location: location})
+	assert.NoError(t, err)
+	backend := &countingBackend{Backend: posix}
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(location, name), writeData, 0600))
+	}
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache, err := newCacheBackend(backend, CacheConf{Dir: dir, MaxSize: 2 * int64(len(writeData))})
+	assert.NoError(t, err)
+
+	assert.Equal(t, writeData, readAll(t, cache, "a"))
+	assert.Equal(t, writeData, readAll(t, cache, "a"))
+	assert.Equal(t, 1, backend.reads, "a should be read from the cache")
+
+	// files not read to the end are not cached
+	reader, err := cache.NewFileReader("b")
+	assert.NoError(t, err)
+	_, err = reader.Read(make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, writeData, readAll(t, cache, "b"))
+	assert.Equal(t, writeData, readAll(t, cache, "b"))
+	assert.Equal(t, 3, backend.reads)
+
+	// b and c fill the cache, a was least recently used
+	assert.Equal(t, writeData, readAll(t, cache, "c"))
+	assert.Equal(t, writeData, readAll(t, cache, "a"))
+	assert.Equal(t, 5, backend.reads, "a should have been removed from the cache")
+	assert.False(t, cached(t, dir, "b"))
+
+	// files changed in the backend are read again
+	assert.NoError(t, os.WriteFile(filepath.Join(location, "c"), writeData[:4], 0600))
+	assert.Equal(t, writeData[:4], readAll(t, cache, "c"))
+	assert.Equal(t, 6, backend.reads)
+
+	// also when the size is the same
+	same := append([]byte{}, writeData[:4]...)
+	same[0]++
+	assert.NoError(t, os.WriteFile(filepath.Join(location, "c"), same, 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(filepath.Join(location, "c"), later, later))
+	assert.Equal(t, same, readAll(t, cache, "c"))
+	assert.Equal(t, same, readAll(t, cache, "c"))
+	assert.Equal(t, 7, backend.reads)
+
+	// files written through the cache are read again
+	writer, err := cache.NewFileWriter("a")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData[4:])
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, writeData[4:], readAll(t, cache, "a"))
+	assert.Equal(t, 8, backend.reads)
+
+	assert.NoError(t, cache.Delete("a"))
+	assert.False(t, cached(t, dir, "a"))
+	_, err = cache.NewFileReader("a")
+	assert.Error(t, err)
+
+	// the cache is kept for the next run
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "partial"+cacheTempSuffix), writeData, 0600))
+	cache, err = newCacheBackend(backend, CacheConf{Dir: dir, MaxSize: 2 * int64(len(writeData))})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "partial"+cacheTempSuffix))
+	assert.Equal(t, same, readAll(t, cache, "c"))
+	assert.Equal(t, 8, backend.reads)
+
+	// files larger than the cache are only passed on
+	cache, err = newCacheBackend(backend, CacheConf{Dir: t.TempDir(), MaxSize: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, writeData, readAll(t, cache, "b"))
+	assert.Equal(t, writeData, readAll(t, cache, "b"))
+	assert.Equal(t, 10, backend.reads)
+
+	_, err = newCacheBackend(backend, CacheConf{Dir: dir, MaxSize: -1})
+	assert.Error(t, err)
+}
+
+func TestNewBackendCache(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: t.TempDir()}, Cache: CacheConf{Dir: dir}})
+	assert.NoError(t, err)
+	cache, ok := backend.(*cacheBackend)
+	assert.True(t, ok, "the backend should be cached")
+	assert.Equal(t, int64(cacheMaxSize), cache.maxSize)
+
+	backend, err = NewBackend(Conf{Type: posixType, Posix: posixConf{Location: t.TempDir()}})
+	assert.NoError(t, err)
+	_, ok = backend.(*cacheBackend)
+	assert.False(t, ok)
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"crypto/md5" // #nosec md5 checksums are part of the messages
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checksumHashes are the hash functions of NewChecksumWriter, by the
+// checksum types of the messages
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// NewChecksumWriter returns a writer that writes to w while computing the
+// checksums of the given types, md5 or sha256, and a function returning
+// the hex encoded checksums of what has been written, by type. Unknown
+// types are logged and left out.
+func NewChecksumWriter(w io.Writer, algos ...string) (io.Writer, func() map[string]string) {
+	hashes := make(map[string]hash.Hash, len(algos))
+	writers := []io.Writer{w}
+	for _, algo := range algos {
+		newHash, ok := checksumHashes[algo]
+		if !ok {
+			log.Errorf("unsupported checksum type %q", algo)
+
+			continue
+		}
+		if _, ok := hashes[algo]; ok {
+			continue
+		}
+		hashes[algo] = newHash()
+		writers = append(writers, hashes[algo])
+	}
+
+	return io.MultiWriter(writers...), func() map[string]string {
+		sums := make(map[string]string, len(hashes))
+		for algo, h := range hashes {
+			sums[algo] = hex.EncodeToString(h.Sum(nil))
+		}
+
+		return sums
+	}
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestChecksumWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer, checksums := NewChecksumWriter(&buf, "sha256", "md5", "crc32", "md5")
+
+	_, err := writer.Write(writeData[:4])
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData[4:])
+	assert.NoError(t, err)
+
+	assert.Equal(t, writeData, buf.Bytes())
+	assert.Equal(t, map[string]string{
+		"sha256": "2e99758548972a8e8822ad47fa1017ff72f06f3ff6a016851f45c398732bc50c",
+		"md5":    "54b0c58c7ce9f2a8b551351102ee0938",
+	}, checksums())
+
+	// only what was written to w is hashed
+	writer, checksums = NewChecksumWriter(failingWriter{}, "sha256")
+	_, err = writer.Write(writeData)
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", checksums()["sha256"])
+
+	_, checksums = NewChecksumWriter(&buf)
+	assert.Empty(t, checksums())
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// s3MaxCopySize is the largest object S3 copies in one request
+const s3MaxCopySize = 5 * 1024 * 1024 * 1024
+
+// CopyFile copies srcPath in src to dstPath in dst and returns the number
+// of bytes copied. The file is streamed from src to dst, except between S3
+// buckets of the same service and credentials, where objects of up to 5
+// GiB are copied by S3 without passing through.
+func CopyFile(src Backend, srcPath string, dst Backend, dstPath string) (int64, error) {
+	if s3src, ok := unwrapBackend(src).(*s3Backend); ok {
+		if s3dst, ok := unwrapBackend(dst).(*s3Backend); ok && s3dst.canCopyFrom(s3src) {
+			size, err := src.GetFileSize(srcPath)
+			if err != nil {
+				return 0, err
+			}
+			if size <= s3MaxCopySize {
+				// the copy doesn't pass through the caches of dst
+				forgetFile(dst, dstPath)
+
+				return size, s3dst.copyObject(s3src, srcPath, dstPath)
+			}
+		}
+	}
+
+	reader, err := src.NewFileReader(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	writer, err := dst.NewFileWriter(dstPath)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err := io.Copy(writer, reader)
+	if err != nil {
+		log.Errorf("Failed to copy %s to %s: %v", srcPath, dstPath, err)
+
+		// the writers that upload can drop what was written
+		if w, ok := writer.(interface{ CloseWithError(error) error }); ok {
+			_ = w.CloseWithError(err)
+		}
+		_ = writer.Close()
+
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		log.Errorf("Failed to finish %s: %v", dstPath, err)
+
+		return 0, err
+	}
+
+	return copied, nil
+}
+
+// forgetFile drops what the wrappers of backend have cached of filePath,
+// when it is changed behind their backs
+func forgetFile(backend Backend, filePath string) {
+	for {
+		switch b := backend.(type) {
+		case *cacheBackend:
+			b.drop(filePath)
+		case *sizeCacheBackend:
+			b.forget(filePath)
+		}
+		wrapper, ok := backend.(interface{ unwrap() Backend })
+		if !ok {
+			return
+		}
+		backend = wrapper.unwrap()
+	}
+}
+
+// canCopyFrom tells whether objects in the bucket of src can be copied by
+// S3 to the bucket of sb, which needs the same service and credentials
+func (sb *s3Backend) canCopyFrom(src *s3Backend) bool {
+	return sb.Conf != nil && src.Conf != nil &&
+		sb.Conf.URL == src.Conf.URL &&
+		sb.Conf.Port == src.Conf.Port &&
+		sb.Conf.Region == src.Conf.Region &&
+		sb.Conf.AccessKey == src.Conf.AccessKey &&
+		sb.Conf.SecretKey == src.Conf.SecretKey &&
+		sb.Conf.AssumeRoleARN == src.Conf.AssumeRoleARN
+}
+
+// copyObject has S3 copy srcPath in the bucket of src to dstPath
+func (sb *s3Backend) copyObject(src *s3Backend, srcPath, dstPath string) error {
+	err := sb.retry(func() error {
+		_, err := sb.Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:                         aws.String(sb.Bucket),
+			Key:                            aws.String(dstPath),
+			CopySource:                     aws.String((&url.URL{Path: src.Bucket + "/" + srcPath}).EscapedPath()),
+			CopySourceSSECustomerAlgorithm: src.sseAlgorithm,
+			CopySourceSSECustomerKey:       src.sseKey,
+			SSECustomerAlgorithm:           sb.sseAlgorithm,
+			SSECustomerKey:                 sb.sseKey})
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyFile(t *testing.T) {
+	posix, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: t.TempDir()}})
+	assert.NoError(t, err)
+	archive, err := NewBackend(Conf{Type: s3Type, S3: testConf.S3})
+	assert.NoError(t, err)
+	otherConf := testConf.S3
+	otherConf.Bucket = "copy"
+	other, err := NewBackend(Conf{Type: s3Type, S3: otherConf})
+	assert.NoError(t, err)
+
+	writer, err := posix.NewFileWriter("file")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	// posix to s3, s3 to s3 by S3 and back to posix
+	for _, step := range []struct {
+		src     Backend
+		srcPath string
+		dst     Backend
+		dstPath string
+	}{
+		{posix, "file", archive, "copied"},
+		{archive, "copied", other, "dir/copied again"},
+		{other, "dir/copied again", posix, "back"},
+	} {
+		copied, err := CopyFile(step.src, step.srcPath, step.dst, step.dstPath)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(writeData)), copied)
+
+		reader, err := step.dst.NewFileReader(step.dstPath)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.NoError(t, reader.Close())
+		assert.Equal(t, writeData, content, "wrong content in %s", step.dstPath)
+	}
+	assert.NoError(t, archive.Delete("copied"))
+	assert.NoError(t, other.Delete("dir/copied again"))
+
+	_, err = CopyFile(posix, "missing", archive, "copied")
+	assert.Error(t, err)
+	_, err = CopyFile(archive, "missing", other, "copied")
+	assert.Error(t, err)
+	_, err = CopyFile(posix, "file", posix, "no/such/dir")
+	assert.Error(t, err)
+}
+
+func TestS3CanCopyFrom(t *testing.T) {
+	archive := &s3Backend{Conf: &S3Conf{URL: "https://s3", Port: 443, AccessKey: "access", SecretKey: "secret", Bucket: "archive"}}
+	backup := &s3Backend{Conf: &S3Conf{URL: "https://s3", Port: 443, AccessKey: "access", SecretKey: "secret", Bucket: "backup"}}
+	assert.True(t, backup.canCopyFrom(archive))
+
+	backup.Conf.AccessKey = "other"
+	assert.False(t, backup.canCopyFrom(archive), "other credentials may not reach the bucket")
+	backup.Conf.AccessKey = "access"
+	backup.Conf.AssumeRoleARN = "arn:aws:iam::123456789012:role/backup"
+	assert.False(t, backup.canCopyFrom(archive), "another role may not reach the bucket")
+	backup.Conf.AssumeRoleARN = ""
+	backup.Conf.URL = "https://other"
+	assert.False(t, backup.canCopyFrom(archive), "another service can't copy the object")
+}
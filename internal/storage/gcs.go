@@ -0,0 +1,743 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gcsChunkSize is the size of the chunks uploaded when no chunk size is
+// configured, chunks must be a multiple of 256 KiB
+const gcsChunkSize = 8 * 1024 * 1024
+
+// gcsScope is the OAuth scope requested for the tokens
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsMetadataEndpoint is where tokens for the service account of the host
+// are requested on GCE and GKE, an internal variable to ease testing
+var gcsMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcsBackend stores files as objects in a Google Cloud Storage bucket
+type gcsBackend struct {
+	Client   *http.Client
+	Endpoint string
+	Bucket   string
+	Conf     *GCSConf
+	auth     *gcsCredentials
+}
+
+// GCSConf stores information about the Google Cloud Storage backend. The
+// backend authenticates with the service account key in CredentialsFile,
+// or else with the application default credentials. With the
+// STORAGE_EMULATOR_HOST environment variable set, the emulator there is
+// used without credentials.
+type GCSConf struct {
+	Bucket          string
+	Prefix          string
+	CredentialsFile string
+	URL             string
+	Chunksize       int
+	Cacert          string
+}
+
+func init() {
+	RegisterBackend("gcs", func(config Conf) (Backend, error) {
+		return newGCSBackend(config.GCS)
+	})
+}
+
+func newGCSBackend(config GCSConf) (*gcsBackend, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no bucket given for the gcs backend")
+	}
+	if config.Chunksize%(256*1024) != 0 {
+		return nil, fmt.Errorf("the gcs chunk size must be a multiple of 256 KiB")
+	}
+
+	gb := &gcsBackend{
+		Client:   &http.Client{Transport: transportConfig(config.Cacert)},
+		Endpoint: strings.TrimSuffix(config.URL, "/"),
+		Bucket:   config.Bucket,
+		Conf:     &config,
+	}
+
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	switch {
+	case emulator != "" && config.URL == "":
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		gb.Endpoint = strings.TrimSuffix(emulator, "/")
+	default:
+		auth, err := newGCSCredentials(config.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		gb.auth = auth
+	}
+	if gb.Endpoint == "" {
+		gb.Endpoint = "https://storage.googleapis.com"
+	}
+
+	// Listing the objects is what the backend can be expected to be
+	// allowed, unlike reading the bucket metadata
+	query := url.Values{"maxResults": {"1"}, "prefix": {config.Prefix}}
+	resp, err := gb.do(http.MethodGet, gb.objectsURL(query), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket %s: %v", config.Bucket, err)
+	}
+	resp.Body.Close()
+
+	return gb, nil
+}
+
+// objectsURL returns the JSON API URL of the objects in the bucket, with
+// the query
+func (gb *gcsBackend) objectsURL(query url.Values) string {
+	return gb.Endpoint + "/storage/v1/b/" + url.PathEscape(gb.Bucket) + "/o?" + query.Encode()
+}
+
+// objectURL returns the JSON API URL of the object for filePath, below the
+// configured prefix, with the query
+func (gb *gcsBackend) objectURL(filePath string, query url.Values) string {
+	name := strings.TrimPrefix(path.Join(gb.Conf.Prefix, filePath), "/")
+	target := gb.Endpoint + "/storage/v1/b/" + url.PathEscape(gb.Bucket) + "/o/" + url.PathEscape(name)
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+
+	return target
+}
+
+// do sends an authorized request to the JSON API
+func (gb *gcsBackend) do(method, target string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	return gb.doContext(context.Background(), method, target, body, length, header)
+}
+
+// doContext sends an authorized request to the JSON API, aborted when ctx
+// is done
+func (gb *gcsBackend) doContext(ctx context.Context, method, target string, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+
+	if gb.auth != nil {
+		token, err := gb.auth.getToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return gb.Client.Do(req)
+}
+
+// checkGCSStatus returns an error, with the message given by the JSON API,
+// unless the response has the expected status. The body is closed when
+// there is an error.
+func checkGCSStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error.Message != "" {
+		err = fmt.Errorf("%v (%s)", err, body.Error.Message)
+	}
+
+	return err
+}
+
+// NewFileReader returns an io.Reader instance
+func (gb *gcsBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return gb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the object that stops
+// reading when ctx is done
+func (gb *gcsBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if gb == nil {
+		return nil, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	resp, err := gb.doContext(ctx, http.MethodGet, gb.objectURL(filePath, url.Values{"alt": {"media"}}), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the object from
+// offset
+func (gb *gcsBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if gb == nil {
+		return nil, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	size, err := gb.GetFileSize(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, size, offset, length); err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{"Range": {httpRange(offset, length)}}
+	resp, err := gb.do(http.MethodGet, gb.objectURL(filePath, url.Values{"alt": {"media"}}), nil, 0, header)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusPartialContent)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// NewFileWriter uploads the contents written to it as an object, the
+// upload is done when Close returns
+func (gb *gcsBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if gb == nil {
+		return nil, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	reader, writer := io.Pipe()
+	w := &uploadWriter{PipeWriter: writer, done: make(chan error, 1)}
+	go func() {
+		err := gb.upload(filePath, reader)
+		if err != nil {
+			_ = reader.CloseWithError(err)
+		}
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// upload sends what is read from reader as a resumable upload, in chunks
+// of the configured size, to the object for filePath
+func (gb *gcsBackend) upload(filePath string, reader io.Reader) error {
+	name := strings.TrimPrefix(path.Join(gb.Conf.Prefix, filePath), "/")
+	query := url.Values{"uploadType": {"resumable"}, "name": {name}}
+	resp, err := gb.do(http.MethodPost,
+		gb.Endpoint+"/upload/storage/v1/b/"+url.PathEscape(gb.Bucket)+"/o?"+query.Encode(),
+		nil, 0, http.Header{"X-Upload-Content-Type": {"application/octet-stream"}})
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start the upload of %s: %v", filePath, err)
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+
+	chunkSize := gb.Conf.Chunksize
+	if chunkSize <= 0 {
+		chunkSize = gcsChunkSize
+	}
+
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(reader, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		// the total is only known with the last chunk, which may be empty
+		contentRange := fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(n)-1)
+		switch {
+		case last && n == 0:
+			contentRange = fmt.Sprintf("bytes */%d", offset)
+		case last:
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, offset+int64(n))
+		}
+
+		expected := http.StatusPermanentRedirect
+		if last {
+			expected = http.StatusOK
+		}
+		resp, err := gb.do(http.MethodPut, session, bytes.NewReader(buf[:n]), int64(n),
+			http.Header{"Content-Range": {contentRange}})
+		if err == nil {
+			err = checkGCSStatus(resp, expected)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upload %s at offset %d: %v", filePath, offset, err)
+		}
+		resp.Body.Close()
+
+		if last {
+			return nil
+		}
+		offset += int64(n)
+	}
+}
+
+// GetFileSize returns the size of a specific object
+func (gb *gcsBackend) GetFileSize(filePath string) (int64, error) {
+	if gb == nil {
+		return 0, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	resp, err := gb.do(http.MethodGet, gb.objectURL(filePath, url.Values{"fields": {"size"}}), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Errorln(err)
+
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// the size is a string in the object metadata
+	var object struct {
+		Size string `json:"size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return 0, fmt.Errorf("bad metadata for %s: %v", filePath, err)
+	}
+
+	return strconv.ParseInt(object.Size, 10, 64)
+}
+
+// GetObjectMetadata returns the metadata of the object, its user defined
+// metadata included
+func (gb *gcsBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if gb == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	fields := url.Values{"fields": {"size,etag,contentType,updated,metadata"}}
+	resp, err := gb.do(http.MethodGet, gb.objectURL(filePath, fields), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return ObjectMetadata{}, err
+	}
+	defer resp.Body.Close()
+
+	var object struct {
+		Size        string            `json:"size"`
+		ETag        string            `json:"etag"`
+		ContentType string            `json:"contentType"`
+		Updated     time.Time         `json:"updated"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return ObjectMetadata{}, fmt.Errorf("bad metadata for %s: %v", filePath, err)
+	}
+	size, err := strconv.ParseInt(object.Size, 10, 64)
+	if err != nil {
+		return ObjectMetadata{}, fmt.Errorf("bad size for %s: %v", filePath, err)
+	}
+
+	return ObjectMetadata{
+		Size:         size,
+		ETag:         object.ETag,
+		ContentType:  object.ContentType,
+		LastModified: object.Updated,
+		Metadata:     object.Metadata}, nil
+}
+
+// Exists tells whether the object exists, an error is only returned when
+// that can't be told
+func (gb *gcsBackend) Exists(filePath string) (bool, error) {
+	if gb == nil {
+		return false, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	resp, err := gb.do(http.MethodGet, gb.objectURL(filePath, url.Values{"fields": {"name"}}), nil, 0, nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+
+		return false, nil
+	}
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// RemoveFile removes an object from the bucket
+func (gb *gcsBackend) RemoveFile(filePath string) error {
+	if gb == nil {
+		return fmt.Errorf("Invalid gcsBackend")
+	}
+
+	resp, err := gb.do(http.MethodDelete, gb.objectURL(filePath, nil), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusNoContent)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Delete removes an object from the bucket, an object that is already gone
+// is not an error
+func (gb *gcsBackend) Delete(filePath string) error {
+	if gb == nil {
+		return fmt.Errorf("Invalid gcsBackend")
+	}
+
+	resp, err := gb.do(http.MethodDelete, gb.objectURL(filePath, nil), nil, 0, nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+
+		return nil
+	}
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusNoContent)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// HealthCheck returns an error unless the objects in the bucket can be
+// listed
+func (gb *gcsBackend) HealthCheck(ctx context.Context) error {
+	if gb == nil {
+		return fmt.Errorf("Invalid gcsBackend")
+	}
+
+	query := url.Values{"maxResults": {"1"}, "prefix": {gb.Conf.Prefix}, "fields": {"nextPageToken"}}
+	resp, err := gb.doContext(ctx, http.MethodGet, gb.objectsURL(query), nil, 0, nil)
+	if err == nil {
+		err = checkGCSStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// PresignGet returns ErrUnsupported, presigned URLs are only made for S3
+func (gb *gcsBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+// List returns the objects below the configured prefix whose names,
+// without it, start with prefix
+func (gb *gcsBackend) List(prefix string) ([]ObjectInfo, error) {
+	if gb == nil {
+		return nil, fmt.Errorf("Invalid gcsBackend")
+	}
+
+	base := strings.TrimPrefix(path.Join("/", gb.Conf.Prefix), "/")
+	if base != "" {
+		base += "/"
+	}
+	query := url.Values{
+		"prefix": {base + strings.TrimPrefix(prefix, "/")},
+		"fields": {"items(name,size,updated),nextPageToken"},
+	}
+
+	objects := []ObjectInfo{}
+	for {
+		resp, err := gb.do(http.MethodGet, gb.objectsURL(query), nil, 0, nil)
+		if err == nil {
+			err = checkGCSStatus(resp, http.StatusOK)
+		}
+		if err != nil {
+			log.Error(err)
+
+			return nil, err
+		}
+
+		// the sizes are strings in the object metadata
+		var list struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    string    `json:"size"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad object list for %s: %v", gb.Bucket, err)
+		}
+
+		for _, item := range list.Items {
+			size, err := strconv.ParseInt(item.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad size for %s: %v", item.Name, err)
+			}
+			objects = append(objects, ObjectInfo{
+				Path:         strings.TrimPrefix(item.Name, base),
+				Size:         size,
+				LastModified: item.Updated})
+		}
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+}
+
+// gcsCredentials hands out OAuth tokens, fetching a new one when the
+// current is about to expire
+type gcsCredentials struct {
+	client *http.Client
+	fetch  func(client *http.Client) (token string, expiresIn int64, err error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcsCredentialsFile is the part of a service account key, or of the
+// application default credentials of a user, used to get tokens
+type gcsCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newGCSCredentials returns the credentials of the service account key in
+// credentialsFile, or the application default credentials: the file named
+// by GOOGLE_APPLICATION_CREDENTIALS, the file written by
+// `gcloud auth application-default login` or the service account of the
+// host, in that order
+func newGCSCredentials(credentialsFile string) (*gcsCredentials, error) {
+	c := &gcsCredentials{client: &http.Client{Timeout: 30 * time.Second}}
+
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			wellKnown := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(wellKnown); err == nil {
+				credentialsFile = wellKnown
+			}
+		}
+	}
+	if credentialsFile == "" {
+		c.fetch = gcsMetadataToken
+
+		return c, nil
+	}
+
+	content, err := os.ReadFile(credentialsFile) // #nosec this file comes from our config
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gcs credentials: %v", err)
+	}
+	var file gcsCredentialsFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("bad gcs credentials in %s: %v", credentialsFile, err)
+	}
+	if file.TokenURI == "" {
+		file.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	switch file.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(file.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("no private key in %s", credentialsFile)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("bad private key in %s: %v", credentialsFile, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("the private key in %s is not an RSA key", credentialsFile)
+		}
+		c.fetch = func(client *http.Client) (string, int64, error) {
+			assertion, err := gcsAssertion(file, rsaKey)
+			if err != nil {
+				return "", 0, err
+			}
+
+			return gcsTokenRequest(client, file.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		c.fetch = func(client *http.Client) (string, int64, error) {
+			return gcsTokenRequest(client, file.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {file.ClientID},
+				"client_secret": {file.ClientSecret},
+				"refresh_token": {file.RefreshToken},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported gcs credentials type %q in %s", file.Type, credentialsFile)
+	}
+
+	return c, nil
+}
+
+// getToken returns the current token, fetching a new one when it is about
+// to expire
+func (c *gcsCredentials) getToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Until(c.expires) > 5*time.Minute {
+		return c.token, nil
+	}
+
+	token, expiresIn, err := c.fetch(c.client)
+	if err != nil {
+		return "", fmt.Errorf("failed to get a gcs token: %v", err)
+	}
+	c.token, c.expires = token, time.Now().Add(time.Duration(expiresIn)*time.Second)
+
+	return c.token, nil
+}
+
+// gcsAssertion returns the signed JWT that is exchanged for a token for the
+// service account
+func gcsAssertion(file gcsCredentialsFile, key *rsa.PrivateKey) (string, error) {
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   file.ClientEmail,
+		"scope": gcsScope,
+		"aud":   file.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// gcsTokenRequest exchanges the form for a token at tokenURI
+func gcsTokenRequest(client *http.Client, tokenURI string, form url.Values) (string, int64, error) {
+	resp, err := client.PostForm(tokenURI, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	return gcsTokenResponse(resp)
+}
+
+// gcsMetadataToken gets a token for the service account of the host from
+// the metadata server
+func gcsMetadataToken(client *http.Client) (string, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, gcsMetadataEndpoint, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	return gcsTokenResponse(resp)
+}
+
+// gcsTokenResponse reads the token and its lifetime in seconds from resp
+func gcsTokenResponse(resp *http.Response) (string, int64, error) {
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("%s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, fmt.Errorf("bad token response: %v", err)
+	}
+
+	return token.AccessToken, token.ExpiresIn, nil
+}
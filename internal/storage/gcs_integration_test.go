@@ -0,0 +1,59 @@
+//go:build integration
+// +build integration
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGCSEmulator runs the backend against the GCS emulator at
+// STORAGE_EMULATOR_HOST, e.g. fake-gcs-server started with -scheme http
+func TestGCSEmulator(t *testing.T) {
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulator == "" {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+	if !strings.Contains(emulator, "://") {
+		emulator = "http://" + emulator
+	}
+
+	resp, err := http.Post(emulator+"/storage/v1/b?project=sda", "application/json",
+		strings.NewReader(`{"name": "integration"}`))
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	backend, err := NewBackend(Conf{Type: "gcs", GCS: GCSConf{Bucket: "integration", Prefix: "sda", Chunksize: 256 * 1024}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	data := bytes.Repeat(writeData, 50000)
+	writer, err := backend.NewFileWriter("dir/file")
+	assert.NoError(t, err)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	size, err := backend.GetFileSize("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	reader, err := backend.NewFileReader("dir/file")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, data, content)
+
+	assert.NoError(t, backend.RemoveFile("dir/file"))
+	_, err = backend.GetFileSize("dir/file")
+	assert.Error(t, err)
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGCS is a JSON API with just enough of it for the backend
+type fakeGCS struct {
+	sync.Mutex
+	token   string
+	buckets map[string]bool
+	objects map[string][]byte
+	uploads map[string][]byte
+	chunks  int
+	server  *httptest.Server
+}
+
+func newFakeGCS(buckets ...string) *fakeGCS {
+	f := &fakeGCS{buckets: map[string]bool{}, objects: map[string][]byte{}, uploads: map[string][]byte{}}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = true
+	}
+	f.server = httptest.NewServer(f)
+
+	return f
+}
+
+func (f *fakeGCS) fail(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, message)
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		f.fail(w, http.StatusUnauthorized, "Invalid Credentials")
+
+		return
+	}
+
+	query := r.URL.Query()
+
+	// resumable uploads, started at /upload/storage/v1/b/<bucket>/o
+	if strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/") {
+		bucket := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/"), "/o")
+		session := fmt.Sprintf("%s/session/%s/%s", f.server.URL, bucket, url.PathEscape(query.Get("name")))
+		f.uploads[session] = []byte{}
+		w.Header().Set("Location", session)
+
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/session/") {
+		session := f.server.URL + r.URL.EscapedPath()
+		body, _ := io.ReadAll(r.Body)
+		f.uploads[session] = append(f.uploads[session], body...)
+		f.chunks++
+		if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+			w.WriteHeader(http.StatusPermanentRedirect)
+
+			return
+		}
+		// the total must match what was uploaded
+		total := r.Header.Get("Content-Range")[strings.LastIndex(r.Header.Get("Content-Range"), "/")+1:]
+		if total != strconv.Itoa(len(f.uploads[session])) {
+			f.fail(w, http.StatusBadRequest, "bad total "+total)
+
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/session/"), "/", 2)
+		f.objects[parts[0]+"/"+parts[1]] = f.uploads[session]
+		fmt.Fprint(w, `{}`)
+
+		return
+	}
+
+	// /storage/v1/b/<bucket>/o[/<object>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1/b/"), "/", 3)
+	if len(parts) < 2 || !f.buckets[parts[0]] {
+		f.fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+
+		return
+	}
+	if len(parts) == 2 {
+		f.list(w, parts[0], query)
+
+		return
+	}
+
+	name, _ := url.PathUnescape(parts[2])
+	object, ok := f.objects[parts[0]+"/"+name]
+	switch {
+	case !ok:
+		f.fail(w, http.StatusNotFound, "No such object: "+parts[0]+"/"+name)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, parts[0]+"/"+name)
+		w.WriteHeader(http.StatusNoContent)
+	case query.Get("alt") == "media":
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(object))
+	default:
+		fmt.Fprintf(w, `{"size": "%d", "etag": "CKih16GjycICEAE=", "contentType": "application/octet-stream", `+
+			`"updated": "2006-01-02T15:04:05.000Z", "metadata": {"checksum": "abc"}}`, len(object))
+	}
+}
+
+// list lists the objects of the bucket, two at a time
+func (f *fakeGCS) list(w http.ResponseWriter, bucket string, query url.Values) {
+	names := []string{}
+	for object := range f.objects {
+		name := strings.TrimPrefix(object, bucket+"/")
+		if name != object && strings.HasPrefix(name, query.Get("prefix")) && name >= query.Get("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > 2 {
+		next, names = names[2], names[:2]
+	}
+	items := []string{}
+	for _, name := range names {
+		items = append(items, fmt.Sprintf(`{"name": %q, "size": "%d", "updated": "2006-01-02T15:04:05.000Z"}`, name, len(f.objects[bucket+"/"+name])))
+	}
+	fmt.Fprintf(w, `{"kind": "storage#objects", "items": [%s], "nextPageToken": %q}`, strings.Join(items, ","), next)
+}
+
+func TestGCSBackend(t *testing.T) {
+	fake := newFakeGCS("archive")
+	defer fake.server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(fake.server.URL, "http://"))
+
+	backend, err := NewBackend(Conf{Type: "gcs", GCS: GCSConf{Bucket: "archive", Prefix: "sda", Chunksize: 256 * 1024}})
+	assert.NoError(t, err)
+	assert.IsType(t, &gcsBackend{}, unwrapBackend(backend))
+	assert.NoError(t, backend.HealthCheck(context.Background()))
+
+	// two full chunks and an empty last one
+	data := make([]byte, 512*1024)
+	_, _ = rand.Read(data)
+	writer, err := backend.NewFileWriter("dir/file")
+	assert.NoError(t, err)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, data, fake.objects["archive/sda/dir/file"])
+	assert.Equal(t, 3, fake.chunks)
+
+	size, err := backend.GetFileSize("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	exists, err := backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	metadata, err := backend.GetObjectMetadata("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectMetadata{
+		Size:         size,
+		ETag:         "CKih16GjycICEAE=",
+		ContentType:  "application/octet-stream",
+		LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		Metadata:     map[string]string{"checksum": "abc"}}, metadata)
+
+	reader, err := backend.NewFileReader("dir/file")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, data, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backend.NewFileReaderContext(ctx, "dir/file")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	reader, err = backend.NewFileReaderAt("dir/file", 300000, 1000)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, data[300000:301000], content)
+
+	// a short file in a single chunk
+	writer, err = backend.NewFileWriter("short")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, writeData, fake.objects["archive/sda/short"])
+
+	assert.NoError(t, backend.RemoveFile("dir/file"))
+
+	_, err = backend.GetFileSize("dir/file")
+	assert.EqualError(t, err, "GET /storage/v1/b/archive/o/sda/dir/file: 404 Not Found (No such object: archive/sda/dir/file)")
+	exists, err = backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	_, err = backend.NewFileReader("dir/file")
+	assert.Error(t, err)
+	assert.Error(t, backend.RemoveFile("dir/file"))
+	assert.NoError(t, backend.Delete("dir/file"), "an object that is already gone is deleted")
+	fake.objects["archive/sda/deleted"] = writeData
+	assert.NoError(t, backend.Delete("deleted"))
+	assert.NotContains(t, fake.objects, "archive/sda/deleted")
+
+	_, err = newGCSBackend(GCSConf{Bucket: "missing"})
+	assert.EqualError(t, err, "failed to access bucket missing: "+
+		"GET /storage/v1/b/missing/o: 404 Not Found (The specified bucket does not exist.)")
+}
+
+func TestGCSList(t *testing.T) {
+	fake := newFakeGCS("archive")
+	defer fake.server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", fake.server.URL)
+
+	backend, err := NewBackend(Conf{Type: "gcs", GCS: GCSConf{Bucket: "archive", Prefix: "sda"}})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"sda/a", "sda/dir/b", "sda/dir/c", "sda/dir/sub/d", "other/e"} {
+		fake.objects["archive/"+name] = []byte(name)
+	}
+
+	// over several pages
+	objects, err := backend.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectInfo{
+		{Path: "a", Size: 5, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/b", Size: 9, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/c", Size: 9, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{Path: "dir/sub/d", Size: 13, LastModified: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)},
+	}, objects)
+
+	objects, err = backend.List("/dir/s")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "dir/sub/d", objects[0].Path)
+
+	objects, err = backend.List("none")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestGCSServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	tokens := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+
+		// the assertion is signed with the key of the service account
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		assert.Len(t, parts, 3)
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c map[string]interface{}
+		assert.NoError(t, json.Unmarshal(claims, &c))
+		assert.Equal(t, "sda@project.iam.gserviceaccount.com", c["iss"])
+		assert.Equal(t, gcsScope, c["scope"])
+
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	}))
+	defer tokenServer.Close()
+
+	credentials, _ := json.Marshal(gcsCredentialsFile{
+		Type:        "service_account",
+		ClientEmail: "sda@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    tokenServer.URL,
+	})
+	credentialsFile := filepath.Join(t.TempDir(), "key.json")
+	assert.NoError(t, os.WriteFile(credentialsFile, credentials, 0600))
+
+	fake := newFakeGCS("archive")
+	defer fake.server.Close()
+	fake.token = "token"
+
+	backend, err := newGCSBackend(GCSConf{Bucket: "archive", URL: fake.server.URL, CredentialsFile: credentialsFile})
+	assert.NoError(t, err)
+
+	writer, err := backend.NewFileWriter("file")
+	assert.NoError(t, err)
+	_, _ = writer.Write(writeData)
+	assert.NoError(t, writer.Close())
+
+	size, err := backend.GetFileSize("file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+
+	// the token is reused until it is about to expire
+	assert.Equal(t, 1, tokens)
+
+	// a token that is not accepted
+	fake.token = "other"
+	_, err = backend.GetFileSize("file")
+	assert.EqualError(t, err, "GET /storage/v1/b/archive/o/file: 401 Unauthorized (Invalid Credentials)")
+}
+
+func TestGCSApplicationDefaultCredentials(t *testing.T) {
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("HOME", t.TempDir())
+
+	// the service account of the host
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		fmt.Fprint(w, `{"access_token": "metadata", "expires_in": 3600}`)
+	}))
+	defer metadata.Close()
+	gcsMetadataEndpoint = metadata.URL
+
+	fake := newFakeGCS("archive")
+	defer fake.server.Close()
+	fake.token = "metadata"
+
+	_, err := newGCSBackend(GCSConf{Bucket: "archive", URL: fake.server.URL})
+	assert.NoError(t, err)
+
+	// a user logged in with gcloud
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "refresh", r.PostForm.Get("refresh_token"))
+		fmt.Fprint(w, `{"access_token": "user", "expires_in": 3600}`)
+	}))
+	defer tokenServer.Close()
+
+	credentials, _ := json.Marshal(gcsCredentialsFile{
+		Type:         "authorized_user",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "refresh",
+		TokenURI:     tokenServer.URL,
+	})
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	assert.NoError(t, os.WriteFile(credentialsFile, credentials, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentialsFile)
+	fake.token = "user"
+
+	_, err = newGCSBackend(GCSConf{Bucket: "archive", URL: fake.server.URL})
+	assert.NoError(t, err)
+}
+
+func TestGCSBackendFail(t *testing.T) {
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+
+	_, err := newGCSBackend(GCSConf{})
+	assert.EqualError(t, err, "no bucket given for the gcs backend")
+
+	_, err = newGCSBackend(GCSConf{Bucket: "archive", Chunksize: 1000})
+	assert.EqualError(t, err, "the gcs chunk size must be a multiple of 256 KiB")
+
+	_, err = newGCSBackend(GCSConf{Bucket: "archive", CredentialsFile: "/this/does/not/exist"})
+	assert.ErrorContains(t, err, "failed to read gcs credentials")
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	assert.NoError(t, os.WriteFile(credentialsFile, []byte(`{"type": "external_account"}`), 0600))
+	_, err = newGCSBackend(GCSConf{Bucket: "archive", CredentialsFile: credentialsFile})
+	assert.EqualError(t, err, `unsupported gcs credentials type "external_account" in `+credentialsFile)
+}
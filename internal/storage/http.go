@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpBackend reads files from a web server, such as public reference data
+// served over https. It is read only.
+type httpBackend struct {
+	Client   *http.Client
+	Endpoint *url.URL
+	Conf     *HTTPConf
+}
+
+// HTTPConf stores information about the HTTP backend. The files are read
+// below URL, sending Token as a bearer token when it is set.
+type HTTPConf struct {
+	URL    string
+	Token  string `redact:"true"`
+	Cacert string
+}
+
+func init() {
+	RegisterBackend("http", func(config Conf) (Backend, error) {
+		return newHTTPBackend(config.HTTP)
+	})
+}
+
+func newHTTPBackend(config HTTPConf) (*httpBackend, error) {
+	endpoint, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("bad url for the http backend: %v", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("no http or https url given for the http backend")
+	}
+	if endpoint.Scheme == "http" && config.Token != "" {
+		log.Warnf("the token for %s is sent over http", endpoint.Host)
+	}
+
+	return &httpBackend{
+		Client:   &http.Client{Transport: transportConfig(config.Cacert)},
+		Endpoint: endpoint,
+		Conf:     &config,
+	}, nil
+}
+
+// fileURL returns the URL of filePath below the configured URL
+func (hb *httpBackend) fileURL(filePath string) string {
+	target := *hb.Endpoint
+	target.Path = path.Join("/", hb.Endpoint.Path, filePath)
+	target.RawPath = ""
+
+	return target.String()
+}
+
+// do sends a request, with the token when there is one, aborted when ctx
+// is done
+func (hb *httpBackend) do(ctx context.Context, method, target string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if hb.Conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+hb.Conf.Token)
+	}
+
+	return hb.Client.Do(req)
+}
+
+// checkHTTPStatus returns an error unless the response has the expected
+// status. The body is closed when there is an error.
+func checkHTTPStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	resp.Body.Close()
+
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// NewFileReader returns an io.Reader instance
+func (hb *httpBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return hb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the file that stops
+// reading when ctx is done
+func (hb *httpBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if hb == nil {
+		return nil, fmt.Errorf("Invalid httpBackend")
+	}
+
+	resp, err := hb.do(ctx, http.MethodGet, hb.fileURL(filePath), nil)
+	if err == nil {
+		err = checkHTTPStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the file from
+// offset, which needs a server that supports ranges
+func (hb *httpBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if hb == nil {
+		return nil, fmt.Errorf("Invalid httpBackend")
+	}
+
+	size, err := hb.GetFileSize(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, size, offset, length); err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{"Range": {httpRange(offset, length)}}
+	resp, err := hb.do(context.Background(), http.MethodGet, hb.fileURL(filePath), header)
+	if err == nil {
+		err = checkHTTPStatus(resp, http.StatusPartialContent)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// GetFileSize returns the size of the file, as given by the Content-Length
+// of a HEAD request
+func (hb *httpBackend) GetFileSize(filePath string) (int64, error) {
+	if hb == nil {
+		return 0, fmt.Errorf("Invalid httpBackend")
+	}
+
+	resp, err := hb.do(context.Background(), http.MethodHead, hb.fileURL(filePath), nil)
+	if err == nil {
+		err = checkHTTPStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("no size given for %s", filePath)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// GetObjectMetadata returns what the headers of a HEAD request tell of the
+// file
+func (hb *httpBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if hb == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid httpBackend")
+	}
+
+	resp, err := hb.do(context.Background(), http.MethodHead, hb.fileURL(filePath), nil)
+	if err == nil {
+		err = checkHTTPStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return ObjectMetadata{}, err
+	}
+	resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return ObjectMetadata{}, fmt.Errorf("no size given for %s", filePath)
+	}
+
+	return headerMetadata(resp, ""), nil
+}
+
+// Exists tells whether the server has the file, an error is only returned
+// when that can't be told
+func (hb *httpBackend) Exists(filePath string) (bool, error) {
+	if hb == nil {
+		return false, fmt.Errorf("Invalid httpBackend")
+	}
+
+	resp, err := hb.do(context.Background(), http.MethodHead, hb.fileURL(filePath), nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+
+		return false, nil
+	}
+	if err == nil {
+		err = checkHTTPStatus(resp, http.StatusOK)
+	}
+	if err != nil {
+		log.Error(err)
+
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// HealthCheck returns an error unless the server answers, whatever the
+// status, as the configured URL itself needn't be a file
+func (hb *httpBackend) HealthCheck(ctx context.Context) error {
+	if hb == nil {
+		return fmt.Errorf("Invalid httpBackend")
+	}
+
+	resp, err := hb.do(ctx, http.MethodHead, hb.Endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("HEAD %s: %s", hb.Endpoint.Path, resp.Status)
+	}
+
+	return nil
+}
+
+// NewFileWriter returns ErrUnsupported, the backend is read only
+func (hb *httpBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	return nil, ErrUnsupported
+}
+
+// RemoveFile returns ErrUnsupported, the backend is read only
+func (hb *httpBackend) RemoveFile(filePath string) error {
+	return ErrUnsupported
+}
+
+// Delete returns ErrUnsupported, the backend is read only
+func (hb *httpBackend) Delete(filePath string) error {
+	return ErrUnsupported
+}
+
+// List returns ErrUnsupported, web servers have no common way of listing
+// files
+func (hb *httpBackend) List(prefix string) ([]ObjectInfo, error) {
+	return nil, ErrUnsupported
+}
+
+// PresignGet returns ErrUnsupported, the files are only served with the
+// configured token
+func (hb *httpBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
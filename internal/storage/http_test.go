@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "data", "ref set"), 0750))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "data", "ref set", "file.c4gh"), writeData, 0600))
+
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	backend, err := NewBackend(Conf{Type: "http", HTTP: HTTPConf{URL: server.URL + "/data/", Token: "secret"}})
+	assert.NoError(t, err)
+	assert.IsType(t, &httpBackend{}, unwrapBackend(backend))
+	assert.NoError(t, backend.HealthCheck(context.Background()))
+
+	size, err := backend.GetFileSize("ref set/file.c4gh")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+
+	reader, err := backend.NewFileReader("ref set/file.c4gh")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, writeData, content)
+
+	reader, err = backend.NewFileReaderAt("ref set/file.c4gh", 4, 6)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, writeData[4:10], content)
+	_, err = backend.NewFileReaderAt("ref set/file.c4gh", 4, size)
+	assert.Error(t, err)
+
+	_, err = backend.GetFileSize("missing")
+	assert.Error(t, err)
+	exists, err := backend.Exists("missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = backend.Exists("ref set/file.c4gh")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	metadata, err := backend.GetObjectMetadata("ref set/file.c4gh")
+	assert.NoError(t, err)
+	assert.Equal(t, size, metadata.Size)
+	assert.NotEmpty(t, metadata.ContentType)
+	assert.False(t, metadata.LastModified.IsZero(), "the Last-Modified header should be used")
+	_, err = backend.NewFileReader("missing")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backend.NewFileReaderContext(ctx, "ref set/file.c4gh")
+	assert.True(t, errors.Is(err, context.Canceled), "unexpected error %v", err)
+
+	_, err = backend.NewFileWriter("new")
+	assert.Equal(t, ErrUnsupported, err)
+	assert.Equal(t, ErrUnsupported, backend.RemoveFile("ref set/file.c4gh"))
+	assert.Equal(t, ErrUnsupported, backend.Delete("ref set/file.c4gh"))
+	_, err = backend.List("")
+	assert.Equal(t, ErrUnsupported, err)
+
+	// without the token nothing can be read
+	backend, err = NewBackend(Conf{Type: "http", HTTP: HTTPConf{URL: server.URL + "/data"}})
+	assert.NoError(t, err)
+	_, err = backend.NewFileReader("ref set/file.c4gh")
+	assert.Error(t, err)
+
+	_, err = NewBackend(Conf{Type: "http", HTTP: HTTPConf{URL: "ftp://example.org/data"}})
+	assert.Error(t, err)
+	_, err = NewBackend(Conf{Type: "http", HTTP: HTTPConf{}})
+	assert.Error(t, err)
+}
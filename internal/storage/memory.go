@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryBackend keeps the files in memory, for tests of the services
+// without any storage to set up
+type memoryBackend struct {
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+// memoryFile is the content of a file in a memoryBackend and when it was
+// written
+type memoryFile struct {
+	data     []byte
+	modified time.Time
+}
+
+// NewMemoryBackend returns a backend that keeps the files in memory,
+// starting with files, by path. The contents are copied.
+func NewMemoryBackend(files map[string][]byte) Backend {
+	mb := &memoryBackend{files: make(map[string]memoryFile, len(files))}
+	now := time.Now()
+	for filePath, data := range files {
+		mb.files[filePath] = memoryFile{append([]byte(nil), data...), now}
+	}
+
+	return mb
+}
+
+// notExist returns the error of a file that doesn't exist, as returned by
+// the posix backend
+func (mb *memoryBackend) notExist(op, filePath string) error {
+	return &fs.PathError{Op: op, Path: filePath, Err: fs.ErrNotExist}
+}
+
+// file returns the content of a file
+func (mb *memoryBackend) file(op, filePath string) ([]byte, error) {
+	if mb == nil {
+		return nil, fmt.Errorf("Invalid memoryBackend")
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	file, ok := mb.files[filePath]
+	if !ok {
+		return nil, mb.notExist(op, filePath)
+	}
+
+	return file.data, nil
+}
+
+// NewFileReader returns an io.Reader instance
+func (mb *memoryBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return mb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the file that fails
+// further reads when ctx is done
+func (mb *memoryBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := mb.file("open", filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newContextReader(ctx, io.NopCloser(bytes.NewReader(data))), nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the file from
+// offset
+func (mb *memoryBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	data, err := mb.file("open", filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, int64(len(data)), offset, length); err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+// NewFileWriter returns an io.Writer for the file, which is stored when
+// the writer is closed
+func (mb *memoryBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if mb == nil {
+		return nil, fmt.Errorf("Invalid memoryBackend")
+	}
+
+	return &memoryWriter{backend: mb, filePath: filePath}, nil
+}
+
+// GetFileSize returns the size of the file
+func (mb *memoryBackend) GetFileSize(filePath string) (int64, error) {
+	data, err := mb.file("stat", filePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+// GetObjectMetadata returns the size of the file, the only metadata kept
+func (mb *memoryBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	size, err := mb.GetFileSize(filePath)
+	if err != nil {
+		return ObjectMetadata{}, err
+	}
+
+	return ObjectMetadata{Size: size}, nil
+}
+
+// Exists tells whether the file exists
+func (mb *memoryBackend) Exists(filePath string) (bool, error) {
+	_, err := mb.file("stat", filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// RemoveFile removes the file
+func (mb *memoryBackend) RemoveFile(filePath string) error {
+	if _, err := mb.file("remove", filePath); err != nil {
+		return err
+	}
+
+	return mb.Delete(filePath)
+}
+
+// Delete removes the file, a file that is already gone is not an error
+func (mb *memoryBackend) Delete(filePath string) error {
+	if mb == nil {
+		return fmt.Errorf("Invalid memoryBackend")
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.files, filePath)
+
+	return nil
+}
+
+// List returns the files whose paths start with prefix, sorted by path
+func (mb *memoryBackend) List(prefix string) ([]ObjectInfo, error) {
+	if mb == nil {
+		return nil, fmt.Errorf("Invalid memoryBackend")
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	objects := []ObjectInfo{}
+	for filePath, file := range mb.files {
+		if strings.HasPrefix(filePath, prefix) {
+			objects = append(objects, ObjectInfo{Path: filePath, Size: int64(len(file.data)), LastModified: file.modified})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+
+	return objects, nil
+}
+
+// PresignGet returns ErrUnsupported, files in memory can't be downloaded
+// without the services
+func (mb *memoryBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+// HealthCheck returns the error of ctx, if any, the files are always there
+func (mb *memoryBackend) HealthCheck(ctx context.Context) error {
+	if mb == nil {
+		return fmt.Errorf("Invalid memoryBackend")
+	}
+
+	return ctx.Err()
+}
+
+// memoryWriter collects what is written to a file of a memoryBackend
+type memoryWriter struct {
+	bytes.Buffer
+	backend  *memoryBackend
+	filePath string
+	closed   bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+
+	return w.Buffer.Write(p)
+}
+
+// Close stores the file, replacing any earlier version
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+	w.backend.files[w.filePath] = memoryFile{w.Bytes(), time.Now()}
+
+	return nil
+}
+
+// CloseWithError drops what was written, leaving the file as it was
+func (w *memoryWriter) CloseWithError(err error) error {
+	w.closed = true
+
+	return nil
+}
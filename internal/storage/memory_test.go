@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	seed := map[string][]byte{"dir/seeded": writeData}
+	backend := NewMemoryBackend(seed)
+	seed["dir/seeded"] = nil
+
+	size, err := backend.GetFileSize("dir/seeded")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+	assert.Equal(t, writeData, readAll(t, backend, "dir/seeded"))
+	metadata, err := backend.GetObjectMetadata("dir/seeded")
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectMetadata{Size: size}, metadata)
+
+	reader, err := backend.NewFileReaderAt("dir/seeded", 4, 6)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, writeData[4:10], content)
+	_, err = backend.NewFileReaderAt("dir/seeded", 4, size)
+	assert.Error(t, err)
+
+	writer, err := backend.NewFileWriter("written")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData[:4])
+	assert.NoError(t, err)
+	_, err = backend.GetFileSize("written")
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "the file should be stored on close")
+	exists, err := backend.Exists("written")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, writer.Close())
+	_, err = writer.Write(writeData)
+	assert.Error(t, err)
+	assert.Equal(t, writeData[:4], readAll(t, backend, "written"))
+
+	objects, err := backend.List("dir/")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+	assert.Equal(t, "dir/seeded", objects[0].Path)
+	assert.Equal(t, size, objects[0].Size)
+
+	_, err = backend.PresignGet("written", 0)
+	assert.Equal(t, ErrUnsupported, err)
+	assert.NoError(t, backend.HealthCheck(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err = backend.NewFileReaderContext(ctx, "written")
+	assert.NoError(t, err)
+	cancel()
+	_, err = reader.Read(make([]byte, 4))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, backend.HealthCheck(ctx))
+
+	assert.NoError(t, backend.RemoveFile("written"))
+	assert.Error(t, backend.RemoveFile("written"))
+	assert.NoError(t, backend.Delete("written"))
+	_, err = backend.NewFileReader("written")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// copies between backends work as with any other
+	copied, err := CopyFile(backend, "dir/seeded", NewMemoryBackend(nil), "copy")
+	assert.NoError(t, err)
+	assert.Equal(t, size, copied)
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("memory", func(config Conf) (Backend, error) {
+		return NewMemoryBackend(map[string][]byte{"seeded": writeData}), nil
+	})
+	defer func() {
+		backendsMu.Lock()
+		delete(backends, "memory")
+		backendsMu.Unlock()
+	}()
+
+	backend, err := NewBackend(Conf{Type: "memory"})
+	assert.NoError(t, err)
+	size, err := backend.GetFileSize("seeded")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+
+	assert.Panics(t, func() {
+		RegisterBackend("memory", func(config Conf) (Backend, error) { return nil, nil })
+	})
+	assert.Panics(t, func() { RegisterBackend("nothing", nil) })
+
+	_, err = NewBackend(Conf{Type: "nosuch"})
+	assert.EqualError(t, err, `unknown storage type "nosuch"`)
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Storage metrics, registered on the default prometheus registry so that
+// they are served by whichever /metrics endpoint the service exposes
+var (
+	bytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_bytes_read_total",
+		Help: "Number of bytes read from the storage.",
+	}, []string{"backend"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_operation_duration_seconds",
+		Help:    "Time spent on a storage operation, until a reader or writer is returned for files.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"operation", "backend"})
+
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_operation_errors_total",
+		Help: "Number of storage operations that failed, reads of files included.",
+	}, []string{"operation", "backend"})
+)
+
+func init() {
+	prometheus.MustRegister(bytesRead, operationDuration, operationErrors)
+}
+
+// metricsBackend records the metrics of the backend it wraps, labeled by
+// its type
+type metricsBackend struct {
+	Backend
+	name string
+}
+
+// observe records how long the operation took since start and whether it
+// failed. It is meant to be deferred with a pointer to the named error
+// result. ErrUnsupported is not counted as an error.
+func (mb *metricsBackend) observe(operation string, start time.Time, err *error) {
+	operationDuration.WithLabelValues(operation, mb.name).Observe(time.Since(start).Seconds())
+	if *err != nil && !errors.Is(*err, ErrUnsupported) {
+		operationErrors.WithLabelValues(operation, mb.name).Inc()
+	}
+}
+
+// unwrap returns the backend whose metrics are recorded
+func (mb *metricsBackend) unwrap() Backend {
+	return mb.Backend
+}
+
+func (mb *metricsBackend) GetFileSize(filePath string) (size int64, err error) {
+	defer mb.observe("get_file_size", time.Now(), &err)
+
+	return mb.Backend.GetFileSize(filePath)
+}
+
+func (mb *metricsBackend) Exists(filePath string) (exists bool, err error) {
+	defer mb.observe("exists", time.Now(), &err)
+
+	return mb.Backend.Exists(filePath)
+}
+
+func (mb *metricsBackend) GetObjectMetadata(filePath string) (metadata ObjectMetadata, err error) {
+	defer mb.observe("get_object_metadata", time.Now(), &err)
+
+	return mb.Backend.GetObjectMetadata(filePath)
+}
+
+func (mb *metricsBackend) RemoveFile(filePath string) (err error) {
+	defer mb.observe("remove_file", time.Now(), &err)
+
+	return mb.Backend.RemoveFile(filePath)
+}
+
+func (mb *metricsBackend) Delete(filePath string) (err error) {
+	defer mb.observe("delete", time.Now(), &err)
+
+	return mb.Backend.Delete(filePath)
+}
+
+func (mb *metricsBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return mb.NewFileReaderContext(context.Background(), filePath)
+}
+
+func (mb *metricsBackend) NewFileReaderContext(ctx context.Context, filePath string) (reader io.ReadCloser, err error) {
+	defer mb.observe("new_file_reader", time.Now(), &err)
+
+	reader, err = mb.Backend.NewFileReaderContext(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metricsReader{ReadCloser: reader, backend: mb.name}, nil
+}
+
+func (mb *metricsBackend) NewFileReaderAt(filePath string, offset, length int64) (reader io.ReadCloser, err error) {
+	defer mb.observe("new_file_reader_at", time.Now(), &err)
+
+	reader, err = mb.Backend.NewFileReaderAt(filePath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metricsReader{ReadCloser: reader, backend: mb.name}, nil
+}
+
+func (mb *metricsBackend) NewFileWriter(filePath string) (writer io.WriteCloser, err error) {
+	defer mb.observe("new_file_writer", time.Now(), &err)
+
+	return mb.Backend.NewFileWriter(filePath)
+}
+
+func (mb *metricsBackend) List(prefix string) (objects []ObjectInfo, err error) {
+	defer mb.observe("list", time.Now(), &err)
+
+	return mb.Backend.List(prefix)
+}
+
+func (mb *metricsBackend) PresignGet(filePath string, ttl time.Duration) (url string, err error) {
+	defer mb.observe("presign_get", time.Now(), &err)
+
+	return mb.Backend.PresignGet(filePath, ttl)
+}
+
+func (mb *metricsBackend) HealthCheck(ctx context.Context) (err error) {
+	defer mb.observe("health_check", time.Now(), &err)
+
+	return mb.Backend.HealthCheck(ctx)
+}
+
+// metricsReader counts the bytes read from a file, and the reads that fail
+type metricsReader struct {
+	io.ReadCloser
+	backend string
+}
+
+func (r *metricsReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		bytesRead.WithLabelValues(r.backend).Add(float64(n))
+	}
+	if err != nil && err != io.EOF {
+		operationErrors.WithLabelValues("read", r.backend).Inc()
+	}
+
+	return n, err
+}
+
+// unwrapBackend returns the backend below the wrappers adding metrics and
+// caching
+func unwrapBackend(backend Backend) Backend {
+	for {
+		wrapper, ok := backend.(interface{ unwrap() Backend })
+		if !ok {
+			return backend
+		}
+		backend = wrapper.unwrap()
+	}
+}
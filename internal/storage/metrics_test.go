@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsBackend(t *testing.T) {
+	backend := &metricsBackend{Backend: NewMemoryBackend(map[string][]byte{"file": writeData}), name: "memory"}
+
+	read := testutil.ToFloat64(bytesRead.WithLabelValues("memory"))
+	sizeErrors := testutil.ToFloat64(operationErrors.WithLabelValues("get_file_size", "memory"))
+	presignErrors := testutil.ToFloat64(operationErrors.WithLabelValues("presign_get", "memory"))
+
+	assert.Equal(t, writeData, readAll(t, backend, "file"))
+	reader, err := backend.NewFileReaderAt("file", 4, 6)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, read+float64(len(writeData)+6), testutil.ToFloat64(bytesRead.WithLabelValues("memory")))
+
+	_, err = backend.GetFileSize("missing")
+	assert.Error(t, err)
+	assert.Equal(t, sizeErrors+1, testutil.ToFloat64(operationErrors.WithLabelValues("get_file_size", "memory")))
+
+	// unsupported operations are not failures of the storage
+	_, err = backend.PresignGet("file", time.Minute)
+	assert.Equal(t, ErrUnsupported, err)
+	assert.Equal(t, presignErrors, testutil.ToFloat64(operationErrors.WithLabelValues("presign_get", "memory")))
+
+	assert.NotZero(t, testutil.CollectAndCount(operationDuration))
+}
+
+func TestNewBackendMetrics(t *testing.T) {
+	backend, err := NewBackend(Conf{Posix: posixConf{Location: t.TempDir()}})
+	assert.NoError(t, err)
+	assert.IsType(t, &metricsBackend{}, backend)
+	assert.Equal(t, "posix", backend.(*metricsBackend).name)
+	assert.IsType(t, &posixBackend{}, unwrapBackend(backend))
+
+	backend, err = NewBackend(Conf{Posix: posixConf{Location: t.TempDir()}, Cache: CacheConf{Dir: t.TempDir()}})
+	assert.NoError(t, err)
+	assert.IsType(t, &posixBackend{}, unwrapBackend(backend))
+}
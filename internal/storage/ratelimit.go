@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitBurst is the most bytes read at once from a rate limited
+// backend, larger reads are shortened to it
+const rateLimitBurst = 256 * 1024
+
+// rateLimitBackend limits how fast the files of the backend it wraps are
+// read, all readers of the backend sharing the rate
+type rateLimitBackend struct {
+	Backend
+	limiter *rate.Limiter
+}
+
+// newRateLimitBackend returns backend, whose files are read at no more
+// than bytesPerSecond
+func newRateLimitBackend(backend Backend, bytesPerSecond int64) *rateLimitBackend {
+	return &rateLimitBackend{Backend: backend, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), rateLimitBurst)}
+}
+
+// unwrap returns the backend whose reads are limited
+func (rb *rateLimitBackend) unwrap() Backend {
+	return rb.Backend
+}
+
+func (rb *rateLimitBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return rb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns a rate limited reader for the file, whose
+// waits for the rate end when ctx is done
+func (rb *rateLimitBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	reader, err := rb.Backend.NewFileReaderContext(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitReader{ReadCloser: reader, ctx: ctx, limiter: rb.limiter}, nil
+}
+
+func (rb *rateLimitBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	reader, err := rb.Backend.NewFileReaderAt(filePath, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rateLimitReader{ReadCloser: reader, ctx: context.Background(), limiter: rb.limiter}, nil
+}
+
+// rateLimitReader waits for the bytes it has read to be within the rate
+// before the next read
+type rateLimitReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitReader) Read(b []byte) (int, error) {
+	if len(b) > r.limiter.Burst() {
+		b = b[:r.limiter.Burst()]
+	}
+
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
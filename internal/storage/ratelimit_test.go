@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitBackend(t *testing.T) {
+	data := bytes.Repeat(writeData, 30)
+	backend := newRateLimitBackend(NewMemoryBackend(map[string][]byte{"file": data}), 1000)
+	// a small burst, so that the rate shows on little data
+	backend.limiter = rate.NewLimiter(rate.Limit(len(data)*4), len(data)/3)
+
+	start := time.Now()
+	assert.Equal(t, data, readAll(t, backend, "file"))
+	reader, err := backend.NewFileReaderAt("file", 0, int64(len(data)))
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, data, content)
+	// all but the first burst of the two files are read at the rate
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err = backend.NewFileReaderContext(ctx, "file")
+	assert.NoError(t, err)
+	cancel()
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err)
+
+	limited, err := NewBackend(Conf{Posix: posixConf{Location: t.TempDir()}, ReadRateLimit: 1 << 20})
+	assert.NoError(t, err)
+	assert.IsType(t, &rateLimitBackend{}, limited)
+	assert.IsType(t, &posixBackend{}, unwrapBackend(limited))
+}
@@ -0,0 +1,979 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types and status codes, from version 3 of the protocol
+// (draft-ietf-secsh-filexfer-02), which is what servers commonly speak
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpWrite   = 6
+	sftpOpenDir = 11
+	sftpReadDir = 12
+	sftpRemove  = 13
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpName    = 104
+	sftpAttrs   = 105
+
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	// file types in the permissions, as in st_mode
+	sftpModeType    = 0170000
+	sftpModeDir     = 0040000
+	sftpModeRegular = 0100000
+)
+
+// sftpMaxData is the most data read or written in one request, servers
+// are only required to handle packets of 32 KiB
+const sftpMaxData = 32 * 1024
+
+// sftpBackend stores files on an SFTP server, reusing one connection for
+// all files
+type sftpBackend struct {
+	Conf   *SFTPConf
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *sftpClient
+}
+
+// SFTPConf stores information about the SFTP storage backend. The backend
+// logs in as User with the private key in KeyFile, or with Password. The
+// server is only trusted if its host key has the SHA256 fingerprint in
+// HostKey, e.g. as shown by ssh-keygen -lf, unless HostKey is empty.
+type SFTPConf struct {
+	Host          string
+	Port          int
+	User          string
+	Password      string `redact:"true"`
+	KeyFile       string
+	KeyPassphrase string `redact:"true"`
+	HostKey       string
+	Location      string
+}
+
+func init() {
+	RegisterBackend("sftp", func(config Conf) (Backend, error) {
+		return newSFTPBackend(config.SFTP)
+	})
+}
+
+func newSFTPBackend(config SFTPConf) (*sftpBackend, error) {
+	if config.Host == "" || config.User == "" {
+		return nil, fmt.Errorf("both host and user are needed for the sftp backend")
+	}
+	if config.Port == 0 {
+		config.Port = 22
+	}
+
+	var auth []ssh.AuthMethod
+	if config.KeyFile != "" {
+		key, err := os.ReadFile(config.KeyFile) // #nosec this file comes from our config
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the sftp key: %v", err)
+		}
+		var signer ssh.Signer
+		if config.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(config.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad sftp key in %s: %v", config.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("either a key file or a password is needed for the sftp backend")
+	}
+
+	hostKeyCallback := func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if fingerprint := ssh.FingerprintSHA256(key); fingerprint != config.HostKey {
+			return fmt.Errorf("the sftp host key %s does not match %s", fingerprint, config.HostKey)
+		}
+
+		return nil
+	}
+	if config.HostKey == "" {
+		log.Warnf("The host key of the sftp server %s is not verified", config.Host)
+		hostKeyCallback = ssh.InsecureIgnoreHostKey() // #nosec verification is optional
+	}
+
+	sb := &sftpBackend{
+		Conf: &config,
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}
+
+	if _, err := sb.connection(); err != nil {
+		return nil, err
+	}
+
+	return sb, nil
+}
+
+// connection returns the connection to the server, connecting again when
+// it has been lost
+func (sb *sftpBackend) connection() (*sftpClient, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if sb.client != nil && sb.client.alive() {
+		return sb.client, nil
+	}
+	if sb.client != nil {
+		sb.client.Close()
+	}
+
+	address := net.JoinHostPort(sb.Conf.Host, strconv.Itoa(sb.Conf.Port))
+	conn, err := ssh.Dial("tcp", address, sb.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+
+	client, err := newSFTPSession(conn)
+	if err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("failed to start sftp on %s: %v", address, err)
+	}
+	sb.client = client
+
+	return client, nil
+}
+
+// newSFTPSession starts the sftp subsystem on the connection
+func newSFTPSession(conn *ssh.Client) (*sftpClient, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+
+	return newSFTPClient(r, w, func() error {
+		session.Close()
+
+		return conn.Close()
+	})
+}
+
+// do runs op on the connection, once more on a new connection if the
+// connection was lost, as idle connections are closed by many servers
+func (sb *sftpBackend) do(op func(*sftpClient) error) error {
+	client, err := sb.connection()
+	if err != nil {
+		return err
+	}
+
+	err = op(client)
+	if err != nil && !client.alive() {
+		log.Debugf("Lost the connection to the sftp server: %v", err)
+		if client, err = sb.connection(); err != nil {
+			return err
+		}
+		err = op(client)
+	}
+
+	return err
+}
+
+// remotePath returns the path on the server for filePath
+func (sb *sftpBackend) remotePath(filePath string) string {
+	return path.Join(sb.Conf.Location, filePath)
+}
+
+// NewFileReader returns an io.Reader instance
+func (sb *sftpBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return sb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the file that is closed,
+// failing further reads, when ctx is done
+func (sb *sftpBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid sftpBackend")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var file *sftpFile
+	err := sb.do(func(c *sftpClient) (err error) {
+		file, err = c.open(sb.remotePath(filePath), sftpFlagRead, 0)
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return newContextReader(ctx, file), nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the file from
+// offset
+func (sb *sftpBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	size, err := sb.GetFileSize(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, size, offset, length); err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	reader, err := sb.NewFileReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	file := reader.(*sftpFile)
+	file.offset = uint64(offset)
+
+	return rangeReader{io.LimitReader(file, length), file}, nil
+}
+
+// NewFileWriter returns an io.Writer instance
+func (sb *sftpBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	var file *sftpFile
+	err := sb.do(func(c *sftpClient) (err error) {
+		file, err = c.open(sb.remotePath(filePath), sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc, 0640)
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// GetFileSize returns the size of the file
+func (sb *sftpBackend) GetFileSize(filePath string) (int64, error) {
+	if sb == nil {
+		return 0, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	var size int64
+	err := sb.do(func(c *sftpClient) (err error) {
+		size, err = c.stat(sb.remotePath(filePath))
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// GetObjectMetadata returns the size and modification time of the file
+func (sb *sftpBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if sb == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	var attrs sftpFileAttrs
+	err := sb.do(func(c *sftpClient) (err error) {
+		attrs, err = c.statAttrs(sb.remotePath(filePath))
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return ObjectMetadata{}, err
+	}
+
+	return ObjectMetadata{Size: attrs.size, LastModified: attrs.modTime}, nil
+}
+
+// Exists tells whether the file exists, an error is only returned when
+// that can't be told
+func (sb *sftpBackend) Exists(filePath string) (bool, error) {
+	if sb == nil {
+		return false, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	err := sb.do(func(c *sftpClient) error {
+		_, err := c.stat(sb.remotePath(filePath))
+
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		log.Error(err)
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RemoveFile removes a file from the server
+func (sb *sftpBackend) RemoveFile(filePath string) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid sftpBackend")
+	}
+
+	err := sb.do(func(c *sftpClient) error {
+		return c.remove(sb.remotePath(filePath))
+	})
+	if err != nil {
+		log.Error(err)
+
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes a file from the server, a file that is already gone is
+// not an error
+func (sb *sftpBackend) Delete(filePath string) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid sftpBackend")
+	}
+
+	err := sb.do(func(c *sftpClient) error {
+		return c.remove(sb.remotePath(filePath))
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Error(err)
+
+		return err
+	}
+
+	return nil
+}
+
+// HealthCheck returns an error unless the location can be found on the
+// server, connecting to it if needed
+func (sb *sftpBackend) HealthCheck(ctx context.Context) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid sftpBackend")
+	}
+
+	location := sb.remotePath("")
+	if location == "" {
+		location = "."
+	}
+
+	// the connection can't be cancelled, it is left to finish
+	done := make(chan error, 1)
+	go func() {
+		done <- sb.do(func(c *sftpClient) error {
+			p, err := c.request(sftpStat, appendSFTPString(nil, location))
+			if err == nil && p.typ != sftpAttrs {
+				err = statusError(p, location)
+			}
+
+			return err
+		})
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PresignGet returns ErrUnsupported, presigned URLs are only made for S3
+func (sb *sftpBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
+}
+
+// List returns the files below the location whose paths, relative to it,
+// start with prefix
+func (sb *sftpBackend) List(prefix string) ([]ObjectInfo, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid sftpBackend")
+	}
+
+	prefix = strings.TrimPrefix(prefix, "/")
+	// only the directory of the prefix needs to be walked
+	root := prefix[:strings.LastIndex(prefix, "/")+1]
+
+	var objects []ObjectInfo
+	err := sb.do(func(c *sftpClient) error {
+		objects = []ObjectInfo{}
+
+		var walk func(dir string) error
+		walk = func(dir string) error {
+			dirPath := sb.remotePath(dir)
+			if dirPath == "" {
+				dirPath = "."
+			}
+			entries, err := c.readDir(dirPath)
+			if err != nil {
+				if dir == root && errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+
+			for _, entry := range entries {
+				name := path.Join(dir, entry.name)
+				switch entry.attrs.mode & sftpModeType {
+				case sftpModeDir:
+					if entry.name == "." || entry.name == ".." || !strings.HasPrefix(name+"/", prefix) {
+						continue
+					}
+					if err := walk(name + "/"); err != nil {
+						return err
+					}
+				case sftpModeRegular:
+					if strings.HasPrefix(name, prefix) {
+						objects = append(objects, ObjectInfo{Path: name, Size: entry.attrs.size, LastModified: entry.attrs.modTime})
+					}
+				}
+			}
+
+			return nil
+		}
+
+		return walk(root)
+	})
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	// directories are listed in no particular order
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+
+	return objects, nil
+}
+
+// sftpClient speaks the part of the SFTP protocol used by the backend.
+// Requests may be sent concurrently, the responses are handed to the
+// requests by id as they arrive.
+type sftpClient struct {
+	w      io.WriteCloser
+	closer func() error
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error
+}
+
+// sftpPacket is a response, data is what follows the request id
+type sftpPacket struct {
+	typ  byte
+	data []byte
+}
+
+// newSFTPClient initializes the protocol on r and w, closer closes the
+// underlying connection
+func newSFTPClient(r io.Reader, w io.WriteCloser, closer func() error) (*sftpClient, error) {
+	c := &sftpClient{w: w, closer: closer, pending: make(map[uint32]chan sftpPacket)}
+
+	if err := c.writePacket(sftpInit, appendSFTPUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	typ, _, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion {
+		return nil, fmt.Errorf("unexpected sftp packet %d when initializing", typ)
+	}
+
+	go c.receive(r)
+
+	return c, nil
+}
+
+// readSFTPPacket reads the next packet from r
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > 256*1024 {
+		return 0, nil, fmt.Errorf("bad sftp packet length %d", n)
+	}
+
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+// writePacket sends a packet of the type with the payload
+func (c *sftpClient) writePacket(typ byte, payload []byte) error {
+	packet := appendSFTPUint32(make([]byte, 0, 5+len(payload)), uint32(1+len(payload)))
+	packet = append(append(packet, typ), payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.w.Write(packet)
+
+	return err
+}
+
+// receive hands out the responses until the connection is lost
+func (c *sftpClient) receive(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = fmt.Errorf("short sftp packet")
+		}
+		if err != nil {
+			c.fail(err)
+
+			return
+		}
+
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if ch != nil {
+			ch <- sftpPacket{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+// fail marks the connection as lost, failing the requests waiting for a
+// response
+func (c *sftpClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("the sftp connection was closed")
+	}
+	c.err = err
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = nil
+}
+
+// alive tells whether the connection can still be used
+func (c *sftpClient) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err == nil
+}
+
+// Close closes the connection
+func (c *sftpClient) Close() error {
+	c.fail(fmt.Errorf("the sftp connection was closed"))
+
+	return c.closer()
+}
+
+// request sends a request of the type, with a new id followed by the
+// payload, and waits for the response
+func (c *sftpClient) request(typ byte, payload []byte) (sftpPacket, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+
+		return sftpPacket{}, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan sftpPacket, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.writePacket(typ, append(appendSFTPUint32(nil, id), payload...)); err != nil {
+		c.fail(err)
+	}
+
+	p, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return sftpPacket{}, c.err
+	}
+
+	return p, nil
+}
+
+// appendSFTPUint32 appends v in network byte order
+func appendSFTPUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendSFTPUint64 appends v in network byte order
+func appendSFTPUint64(b []byte, v uint64) []byte {
+	return appendSFTPUint32(appendSFTPUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// appendSFTPString appends s as an SFTP string, prefixed by its length
+func appendSFTPString(b []byte, s string) []byte {
+	return append(appendSFTPUint32(b, uint32(len(s))), s...)
+}
+
+// readSFTPString returns the string at the start of b and what follows
+func readSFTPString(b []byte) (string, []byte, error) {
+	if len(b) < 4 || uint32(len(b)-4) < binary.BigEndian.Uint32(b) {
+		return "", nil, fmt.Errorf("short sftp string")
+	}
+	n := binary.BigEndian.Uint32(b)
+
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
+
+// statusError returns the error for a STATUS response about filePath, nil
+// when it is OK and io.EOF at the end of a file
+func statusError(p sftpPacket, filePath string) error {
+	if p.typ != sftpStatus {
+		return fmt.Errorf("unexpected sftp packet %d for %s", p.typ, filePath)
+	}
+	if len(p.data) < 4 {
+		return fmt.Errorf("short sftp status for %s", filePath)
+	}
+
+	switch code := binary.BigEndian.Uint32(p.data); code {
+	case sftpStatusOK:
+		return nil
+	case sftpStatusEOF:
+		return io.EOF
+	case sftpStatusNoSuchFile:
+		return &os.PathError{Op: "sftp", Path: filePath, Err: os.ErrNotExist}
+	case sftpStatusPermissionDenied:
+		return &os.PathError{Op: "sftp", Path: filePath, Err: os.ErrPermission}
+	default:
+		message, _, _ := readSFTPString(p.data[4:])
+
+		return &os.PathError{Op: "sftp", Path: filePath, Err: fmt.Errorf("%s (status %d)", message, code)}
+	}
+}
+
+// open opens the file with the flags, creating it with perm
+func (c *sftpClient) open(filePath string, flags uint32, perm uint32) (*sftpFile, error) {
+	payload := appendSFTPUint32(appendSFTPString(nil, filePath), flags)
+	if flags&sftpFlagCreat != 0 {
+		payload = appendSFTPUint32(appendSFTPUint32(payload, sftpAttrPermissions), perm)
+	} else {
+		payload = appendSFTPUint32(payload, 0)
+	}
+
+	p, err := c.request(sftpOpen, payload)
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != sftpHandle {
+		return nil, statusError(p, filePath)
+	}
+	handle, _, err := readSFTPString(p.data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpFile{client: c, path: filePath, handle: handle}, nil
+}
+
+// stat returns the size of the file
+func (c *sftpClient) stat(filePath string) (int64, error) {
+	p, err := c.request(sftpStat, appendSFTPString(nil, filePath))
+	if err != nil {
+		return 0, err
+	}
+	if p.typ != sftpAttrs {
+		return 0, statusError(p, filePath)
+	}
+	if len(p.data) < 12 || binary.BigEndian.Uint32(p.data)&sftpAttrSize == 0 {
+		return 0, fmt.Errorf("no size for %s from the sftp server", filePath)
+	}
+
+	return int64(binary.BigEndian.Uint64(p.data[4:])), nil
+}
+
+// statAttrs returns the attributes of the file
+func (c *sftpClient) statAttrs(filePath string) (sftpFileAttrs, error) {
+	p, err := c.request(sftpStat, appendSFTPString(nil, filePath))
+	if err != nil {
+		return sftpFileAttrs{}, err
+	}
+	if p.typ != sftpAttrs {
+		return sftpFileAttrs{}, statusError(p, filePath)
+	}
+	attrs, _, err := readSFTPAttrs(p.data)
+
+	return attrs, err
+}
+
+// sftpFileAttrs are the attributes of a file used by the backend
+type sftpFileAttrs struct {
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+// readSFTPAttrs returns the attributes at the start of b and what follows
+func readSFTPAttrs(b []byte) (sftpFileAttrs, []byte, error) {
+	var attrs sftpFileAttrs
+	errShort := fmt.Errorf("short sftp attributes")
+
+	if len(b) < 4 {
+		return attrs, nil, errShort
+	}
+	flags := binary.BigEndian.Uint32(b)
+	b = b[4:]
+
+	// the attributes present follow in the order of their flags
+	for _, field := range []struct {
+		flag uint32
+		size int
+	}{{sftpAttrSize, 8}, {sftpAttrUIDGID, 8}, {sftpAttrPermissions, 4}, {sftpAttrACModTime, 8}} {
+		if flags&field.flag == 0 {
+			continue
+		}
+		if len(b) < field.size {
+			return attrs, nil, errShort
+		}
+		switch field.flag {
+		case sftpAttrSize:
+			attrs.size = int64(binary.BigEndian.Uint64(b))
+		case sftpAttrPermissions:
+			attrs.mode = binary.BigEndian.Uint32(b)
+		case sftpAttrACModTime:
+			attrs.modTime = time.Unix(int64(binary.BigEndian.Uint32(b[4:])), 0)
+		}
+		b = b[field.size:]
+	}
+
+	if flags&sftpAttrExtended != 0 {
+		if len(b) < 4 {
+			return attrs, nil, errShort
+		}
+		count := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		for i := uint32(0); i < 2*count; i++ {
+			var err error
+			if _, b, err = readSFTPString(b); err != nil {
+				return attrs, nil, err
+			}
+		}
+	}
+
+	return attrs, b, nil
+}
+
+// sftpDirEntry is a file in a directory listing
+type sftpDirEntry struct {
+	name  string
+	attrs sftpFileAttrs
+}
+
+// readDir returns the entries of the directory, including . and ..
+func (c *sftpClient) readDir(dirPath string) ([]sftpDirEntry, error) {
+	p, err := c.request(sftpOpenDir, appendSFTPString(nil, dirPath))
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != sftpHandle {
+		return nil, statusError(p, dirPath)
+	}
+	handle, _, err := readSFTPString(p.data)
+	if err != nil {
+		return nil, err
+	}
+	dir := &sftpFile{client: c, path: dirPath, handle: handle}
+	defer dir.Close()
+
+	var entries []sftpDirEntry
+	for {
+		p, err := c.request(sftpReadDir, appendSFTPString(nil, handle))
+		if err != nil {
+			return nil, err
+		}
+		if p.typ != sftpName {
+			// the listing ends with EOF
+			switch err := statusError(p, dirPath); err {
+			case io.EOF:
+				return entries, nil
+			case nil:
+				return nil, fmt.Errorf("no entries for %s from the sftp server", dirPath)
+			default:
+				return nil, err
+			}
+		}
+		if len(p.data) < 4 {
+			return nil, fmt.Errorf("short sftp listing for %s", dirPath)
+		}
+
+		data := p.data[4:]
+		for i := binary.BigEndian.Uint32(p.data); i > 0; i-- {
+			var entry sftpDirEntry
+			// the name is followed by a long name, as from ls -l
+			if entry.name, data, err = readSFTPString(data); err == nil {
+				if _, data, err = readSFTPString(data); err == nil {
+					entry.attrs, data, err = readSFTPAttrs(data)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+}
+
+// remove removes the file
+func (c *sftpClient) remove(filePath string) error {
+	p, err := c.request(sftpRemove, appendSFTPString(nil, filePath))
+	if err != nil {
+		return err
+	}
+
+	return statusError(p, filePath)
+}
+
+// sftpFile is an open file on the server, read or written from the start
+type sftpFile struct {
+	client *sftpClient
+	path   string
+	handle string
+	offset uint64
+}
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	if len(b) > sftpMaxData {
+		b = b[:sftpMaxData]
+	}
+
+	payload := appendSFTPUint64(appendSFTPString(nil, f.handle), f.offset)
+	p, err := f.client.request(sftpRead, appendSFTPUint32(payload, uint32(len(b))))
+	if err != nil {
+		return 0, err
+	}
+	if p.typ != sftpData {
+		return 0, statusError(p, f.path)
+	}
+	data, _, err := readSFTPString(p.data)
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(b, data)
+	f.offset += uint64(n)
+
+	return n, nil
+}
+
+func (f *sftpFile) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > sftpMaxData {
+			chunk = chunk[:sftpMaxData]
+		}
+
+		payload := appendSFTPUint64(appendSFTPString(nil, f.handle), f.offset)
+		p, err := f.client.request(sftpWrite, appendSFTPString(payload, string(chunk)))
+		if err == nil {
+			err = statusError(p, f.path)
+		}
+		if err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		f.offset += uint64(len(chunk))
+	}
+
+	return written, nil
+}
+
+// Close closes the handle, a written file is complete when it returns
+func (f *sftpFile) Close() error {
+	p, err := f.client.request(sftpClose, appendSFTPString(nil, f.handle))
+	if err != nil {
+		return err
+	}
+
+	return statusError(p, f.path)
+}
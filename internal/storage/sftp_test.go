@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSFTP is an SSH server with an sftp subsystem serving files from
+// memory
+type fakeSFTP struct {
+	sync.Mutex
+	listener   net.Listener
+	hostKey    ssh.Signer
+	files      map[string][]byte
+	userKey    ssh.PublicKey
+	handshakes int
+	conns      []net.Conn
+}
+
+func newFakeSFTP(t *testing.T, userKey ssh.PublicKey) *fakeSFTP {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	f := &fakeSFTP{listener: listener, hostKey: hostKey, userKey: userKey, files: map[string][]byte{}}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "sda" && string(password) == "secret" {
+				return nil, nil
+			}
+
+			return nil, io.ErrUnexpectedEOF
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			f.Lock()
+			defer f.Unlock()
+			if f.userKey != nil && string(key.Marshal()) == string(f.userKey.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, config)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeSFTP) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+// drop closes all connections, as when the server restarts
+func (f *fakeSFTP) drop() {
+	f.Lock()
+	defer f.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeSFTP) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+
+		return
+	}
+	f.Lock()
+	f.handshakes++
+	f.conns = append(f.conns, conn)
+	f.Unlock()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					go f.subsystem(channel)
+				}
+			}
+		}()
+	}
+}
+
+// subsystem answers the requests used by the backend
+func (f *fakeSFTP) subsystem(channel ssh.Channel) {
+	defer channel.Close()
+
+	handles := map[string]string{}
+	listings := map[string][]byte{}
+	send := func(typ byte, payload []byte) {
+		_, _ = channel.Write(append(appendSFTPUint32(nil, uint32(1+len(payload))), append([]byte{typ}, payload...)...))
+	}
+	status := func(id uint32, code uint32) {
+		send(sftpStatus, appendSFTPString(appendSFTPUint32(appendSFTPUint32(nil, id), code), "failed"))
+	}
+
+	for {
+		typ, data, err := readSFTPPacket(channel)
+		if err != nil {
+			return
+		}
+		if typ == sftpInit {
+			send(sftpVersion, appendSFTPUint32(nil, 3))
+
+			continue
+		}
+
+		id := binary.BigEndian.Uint32(data)
+		name, rest, _ := readSFTPString(data[4:])
+
+		f.Lock()
+		switch typ {
+		case sftpOpen:
+			flags := binary.BigEndian.Uint32(rest)
+			_, exists := f.files[name]
+			switch {
+			case flags&sftpFlagCreat != 0:
+				f.files[name] = []byte{}
+			case !exists:
+				status(id, sftpStatusNoSuchFile)
+				f.Unlock()
+
+				continue
+			}
+			handle := string(rune('a' + len(handles)))
+			handles[handle] = name
+			send(sftpHandle, appendSFTPString(appendSFTPUint32(nil, id), handle))
+		case sftpRead:
+			file := f.files[handles[name]]
+			offset := binary.BigEndian.Uint64(rest)
+			length := uint64(binary.BigEndian.Uint32(rest[8:]))
+			if offset >= uint64(len(file)) {
+				status(id, sftpStatusEOF)
+				f.Unlock()
+
+				continue
+			}
+			if offset+length > uint64(len(file)) {
+				length = uint64(len(file)) - offset
+			}
+			send(sftpData, appendSFTPString(appendSFTPUint32(nil, id), string(file[offset:offset+length])))
+		case sftpWrite:
+			offset := binary.BigEndian.Uint64(rest)
+			chunk, _, _ := readSFTPString(rest[8:])
+			file := f.files[handles[name]]
+			f.files[handles[name]] = append(file[:offset], chunk...)
+			status(id, sftpStatusOK)
+		case sftpOpenDir:
+			listing := f.listing(name)
+			if listing == nil {
+				status(id, sftpStatusNoSuchFile)
+				f.Unlock()
+
+				continue
+			}
+			handle := string(rune('a' + len(handles)))
+			handles[handle] = name
+			listings[handle] = listing
+			send(sftpHandle, appendSFTPString(appendSFTPUint32(nil, id), handle))
+		case sftpReadDir:
+			// all of the listing at once
+			if listing, ok := listings[name]; ok {
+				delete(listings, name)
+				send(sftpName, append(appendSFTPUint32(nil, id), listing...))
+				f.Unlock()
+
+				continue
+			}
+			status(id, sftpStatusEOF)
+		case sftpClose:
+			delete(handles, name)
+			delete(listings, name)
+			status(id, sftpStatusOK)
+		case sftpStat:
+			file, ok := f.files[name]
+			if !ok && f.listing(name) != nil {
+				send(sftpAttrs, appendSFTPUint32(appendSFTPUint32(appendSFTPUint32(nil, id), sftpAttrPermissions), sftpModeDir|0755))
+				f.Unlock()
+
+				continue
+			}
+			if !ok {
+				status(id, sftpStatusNoSuchFile)
+				f.Unlock()
+
+				continue
+			}
+			send(sftpAttrs, appendSFTPUint64(appendSFTPUint32(appendSFTPUint32(nil, id), sftpAttrSize), uint64(len(file))))
+		case sftpRemove:
+			if _, ok := f.files[name]; !ok {
+				status(id, sftpStatusNoSuchFile)
+				f.Unlock()
+
+				continue
+			}
+			delete(f.files, name)
+			status(id, sftpStatusOK)
+		default:
+			status(id, 8)
+		}
+		f.Unlock()
+	}
+}
+
+// listing returns the entries of the directory, as in a NAME response,
+// or nil if there is no such directory
+func (f *fakeSFTP) listing(dir string) []byte {
+	entries := map[string]uint32{".": sftpModeDir | 0755, "..": sftpModeDir | 0755}
+	for name := range f.files {
+		if rest := strings.TrimPrefix(name, strings.TrimSuffix(dir, "/")+"/"); rest != name {
+			if i := strings.Index(rest, "/"); i >= 0 {
+				entries[rest[:i]] = sftpModeDir | 0755
+			} else {
+				entries[rest] = sftpModeRegular | 0640
+			}
+		}
+	}
+	if len(entries) == 2 {
+		return nil
+	}
+
+	listing := appendSFTPUint32(nil, uint32(len(entries)))
+	for name, mode := range entries {
+		size := uint64(len(f.files[path.Join(dir, name)]))
+		listing = appendSFTPString(appendSFTPString(listing, name), "-rw-r----- 1 sda sda "+name)
+		listing = appendSFTPUint64(appendSFTPUint32(listing, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime), size)
+		listing = appendSFTPUint32(appendSFTPUint32(appendSFTPUint32(listing, mode), 1136214245), 1136214245)
+	}
+
+	return listing
+}
+
+func TestSFTPBackend(t *testing.T) {
+	fake := newFakeSFTP(t, nil)
+	defer fake.listener.Close()
+
+	backend, err := NewBackend(Conf{Type: "sftp", SFTP: SFTPConf{
+		Host:     "127.0.0.1",
+		Port:     fake.port(),
+		User:     "sda",
+		Password: "secret",
+		HostKey:  ssh.FingerprintSHA256(fake.hostKey.PublicKey()),
+		Location: "/archive",
+	}})
+	assert.NoError(t, err)
+	assert.IsType(t, &sftpBackend{}, unwrapBackend(backend))
+
+	// larger than one request
+	data := make([]byte, 100000)
+	_, _ = rand.Read(data)
+	writer, err := backend.NewFileWriter("dir/file")
+	assert.NoError(t, err)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, data, fake.files["/archive/dir/file"])
+	assert.NoError(t, backend.HealthCheck(context.Background()))
+
+	size, err := backend.GetFileSize("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	exists, err := backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	metadata, err := backend.GetObjectMetadata("dir/file")
+	assert.NoError(t, err)
+	assert.Equal(t, size, metadata.Size)
+
+	reader, err := backend.NewFileReader("dir/file")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, data, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backend.NewFileReaderContext(ctx, "dir/file")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	reader, err = backend.NewFileReaderAt("dir/file", 40000, 50000)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, data[40000:90000], content)
+
+	// all of the above on one connection
+	assert.Equal(t, 1, fake.handshakes)
+
+	assert.NoError(t, backend.RemoveFile("dir/file"))
+
+	_, err = backend.GetFileSize("dir/file")
+	assert.EqualError(t, err, "sftp /archive/dir/file: file does not exist")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	exists, err = backend.Exists("dir/file")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	_, err = backend.NewFileReader("dir/file")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorIs(t, backend.RemoveFile("dir/file"), os.ErrNotExist)
+	assert.NoError(t, backend.Delete("dir/file"), "a file that is already gone is deleted")
+	fake.files["/archive/deleted"] = writeData
+	assert.NoError(t, backend.Delete("deleted"))
+	assert.NotContains(t, fake.files, "/archive/deleted")
+
+	// a lost connection is replaced
+	fake.drop()
+	fake.files["/archive/other"] = writeData
+	size, err = backend.GetFileSize("other")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+	assert.Equal(t, 2, fake.handshakes)
+}
+
+func TestSFTPList(t *testing.T) {
+	fake := newFakeSFTP(t, nil)
+	defer fake.listener.Close()
+
+	backend, err := NewBackend(Conf{Type: "sftp", SFTP: SFTPConf{
+		Host:     "127.0.0.1",
+		Port:     fake.port(),
+		User:     "sda",
+		Password: "secret",
+		Location: "/archive",
+	}})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"/archive/a", "/archive/dir/b", "/archive/dir/c", "/archive/dir/sub/d", "/other/e"} {
+		fake.files[name] = []byte(name)
+	}
+
+	objects, err := backend.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []ObjectInfo{
+		{Path: "a", Size: 10, LastModified: time.Unix(1136214245, 0)},
+		{Path: "dir/b", Size: 14, LastModified: time.Unix(1136214245, 0)},
+		{Path: "dir/c", Size: 14, LastModified: time.Unix(1136214245, 0)},
+		{Path: "dir/sub/d", Size: 18, LastModified: time.Unix(1136214245, 0)},
+	}, objects)
+
+	for prefix, expected := range map[string][]string{
+		"dir/":   {"dir/b", "dir/c", "dir/sub/d"},
+		"/dir/s": {"dir/sub/d"},
+		"di":     {"dir/b", "dir/c", "dir/sub/d"},
+		"none/":  {},
+	} {
+		objects, err := backend.List(prefix)
+		assert.NoError(t, err)
+		paths := []string{}
+		for _, object := range objects {
+			paths = append(paths, object.Path)
+		}
+		assert.Equal(t, expected, paths, "wrong listing of %q", prefix)
+	}
+}
+
+func TestSFTPKeyAuthentication(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	assert.NoError(t, err)
+
+	fake := newFakeSFTP(t, sshPublicKey)
+	defer fake.listener.Close()
+	fake.files["file"] = writeData
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	backend, err := newSFTPBackend(SFTPConf{Host: "127.0.0.1", Port: fake.port(), User: "sda", KeyFile: keyFile})
+	assert.NoError(t, err)
+
+	reader, err := backend.NewFileReader("file")
+	assert.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, writeData, content)
+
+	// an encrypted key
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	rsaPublicKey, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	fake.Lock()
+	fake.userKey = rsaPublicKey
+	fake.Unlock()
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("passphrase"), x509.PEMCipherAES256) // nolint:staticcheck
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", Port: fake.port(), User: "sda", KeyFile: keyFile, KeyPassphrase: "passphrase"})
+	assert.NoError(t, err)
+
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", Port: fake.port(), User: "sda", KeyFile: keyFile, KeyPassphrase: "wrong"})
+	assert.ErrorContains(t, err, "bad sftp key in "+keyFile)
+}
+
+func TestSFTPBackendFail(t *testing.T) {
+	fake := newFakeSFTP(t, nil)
+	defer fake.listener.Close()
+
+	_, err := newSFTPBackend(SFTPConf{Host: "127.0.0.1", Password: "secret"})
+	assert.EqualError(t, err, "both host and user are needed for the sftp backend")
+
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", User: "sda"})
+	assert.EqualError(t, err, "either a key file or a password is needed for the sftp backend")
+
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", User: "sda", KeyFile: "/this/does/not/exist"})
+	assert.ErrorContains(t, err, "failed to read the sftp key")
+
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", Port: fake.port(), User: "sda", Password: "wrong"})
+	assert.ErrorContains(t, err, "unable to authenticate")
+
+	// a server that is not the one expected
+	_, err = newSFTPBackend(SFTPConf{Host: "127.0.0.1", Port: fake.port(), User: "sda", Password: "secret", HostKey: "SHA256:other"})
+	assert.ErrorContains(t, err, "the sftp host key "+ssh.FingerprintSHA256(fake.hostKey.PublicKey())+" does not match SHA256:other")
+	assert.True(t, strings.HasPrefix(err.Error(), "failed to connect to 127.0.0.1:"))
+}
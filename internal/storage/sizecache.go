@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// sizeCacheBackend remembers the sizes of the files for a while, so that
+// reading a file just after asking for its size, or retrying, doesn't cost
+// another request. Files written or removed through it are forgotten.
+type sizeCacheBackend struct {
+	Backend
+	ttl time.Duration
+
+	mu    sync.Mutex
+	sizes map[string]cachedSize
+}
+
+// cachedSize is the size of a file and when it is no longer trusted
+type cachedSize struct {
+	size    int64
+	expires time.Time
+}
+
+func newSizeCacheBackend(backend Backend, ttl time.Duration) *sizeCacheBackend {
+	return &sizeCacheBackend{Backend: backend, ttl: ttl, sizes: make(map[string]cachedSize)}
+}
+
+// unwrap returns the backend whose sizes are cached
+func (sb *sizeCacheBackend) unwrap() Backend {
+	return sb.Backend
+}
+
+// GetFileSize returns the size of the file, as cached when it was asked for
+// less than the TTL ago
+func (sb *sizeCacheBackend) GetFileSize(filePath string) (int64, error) {
+	sb.mu.Lock()
+	cached, ok := sb.sizes[filePath]
+	sb.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.size, nil
+	}
+
+	return sb.getFileSizeNoCache(filePath)
+}
+
+// getFileSizeNoCache asks the storage for the size of the file, which is
+// cached for the next TTL
+func (sb *sizeCacheBackend) getFileSizeNoCache(filePath string) (int64, error) {
+	size, err := sb.Backend.GetFileSize(filePath)
+	if err != nil {
+		sb.forget(filePath)
+
+		return 0, err
+	}
+
+	now := time.Now()
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	// the sizes that have expired are dropped as new ones are added, which
+	// keeps the map to what has been asked for within the TTL
+	for name, cached := range sb.sizes {
+		if !now.Before(cached.expires) {
+			delete(sb.sizes, name)
+		}
+	}
+	sb.sizes[filePath] = cachedSize{size: size, expires: now.Add(sb.ttl)}
+
+	return size, nil
+}
+
+// Exists tells whether the file exists, which it does when its size was
+// asked for less than the TTL ago
+func (sb *sizeCacheBackend) Exists(filePath string) (bool, error) {
+	sb.mu.Lock()
+	cached, ok := sb.sizes[filePath]
+	sb.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return true, nil
+	}
+
+	exists, err := sb.Backend.Exists(filePath)
+	if !exists {
+		sb.forget(filePath)
+	}
+
+	return exists, err
+}
+
+// forget drops the cached size of the file
+func (sb *sizeCacheBackend) forget(filePath string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	delete(sb.sizes, filePath)
+}
+
+// NewFileWriter returns an io.Writer for the file, whose size is forgotten
+// now and when the writer is closed
+func (sb *sizeCacheBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	sb.forget(filePath)
+	writer, err := sb.Backend.NewFileWriter(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sizeCacheWriter{WriteCloser: writer, forget: func() { sb.forget(filePath) }}, nil
+}
+
+// RemoveFile removes the file and forgets its size
+func (sb *sizeCacheBackend) RemoveFile(filePath string) error {
+	defer sb.forget(filePath)
+
+	return sb.Backend.RemoveFile(filePath)
+}
+
+// Delete removes the file and forgets its size
+func (sb *sizeCacheBackend) Delete(filePath string) error {
+	defer sb.forget(filePath)
+
+	return sb.Backend.Delete(filePath)
+}
+
+// sizeCacheWriter forgets the size of the file it writes when closed
+type sizeCacheWriter struct {
+	io.WriteCloser
+	forget func()
+}
+
+func (w *sizeCacheWriter) Close() error {
+	defer w.forget()
+
+	return w.WriteCloser.Close()
+}
+
+// CloseWithError drops what was written, for the writers that can
+func (w *sizeCacheWriter) CloseWithError(err error) error {
+	defer w.forget()
+
+	if writer, ok := w.WriteCloser.(interface{ CloseWithError(error) error }); ok {
+		return writer.CloseWithError(err)
+	}
+
+	return w.WriteCloser.Close()
+}
+
+// GetFileSizeNoCache returns the size of the file as the storage has it
+// now, for callers that can't use a size cached by the backend, such as
+// right after the file has been written elsewhere
+func GetFileSizeNoCache(backend Backend, filePath string) (int64, error) {
+	for b := backend; ; {
+		if sizes, ok := b.(*sizeCacheBackend); ok {
+			return sizes.getFileSizeNoCache(filePath)
+		}
+		wrapper, ok := b.(interface{ unwrap() Backend })
+		if !ok {
+			return backend.GetFileSize(filePath)
+		}
+		b = wrapper.unwrap()
+	}
+}
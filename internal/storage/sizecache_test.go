@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sizeCountingBackend counts the sizes asked of the backend it wraps
+type sizeCountingBackend struct {
+	Backend
+	sizes int
+}
+
+func (sb *sizeCountingBackend) GetFileSize(filePath string) (int64, error) {
+	sb.sizes++
+
+	return sb.Backend.GetFileSize(filePath)
+}
+
+func TestSizeCacheBackend(t *testing.T) {
+	memory := NewMemoryBackend(map[string][]byte{"file": writeData})
+	counting := &sizeCountingBackend{Backend: memory}
+	backend := newSizeCacheBackend(&metricsBackend{Backend: counting, name: "memory"}, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		size, err := backend.GetFileSize("file")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(writeData)), size)
+	}
+	assert.Equal(t, 1, counting.sizes)
+	exists, err := backend.Exists("file")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = backend.Exists("missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	size, err := GetFileSizeNoCache(backend, "file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+	assert.Equal(t, 2, counting.sizes)
+
+	// a file written through the backend is asked for again
+	writer, err := backend.NewFileWriter("file")
+	assert.NoError(t, err)
+	_, err = writer.Write(writeData[:4])
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	size, err = backend.GetFileSize("file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	assert.Equal(t, 3, counting.sizes)
+
+	// as is one changed elsewhere, for those that ask for a fresh size
+	writer, err = memory.NewFileWriter("file")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	size, err = backend.GetFileSize("file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), size)
+	size, err = GetFileSizeNoCache(backend, "file")
+	assert.NoError(t, err)
+	assert.Zero(t, size)
+
+	assert.NoError(t, backend.Delete("file"))
+	_, err = backend.GetFileSize("file")
+	assert.Error(t, err)
+	_, err = backend.GetFileSize("file")
+	assert.Error(t, err)
+	assert.Equal(t, 6, counting.sizes, "failures should not be cached")
+
+	// sizes expire
+	backend = newSizeCacheBackend(counting, time.Nanosecond)
+	backend.sizes["old"] = cachedSize{size: 1, expires: time.Now()}
+	writer, err = memory.NewFileWriter("new")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	_, err = backend.GetFileSize("new")
+	assert.NoError(t, err)
+	_, err = backend.GetFileSize("new")
+	assert.NoError(t, err)
+	assert.Equal(t, 8, counting.sizes)
+	assert.NotContains(t, backend.sizes, "old")
+
+	// without a backend that caches sizes the size is just asked for
+	size, err = GetFileSizeNoCache(memory, "new")
+	assert.NoError(t, err)
+	assert.Zero(t, size)
+}
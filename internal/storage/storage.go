@@ -2,20 +2,30 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -23,12 +33,211 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// Backend defines methods to be implemented by PosixBackend and S3Backend
+// Backend defines methods to be implemented by PosixBackend, S3Backend,
+// azureBackend, gcsBackend, sftpBackend, the read only httpBackend and, for
+// tests, memoryBackend
 type Backend interface {
 	GetFileSize(filePath string) (int64, error)
+	Exists(filePath string) (bool, error)
+	GetObjectMetadata(filePath string) (ObjectMetadata, error)
 	RemoveFile(filePath string) error
+	Delete(filePath string) error
 	NewFileReader(filePath string) (io.ReadCloser, error)
+	NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error)
+	NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error)
 	NewFileWriter(filePath string) (io.WriteCloser, error)
+	List(prefix string) ([]ObjectInfo, error)
+	PresignGet(filePath string, ttl time.Duration) (string, error)
+	HealthCheck(ctx context.Context) error
+}
+
+// ErrUnsupported is returned by the backends for what they can't do, such
+// as presigning URLs for files on a file system
+var ErrUnsupported = errors.New("not supported by the storage backend")
+
+// ErrRestoreInProgress is returned when a file in an archive tier, such as
+// S3 Glacier, is being restored and can't be read until that is done
+var ErrRestoreInProgress = errors.New("the file is being restored from an archive tier")
+
+// ObjectInfo describes a file in a storage backend, as returned by List
+type ObjectInfo struct {
+	Path         string
+	Size         int64
+	LastModified time.Time
+}
+
+// ObjectMetadata is what a storage backend tells of a file besides its
+// content. Backends leave out what they don't keep, e.g. files on a file
+// system have no ETag.
+type ObjectMetadata struct {
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	// Metadata is the user defined metadata of the object
+	Metadata map[string]string
+}
+
+// unquoteETag returns the ETag without the quotes it is sent with
+func unquoteETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// headerMetadata returns the metadata of a file given by the headers of
+// the response to a HEAD request, the user defined metadata being in the
+// headers starting with metaPrefix, when given
+func headerMetadata(resp *http.Response, metaPrefix string) ObjectMetadata {
+	metadata := ObjectMetadata{
+		Size:        resp.ContentLength,
+		ETag:        unquoteETag(resp.Header.Get("ETag")),
+		ContentType: resp.Header.Get("Content-Type")}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		metadata.LastModified = modified
+	}
+	if metaPrefix == "" {
+		return metadata
+	}
+
+	for name, values := range resp.Header {
+		if len(name) <= len(metaPrefix) || !strings.EqualFold(name[:len(metaPrefix)], metaPrefix) || len(values) == 0 {
+			continue
+		}
+		if metadata.Metadata == nil {
+			metadata.Metadata = make(map[string]string)
+		}
+		metadata.Metadata[strings.ToLower(name[len(metaPrefix):])] = values[0]
+	}
+
+	return metadata
+}
+
+// checkRange returns an error unless length bytes from offset are within a
+// file of the given size
+func checkRange(filePath string, size, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("invalid range of %d bytes at %d in %s", length, offset, filePath)
+	}
+	if offset+length > size {
+		return fmt.Errorf("range of %d bytes at %d is beyond the end of %s (%d bytes)", length, offset, filePath, size)
+	}
+
+	return nil
+}
+
+// httpRange returns the value of the Range header for length bytes from
+// offset
+func httpRange(offset, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// rangeReader reads a range of a file and closes the file
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// contextReader closes the reader when its context is done, which aborts
+// reads in progress
+type contextReader struct {
+	io.ReadCloser
+	ctx  context.Context
+	done chan struct{}
+	once sync.Once
+}
+
+// newContextReader returns r, closed when ctx is done. Reads fail with the
+// error of the context from then on.
+func newContextReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return r
+	}
+
+	cr := &contextReader{ReadCloser: r, ctx: ctx, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-cr.done:
+		}
+	}()
+
+	return cr
+}
+
+// ReaderWithContext returns r, closed when ctx is done, for a reader that
+// has no context aware variant, such as those of NewFileReaderAt
+func ReaderWithContext(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	return newContextReader(ctx, r)
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.ReadCloser.Read(b)
+	if err != nil && r.ctx.Err() != nil {
+		return n, r.ctx.Err()
+	}
+
+	return n, err
+}
+
+// Close closes the reader, unless that was done when the context ended
+func (r *contextReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	if r.ctx.Err() != nil {
+		return nil
+	}
+
+	return r.ReadCloser.Close()
+}
+
+// readTimeoutReader fails a read that gets no data within timeout, by
+// closing the reader, which aborts the read in progress
+type readTimeoutReader struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut int32
+}
+
+// newReadTimeoutReader returns r, failing reads that take longer than
+// timeout when that is set
+func newReadTimeoutReader(r io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	if timeout <= 0 {
+		return r
+	}
+
+	tr := &readTimeoutReader{ReadCloser: r, timeout: timeout}
+	tr.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&tr.timedOut, 1)
+		r.Close()
+	})
+	tr.timer.Stop()
+
+	return tr
+}
+
+func (r *readTimeoutReader) Read(b []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.ReadCloser.Read(b)
+	r.timer.Stop()
+	if err != nil && atomic.LoadInt32(&r.timedOut) == 1 {
+		return n, fmt.Errorf("no data read in %v: %w", r.timeout, context.DeadlineExceeded)
+	}
+
+	return n, err
+}
+
+// Close closes the reader, unless that was done when a read timed out
+func (r *readTimeoutReader) Close() error {
+	r.timer.Stop()
+	if atomic.LoadInt32(&r.timedOut) == 1 {
+		return nil
+	}
+
+	return r.ReadCloser.Close()
 }
 
 // Conf is a wrapper for the storage config
@@ -36,26 +245,140 @@ type Conf struct {
 	Type  string
 	S3    S3Conf
 	Posix posixConf
+	Azure AzureConf
+	GCS   GCSConf
+	SFTP  SFTPConf
+	HTTP  HTTPConf
+	Cache CacheConf
+	// ReadBufferSize is the size of the buffers the services read files
+	// through, DefaultReadBufferSize when unset
+	ReadBufferSize int
+	// SizeCacheTTL is for how long the sizes of the files are remembered,
+	// they are asked for every time when it is unset
+	SizeCacheTTL time.Duration
+	// ReadRateLimit is the most bytes per second read from the storage,
+	// by all readers together, there is no limit when it is unset
+	ReadRateLimit int64
+}
+
+// DefaultReadBufferSize is the read buffer size used when none is
+// configured, the size io.Copy uses
+const DefaultReadBufferSize = 32 * 1024
+
+// BufferSize returns the configured read buffer size, or the default
+func (c Conf) BufferSize() int {
+	if c.ReadBufferSize <= 0 {
+		return DefaultReadBufferSize
+	}
+
+	return c.ReadBufferSize
 }
 
 type posixBackend struct {
-	FileReader io.Reader
-	FileWriter io.Writer
-	Location   string
+	FileReader       io.Reader
+	FileWriter       io.Writer
+	Location         string
+	FileMode         os.FileMode
+	DirMode          os.FileMode
+	OperationTimeout time.Duration
 }
 
 type posixConf struct {
 	Location string
+	// FileMode is the permissions of the files written, set regardless of
+	// the umask. When unset files are created with 0640, less the umask.
+	FileMode os.FileMode
+	// DirMode is the permissions of the missing parent directories, which
+	// are created for the files written only when it is set
+	DirMode os.FileMode
+	// OperationTimeout is how long to wait for the size, existence or
+	// removal of a file, or a listing, e.g. when a network file system
+	// hangs. There is no limit when it is unset.
+	OperationTimeout time.Duration
 }
 
-// NewBackend initiates a storage backend
+// posixFileMode is the permissions files are created with when no file
+// mode is configured
+const posixFileMode os.FileMode = 0640
+
+// NewBackend initiates a storage backend, whose metrics are recorded, that
+// is read at no more than ReadRateLimit when it is set, caches the sizes of
+// the files for SizeCacheTTL when that is set, and the files on local disk
+// when a cache directory is configured
 func NewBackend(config Conf) (Backend, error) {
-	switch config.Type {
-	case "s3":
-		return newS3Backend(config.S3)
-	default:
-		return newPosixBackend(config.Posix)
+	backend, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.Type
+	if name == "" {
+		name = "posix"
+	}
+	backend = &metricsBackend{Backend: backend, name: name}
+	if config.ReadRateLimit > 0 {
+		backend = newRateLimitBackend(backend, config.ReadRateLimit)
+	}
+	if config.SizeCacheTTL > 0 {
+		backend = newSizeCacheBackend(backend, config.SizeCacheTTL)
 	}
+	if config.Cache.Dir == "" {
+		return backend, nil
+	}
+
+	return newCacheBackend(backend, config.Cache)
+}
+
+// BackendFactory creates a backend from the storage config, see
+// RegisterBackend
+type BackendFactory func(config Conf) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes the backends created by factory available to
+// NewBackend as the type name. The backends of this package register
+// themselves when it is loaded. It panics if name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("storage: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("storage: RegisterBackend called twice for " + name)
+	}
+	backends[name] = factory
+}
+
+// newBackend creates a backend of the configured type, posix when no type
+// is given
+func newBackend(config Conf) (Backend, error) {
+	name := config.Type
+	if name == "" {
+		name = "posix"
+	}
+
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", config.Type)
+	}
+
+	return factory(config)
+}
+
+func init() {
+	RegisterBackend("posix", func(config Conf) (Backend, error) {
+		return newPosixBackend(config.Posix)
+	})
+	RegisterBackend("s3", func(config Conf) (Backend, error) {
+		return newS3Backend(config.S3)
+	})
 }
 
 func newPosixBackend(config posixConf) (*posixBackend, error) {
@@ -69,14 +392,55 @@ func newPosixBackend(config posixConf) (*posixBackend, error) {
 		return nil, fmt.Errorf("%s is not a directory", config.Location)
 	}
 
-	return &posixBackend{Location: config.Location}, nil
+	if config.FileMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("%#o is not a valid file mode", uint32(config.FileMode))
+	}
+	if config.DirMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("%#o is not a valid directory mode", uint32(config.DirMode))
+	}
+
+	return &posixBackend{
+		Location:         config.Location,
+		FileMode:         config.FileMode,
+		DirMode:          config.DirMode,
+		OperationTimeout: config.OperationTimeout}, nil
+}
+
+// withTimeout runs op, waiting for it for at most timeout when that is set.
+// Calls to the file system can't be interrupted, an op that times out goes
+// on in the background and what it returns is dropped.
+func withTimeout(timeout time.Duration, op func() error) error {
+	if timeout <= 0 {
+		return op()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("storage operation timed out after %v: %w", timeout, context.DeadlineExceeded)
+	}
 }
 
 // NewFileReader returns an io.Reader instance
 func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return pb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the file that is closed,
+// failing further reads, when ctx is done
+func (pb *posixBackend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
 	if pb == nil {
 		return nil, fmt.Errorf("Invalid posixBackend")
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	file, err := os.Open(filepath.Join(filepath.Clean(pb.Location), filePath))
 	if err != nil {
@@ -84,7 +448,36 @@ func (pb *posixBackend) NewFileReader(filePath string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	return file, nil
+	return newContextReader(ctx, file), nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the file from
+// offset
+func (pb *posixBackend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if pb == nil {
+		return nil, fmt.Errorf("Invalid posixBackend")
+	}
+
+	file, err := os.Open(filepath.Join(filepath.Clean(pb.Location), filePath))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err == nil {
+		err = checkRange(filePath, stat.Size(), offset, length)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		log.Error(err)
+		return nil, err
+	}
+
+	return rangeReader{io.LimitReader(file, length), file}, nil
 }
 
 // NewFileWriter returns an io.Writer instance
@@ -93,169 +486,1111 @@ func (pb *posixBackend) NewFileWriter(filePath string) (io.WriteCloser, error) {
 		return nil, fmt.Errorf("Invalid posixBackend")
 	}
 
-	file, err := os.OpenFile(filepath.Join(filepath.Clean(pb.Location), filePath), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0640)
+	name := filepath.Join(filepath.Clean(pb.Location), filePath)
+	if pb.DirMode != 0 {
+		if err := pb.mkdirAll(filepath.Dir(name)); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	mode := pb.FileMode
+	if mode == 0 {
+		mode = posixFileMode
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, mode)
 	if err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
+	// the mode given when creating is masked by the umask, and an existing
+	// file keeps its mode
+	if pb.FileMode != 0 {
+		if err := file.Chmod(pb.FileMode); err != nil {
+			file.Close()
+			log.Error(err)
+			return nil, err
+		}
+	}
+
 	return file, nil
 }
 
+// mkdirAll creates dir and its missing parents with the directory mode
+func (pb *posixBackend) mkdirAll(dir string) error {
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := pb.mkdirAll(filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	err := os.Mkdir(dir, pb.DirMode)
+	if errors.Is(err, fs.ErrExist) {
+		// created by another writer in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(dir, pb.DirMode)
+}
+
 // GetFileSize returns the size of the file
 func (pb *posixBackend) GetFileSize(filePath string) (int64, error) {
 	if pb == nil {
 		return 0, fmt.Errorf("Invalid posixBackend")
 	}
 
-	stat, err := os.Stat(filepath.Join(filepath.Clean(pb.Location), filePath))
+	var size int64
+	err := withTimeout(pb.OperationTimeout, func() error {
+		stat, err := os.Stat(filepath.Join(filepath.Clean(pb.Location), filePath))
+		if err == nil {
+			size = stat.Size()
+		}
+
+		return err
+	})
 	if err != nil {
 		log.Error(err)
 		return 0, err
 	}
 
-	return stat.Size(), nil
+	return size, nil
 }
 
-// RemoveFile removes a file from a give path
-func (pb *posixBackend) RemoveFile(filePath string) error {
+// Exists tells whether the file exists, an error is only returned when
+// that can't be told
+func (pb *posixBackend) Exists(filePath string) (bool, error) {
 	if pb == nil {
-		return fmt.Errorf("Invalid posixBackend")
+		return false, fmt.Errorf("Invalid posixBackend")
 	}
 
-	err := os.Remove(filepath.Join(filepath.Clean(pb.Location), filePath))
+	var isDir bool
+	err := withTimeout(pb.OperationTimeout, func() error {
+		stat, err := os.Stat(filepath.Join(filepath.Clean(pb.Location), filePath))
+		if err == nil {
+			isDir = stat.IsDir()
+		}
+
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
 	if err != nil {
 		log.Error(err)
-		return err
+		return false, err
 	}
 
-	return nil
-}
-
-type s3Backend struct {
-	Client   *s3.S3
-	Uploader *s3manager.Uploader
-	Bucket   string
-	Conf     *S3Conf
+	return !isDir, nil
 }
 
-// S3Conf stores information about the S3 storage backend
-type S3Conf struct {
-	URL               string
-	Port              int
-	AccessKey         string
-	SecretKey         string
-	Bucket            string
-	Region            string
-	UploadConcurrency int
-	Chunksize         int
-	Cacert            string
-	NonExistRetryTime time.Duration
-}
+// GetObjectMetadata returns the size and modification time of the file
+func (pb *posixBackend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if pb == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid posixBackend")
+	}
 
-func newS3Backend(config S3Conf) (*s3Backend, error) {
-	s3Transport := transportConfigS3(config)
-	client := http.Client{Transport: s3Transport}
-	s3Session := session.Must(session.NewSession(
-		&aws.Config{
-			Endpoint:         aws.String(fmt.Sprintf("%s:%d", config.URL, config.Port)),
-			Region:           aws.String(config.Region),
-			HTTPClient:       &client,
-			S3ForcePathStyle: aws.Bool(true),
-			DisableSSL:       aws.Bool(strings.HasPrefix(config.URL, "http:")),
-			Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
-		},
-	))
+	var metadata ObjectMetadata
+	err := withTimeout(pb.OperationTimeout, func() error {
+		stat, err := os.Stat(filepath.Join(filepath.Clean(pb.Location), filePath))
+		if err == nil {
+			metadata = ObjectMetadata{Size: stat.Size(), LastModified: stat.ModTime()}
+		}
 
-	// Attempt to create a bucket, but we really expect an error here
-	// (BucketAlreadyOwnedByYou)
-	_, err := s3.New(s3Session).CreateBucket(&s3.CreateBucketInput{
-		Bucket: aws.String(config.Bucket),
+		return err
 	})
-
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-
-			if aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou &&
-				aerr.Code() != s3.ErrCodeBucketAlreadyExists {
-				log.Error("Unexpected issue while creating bucket", err)
-			}
-		}
+		log.Error(err)
+		return ObjectMetadata{}, err
 	}
 
-	sb := &s3Backend{
-		Bucket: config.Bucket,
-		Uploader: s3manager.NewUploader(s3Session, func(u *s3manager.Uploader) {
-			u.PartSize = int64(config.Chunksize)
-			u.Concurrency = config.UploadConcurrency
-			u.LeavePartsOnError = false
-		}),
-		Client: s3.New(s3Session),
-		Conf:   &config}
+	return metadata, nil
+}
 
-	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
+// RemoveFile removes a file from a give path
+func (pb *posixBackend) RemoveFile(filePath string) error {
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
+	}
 
+	err := withTimeout(pb.OperationTimeout, func() error {
+		return os.Remove(filepath.Join(filepath.Clean(pb.Location), filePath))
+	})
 	if err != nil {
-		return nil, err
+		log.Error(err)
+		return err
 	}
 
-	return sb, nil
+	return nil
 }
 
-// NewFileReader returns an io.Reader instance
-func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
-	if sb == nil {
-		return nil, fmt.Errorf("Invalid s3Backend")
+// Delete removes the file, a file that is already gone is not an error
+func (pb *posixBackend) Delete(filePath string) error {
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
 	}
 
-	r, err := sb.Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(sb.Bucket),
-		Key:    aws.String(filePath),
+	err := withTimeout(pb.OperationTimeout, func() error {
+		return os.Remove(filepath.Join(filepath.Clean(pb.Location), filePath))
 	})
-
-	retryTime := 2 * time.Minute
-	if sb.Conf != nil {
-		retryTime = sb.Conf.NonExistRetryTime
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error(err)
+		return err
 	}
 
-	start := time.Now()
-	for err != nil && time.Since(start) < retryTime {
-		r, err = sb.Client.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(sb.Bucket),
-			Key:    aws.String(filePath),
-		})
-		time.Sleep(1 * time.Second)
+	return nil
+}
+
+// HealthCheck returns an error unless the location is a directory
+func (pb *posixBackend) HealthCheck(ctx context.Context) error {
+	if pb == nil {
+		return fmt.Errorf("Invalid posixBackend")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
+	fileInfo, err := os.Stat(pb.Location)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return err
+	}
+	if !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", pb.Location)
 	}
 
-	return r.Body, nil
+	return nil
+}
+
+// PresignGet returns ErrUnsupported, files on a file system can't be
+// downloaded without the services
+func (pb *posixBackend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	return "", ErrUnsupported
 }
 
-// NewFileWriter uploads the contents of an io.Reader to a S3 bucket
-func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
-	if sb == nil {
-		return nil, fmt.Errorf("Invalid s3Backend")
+// List returns the files below the location whose paths, relative to it,
+// start with prefix
+func (pb *posixBackend) List(prefix string) ([]ObjectInfo, error) {
+	if pb == nil {
+		return nil, fmt.Errorf("Invalid posixBackend")
 	}
 
-	reader, writer := io.Pipe()
-	go func() {
+	location := filepath.Clean(pb.Location)
+	prefix = strings.TrimPrefix(filepath.ToSlash(prefix), "/")
+	// only the directory of the prefix needs to be walked
+	root := filepath.Join(location, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
 
-		_, err := sb.Uploader.Upload(&s3manager.UploadInput{
-			Body:            reader,
-			Bucket:          aws.String(sb.Bucket),
-			Key:             aws.String(filePath),
-			ContentEncoding: aws.String("application/octet-stream"),
+	objects := []ObjectInfo{}
+	err := withTimeout(pb.OperationTimeout, func() error {
+		return filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if name == root && errors.Is(err, fs.ErrNotExist) {
+					return filepath.SkipDir
+				}
+
+				return err
+			}
+			if name == root {
+				return nil
+			}
+
+			rel, err := filepath.Rel(location, name)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			switch {
+			case entry.IsDir():
+				if !strings.HasPrefix(rel+"/", prefix) {
+					return filepath.SkipDir
+				}
+			case entry.Type().IsRegular() && strings.HasPrefix(rel, prefix):
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				objects = append(objects, ObjectInfo{Path: rel, Size: info.Size(), LastModified: info.ModTime()})
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+type s3Backend struct {
+	Client *s3.S3
+	Bucket string
+	Conf   *S3Conf
+
+	// sseAlgorithm and sseKey are sent with the requests for objects when
+	// they are encrypted with a customer key (SSE-C), nil otherwise
+	sseAlgorithm *string
+	sseKey       *string
+}
+
+// S3Conf stores information about the S3 storage backend
+type S3Conf struct {
+	URL               string
+	Port              int
+	AccessKey         string `redact:"true"`
+	SecretKey         string `redact:"true"`
+	Bucket            string
+	Region            string
+	UploadConcurrency int
+	Chunksize         int
+	Cacert            string
+	// MaxAttempts is how many times a read is attempted when S3 fails
+	// with a transient error, such as a 503 SlowDown
+	MaxAttempts int
+	// SSECKey is the base64 encoded 256 bit key the objects are encrypted
+	// with by S3 (SSE-C), which requires https
+	SSECKey string `redact:"true"`
+	// MaxIdleConns is how many connections to S3 are kept open for reuse
+	// while idle, and IdleConnTimeout for how long
+	MaxIdleConns    int
+	IdleConnTimeout time.Duration
+	// DownloadConcurrency is how many ranges of DownloadChunksize bytes
+	// of an object are fetched at a time when it is read, objects are
+	// read as one stream unless it is more than one
+	DownloadConcurrency int
+	DownloadChunksize   int
+	// ForcePathStyle addresses the bucket in the path of the URLs, as
+	// MinIO and most other S3 compatible stores need, rather than in the
+	// host name (virtual-hosted style)
+	ForcePathStyle bool
+	// AssumeRoleARN is a role assumed with the credentials, which are the
+	// static keys when set and otherwise those of the default AWS chain
+	// (environment, web identity, container or instance role)
+	AssumeRoleARN string
+	// ConnectTimeout is how long connecting to S3 may take, ReadTimeout
+	// how long to wait for a response or the next data of an object, and
+	// OperationTimeout how long a request may take, retries included,
+	// other than reading an object as a stream. Unset ones don't limit.
+	ConnectTimeout   time.Duration
+	ReadTimeout      time.Duration
+	OperationTimeout time.Duration
+	// RestoreTier is the retrieval tier (Expedited, Standard or Bulk) that
+	// objects in Glacier are restored with when they are read, they are
+	// not restored when it is unset. The restored copies are kept for
+	// RestoreDays days (default 1). Reads wait up to RestoreWait for the
+	// restore, and fail with ErrRestoreInProgress when it is not done.
+	RestoreTier string
+	RestoreDays int
+	RestoreWait time.Duration
+}
+
+// s3MaxPresignTTL is the longest time presigned URLs are valid for
+const s3MaxPresignTTL = 7 * 24 * time.Hour
+
+// s3RetryBackoff is the wait before the first retry of a read that failed
+// with a transient error, doubled for each attempt up to s3RetryMaxBackoff
+var (
+	s3RetryBackoff    = 500 * time.Millisecond
+	s3RetryMaxBackoff = 30 * time.Second
+)
+
+// s3RestorePollInterval is how often an object being restored is checked
+// while waiting for it
+var s3RestorePollInterval = 30 * time.Second
+
+// s3STSEndpoint is where roles are assumed, the regional AWS STS endpoint
+// when empty
+var s3STSEndpoint = ""
+
+// s3MaxAttempts is the default of S3Conf.MaxAttempts
+const s3MaxAttempts = 5
+
+// s3DownloadChunkSize is the default of S3Conf.DownloadChunksize
+const s3DownloadChunkSize = 16 * 1024 * 1024
+
+func newS3Backend(config S3Conf) (*s3Backend, error) {
+	// All parts but the last must be at least 5 MiB
+	if config.Chunksize == 0 {
+		config.Chunksize = int(s3manager.MinUploadPartSize)
+	}
+	if config.Chunksize < int(s3manager.MinUploadPartSize) {
+		return nil, fmt.Errorf("the s3 chunk size must be at least 5 MiB")
+	}
+	if config.UploadConcurrency <= 0 {
+		config.UploadConcurrency = s3manager.DefaultUploadConcurrency
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = s3MaxAttempts
+	}
+	if config.DownloadChunksize <= 0 {
+		config.DownloadChunksize = s3DownloadChunkSize
+	}
+	if config.RestoreTier != "" {
+		tier := config.RestoreTier
+		config.RestoreTier = ""
+		for _, valid := range s3.Tier_Values() {
+			if strings.EqualFold(tier, valid) {
+				config.RestoreTier = valid
+			}
+		}
+		if config.RestoreTier == "" {
+			return nil, fmt.Errorf("%q is not a restore tier, use one of %s", tier, strings.Join(s3.Tier_Values(), ", "))
+		}
+	}
+	if config.RestoreDays <= 0 {
+		config.RestoreDays = 1
+	}
+
+	var sseAlgorithm, sseKey *string
+	if config.SSECKey != "" {
+		key, err := base64.StdEncoding.DecodeString(config.SSECKey)
+		if err != nil {
+			return nil, fmt.Errorf("the s3 SSE-C key is not valid base64")
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("the s3 SSE-C key must be 32 bytes, got %d", len(key))
+		}
+		sseAlgorithm, sseKey = aws.String("AES256"), aws.String(string(key))
+	}
+
+	// All requests share the connections of one client, the workers of a
+	// service reading many files at once shouldn't have to reconnect
+	s3Transport := transportConfig(config.Cacert)
+	if config.MaxIdleConns > 0 {
+		s3Transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.IdleConnTimeout > 0 {
+		s3Transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	s3Transport.MaxIdleConnsPerHost = s3Transport.MaxIdleConns
+	if config.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+		s3Transport.DialContext = dialer.DialContext
+		s3Transport.TLSHandshakeTimeout = config.ConnectTimeout
+	}
+	if config.ReadTimeout > 0 {
+		s3Transport.ResponseHeaderTimeout = config.ReadTimeout
+	}
+	client := http.Client{Transport: s3Transport}
+	creds, err := s3Credentials(config, &client)
+	if err != nil {
+		return nil, err
+	}
+	s3Session := session.Must(session.NewSession(
+		&aws.Config{
+			Endpoint:         aws.String(fmt.Sprintf("%s:%d", config.URL, config.Port)),
+			Region:           aws.String(config.Region),
+			HTTPClient:       &client,
+			S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+			DisableSSL:       aws.Bool(strings.HasPrefix(config.URL, "http:")),
+			Credentials:      creds,
+			// Reads are retried by the backend, see retry
+			MaxRetries: aws.Int(0),
+		},
+	))
+
+	// Attempt to create a bucket, but we really expect an error here
+	// (BucketAlreadyOwnedByYou)
+	s3Client := s3.New(s3Session)
+	_, err = s3Client.CreateBucket(&s3.CreateBucketInput{
+		Bucket: aws.String(config.Bucket),
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+
+			if aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou &&
+				aerr.Code() != s3.ErrCodeBucketAlreadyExists {
+				log.Error("Unexpected issue while creating bucket", err)
+			}
+		}
+	}
+
+	sb := &s3Backend{
+		Bucket:       config.Bucket,
+		Client:       s3Client,
+		Conf:         &config,
+		sseAlgorithm: sseAlgorithm,
+		sseKey:       sseKey}
+
+	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sb, nil
+}
+
+// s3Credentials returns the credentials requests to S3 are signed with, the
+// static keys when configured and otherwise nil, for the session to use the
+// default AWS chain. A role to assume is assumed with these.
+func s3Credentials(config S3Conf, client *http.Client) (*credentials.Credentials, error) {
+	var creds *credentials.Credentials
+	switch {
+	case config.AccessKey != "" && config.SecretKey != "":
+		creds = credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, "")
+	case config.AccessKey != "" || config.SecretKey != "":
+		return nil, fmt.Errorf("the s3 access key and secret key must be set together")
+	}
+
+	if config.AssumeRoleARN == "" {
+		return creds, nil
+	}
+
+	// The role is assumed at STS, not at the endpoint of the bucket,
+	// which needn't be AWS
+	stsConfig := &aws.Config{
+		Region:      aws.String(config.Region),
+		HTTPClient:  client,
+		Credentials: creds,
+	}
+	if s3STSEndpoint != "" {
+		stsConfig.Endpoint = aws.String(s3STSEndpoint)
+	}
+	stsSession, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up assuming the s3 role: %v", err)
+	}
+
+	return stscreds.NewCredentials(stsSession, config.AssumeRoleARN), nil
+}
+
+// operationContext returns a context for an operation, ended after
+// OperationTimeout when that is set
+func (sb *s3Backend) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sb.Conf == nil || sb.Conf.OperationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, sb.Conf.OperationTimeout)
+}
+
+// readTimeout returns the ReadTimeout of the backend, if any
+func (sb *s3Backend) readTimeout() time.Duration {
+	if sb.Conf == nil {
+		return 0
+	}
+
+	return sb.Conf.ReadTimeout
+}
+
+// retry runs op until it succeeds, fails with an error that is not
+// transient or has been attempted MaxAttempts times
+func (sb *s3Backend) retry(op func() error) error {
+	attempts := s3MaxAttempts
+	if sb.Conf != nil {
+		attempts = sb.Conf.MaxAttempts
+	}
+
+	backoff := s3RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= attempts || !isTransientS3Error(err) {
+			return err
+		}
+
+		log.Warnf("S3 request failed, retrying in %v (attempt %d of %d): %v", backoff, attempt, attempts, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > s3RetryMaxBackoff {
+			backoff = s3RetryMaxBackoff
+		}
+	}
+}
+
+// isTransientS3Error tells whether a request that failed with err may
+// succeed if retried: server errors, throttling and requests that got no
+// response, e.g. when the connection was reset. Errors such as 404 and 403
+// are permanent.
+func isTransientS3Error(err error) bool {
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) {
+		return failure.StatusCode() >= 500 || failure.StatusCode() == http.StatusTooManyRequests
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout",
+			request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewFileReader returns an io.Reader instance
+func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
+	return sb.NewFileReaderContext(context.Background(), filePath)
+}
+
+// NewFileReaderContext returns an io.Reader for the object, the requests
+// for which are aborted, failing further reads, when ctx is done
+func (sb *s3Backend) NewFileReaderContext(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	if sb.Conf != nil && sb.Conf.DownloadConcurrency > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		size, err := sb.GetFileSize(filePath)
+		if err != nil {
+			return nil, err
+		}
+		if size > int64(sb.Conf.DownloadChunksize) {
+			// the ranges are only read once the object can be
+			if sb.Conf.RestoreTier != "" {
+				if err := sb.restore(ctx, filePath); err != nil {
+					return nil, err
+				}
+			}
+
+			return newContextReader(ctx, sb.newParallelReader(ctx, filePath, size)), nil
+		}
+	}
+
+	r, err := sb.getObject(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(sb.Bucket),
+		Key:                  aws.String(filePath),
+		SSECustomerAlgorithm: sb.sseAlgorithm,
+		SSECustomerKey:       sb.sseKey,
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return newContextReader(ctx, newReadTimeoutReader(r.Body, sb.readTimeout())), nil
+}
+
+// NewFileReaderAt returns an io.Reader for length bytes of the object from
+// offset
+func (sb *s3Backend) NewFileReaderAt(filePath string, offset, length int64) (io.ReadCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	size, err := sb.GetFileSize(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRange(filePath, size, offset, length); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	r, err := sb.getObject(context.Background(), &s3.GetObjectInput{
+		Bucket:               aws.String(sb.Bucket),
+		Key:                  aws.String(filePath),
+		Range:                aws.String(httpRange(offset, length)),
+		SSECustomerAlgorithm: sb.sseAlgorithm,
+		SSECustomerKey:       sb.sseKey,
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return newReadTimeoutReader(r.Body, sb.readTimeout()), nil
+}
+
+// getObject gets the object, restoring it first when it is in Glacier and
+// a restore tier is configured
+func (sb *s3Backend) getObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	var r *s3.GetObjectOutput
+	get := func() error {
+		return sb.retry(func() (err error) {
+			r, err = sb.Client.GetObjectWithContext(ctx, input)
+
+			return err
+		})
+	}
+
+	err := get()
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeInvalidObjectState &&
+		sb.Conf != nil && sb.Conf.RestoreTier != "" {
+		if err = sb.restore(ctx, aws.StringValue(input.Key)); err == nil {
+			err = get()
+		}
+	}
+
+	return r, err
+}
+
+// restore makes sure that the object can be read. An object in Glacier is
+// restored, unless it is or is being restored already, and waited for up
+// to RestoreWait. ErrRestoreInProgress is returned when it is not done by
+// then.
+func (sb *s3Backend) restore(ctx context.Context, filePath string) error {
+	head, err := sb.headObject(ctx, filePath)
+	if err != nil {
+		return err
+	}
+
+	archived := aws.StringValue(head.StorageClass) == s3.StorageClassGlacier ||
+		aws.StringValue(head.StorageClass) == s3.StorageClassDeepArchive ||
+		aws.StringValue(head.ArchiveStatus) != ""
+	if !archived || s3Restored(head) {
+		return nil
+	}
+
+	if !strings.Contains(aws.StringValue(head.Restore), `ongoing-request="true"`) {
+		request := &s3.RestoreRequest{GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(sb.Conf.RestoreTier)}}
+		// the archive tiers of Intelligent-Tiering restore to the
+		// frequent access tier, for good
+		if aws.StringValue(head.ArchiveStatus) == "" {
+			request.Days = aws.Int64(int64(sb.Conf.RestoreDays))
+		}
+		_, err := sb.Client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+			Bucket:         aws.String(sb.Bucket),
+			Key:            aws.String(filePath),
+			RestoreRequest: request})
+		var aerr awserr.Error
+		if err != nil && !(errors.As(err, &aerr) && aerr.Code() == "RestoreAlreadyInProgress") {
+			log.Errorf("failed to restore %s: %v", filePath, err)
+
+			return err
+		}
+		log.Infof("Restoring %s from %s with the %s tier", filePath, aws.StringValue(head.StorageClass), sb.Conf.RestoreTier)
+	}
+
+	deadline := time.Now().Add(sb.Conf.RestoreWait)
+	for time.Now().Before(deadline) {
+		timer := time.NewTimer(s3RestorePollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		}
+
+		head, err := sb.headObject(ctx, filePath)
+		if err != nil {
+			return err
+		}
+		if s3Restored(head) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", filePath, ErrRestoreInProgress)
+}
+
+// headObject returns the headers of the object
+func (sb *s3Backend) headObject(ctx context.Context, filePath string) (*s3.HeadObjectOutput, error) {
+	ctx, cancel := sb.operationContext(ctx)
+	defer cancel()
+
+	var head *s3.HeadObjectOutput
+	err := sb.retry(func() (err error) {
+		head, err = sb.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(sb.Bucket),
+			Key:                  aws.String(filePath),
+			SSECustomerAlgorithm: sb.sseAlgorithm,
+			SSECustomerKey:       sb.sseKey})
+
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+
+		return nil, err
+	}
+
+	return head, nil
+}
+
+// s3Restored tells whether an archived object has been restored, which for
+// Intelligent-Tiering is when it is no longer archived
+func s3Restored(head *s3.HeadObjectOutput) bool {
+	if aws.StringValue(head.StorageClass) == s3.StorageClassIntelligentTiering {
+		return aws.StringValue(head.ArchiveStatus) == ""
+	}
+
+	return strings.Contains(aws.StringValue(head.Restore), `ongoing-request="false"`)
+}
+
+// getRange returns length bytes of the object from offset
+func (sb *s3Backend) getRange(ctx context.Context, filePath string, offset, length int64) ([]byte, error) {
+	ctx, cancel := sb.operationContext(ctx)
+	defer cancel()
+
+	var data []byte
+	err := sb.retry(func() error {
+		r, err := sb.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:               aws.String(sb.Bucket),
+			Key:                  aws.String(filePath),
+			Range:                aws.String(httpRange(offset, length)),
+			SSECustomerAlgorithm: sb.sseAlgorithm,
+			SSECustomerKey:       sb.sseKey,
 		})
+		if err != nil {
+			return err
+		}
+		body := newReadTimeoutReader(r.Body, sb.readTimeout())
+		defer body.Close()
+
+		// a lost connection is retried like a failed request
+		if data, err = io.ReadAll(body); err != nil {
+			return awserr.New(request.ErrCodeRequestError, "failed to read "+filePath, err)
+		}
+
+		return nil
+	})
+	if err == nil && int64(len(data)) != length {
+		err = fmt.Errorf("got %d bytes at %d of %s, expected %d", len(data), offset, filePath, length)
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// s3Chunk is a range of an object fetched for an s3ParallelReader
+type s3Chunk struct {
+	data []byte
+	err  error
+}
+
+// s3ParallelReader reads an object in chunks of DownloadChunksize bytes,
+// fetched by up to DownloadConcurrency range requests at a time and read
+// in order
+type s3ParallelReader struct {
+	// chunks has the chunks in the order of the object, each chunk is
+	// received once it has been fetched
+	chunks  chan chan s3Chunk
+	current []byte
+	err     error
+	done    chan struct{}
+	once    sync.Once
+	// stopped is the error of the context when it ended before all chunks
+	// were queued, set before chunks is closed
+	stopped error
+}
+
+// newParallelReader starts fetching the chunks of the object of size
+// bytes, until ctx is done
+func (sb *s3Backend) newParallelReader(ctx context.Context, filePath string, size int64) *s3ParallelReader {
+	r := &s3ParallelReader{
+		chunks: make(chan chan s3Chunk, sb.Conf.DownloadConcurrency-1),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.chunks)
+
+		chunkSize := int64(sb.Conf.DownloadChunksize)
+		for offset := int64(0); offset < size; offset += chunkSize {
+			length := chunkSize
+			if size-offset < length {
+				length = size - offset
+			}
+
+			// the chunk waiting to be read and those queued are being
+			// fetched
+			chunk := make(chan s3Chunk, 1)
+			select {
+			case r.chunks <- chunk:
+			case <-r.done:
+				return
+			case <-ctx.Done():
+				r.stopped = ctx.Err()
+
+				return
+			}
+			go func(offset, length int64) {
+				data, err := sb.getRange(ctx, filePath, offset, length)
+				chunk <- s3Chunk{data, err}
+			}(offset, length)
+		}
+	}()
+
+	return r
+}
+
+func (r *s3ParallelReader) Read(b []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		chunk, ok := <-r.chunks
+		if !ok {
+			if r.err = r.stopped; r.err == nil {
+				r.err = io.EOF
+			}
+
+			continue
+		}
+		fetched := <-chunk
+		r.current, r.err = fetched.data, fetched.err
+	}
+
+	n := copy(b, r.current)
+	r.current = r.current[n:]
+
+	return n, nil
+}
+
+// Close stops fetching chunks
+func (r *s3ParallelReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+
+	return nil
+}
+
+// NewFileWriter returns a writer that uploads what is written to it to a
+// S3 bucket, in parts of Chunksize bytes as they fill up. The upload is
+// complete when Close returns without error, and the parts are removed when
+// an upload fails or is ended with CloseWithError.
+func (sb *s3Backend) NewFileWriter(filePath string) (io.WriteCloser, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	return &s3Writer{
+		sb:      sb,
+		key:     filePath,
+		running: make(chan struct{}, sb.Conf.UploadConcurrency),
+	}, nil
+}
+
+// s3Writer uploads a file in parts with the multipart upload API, up to
+// UploadConcurrency parts at a time. Files smaller than one part are
+// uploaded with a single PutObject.
+type s3Writer struct {
+	sb       *s3Backend
+	key      string
+	buf      []byte
+	uploadID *string
+	partSize int
+	closed   bool
 
+	running chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	parts   []*s3.CompletedPart
+	err     error
+}
+
+// s3PartSize returns the size of the given part, the base size doubled
+// every thousand parts so that the 10000 parts allowed hold files up to
+// the 5 TB limit of S3 even with the smallest base size
+func s3PartSize(base int, part int) int {
+	return base << ((part - 1) / 1000)
+}
+
+// failed returns the error of the upload, if any
+func (w *s3Writer) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// fail records the first error of the upload
+func (w *s3Writer) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return written, err
+		}
+
+		if w.buf == nil {
+			w.partSize = s3PartSize(w.sb.Conf.Chunksize, len(w.parts)+1)
+			w.buf = make([]byte, 0, w.partSize)
+		}
+		n := w.partSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == w.partSize {
+			w.uploadPart()
+		}
+	}
+
+	return written, nil
+}
+
+// uploadPart starts uploading the buffered data as the next part, after
+// starting the multipart upload for the first part
+func (w *s3Writer) uploadPart() {
+	if w.uploadID == nil {
+		ctx, cancel := w.sb.operationContext(context.Background())
+		upload, err := w.sb.Client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(w.sb.Bucket),
+			Key:                  aws.String(w.key),
+			ContentEncoding:      aws.String("application/octet-stream"),
+			SSECustomerAlgorithm: w.sb.sseAlgorithm,
+			SSECustomerKey:       w.sb.sseKey,
+		})
+		cancel()
 		if err != nil {
-			_ = reader.CloseWithError(err)
+			w.fail(fmt.Errorf("failed to start upload of %s: %v", w.key, err))
+
+			return
 		}
+		w.uploadID = upload.UploadId
+	}
+
+	if len(w.parts) == s3manager.MaxUploadParts {
+		w.fail(fmt.Errorf("too many parts for %s", w.key))
+
+		return
+	}
+
+	part := &s3.CompletedPart{PartNumber: aws.Int64(int64(len(w.parts) + 1))}
+	w.parts = append(w.parts, part)
+	body := w.buf
+	w.buf = nil
+
+	w.running <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.running
+			w.wg.Done()
+		}()
+
+		ctx, cancel := w.sb.operationContext(context.Background())
+		defer cancel()
+		result, err := w.sb.Client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:               aws.String(w.sb.Bucket),
+			Key:                  aws.String(w.key),
+			UploadId:             w.uploadID,
+			PartNumber:           part.PartNumber,
+			Body:                 bytes.NewReader(body),
+			SSECustomerAlgorithm: w.sb.sseAlgorithm,
+			SSECustomerKey:       w.sb.sseKey,
+		})
+		if err != nil {
+			w.fail(fmt.Errorf("failed to upload part %d of %s: %v", *part.PartNumber, w.key, err))
+
+			return
+		}
+		part.ETag = result.ETag
 	}()
-	return writer, nil
+}
+
+// abort removes the parts uploaded so far
+func (w *s3Writer) abort() {
+	if w.uploadID == nil {
+		return
+	}
+
+	ctx, cancel := w.sb.operationContext(context.Background())
+	defer cancel()
+	_, err := w.sb.Client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.sb.Bucket),
+		Key:      aws.String(w.key),
+		UploadId: w.uploadID,
+	})
+	if err != nil {
+		log.Errorf("failed to abort upload of %s: %v", w.key, err)
+	}
+}
+
+// Close uploads what remains and completes the upload
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.failed()
+	}
+	w.closed = true
+
+	if w.uploadID == nil && w.failed() == nil {
+		ctx, cancel := w.sb.operationContext(context.Background())
+		defer cancel()
+		_, err := w.sb.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(w.sb.Bucket),
+			Key:                  aws.String(w.key),
+			ContentEncoding:      aws.String("application/octet-stream"),
+			Body:                 bytes.NewReader(w.buf),
+			SSECustomerAlgorithm: w.sb.sseAlgorithm,
+			SSECustomerKey:       w.sb.sseKey,
+		})
+		if err != nil {
+			w.fail(fmt.Errorf("failed to upload %s: %v", w.key, err))
+		}
+
+		return w.failed()
+	}
+
+	if len(w.buf) > 0 && w.failed() == nil {
+		w.uploadPart()
+	}
+	w.wg.Wait()
+
+	if err := w.failed(); err != nil {
+		log.Error(err)
+		w.abort()
+
+		return err
+	}
+
+	ctx, cancel := w.sb.operationContext(context.Background())
+	defer cancel()
+	_, err := w.sb.Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               aws.String(w.sb.Bucket),
+		Key:                  aws.String(w.key),
+		UploadId:             w.uploadID,
+		MultipartUpload:      &s3.CompletedMultipartUpload{Parts: w.parts},
+		SSECustomerAlgorithm: w.sb.sseAlgorithm,
+		SSECustomerKey:       w.sb.sseKey,
+	})
+	if err != nil {
+		w.fail(fmt.Errorf("failed to complete upload of %s: %v", w.key, err))
+		log.Error(w.failed())
+		w.abort()
+	}
+
+	return w.failed()
+}
+
+// CloseWithError ends the upload without completing it, removing the
+// parts uploaded so far, e.g. when reading the source of the file failed
+func (w *s3Writer) CloseWithError(err error) error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.fail(err)
+	w.wg.Wait()
+	w.abort()
+
+	return nil
 }
 
 // GetFileSize returns the size of a specific object
@@ -264,34 +1599,76 @@ func (sb *s3Backend) GetFileSize(filePath string) (int64, error) {
 		return 0, fmt.Errorf("Invalid s3Backend")
 	}
 
-	r, err := sb.Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(sb.Bucket),
-		Key:    aws.String(filePath)})
+	ctx, cancel := sb.operationContext(context.Background())
+	defer cancel()
 
-	start := time.Now()
+	var r *s3.HeadObjectOutput
+	err := sb.retry(func() (err error) {
+		r, err = sb.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(sb.Bucket),
+			Key:                  aws.String(filePath),
+			SSECustomerAlgorithm: sb.sseAlgorithm,
+			SSECustomerKey:       sb.sseKey})
 
-	retryTime := 2 * time.Minute
-	if sb.Conf != nil {
-		retryTime = sb.Conf.NonExistRetryTime
+		return err
+	})
+	if err != nil {
+		log.Errorln(err)
+		return 0, err
 	}
 
-	// Retry on error up to five minutes to allow for
-	// "slow writes' or s3 eventual consistency
-	for err != nil && time.Since(start) < retryTime {
-		r, err = sb.Client.HeadObject(&s3.HeadObjectInput{
-			Bucket: aws.String(sb.Bucket),
-			Key:    aws.String(filePath)})
+	return *r.ContentLength, nil
+}
 
-		time.Sleep(1 * time.Second)
+// Exists tells whether the object exists, an error is only returned when
+// that can't be told
+func (sb *s3Backend) Exists(filePath string) (bool, error) {
+	if sb == nil {
+		return false, fmt.Errorf("Invalid s3Backend")
+	}
+
+	ctx, cancel := sb.operationContext(context.Background())
+	defer cancel()
+
+	err := sb.retry(func() error {
+		_, err := sb.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(sb.Bucket),
+			Key:                  aws.String(filePath),
+			SSECustomerAlgorithm: sb.sseAlgorithm,
+			SSECustomerKey:       sb.sseKey})
+
+		return err
+	})
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
 
+	return true, nil
+}
+
+// GetObjectMetadata returns the metadata of the object that a HEAD request
+// gives
+func (sb *s3Backend) GetObjectMetadata(filePath string) (ObjectMetadata, error) {
+	if sb == nil {
+		return ObjectMetadata{}, fmt.Errorf("Invalid s3Backend")
 	}
 
+	r, err := sb.headObject(context.Background(), filePath)
 	if err != nil {
-		log.Errorln(err)
-		return 0, err
+		return ObjectMetadata{}, err
 	}
 
-	return *r.ContentLength, nil
+	return ObjectMetadata{
+		Size:         aws.Int64Value(r.ContentLength),
+		ETag:         unquoteETag(aws.StringValue(r.ETag)),
+		ContentType:  aws.StringValue(r.ContentType),
+		LastModified: aws.TimeValue(r.LastModified),
+		Metadata:     aws.StringValueMap(r.Metadata)}, nil
 }
 
 // RemoveFile removes an object from a bucket
@@ -300,7 +1677,10 @@ func (sb *s3Backend) RemoveFile(filePath string) error {
 		return fmt.Errorf("Invalid s3Backend")
 	}
 
-	_, err := sb.Client.DeleteObject(&s3.DeleteObjectInput{
+	ctx, cancel := sb.operationContext(context.Background())
+	defer cancel()
+
+	_, err := sb.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(sb.Bucket),
 		Key:    aws.String(filePath)})
 	if err != nil {
@@ -308,18 +1688,149 @@ func (sb *s3Backend) RemoveFile(filePath string) error {
 		return err
 	}
 
-	err = sb.Client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+	err = sb.Client.WaitUntilObjectNotExistsWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(sb.Bucket),
+		Key:                  aws.String(filePath),
+		SSECustomerAlgorithm: sb.sseAlgorithm,
+		SSECustomerKey:       sb.sseKey})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes an object from a bucket, an object that is already gone
+// is not an error
+func (sb *s3Backend) Delete(filePath string) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	ctx, cancel := sb.operationContext(context.Background())
+	defer cancel()
+
+	err := sb.retry(func() error {
+		_, err := sb.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(filePath)})
+
+		return err
+	})
+	// S3 itself does not fail on missing objects, but other stores may
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// HealthCheck returns an error unless the bucket can be reached
+func (sb *s3Backend) HealthCheck(ctx context.Context) error {
+	if sb == nil {
+		return fmt.Errorf("Invalid s3Backend")
+	}
+
+	ctx, cancel := sb.operationContext(ctx)
+	defer cancel()
+
+	_, err := sb.Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(sb.Bucket)})
+
+	return err
+}
+
+// PresignGet returns a URL to download the object from S3 without
+// credentials, valid for ttl of at most seven days
+func (sb *s3Backend) PresignGet(filePath string, ttl time.Duration) (string, error) {
+	if sb == nil {
+		return "", fmt.Errorf("Invalid s3Backend")
+	}
+
+	// the key would have to be sent along with the URL
+	if sb.sseKey != nil {
+		return "", fmt.Errorf("presigned URLs can't be used with an SSE-C key: %w", ErrUnsupported)
+	}
+	if ttl <= 0 || ttl > s3MaxPresignTTL {
+		return "", fmt.Errorf("presigned URLs must be valid for up to %v, not %v", s3MaxPresignTTL, ttl)
+	}
+
+	req, _ := sb.Client.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(sb.Bucket),
 		Key:    aws.String(filePath)})
+	presigned, err := req.Presign(ttl)
 	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	return presigned, nil
+}
+
+// List returns the objects whose keys start with prefix, a page of up to
+// a thousand at a time
+func (sb *s3Backend) List(prefix string) ([]ObjectInfo, error) {
+	if sb == nil {
+		return nil, fmt.Errorf("Invalid s3Backend")
+	}
+
+	ctx, cancel := sb.operationContext(context.Background())
+	defer cancel()
+
+	objects := []ObjectInfo{}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(sb.Bucket),
+		Prefix: aws.String(prefix)}
+	for {
+		var page *s3.ListObjectsV2Output
+		err := sb.retry(func() (err error) {
+			page, err = sb.Client.ListObjectsV2WithContext(ctx, input)
+
+			return err
+		})
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Path:         aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified)})
+		}
+		if !aws.BoolValue(page.IsTruncated) {
+			return objects, nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// uploadWriter is the writer returned by NewFileWriter of the backends that
+// upload what is written in the background, done receives the result of
+// the upload
+type uploadWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// Close ends the upload and waits for it to be done
+func (w *uploadWriter) Close() error {
+	if err := w.PipeWriter.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	return <-w.done
 }
 
-// transportConfigS3 is a helper method to setup TLS for the S3 client.
-func transportConfigS3(config S3Conf) http.RoundTripper {
+// transportConfig is a helper method to setup TLS for the S3, Azure and
+// GCS clients, trusting cacert in addition to the system CAs. The transport
+// otherwise has the defaults of http.DefaultTransport.
+func transportConfig(cacert string) *http.Transport {
 	cfg := new(tls.Config)
 
 	// Enforce TLS1.2 or higher
@@ -333,19 +1844,18 @@ func transportConfigS3(config S3Conf) http.RoundTripper {
 	}
 	cfg.RootCAs = systemCAs
 
-	if config.Cacert != "" {
-		cacert, e := os.ReadFile(config.Cacert) // #nosec this file comes from our config
+	if cacert != "" {
+		pem, e := os.ReadFile(cacert) // #nosec this file comes from our config
 		if e != nil {
 			log.Fatalf("failed to append %q to RootCAs: %v", cacert, e)
 		}
-		if ok := cfg.RootCAs.AppendCertsFromPEM(cacert); !ok {
+		if ok := cfg.RootCAs.AppendCertsFromPEM(pem); !ok {
 			log.Debug("no certs appended, using system certs only")
 		}
 	}
 
-	var trConfig http.RoundTripper = &http.Transport{
-		TLSClientConfig:   cfg,
-		ForceAttemptHTTP2: true}
+	trConfig := http.DefaultTransport.(*http.Transport).Clone()
+	trConfig.TLSClientConfig = cfg
 
 	return trConfig
 }
@@ -2,11 +2,26 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -37,9 +52,22 @@ var testS3Conf = S3Conf{
 	10,
 	5 * 1024 * 1024,
 	"../../dev_utils/certs/ca.pem",
-	2 * time.Second}
-
-var testConf = Conf{posixType, testS3Conf, testPosixConf}
+	2,
+	"",
+	0,
+	0,
+	0,
+	0,
+	true,
+	"",
+	0,
+	0,
+	0,
+	"",
+	0,
+	0}
+
+var testConf = Conf{posixType, testS3Conf, testPosixConf, AzureConf{}, GCSConf{}, SFTPConf{}, HTTPConf{}, CacheConf{}, 0, 0, 0}
 
 var posixDoesNotExist = "/this/does/not/exist"
 var posixNotCreatable = posixDoesNotExist
@@ -55,7 +83,7 @@ var cleanupFilesBack [1000]string
 var cleanupFiles []string = cleanupFilesBack[0:0]
 
 var testPosixConf = posixConf{
-	"/"}
+	"/", 0, 0, 0}
 
 func writeName() (name string, err error) {
 	f, err := os.CreateTemp("", "writablefile")
@@ -88,14 +116,14 @@ func TestNewBackend(t *testing.T) {
 	s, err := NewBackend(testConf)
 	assert.Nil(t, err, "Backend s3 failed")
 
-	assert.IsType(t, p, &posixBackend{}, "Wrong type from NewBackend with posix")
-	assert.IsType(t, s, &s3Backend{}, "Wrong type from NewBackend with S3")
+	assert.IsType(t, unwrapBackend(p), &posixBackend{}, "Wrong type from NewBackend with posix")
+	assert.IsType(t, unwrapBackend(s), &s3Backend{}, "Wrong type from NewBackend with S3")
 
 	// test some extra ssl handling
 	testConf.S3.Cacert = "/dev/null"
 	s, err = NewBackend(testConf)
 	assert.Nil(t, err, "Backend s3 failed")
-	assert.IsType(t, s, &s3Backend{}, "Wrong type from NewBackend with S3")
+	assert.IsType(t, unwrapBackend(s), &s3Backend{}, "Wrong type from NewBackend with S3")
 }
 
 func TestMain(m *testing.M) {
@@ -120,7 +148,7 @@ func TestPosixBackend(t *testing.T) {
 
 	var buf bytes.Buffer
 
-	assert.IsType(t, backend, &posixBackend{}, "Wrong type from NewBackend with posix")
+	assert.IsType(t, unwrapBackend(backend), &posixBackend{}, "Wrong type from NewBackend with posix")
 
 	log.SetOutput(os.Stdout)
 
@@ -170,6 +198,20 @@ func TestPosixBackend(t *testing.T) {
 	assert.Nil(t, err, "posix NewFileReader failed when it should work")
 	assert.NotNil(t, size, "Got a nil size for posix")
 
+	exists, err := backend.Exists(writable)
+	assert.Nil(t, err, "posix Exists failed when it should work")
+	assert.True(t, exists, "posix Exists didn't find the file")
+	exists, err = backend.Exists(posixDoesNotExist)
+	assert.Nil(t, err, "posix Exists failed for a missing file")
+	assert.False(t, exists, "posix Exists found a missing file")
+
+	metadata, err := backend.GetObjectMetadata(writable)
+	assert.Nil(t, err, "posix GetObjectMetadata failed when it should work")
+	assert.Equal(t, size, metadata.Size)
+	assert.False(t, metadata.LastModified.IsZero(), "posix metadata should have the modification time")
+	_, err = backend.GetObjectMetadata(posixDoesNotExist)
+	assert.NotNil(t, err, "posix GetObjectMetadata worked for a missing file")
+
 	err = backend.RemoveFile(writable)
 	assert.Nil(t, err, "posix RemoveFile failed when it should work")
 	assert.NotNil(t, size, "Got a nil size for posix")
@@ -191,6 +233,59 @@ func TestPosixBackend(t *testing.T) {
 
 }
 
+func TestPosixFileMode(t *testing.T) {
+	dir := t.TempDir()
+
+	for mode, want := range map[os.FileMode]os.FileMode{0: 0640, 0600: 0600, 0644: 0644} {
+		backend, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir, FileMode: mode}})
+		assert.NoError(t, err)
+
+		name := fmt.Sprintf("file%o", mode)
+		writer, err := backend.NewFileWriter(name)
+		assert.NoError(t, err)
+		_, err = writer.Write(writeData)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		stat, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, stat.Mode().Perm(), "wrong mode for file mode %o", mode)
+	}
+
+	_, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir, FileMode: os.ModeDir | 0755}})
+	assert.Error(t, err, "a mode with other than permission bits should not be accepted")
+	_, err = NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir, DirMode: os.ModeSticky | 0755}})
+	assert.Error(t, err, "a mode with other than permission bits should not be accepted")
+
+	// the configured modes are set regardless of the umask
+	defer syscall.Umask(syscall.Umask(0077))
+	backend, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir, FileMode: 0640, DirMode: 0750}})
+	assert.NoError(t, err)
+	writer, err := backend.NewFileWriter("shared/sub/file")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	for name, want := range map[string]os.FileMode{"shared": os.ModeDir | 0750, "shared/sub": os.ModeDir | 0750, "shared/sub/file": 0640} {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, stat.Mode(), "wrong mode for %s", name)
+	}
+
+	// also when the file is replaced
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "shared/sub/file"), 0600))
+	writer, err = backend.NewFileWriter("shared/sub/file")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	stat, err := os.Stat(filepath.Join(dir, "shared/sub/file"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), stat.Mode())
+
+	// without a directory mode no directories are created
+	backend, err = NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir}})
+	assert.NoError(t, err)
+	_, err = backend.NewFileWriter("other/file")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
 func setupFakeS3() (err error) {
 	// fake s3
 
@@ -219,7 +314,7 @@ func setupFakeS3() (err error) {
 		return err
 	}
 
-	s3back := backEnd.(*s3Backend)
+	s3back := unwrapBackend(backEnd).(*s3Backend)
 
 	_, err = s3back.Client.CreateBucket(&s3.CreateBucketInput{
 		Bucket: aws.String(testConf.S3.Bucket)})
@@ -307,11 +402,12 @@ func TestS3Backend(t *testing.T) {
 	backend, err := NewBackend(testConf)
 	assert.Nil(t, err, "Backend failed")
 
-	s3back := backend.(*s3Backend)
+	s3back := unwrapBackend(backend).(*s3Backend)
 
 	var buf bytes.Buffer
 
-	assert.IsType(t, s3back, &s3Backend{}, "Wrong type from NewBackend with s3")
+	assert.IsType(t, unwrapBackend(s3back), &s3Backend{}, "Wrong type from NewBackend with s3")
+	assert.True(t, aws.BoolValue(s3back.Client.Config.S3ForcePathStyle), "the bucket should be in the path")
 
 	writer, err := s3back.NewFileWriter(s3Creatable)
 
@@ -332,6 +428,30 @@ func TestS3Backend(t *testing.T) {
 	assert.Nil(t, err, "s3 GetFileSize failed when it should work")
 	assert.Equal(t, int64(len(writeData)), size, "Got an incorrect file size")
 
+	exists, err := s3back.Exists(s3Creatable)
+	assert.Nil(t, err, "s3 Exists failed when it should work")
+	assert.True(t, exists, "s3 Exists didn't find the object")
+	exists, err = s3back.Exists(s3DoesNotExist)
+	assert.Nil(t, err, "s3 Exists failed for a missing object")
+	assert.False(t, exists, "s3 Exists found a missing object")
+
+	_, err = s3back.Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s3back.Bucket),
+		Key:         aws.String("metadata"),
+		Body:        bytes.NewReader(writeData),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata:    map[string]*string{"Checksum": aws.String("abc")}})
+	assert.Nil(t, err, "PutObject failed")
+	metadata, err := s3back.GetObjectMetadata("metadata")
+	assert.Nil(t, err, "s3 GetObjectMetadata failed when it should work")
+	assert.Equal(t, int64(len(writeData)), metadata.Size)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(writeData)), metadata.ETag) // #nosec the ETag of S3
+	assert.Equal(t, "application/octet-stream", metadata.ContentType)
+	assert.False(t, metadata.LastModified.IsZero(), "s3 metadata should have the modification time")
+	assert.Equal(t, map[string]string{"Checksum": "abc"}, metadata.Metadata)
+	_, err = s3back.GetObjectMetadata(s3DoesNotExist)
+	assert.NotNil(t, err, "s3 GetObjectMetadata worked for a missing object")
+
 	if reader == nil {
 		t.Error("reader that should be usable is not, bailing out")
 		return
@@ -371,3 +491,748 @@ func TestS3Backend(t *testing.T) {
 	log.SetOutput(os.Stdout)
 
 }
+
+func TestNewFileReaderAt(t *testing.T) {
+	defer doCleanup()
+
+	writable, err := writeName()
+	assert.Nil(t, err, "could not find a writable name")
+
+	for _, backendType := range []string{posixType, s3Type} {
+		testConf.Type = backendType
+		backend, err := NewBackend(testConf)
+		assert.Nil(t, err, "Backend failed")
+
+		writer, err := backend.NewFileWriter(writable)
+		assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+		_, err = writer.Write(writeData)
+		assert.Nil(t, err, "Failure when writing")
+		assert.Nil(t, writer.Close())
+
+		reader, err := backend.NewFileReaderAt(writable, 5, 4)
+		assert.Nil(t, err, "NewFileReaderAt failed when it should work")
+		readBack, err := io.ReadAll(reader)
+		assert.Nil(t, err, "unexpected error when reading back data")
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, writeData[5:9], readBack, "did not read back the range")
+
+		// the end of the file and an empty range
+		reader, err = backend.NewFileReaderAt(writable, 10, int64(len(writeData))-10)
+		assert.Nil(t, err, "NewFileReaderAt failed when it should work")
+		readBack, _ = io.ReadAll(reader)
+		assert.Equal(t, writeData[10:], readBack, "did not read back the range")
+		reader, err = backend.NewFileReaderAt(writable, 3, 0)
+		assert.Nil(t, err, "NewFileReaderAt failed when it should work")
+		readBack, _ = io.ReadAll(reader)
+		assert.Empty(t, readBack)
+
+		_, err = backend.NewFileReaderAt(writable, 10, int64(len(writeData)))
+		assert.EqualError(t, err, fmt.Sprintf("range of %d bytes at 10 is beyond the end of %s (%d bytes)",
+			len(writeData), writable, len(writeData)))
+		_, err = backend.NewFileReaderAt(writable, -1, 2)
+		assert.EqualError(t, err, "invalid range of 2 bytes at -1 in "+writable)
+
+		assert.Nil(t, backend.RemoveFile(writable))
+	}
+}
+
+func TestS3Retry(t *testing.T) {
+	defer func(backoff time.Duration) { s3RetryBackoff = backoff }(s3RetryBackoff)
+	s3RetryBackoff = time.Millisecond
+
+	// a proxy in front of the fake S3 answering reads of the object with
+	// the statuses in failures before passing them on
+	target, _ := url.Parse(ts.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var failures []int
+	requests := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/flaky") || r.Method == http.MethodPut {
+			proxy.ServeHTTP(w, r)
+
+			return
+		}
+		requests++
+		if len(failures) == 0 {
+			proxy.ServeHTTP(w, r)
+
+			return
+		}
+
+		status := failures[0]
+		failures = failures[1:]
+		if status == 0 {
+			// the connection is reset
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", strings.ReplaceAll(http.StatusText(status), " ", ""))
+	}))
+	defer flaky.Close()
+
+	conf := testConf.S3
+	portAt := strings.LastIndex(flaky.URL, ":")
+	conf.URL = flaky.URL[:portAt]
+	conf.Port, _ = strconv.Atoi(flaky.URL[portAt+1:])
+	conf.MaxAttempts = 3
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+
+	writer, _ := backend.NewFileWriter("flaky")
+	_, _ = writer.Write(writeData)
+	assert.Nil(t, writer.Close())
+
+	// transient errors are retried
+	failures = []int{http.StatusServiceUnavailable, 0}
+	size, err := backend.GetFileSize("flaky")
+	assert.Nil(t, err, "GetFileSize failed after transient errors")
+	assert.Equal(t, int64(len(writeData)), size)
+	assert.Equal(t, 3, requests)
+
+	requests = 0
+	failures = []int{http.StatusInternalServerError, http.StatusTooManyRequests}
+	reader, err := backend.NewFileReader("flaky")
+	assert.Nil(t, err, "NewFileReader failed after transient errors")
+	readBack, _ := io.ReadAll(reader)
+	assert.Equal(t, writeData, readBack)
+	assert.Equal(t, 3, requests)
+
+	// but not more than MaxAttempts times
+	requests = 0
+	failures = []int{503, 503, 503, 503}
+	_, err = backend.GetFileSize("flaky")
+	assert.NotNil(t, err, "GetFileSize worked when it should not")
+	assert.Equal(t, 3, requests)
+
+	// a failure is not a missing object
+	requests = 0
+	failures = []int{503, 503, 503}
+	_, err = backend.Exists("flaky")
+	assert.NotNil(t, err, "Exists worked when it should not")
+
+	// permanent errors are not retried
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		requests = 0
+		failures = []int{status}
+		_, err = backend.NewFileReader("flaky")
+		assert.NotNil(t, err, "NewFileReader worked when it should not")
+		assert.Equal(t, 1, requests)
+	}
+}
+
+func TestS3CustomerKey(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	keyMD5 := md5.Sum(key) // #nosec required by SSE-C
+
+	// SSE-C needs https, so the fake S3 is reached through a TLS proxy that
+	// records the headers of the requests for the object
+	target, _ := url.Parse(ts.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var mu sync.Mutex
+	headers := map[string]http.Header{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/ssec") {
+			mu.Lock()
+			headers[r.Method+" "+r.URL.RawQuery] = r.Header.Clone()
+			mu.Unlock()
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the SDK would trust only the bundle in AWS_CA_BUNDLE
+	t.Setenv("AWS_CA_BUNDLE", "")
+	cacert := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(cacert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	conf := testConf.S3
+	portAt := strings.LastIndex(server.URL, ":")
+	conf.URL = server.URL[:portAt]
+	conf.Port, _ = strconv.Atoi(server.URL[portAt+1:])
+	conf.Cacert = cacert
+	conf.SSECKey = base64.StdEncoding.EncodeToString(key)
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+
+	// both a single and a multipart upload
+	for _, size := range []int{len(writeData), conf.Chunksize + 1} {
+		headers = map[string]http.Header{}
+		data := bytes.Repeat([]byte("x"), size)
+
+		writer, err := backend.NewFileWriter("ssec")
+		assert.Nil(t, err, "NewFileWriter failed")
+		_, err = writer.Write(data)
+		assert.Nil(t, err, "Failure when writing")
+		assert.Nil(t, writer.Close(), "Upload failed")
+
+		fileSize, err := backend.GetFileSize("ssec")
+		assert.Nil(t, err, "GetFileSize failed")
+		assert.Equal(t, int64(size), fileSize)
+
+		reader, err := backend.NewFileReader("ssec")
+		assert.Nil(t, err, "NewFileReader failed")
+		readBack, _ := io.ReadAll(reader)
+		assert.Equal(t, data, readBack)
+
+		reader, err = backend.NewFileReaderAt("ssec", 1, 2)
+		assert.Nil(t, err, "NewFileReaderAt failed")
+		_, _ = io.ReadAll(reader)
+
+		for request, header := range headers {
+			assert.Equal(t, "AES256", header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm"), request)
+			assert.Equal(t, base64.StdEncoding.EncodeToString(key), header.Get("X-Amz-Server-Side-Encryption-Customer-Key"), request)
+			assert.Equal(t, base64.StdEncoding.EncodeToString(keyMD5[:]), header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"), request)
+		}
+	}
+	assert.Contains(t, headers, "PUT partNumber=1&uploadId=1")
+	assert.Nil(t, backend.RemoveFile("ssec"))
+
+	conf.SSECKey = base64.StdEncoding.EncodeToString(key[:16])
+	_, err = newS3Backend(conf)
+	assert.EqualError(t, err, "the s3 SSE-C key must be 32 bytes, got 16")
+
+	conf.SSECKey = "not base64"
+	_, err = newS3Backend(conf)
+	assert.EqualError(t, err, "the s3 SSE-C key is not valid base64")
+}
+
+func TestS3Connections(t *testing.T) {
+	// a proxy in front of the fake S3 counting the connections made to it
+	target, _ := url.Parse(ts.URL)
+	var connections int32
+	server := httptest.NewUnstartedServer(httputil.NewSingleHostReverseProxy(target))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	conf := testConf.S3
+	portAt := strings.LastIndex(server.URL, ":")
+	conf.URL = server.URL[:portAt]
+	conf.Port, _ = strconv.Atoi(server.URL[portAt+1:])
+	conf.MaxIdleConns = 8
+	conf.IdleConnTimeout = time.Minute
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+
+	transport := backend.Client.Config.HTTPClient.Transport.(*http.Transport)
+	assert.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+
+	writer, _ := backend.NewFileWriter("connections")
+	_, _ = writer.Write(writeData)
+	assert.Nil(t, writer.Close())
+
+	// concurrent reads open a connection each, which are kept for the
+	// reads that follow
+	for round := 0; round < 3; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reader, err := backend.NewFileReader("connections")
+				assert.Nil(t, err, "NewFileReader failed")
+				_, _ = io.Copy(io.Discard, reader)
+				reader.Close()
+			}()
+		}
+		wg.Wait()
+	}
+	assert.LessOrEqual(t, atomic.LoadInt32(&connections), int32(9))
+}
+
+func TestS3Credentials(t *testing.T) {
+	// without keys the credentials come from the AWS chain
+	t.Setenv("AWS_ACCESS_KEY_ID", "envaccess")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	conf := testConf.S3
+	conf.AccessKey, conf.SecretKey = "", ""
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	creds, err := backend.Client.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "envaccess", creds.AccessKeyID)
+
+	conf.AccessKey = "accesskey"
+	_, err = newS3Backend(conf)
+	assert.Error(t, err, "a key alone should not be accepted")
+
+	// a role is assumed at STS with the credentials
+	var roles []string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		roles = append(roles, r.Form.Get("RoleArn"))
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleResult><Credentials>
+<AccessKeyId>roleaccess</AccessKeyId><SecretAccessKey>rolesecret</SecretAccessKey>
+<SessionToken>token</SessionToken><Expiration>2100-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer sts.Close()
+	defer func(endpoint string) { s3STSEndpoint = endpoint }(s3STSEndpoint)
+	s3STSEndpoint = sts.URL
+
+	conf.SecretKey = "secretkey"
+	conf.AssumeRoleARN = "arn:aws:iam::123456789012:role/pipeline"
+	backend, err = newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	creds, err = backend.Client.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "roleaccess", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SessionToken)
+	assert.Equal(t, []string{conf.AssumeRoleARN}, roles, "the role should be assumed once")
+}
+
+func TestS3Timeouts(t *testing.T) {
+	// a proxy in front of the fake S3 that stalls some requests
+	target, _ := url.Parse(ts.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/stalled"):
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write([]byte("some"))
+			w.(http.Flusher).Flush()
+			<-stalled
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/stalled"):
+			<-stalled
+		default:
+			proxy.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	conf := testConf.S3
+	portAt := strings.LastIndex(server.URL, ":")
+	conf.URL = server.URL[:portAt]
+	conf.Port, _ = strconv.Atoi(server.URL[portAt+1:])
+	conf.ConnectTimeout = time.Second
+	conf.ReadTimeout = 500 * time.Millisecond
+	conf.OperationTimeout = 200 * time.Millisecond
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+
+	transport := backend.Client.Config.HTTPClient.Transport.(*http.Transport)
+	assert.Equal(t, time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 500*time.Millisecond, transport.ResponseHeaderTimeout)
+
+	start := time.Now()
+	_, err = backend.GetFileSize("stalled")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "the operation should time out")
+
+	reader, err := backend.NewFileReader("stalled")
+	assert.Nil(t, err, "NewFileReader failed")
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, reader.Close())
+
+	// the requests that don't stall are not affected
+	writer, _ := backend.NewFileWriter("timeouts")
+	_, _ = writer.Write(writeData)
+	assert.Nil(t, writer.Close())
+	size, err := backend.GetFileSize("timeouts")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(writeData)), size)
+}
+
+func TestS3Restore(t *testing.T) {
+	// a proxy in front of the fake S3 that has the object cold in Glacier
+	target, _ := url.Parse(ts.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var mu sync.Mutex
+	var restores []string
+	restoring, restored := false, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasSuffix(r.URL.Path, "/cold") || r.Method == http.MethodPut {
+			proxy.ServeHTTP(w, r)
+
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Has("restore"):
+			var request struct {
+				Days int
+				Tier string `xml:"GlacierJobParameters>Tier"`
+			}
+			body, _ := io.ReadAll(r.Body)
+			_ = xml.Unmarshal(body, &request)
+			restores = append(restores, fmt.Sprintf("%s %d", request.Tier, request.Days))
+			restoring = true
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodHead:
+			w.Header().Set("x-amz-storage-class", "GLACIER")
+			switch {
+			case restored:
+				w.Header().Set("x-amz-restore", `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+			case restoring:
+				w.Header().Set("x-amz-restore", `ongoing-request="true"`)
+				// done by the time it is checked again
+				restored = true
+			}
+			proxy.ServeHTTP(w, r)
+		case restored:
+			proxy.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>`)
+		}
+	}))
+	defer server.Close()
+	defer func(interval time.Duration) { s3RestorePollInterval = interval }(s3RestorePollInterval)
+	s3RestorePollInterval = time.Millisecond
+
+	conf := testConf.S3
+	portAt := strings.LastIndex(server.URL, ":")
+	conf.URL = server.URL[:portAt]
+	conf.Port, _ = strconv.Atoi(server.URL[portAt+1:])
+	backend, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	writer, _ := backend.NewFileWriter("cold")
+	_, _ = writer.Write(writeData)
+	assert.Nil(t, writer.Close())
+
+	// without a tier the object is not restored
+	_, err = backend.NewFileReader("cold")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRestoreInProgress)
+	assert.Empty(t, restores)
+
+	conf.RestoreTier = "bulk"
+	backend, err = newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	_, err = backend.NewFileReader("cold")
+	assert.ErrorIs(t, err, ErrRestoreInProgress)
+	assert.Equal(t, []string{"Bulk 1"}, restores)
+
+	// a restore in progress is waited for, not started again
+	conf.RestoreWait = time.Second
+	backend, err = newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	reader, err := backend.NewFileReader("cold")
+	assert.Nil(t, err, "NewFileReader failed")
+	content, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, writeData, content)
+	assert.Len(t, restores, 1)
+
+	conf.RestoreTier = "Frozen"
+	_, err = newS3Backend(conf)
+	assert.Error(t, err)
+}
+
+func TestWithTimeout(t *testing.T) {
+	assert.NoError(t, withTimeout(0, func() error { return nil }))
+	assert.NoError(t, withTimeout(time.Second, func() error { return nil }))
+	assert.Equal(t, io.EOF, withTimeout(time.Second, func() error { return io.EOF }))
+
+	hung := make(chan struct{})
+	defer close(hung)
+	err := withTimeout(10*time.Millisecond, func() error {
+		<-hung
+
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestS3MultipartWriter(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	assert.Nil(t, err, "Backend failed")
+	s3back := unwrapBackend(backend).(*s3Backend)
+
+	// two full parts and a short last one
+	data := make([]byte, 2*testConf.S3.Chunksize+1024)
+	_, _ = rand.Read(data)
+
+	writer, err := s3back.NewFileWriter("multipart")
+	assert.Nil(t, err, "s3 NewFileWriter failed when it shouldn't")
+	written, err := io.Copy(writer, bytes.NewReader(data))
+	assert.Nil(t, err, "Failure when writing to s3 writer")
+	assert.Equal(t, int64(len(data)), written, "Did not write all data")
+	assert.Nil(t, writer.Close(), "s3 upload failed when it shouldn't")
+
+	reader, err := s3back.NewFileReader("multipart")
+	assert.Nil(t, err, "s3 NewFileReader failed when it should work")
+	readBack, err := io.ReadAll(reader)
+	assert.Nil(t, err, "unexpected error when reading back data")
+	assert.Equal(t, data, readBack, "did not read back data as expected")
+	assert.Nil(t, s3back.RemoveFile("multipart"))
+
+	// an upload ended with an error leaves neither object nor parts
+	writer, err = s3back.NewFileWriter("aborted")
+	assert.Nil(t, err, "s3 NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(data[:testConf.S3.Chunksize+1])
+	assert.Nil(t, err, "Failure when writing to s3 writer")
+	assert.Nil(t, writer.(*s3Writer).CloseWithError(io.ErrUnexpectedEOF))
+	assert.Equal(t, io.ErrUnexpectedEOF, writer.Close())
+	_, err = writer.Write(data)
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	_, err = s3back.Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s3back.Bucket), Key: aws.String("aborted")})
+	assert.NotNil(t, err, "aborted upload was stored")
+	uploads, err := s3back.Client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: aws.String(s3back.Bucket)})
+	assert.Nil(t, err)
+	assert.Empty(t, uploads.Uploads, "aborted upload left parts")
+
+	// parts grow so that 10000 of them hold 5 TB
+	assert.Equal(t, 5, s3PartSize(5, 1000))
+	assert.Equal(t, 10, s3PartSize(5, 1001))
+	assert.Equal(t, 5<<9, s3PartSize(5, 10000))
+
+	conf := testConf.S3
+	conf.Chunksize = 1024 * 1024
+	_, err = newS3Backend(conf)
+	assert.EqualError(t, err, "the s3 chunk size must be at least 5 MiB")
+}
+
+func TestList(t *testing.T) {
+	files := []string{"list/a", "list/dir/b", "list/dir/sub/c", "list/dirx/d"}
+	for _, backendType := range []string{posixType, s3Type} {
+		conf := testConf
+		conf.Type = backendType
+		conf.Posix.Location = t.TempDir()
+		assert.Nil(t, os.MkdirAll(filepath.Join(conf.Posix.Location, "list/dir/sub"), 0750))
+		assert.Nil(t, os.MkdirAll(filepath.Join(conf.Posix.Location, "list/dirx"), 0750))
+		backend, err := NewBackend(conf)
+		assert.Nil(t, err, "Backend failed")
+
+		for i, name := range files {
+			writer, err := backend.NewFileWriter(name)
+			assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+			_, err = writer.Write(writeData[:i+1])
+			assert.Nil(t, err, "Failure when writing")
+			assert.Nil(t, writer.Close())
+		}
+
+		for prefix, expected := range map[string][]string{
+			"list/":      files,
+			"list/dir/":  {"list/dir/b", "list/dir/sub/c"},
+			"list/dir":   {"list/dir/b", "list/dir/sub/c", "list/dirx/d"},
+			"list/dir/s": {"list/dir/sub/c"},
+			"list/none/": {},
+		} {
+			objects, err := backend.List(prefix)
+			assert.Nil(t, err, "List failed when it shouldn't")
+
+			paths := []string{}
+			for _, object := range objects {
+				paths = append(paths, object.Path)
+				assert.False(t, object.LastModified.IsZero(), "no modification time for %s", object.Path)
+			}
+			assert.Equal(t, expected, paths, "wrong %s listing of %q", backendType, prefix)
+		}
+
+		objects, err := backend.List("list/dir/sub/")
+		assert.Nil(t, err, "List failed when it shouldn't")
+		assert.Equal(t, int64(3), objects[0].Size)
+
+		for _, name := range files {
+			assert.Nil(t, backend.RemoveFile(name))
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, backendType := range []string{posixType, s3Type} {
+		conf := testConf
+		conf.Type = backendType
+		conf.Posix.Location = t.TempDir()
+		backend, err := NewBackend(conf)
+		assert.Nil(t, err, "Backend failed")
+
+		writer, err := backend.NewFileWriter("deleted")
+		assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+		assert.Nil(t, writer.Close())
+
+		assert.Nil(t, backend.Delete("deleted"), "%s Delete failed when it shouldn't", backendType)
+		_, err = backend.GetFileSize("deleted")
+		assert.NotNil(t, err, "%s file was not deleted", backendType)
+
+		// once more, when it is already gone
+		assert.Nil(t, backend.Delete("deleted"), "%s Delete of a missing file failed", backendType)
+	}
+
+	// other errors are returned
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "dir/sub"), 0750))
+	backend, err := NewBackend(Conf{Type: posixType, Posix: posixConf{Location: dir}})
+	assert.Nil(t, err, "Backend failed")
+	assert.NotNil(t, backend.Delete("dir"), "posix Delete of a directory that is not empty worked")
+}
+
+func TestPresignGet(t *testing.T) {
+	testConf.Type = s3Type
+	backend, err := NewBackend(testConf)
+	assert.Nil(t, err, "Backend failed")
+
+	writer, err := backend.NewFileWriter("presigned")
+	assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+	_, err = writer.Write(writeData)
+	assert.Nil(t, err, "Failure when writing")
+	assert.Nil(t, writer.Close())
+
+	presigned, err := backend.PresignGet("presigned", 10*time.Minute)
+	assert.Nil(t, err, "PresignGet failed when it shouldn't")
+	assert.Contains(t, presigned, "X-Amz-Expires=600")
+	assert.Contains(t, presigned, "X-Amz-Signature=")
+
+	resp, err := http.Get(presigned) // #nosec G107 the URL of the fake s3
+	assert.Nil(t, err, "could not download the presigned URL")
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, writeData, content)
+	assert.Nil(t, backend.RemoveFile("presigned"))
+
+	_, err = backend.PresignGet("presigned", 0)
+	assert.EqualError(t, err, "presigned URLs must be valid for up to 168h0m0s, not 0s")
+	_, err = backend.PresignGet("presigned", 8*24*time.Hour)
+	assert.NotNil(t, err, "PresignGet worked for longer than S3 allows")
+
+	conf := testConf.S3
+	conf.SSECKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	s3back, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+	_, err = s3back.PresignGet("presigned", time.Minute)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	testConf.Type = posixType
+	backend, err = NewBackend(testConf)
+	assert.Nil(t, err, "Backend failed")
+	_, err = backend.PresignGet("presigned", time.Minute)
+	assert.Equal(t, ErrUnsupported, err)
+}
+
+func TestS3ParallelReader(t *testing.T) {
+	conf := testConf.S3
+	conf.DownloadConcurrency = 3
+	conf.DownloadChunksize = 1000
+	s3back, err := newS3Backend(conf)
+	assert.Nil(t, err, "Backend failed")
+
+	// a single chunk, a whole number of them and several rounds
+	for _, size := range []int{1000, 4000, 10500} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		writer, err := s3back.NewFileWriter("parallel")
+		assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+		_, err = writer.Write(data)
+		assert.Nil(t, err, "Failure when writing")
+		assert.Nil(t, writer.Close())
+
+		reader, err := s3back.NewFileReader("parallel")
+		assert.Nil(t, err, "NewFileReader failed when it shouldn't")
+		_, parallel := reader.(*s3ParallelReader)
+		assert.Equal(t, size > conf.DownloadChunksize, parallel, "wrong reader for %d bytes", size)
+
+		readBack, err := io.ReadAll(reader)
+		assert.Nil(t, err, "unexpected error when reading back data")
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, data, readBack, "did not read back %d bytes in order", size)
+	}
+
+	// a reader closed early does not wait for the rest
+	reader, err := s3back.NewFileReader("parallel")
+	assert.Nil(t, err, "NewFileReader failed when it shouldn't")
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, s3back.RemoveFile("parallel"))
+
+	_, err = io.ReadAll(s3back.newParallelReader(context.Background(), "missing", 2500))
+	assert.NotNil(t, err, "reading a missing object worked")
+	_, err = s3back.NewFileReader("missing")
+	assert.NotNil(t, err, "reading a missing object worked")
+}
+
+func TestNewFileReaderContext(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	_, _ = rand.Read(data)
+
+	conf := testConf
+	conf.Posix.Location = t.TempDir()
+	parallelConf := conf.S3
+	parallelConf.DownloadConcurrency = 2
+	parallelConf.DownloadChunksize = 1024 * 1024
+	parallel, err := newS3Backend(parallelConf)
+	assert.Nil(t, err, "Backend failed")
+
+	for _, backendType := range []string{posixType, s3Type, "parallel"} {
+		var backend Backend = parallel
+		if backendType != "parallel" {
+			conf.Type = backendType
+			backend, err = NewBackend(conf)
+			assert.Nil(t, err, "Backend failed")
+		}
+
+		writer, err := backend.NewFileWriter("context")
+		assert.Nil(t, err, "NewFileWriter failed when it shouldn't")
+		_, err = writer.Write(data)
+		assert.Nil(t, err, "Failure when writing")
+		assert.Nil(t, writer.Close())
+
+		// read all of it with a context that is not done
+		ctx, cancel := context.WithCancel(context.Background())
+		reader, err := backend.NewFileReaderContext(ctx, "context")
+		assert.Nil(t, err, "NewFileReaderContext failed when it shouldn't")
+		readBack, err := io.ReadAll(reader)
+		assert.Nil(t, err, "unexpected error when reading back data")
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, data, readBack, "did not read back data from %s", backendType)
+		cancel()
+
+		// reads stop once the context is done
+		ctx, cancel = context.WithCancel(context.Background())
+		reader, err = backend.NewFileReaderContext(ctx, "context")
+		assert.Nil(t, err, "NewFileReaderContext failed when it shouldn't")
+		_, err = io.ReadFull(reader, make([]byte, 1000))
+		assert.Nil(t, err, "unexpected error when reading")
+		cancel()
+		_, err = io.ReadAll(reader)
+		assert.ErrorIs(t, err, context.Canceled, "%s read went on after the context was done", backendType)
+		assert.Nil(t, reader.Close())
+
+		_, err = backend.NewFileReaderContext(ctx, "context")
+		assert.NotNil(t, err, "%s file was opened with a context that is done", backendType)
+
+		assert.Nil(t, backend.RemoveFile("context"))
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, backendType := range []string{posixType, s3Type} {
+		conf := testConf
+		conf.Type = backendType
+		conf.Posix.Location = t.TempDir()
+		backend, err := NewBackend(conf)
+		assert.Nil(t, err, "Backend failed")
+		assert.Nil(t, backend.HealthCheck(context.Background()), "%s health check failed", backendType)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.NotNil(t, backend.HealthCheck(ctx), "%s health check worked when it was cancelled", backendType)
+	}
+
+	s3back, err := newS3Backend(testConf.S3)
+	assert.Nil(t, err, "Backend failed")
+	s3back.Bucket = "missing"
+	assert.NotNil(t, s3back.HealthCheck(context.Background()), "health check of a missing bucket worked")
+
+	posix, err := newPosixBackend(posixConf{Location: t.TempDir()})
+	assert.Nil(t, err, "Backend failed")
+	posix.Location = "/dev/null"
+	assert.EqualError(t, posix.HealthCheck(context.Background()), "/dev/null is not a directory")
+}